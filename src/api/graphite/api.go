@@ -0,0 +1,265 @@
+package graphite
+
+// This server accepts the graphite plaintext protocol over tcp, i.e.
+// lines of the form `metric.path value timestamp`. Each metric path
+// is written to a series with the same name and a single column
+// `value`. Timestamps are in seconds. Points are batched and written
+// to the configured database when the batch is full or when the
+// flush interval elapses, whichever comes first.
+
+import (
+	"bufio"
+	log "code.google.com/p/log4go"
+	. "common"
+	"coordinator"
+	"fmt"
+	"io"
+	"net"
+	"protocol"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Server struct {
+	listenAddress string
+	database      string
+	username      string
+	password      string
+	batchSize     int
+	flushInterval time.Duration
+	coordinator   coordinator.Coordinator
+	userManager   coordinator.UserManager
+	points        chan *graphitePoint
+	stop          chan bool
+	shutdown      chan bool
+	// guards the user, it's looked up again if it can't write
+	userLock sync.Mutex
+	user     User
+	// guards the listener, Close can be called before it's opened
+	connLock sync.Mutex
+	conn     net.Listener
+	closed   bool
+}
+
+type graphitePoint struct {
+	name  string
+	point *protocol.Point
+}
+
+func NewServer(listenAddress, database, username, password string, batchSize int, flushInterval time.Duration, coord coordinator.Coordinator, userManager coordinator.UserManager) *Server {
+	return &Server{
+		listenAddress: listenAddress,
+		database:      database,
+		username:      username,
+		password:      password,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		coordinator:   coord,
+		userManager:   userManager,
+		points:        make(chan *graphitePoint, batchSize),
+		stop:          make(chan bool),
+		shutdown:      make(chan bool, 1),
+	}
+}
+
+func (self *Server) ListenAndServe() {
+	if self.listenAddress == "" {
+		return
+	}
+
+	// the database or the user may not exist yet, the batches are
+	// dropped until they do
+	if _, err := self.getUser(); err != nil {
+		log.Warn("GraphiteServer: cannot authenticate user %s on database %s yet: %s", self.username, self.database, err)
+	}
+
+	listener, err := net.Listen("tcp", self.listenAddress)
+	if err != nil {
+		log.Error("GraphiteServer: cannot listen on %s: %s", self.listenAddress, err)
+		return
+	}
+	self.connLock.Lock()
+	if self.closed {
+		self.connLock.Unlock()
+		listener.Close()
+		return
+	}
+	self.conn = listener
+	self.connLock.Unlock()
+
+	go self.committer()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if strings.Contains(err.Error(), "closed network") {
+				break
+			}
+			log.Error("GraphiteServer: error while accepting connection: %s", err)
+			continue
+		}
+		go self.handleClient(conn)
+	}
+	close(self.stop)
+}
+
+func (self *Server) handleClient(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if line = strings.TrimSpace(line); line != "" {
+			point, err := parseLine(line)
+			if err != nil {
+				log.Warn("GraphiteServer: %s", err)
+			} else {
+				select {
+				case self.points <- point:
+				case <-self.stop:
+					return
+				}
+			}
+		}
+
+		if err != nil {
+			if err != io.EOF {
+				log.Error("GraphiteServer: error while reading from %s: %s", conn.RemoteAddr(), err)
+			}
+			return
+		}
+	}
+}
+
+// Parses a single line of the form `metric.path value timestamp`
+// into a point of the series `metric.path`
+func parseLine(line string) (*graphitePoint, error) {
+	elems := strings.Fields(line)
+	if len(elems) != 3 {
+		return nil, fmt.Errorf("invalid line '%s', expected 'metric.path value timestamp'", line)
+	}
+
+	name := elems[0]
+	if !VALID_TABLE_NAMES.MatchString(name) {
+		return nil, fmt.Errorf("%s is not a valid series name", name)
+	}
+
+	value := &protocol.FieldValue{}
+	if i, err := strconv.ParseInt(elems[1], 10, 64); err == nil {
+		value.Int64Value = &i
+	} else if f, err := strconv.ParseFloat(elems[1], 64); err == nil {
+		value.DoubleValue = &f
+	} else {
+		return nil, fmt.Errorf("invalid value '%s' for metric %s", elems[1], name)
+	}
+
+	seconds, err := strconv.ParseInt(elems[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp '%s' for metric %s", elems[2], name)
+	}
+
+	point := &protocol.Point{Values: []*protocol.FieldValue{value}}
+	point.SetTimestampInMicroseconds(seconds * int64(time.Second/time.Microsecond))
+	return &graphitePoint{name: name, point: point}, nil
+}
+
+func (self *Server) committer() {
+	defer func() { self.shutdown <- true }()
+
+	ticker := time.NewTicker(self.flushInterval)
+	defer ticker.Stop()
+
+	batch := map[string]*protocol.Series{}
+	count := 0
+	for {
+		select {
+		case <-self.stop:
+			self.flush(batch)
+			return
+		case p := <-self.points:
+			series := batch[p.name]
+			if series == nil {
+				series = &protocol.Series{Name: protocol.String(p.name), Fields: []string{"value"}}
+				batch[p.name] = series
+			}
+			series.Points = append(series.Points, p.point)
+			count++
+			if count < self.batchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+
+		self.flush(batch)
+		batch = map[string]*protocol.Series{}
+		count = 0
+	}
+}
+
+// Returns the user that writes the points, it's authenticated on the
+// first call and after the user couldn't write
+func (self *Server) getUser() (User, error) {
+	self.userLock.Lock()
+	defer self.userLock.Unlock()
+	if self.user != nil {
+		return self.user, nil
+	}
+	user, err := self.userManager.AuthenticateDbUser(self.database, self.username, self.password)
+	if err != nil {
+		return nil, err
+	}
+	self.user = user
+	return user, nil
+}
+
+func (self *Server) forgetUser() {
+	self.userLock.Lock()
+	defer self.userLock.Unlock()
+	self.user = nil
+}
+
+func (self *Server) flush(batch map[string]*protocol.Series) {
+	if len(batch) == 0 {
+		return
+	}
+	user, err := self.getUser()
+	if err != nil {
+		log.Error("GraphiteServer: cannot authenticate user %s on database %s, dropping %d series: %s", self.username, self.database, len(batch), err)
+		return
+	}
+	for _, series := range batch {
+		err := self.coordinator.WriteSeriesData(user, self.database, series)
+		if err != nil {
+			log.Error("GraphiteServer: cannot write series %s: %s", *series.Name, err)
+			if isAuthError(err) {
+				self.forgetUser()
+			}
+		}
+	}
+}
+
+func isAuthError(err error) bool {
+	switch err.(type) {
+	case AuthenticationError, AuthorizationError:
+		return true
+	}
+	return false
+}
+
+func (self *Server) Close() {
+	self.connLock.Lock()
+	self.closed = true
+	conn := self.conn
+	self.connLock.Unlock()
+	if conn == nil {
+		return
+	}
+	log.Info("Closing graphite server")
+	conn.Close()
+	select {
+	case <-time.After(time.Second * 5):
+		log.Error("GraphiteServer: timed out waiting for the last batch to be written")
+	case <-self.shutdown:
+	}
+}
@@ -0,0 +1,120 @@
+package graphite
+
+import (
+	"cluster"
+	. "common"
+	"coordinator"
+	. "launchpad.net/gocheck"
+	"protocol"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Hook up gocheck into the gotest runner.
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type GraphiteApiSuite struct{}
+
+var _ = Suite(&GraphiteApiSuite{})
+
+type MockCoordinator struct {
+	coordinator.Coordinator
+	lock   sync.Mutex
+	series []*protocol.Series
+}
+
+func (self *MockCoordinator) WriteSeriesData(_ User, db string, series *protocol.Series) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.series = append(self.series, series)
+	return nil
+}
+
+type MockUserManager struct {
+	coordinator.UserManager
+	missing         bool
+	authentications int
+}
+
+func (self *MockUserManager) AuthenticateDbUser(db, username, password string) (User, error) {
+	self.authentications++
+	if self.missing {
+		return nil, NewAuthenticationError("Invalid username/password")
+	}
+	return &cluster.DbUser{CommonUser: cluster.CommonUser{Name: username}, Db: db}, nil
+}
+
+func (self *GraphiteApiSuite) TestParsingLines(c *C) {
+	p, err := parseLine("servers.host1.cpu 12 1382131686")
+	c.Assert(err, IsNil)
+	c.Assert(p.name, Equals, "servers.host1.cpu")
+	c.Assert(*p.point.Values[0].Int64Value, Equals, int64(12))
+	c.Assert(*p.point.GetTimestampInMicroseconds(), Equals, int64(1382131686000000))
+
+	p, err = parseLine("servers.host1.load 1.5 1382131686")
+	c.Assert(err, IsNil)
+	c.Assert(*p.point.Values[0].DoubleValue, Equals, 1.5)
+
+	for _, line := range []string{"servers.host1.cpu 12", "servers.host1.cpu abc 1382131686", "servers.host1.cpu 12 abc", "1servers 12 1382131686"} {
+		_, err = parseLine(line)
+		c.Assert(err, NotNil)
+	}
+}
+
+func (self *GraphiteApiSuite) TestBatchingPoints(c *C) {
+	coord := &MockCoordinator{}
+	server := NewServer("", "db1", "user", "pass", 3, time.Hour, coord, &MockUserManager{})
+	go server.committer()
+
+	for _, line := range []string{"foo 1 1382131686", "bar 2 1382131686", "foo 3 1382131687", "foo 4 1382131688"} {
+		p, err := parseLine(line)
+		c.Assert(err, IsNil)
+		server.points <- p
+	}
+	close(server.stop)
+	<-server.shutdown
+
+	c.Assert(coord.series, HasLen, 3)
+	points := map[string]int{}
+	for _, series := range coord.series {
+		c.Assert(series.Fields, DeepEquals, []string{"value"})
+		points[*series.Name] += len(series.Points)
+	}
+	c.Assert(points, DeepEquals, map[string]int{"foo": 3, "bar": 1})
+}
+
+func (self *GraphiteApiSuite) TestUserIsAuthenticatedAgainForEveryBatchUntilItExists(c *C) {
+	coord := &MockCoordinator{}
+	userManager := &MockUserManager{missing: true}
+	server := NewServer("", "db1", "user", "pass", 1, time.Hour, coord, userManager)
+	p, err := parseLine("foo 1 1382131686")
+	c.Assert(err, IsNil)
+	batch := map[string]*protocol.Series{"foo": {Name: protocol.String("foo"), Fields: []string{"value"}, Points: []*protocol.Point{p.point}}}
+
+	server.flush(batch)
+	c.Assert(coord.series, HasLen, 0)
+
+	userManager.missing = false
+	server.flush(batch)
+	server.flush(batch)
+	c.Assert(coord.series, HasLen, 2)
+	c.Assert(userManager.authentications, Equals, 2)
+}
+
+func (self *GraphiteApiSuite) TestClosingBeforeListening(c *C) {
+	server := NewServer("localhost:0", "db1", "user", "pass", 1, time.Hour, &MockCoordinator{}, &MockUserManager{})
+	server.Close()
+	done := make(chan bool)
+	go func() {
+		server.ListenAndServe()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatal("the server kept listening after it was closed")
+	}
+}
@@ -11,7 +11,9 @@ import (
 	"errors"
 	"fmt"
 	"github.com/bmizerany/pat"
+	"io"
 	"io/ioutil"
+	"math"
 	"net"
 	libhttp "net/http"
 	"path/filepath"
@@ -33,6 +35,14 @@ type HttpServer struct {
 	shutdown       chan bool
 	clusterConfig  *cluster.ClusterConfiguration
 	raftServer     *coordinator.RaftServer
+	backupWriter   BackupWriter
+	maxBodySize    int64
+}
+
+type BackupWriter interface {
+	// Writes a backup archive of the given cluster configuration and
+	// all the local shards to w
+	Backup(w io.Writer, clusterConfiguration []byte) error
 }
 
 func NewHttpServer(httpPort string, adminAssetsDir string, theCoordinator coordinator.Coordinator, userManager coordinator.UserManager, clusterConfig *cluster.ClusterConfiguration, raftServer *coordinator.RaftServer) *HttpServer {
@@ -60,6 +70,16 @@ func (self *HttpServer) EnableSsl(addr, certPath string) {
 	return
 }
 
+func (self *HttpServer) EnableBackup(backupWriter BackupWriter) {
+	self.backupWriter = backupWriter
+}
+
+// Requests that write points are rejected with a 413 if their body
+// is bigger than the given number of bytes. A size of 0 means no limit.
+func (self *HttpServer) SetMaxBodySize(maxBodySize int64) {
+	self.maxBodySize = maxBodySize
+}
+
 func (self *HttpServer) ListenAndServe() {
 	var err error
 	if self.httpPort != "" {
@@ -76,7 +96,7 @@ func (self *HttpServer) registerEndpoint(p *pat.PatternServeMux, method string,
 	case "get":
 		p.Get(pattern, CorsHeaderHandler(f))
 	case "post":
-		p.Post(pattern, CorsHeaderHandler(f))
+		p.Post(pattern, CorsHeaderHandler(self.DecompressionHandler(f)))
 	case "del":
 		p.Del(pattern, CorsHeaderHandler(f))
 	}
@@ -93,9 +113,10 @@ func (self *HttpServer) Serve(listener net.Listener) {
 	// with each batch of points we get back
 	self.registerEndpoint(p, "get", "/db/:db/series", self.query)
 
-	// Write points to the given database
+	// Write points to the given database, either as json or as csv (format=csv)
 	self.registerEndpoint(p, "post", "/db/:db/series", self.writePoints)
 	self.registerEndpoint(p, "del", "/db/:db/series/:series", self.dropSeries)
+	self.registerEndpoint(p, "get", "/db/:db/stats", self.databaseStats)
 	self.registerEndpoint(p, "get", "/db", self.listDatabases)
 	self.registerEndpoint(p, "post", "/db", self.createDatabase)
 	self.registerEndpoint(p, "del", "/db/:name", self.dropDatabase)
@@ -120,6 +141,17 @@ func (self *HttpServer) Serve(listener net.Listener) {
 	self.registerEndpoint(p, "post", "/db/:db/continuous_queries", self.createDbContinuousQueries)
 	self.registerEndpoint(p, "del", "/db/:db/continuous_queries/:id", self.deleteDbContinuousQueries)
 
+	// indexed columns management interface
+	self.registerEndpoint(p, "get", "/db/:db/indexes", self.listDbIndexes)
+	self.registerEndpoint(p, "post", "/db/:db/indexes", self.createDbIndex)
+	self.registerEndpoint(p, "del", "/db/:db/indexes/:series/:column", self.deleteDbIndex)
+
+	// write limits management interface
+	self.registerEndpoint(p, "get", "/db/:db/write_limits", self.getWriteLimit)
+	self.registerEndpoint(p, "post", "/db/:db/write_limits", self.setWriteLimit)
+	self.registerEndpoint(p, "get", "/db/:db/users/:user/write_limits", self.getWriteLimit)
+	self.registerEndpoint(p, "post", "/db/:db/users/:user/write_limits", self.setWriteLimit)
+
 	// healthcheck
 	self.registerEndpoint(p, "get", "/ping", self.ping)
 
@@ -131,9 +163,21 @@ func (self *HttpServer) Serve(listener net.Listener) {
 
 	// cluster config endpoints
 	self.registerEndpoint(p, "get", "/cluster/servers", self.listServers)
+	self.registerEndpoint(p, "del", "/cluster/servers/:id", self.removeServer)
+	self.registerEndpoint(p, "post", "/cluster/servers/:id/replace", self.replaceServer)
 	self.registerEndpoint(p, "post", "/cluster/shards", self.createShard)
 	self.registerEndpoint(p, "get", "/cluster/shards", self.getShards)
 	self.registerEndpoint(p, "del", "/cluster/shards/:id", self.dropShard)
+	self.registerEndpoint(p, "post", "/cluster/shards/:id/rebalance", self.rebalanceShard)
+	self.registerEndpoint(p, "del", "/cluster/shards/:id/rebalance", self.cancelShardCopy)
+	self.registerEndpoint(p, "get", "/cluster/handoff", self.getHandoffStates)
+
+	// backup the cluster configuration and the local shards
+	self.registerEndpoint(p, "get", "/cluster/backup", self.backup)
+
+	// list and kill the queries this server coordinates
+	self.registerEndpoint(p, "get", "/queries", self.listQueries)
+	self.registerEndpoint(p, "del", "/queries/:id", self.killQuery)
 
 	go self.startSsl(p)
 
@@ -283,14 +327,31 @@ func (self *HttpServer) query(w libhttp.ResponseWriter, r *libhttp.Request) {
 			return libhttp.StatusBadRequest, err.Error()
 		}
 
+		var timeout time.Duration
+		if timeoutString := r.URL.Query().Get("timeout"); timeoutString != "" {
+			timeout, err = time.ParseDuration(timeoutString)
+			if err != nil || timeout <= 0 {
+				return libhttp.StatusBadRequest, fmt.Sprintf("Invalid timeout %s", timeoutString)
+			}
+		}
+
+		// the query is cancelled on all the servers if the client goes away
+		var disconnected <-chan bool
+		if notifier, ok := w.(libhttp.CloseNotifier); ok {
+			disconnected = notifier.CloseNotify()
+		}
+
+		chunked := r.URL.Query().Get("chunked") == "true"
 		var writer Writer
-		if r.URL.Query().Get("chunked") == "true" {
+		if isCsvRequest(r) {
+			writer = NewCsvWriter(w, precision, chunked)
+		} else if chunked {
 			writer = &ChunkWriter{w, precision, false}
 		} else {
 			writer = &AllPointsWriter{map[string]*protocol.Series{}, w, precision}
 		}
 		seriesWriter := NewSeriesWriter(writer.yield)
-		err = self.coordinator.RunQuery(user, db, query, seriesWriter)
+		err = self.coordinator.RunQuery(user, db, query, seriesWriter, timeout, disconnected)
 		if err != nil {
 			return errorToStatusCode(err), err.Error()
 		}
@@ -306,13 +367,51 @@ func errorToStatusCode(err error) int {
 		return libhttp.StatusUnauthorized // HTTP 401
 	case AuthorizationError:
 		return libhttp.StatusForbidden // HTTP 403
+	case bodyTooLargeError:
+		return libhttp.StatusRequestEntityTooLarge // HTTP 413
+	case *WriteLimitError:
+		return 429 // Too Many Requests, net/http doesn't define it
+	case *PartialWriteError:
+		return libhttp.StatusGatewayTimeout // HTTP 504
+	case *QueryError:
+		if err.(*QueryError).ErrorCode == QueryTimedOut {
+			return libhttp.StatusGatewayTimeout // HTTP 504
+		}
+		return libhttp.StatusBadRequest
 	default:
 		return libhttp.StatusBadRequest // HTTP 400
 	}
 }
 
+// Tells the client when to retry writes that were rejected because of
+// the write limits
+func setRetryAfter(w libhttp.ResponseWriter, err error) {
+	if limitErr, ok := err.(*WriteLimitError); ok {
+		seconds := int64(math.Ceil(limitErr.RetryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	}
+}
+
 func (self *HttpServer) writePoints(w libhttp.ResponseWriter, r *libhttp.Request) {
+	if self.maxBodySize > 0 {
+		if r.ContentLength > self.maxBodySize {
+			w.WriteHeader(libhttp.StatusRequestEntityTooLarge)
+			w.Write([]byte(bodyTooLargeError{self.maxBodySize}.Error()))
+			return
+		}
+		// the content length isn't known for chunked requests
+		r.Body = newLimitedBody(r.Body, self.maxBodySize)
+	}
+
+	if isCsvBody(r) {
+		self.importCsv(w, r)
+		return
+	}
+
 	db := r.URL.Query().Get(":db")
+	// how many replicas have to write the points, the server's default
+	// is used if it's empty
+	consistency := r.URL.Query().Get("consistency")
 	precision, err := TimePrecisionFromString(r.URL.Query().Get("time_precision"))
 	if err != nil {
 		w.WriteHeader(libhttp.StatusBadRequest)
@@ -321,18 +420,19 @@ func (self *HttpServer) writePoints(w libhttp.ResponseWriter, r *libhttp.Request
 	}
 
 	self.tryAsDbUserAndClusterAdmin(w, r, func(user User) (int, interface{}) {
-		series, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			return libhttp.StatusInternalServerError, err.Error()
-		}
-		serializedSeries := []*SerializedSeries{}
-		err = json.Unmarshal(series, &serializedSeries)
-		if err != nil {
-			return libhttp.StatusBadRequest, err.Error()
-		}
+		// the series are decoded and written one at a time, so series
+		// that come before an invalid one in the body are still written
+		writeSeries := self.coordinator.NewWriteRequest(user, db, consistency)
+		decoder := newSeriesDecoder(r.Body)
+		for {
+			s, err := decoder.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return errorToStatusCode(err), err.Error()
+			}
 
-		// convert the wire format to the internal representation of the time series
-		for _, s := range serializedSeries {
 			if len(s.Points) == 0 {
 				continue
 			}
@@ -342,9 +442,10 @@ func (self *HttpServer) writePoints(w libhttp.ResponseWriter, r *libhttp.Request
 				return libhttp.StatusBadRequest, err.Error()
 			}
 
-			err = self.coordinator.WriteSeriesData(user, db, series)
+			err = writeSeries(series)
 
 			if err != nil {
+				setRetryAfter(w, err)
 				return errorToStatusCode(err), err.Error()
 			}
 		}
@@ -408,7 +509,7 @@ func (self *HttpServer) dropSeries(w libhttp.ResponseWriter, r *libhttp.Request)
 			return nil
 		}
 		seriesWriter := NewSeriesWriter(f)
-		err := self.coordinator.RunQuery(user, db, fmt.Sprintf("drop series %s", series), seriesWriter)
+		err := self.coordinator.RunQuery(user, db, fmt.Sprintf("drop series %s", series), seriesWriter, 0, nil)
 		if err != nil {
 			return errorToStatusCode(err), err.Error()
 		}
@@ -550,6 +651,11 @@ type NewContinuousQuery struct {
 	Query string `json:"query"`
 }
 
+type IndexedColumn struct {
+	Series string `json:"series"`
+	Column string `json:"column"`
+}
+
 func (self *HttpServer) listClusterAdmins(w libhttp.ResponseWriter, r *libhttp.Request) {
 	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
 		names, err := self.userManager.ListClusterAdmins(u)
@@ -903,6 +1009,58 @@ func (self *HttpServer) deleteDbContinuousQueries(w libhttp.ResponseWriter, r *l
 	})
 }
 
+func (self *HttpServer) listDbIndexes(w libhttp.ResponseWriter, r *libhttp.Request) {
+	db := r.URL.Query().Get(":db")
+
+	self.tryAsDbUserAndClusterAdmin(w, r, func(u User) (int, interface{}) {
+		seriesColumns, err := self.coordinator.ListIndexedColumns(u, db)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+
+		indexes := make([]IndexedColumn, 0)
+		for series, columns := range seriesColumns {
+			for _, column := range columns {
+				indexes = append(indexes, IndexedColumn{series, column})
+			}
+		}
+		return libhttp.StatusOK, indexes
+	})
+}
+
+func (self *HttpServer) createDbIndex(w libhttp.ResponseWriter, r *libhttp.Request) {
+	db := r.URL.Query().Get(":db")
+
+	self.tryAsDbUserAndClusterAdmin(w, r, func(u User) (int, interface{}) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		index := &IndexedColumn{}
+		if err := json.Unmarshal(body, index); err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+
+		if err := self.coordinator.CreateIndexedColumn(u, db, index.Series, index.Column); err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, nil
+	})
+}
+
+func (self *HttpServer) deleteDbIndex(w libhttp.ResponseWriter, r *libhttp.Request) {
+	db := r.URL.Query().Get(":db")
+	series := r.URL.Query().Get(":series")
+	column := r.URL.Query().Get(":column")
+
+	self.tryAsDbUserAndClusterAdmin(w, r, func(u User) (int, interface{}) {
+		if err := self.coordinator.DropIndexedColumn(u, db, series, column); err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, nil
+	})
+}
+
 func (self *HttpServer) listServers(w libhttp.ResponseWriter, r *libhttp.Request) {
 	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
 		servers := self.clusterConfig.Servers()
@@ -914,6 +1072,49 @@ func (self *HttpServer) listServers(w libhttp.ResponseWriter, r *libhttp.Request
 	})
 }
 
+func (self *HttpServer) removeServer(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 64)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		if err := self.coordinator.RemoveServer(u, uint32(id), 0); err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusAccepted, nil
+	})
+}
+
+type replaceServerInfo struct {
+	ReplacementServerId uint32 `json:"replacementServerId"`
+}
+
+func (self *HttpServer) replaceServer(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 64)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		info := &replaceServerInfo{}
+		err = json.Unmarshal(body, info)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		if info.ReplacementServerId == 0 {
+			return libhttp.StatusBadRequest, "Request must include a 'replacementServerId'"
+		}
+
+		if err := self.coordinator.RemoveServer(u, uint32(id), info.ReplacementServerId); err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusAccepted, nil
+	})
+}
+
 type newShardInfo struct {
 	StartTime int64               `json:"startTime"`
 	EndTime   int64               `json:"endTime"`
@@ -995,6 +1196,51 @@ func (self *HttpServer) dropShard(w libhttp.ResponseWriter, r *libhttp.Request)
 	})
 }
 
+type rebalanceShardInfo struct {
+	TargetServerId uint32 `json:"targetServerId"`
+	DropServerId   uint32 `json:"dropServerId"`
+}
+
+func (self *HttpServer) rebalanceShard(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 64)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		info := &rebalanceShardInfo{}
+		err = json.Unmarshal(body, info)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		if info.TargetServerId == 0 {
+			return libhttp.StatusBadRequest, "Request must include a 'targetServerId'"
+		}
+
+		err = self.coordinator.RebalanceShard(u, uint32(id), info.TargetServerId, info.DropServerId)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusAccepted, nil
+	})
+}
+
+func (self *HttpServer) cancelShardCopy(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 64)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		if err := self.coordinator.CancelShardCopy(u, uint32(id)); err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, nil
+	})
+}
+
 func (self *HttpServer) convertShardsToMap(shards []*cluster.ShardData) []interface{} {
 	result := make([]interface{}, 0)
 	for _, shard := range shards {
@@ -1003,7 +1249,118 @@ func (self *HttpServer) convertShardsToMap(shards []*cluster.ShardData) []interf
 		s["startTime"] = shard.StartTime().Unix()
 		s["endTime"] = shard.EndTime().Unix()
 		s["serverIds"] = shard.ServerIds()
+		s["pendingServerIds"] = shard.PendingServerIds()
 		result = append(result, s)
 	}
 	return result
 }
+
+func (self *HttpServer) getHandoffStates(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		states, err := self.coordinator.GetHandoffStates(u)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, states
+	})
+}
+
+func (self *HttpServer) listQueries(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		queries := self.coordinator.ListRunningQueries(u)
+		result := make([]map[string]interface{}, 0, len(queries))
+		for _, query := range queries {
+			result = append(result, map[string]interface{}{
+				"id":              query.Id,
+				"query":           query.Query,
+				"database":        query.Database,
+				"user":            query.UserName(),
+				"startTime":       query.StartTime.Unix(),
+				"shards":          query.Shards(),
+				"pointsProcessed": query.PointsProcessed(),
+			})
+		}
+		return libhttp.StatusOK, result
+	})
+}
+
+func (self *HttpServer) killQuery(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		id, err := strconv.ParseUint(r.URL.Query().Get(":id"), 10, 32)
+		if err != nil {
+			return libhttp.StatusBadRequest, fmt.Sprintf("Invalid query id %s", r.URL.Query().Get(":id"))
+		}
+		if err := self.coordinator.KillQuery(u, uint32(id)); err != nil {
+			return libhttp.StatusNotFound, err.Error()
+		}
+		return libhttp.StatusNoContent, nil
+	})
+}
+
+func (self *HttpServer) databaseStats(w libhttp.ResponseWriter, r *libhttp.Request) {
+	db := r.URL.Query().Get(":db")
+
+	self.tryAsDbUserAndClusterAdmin(w, r, func(u User) (int, interface{}) {
+		stats, err := self.coordinator.GetDatabaseStats(u, db)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, stats
+	})
+}
+
+func (self *HttpServer) getWriteLimit(w libhttp.ResponseWriter, r *libhttp.Request) {
+	db := r.URL.Query().Get(":db")
+	username := r.URL.Query().Get(":user")
+
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		limit, err := self.coordinator.GetWriteLimit(u, db, username)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, limit
+	})
+}
+
+func (self *HttpServer) setWriteLimit(w libhttp.ResponseWriter, r *libhttp.Request) {
+	db := r.URL.Query().Get(":db")
+	username := r.URL.Query().Get(":user")
+
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		limit := &cluster.WriteLimit{}
+		if err := json.Unmarshal(body, limit); err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+
+		if err := self.coordinator.SetWriteLimit(u, db, username, limit); err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, nil
+	})
+}
+
+func (self *HttpServer) backup(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		if self.backupWriter == nil {
+			return libhttp.StatusNotImplemented, "Backups aren't enabled on this server"
+		}
+		clusterConfiguration, err := self.clusterConfig.Save()
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+
+		w.Header().Set("Content-Type", "application/x-tar")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=influxdb-backup-%d.tar", time.Now().Unix()))
+		w.WriteHeader(libhttp.StatusOK)
+		if err := self.backupWriter.Backup(w, clusterConfiguration); err != nil {
+			// the headers were already sent, all we can do is log the
+			// error and cut the archive short
+			log.Error("Backup failed: %s", err)
+		}
+		return -1, nil
+	})
+}
@@ -4,10 +4,13 @@ import (
 	"bytes"
 	"cluster"
 	. "common"
+	"compress/gzip"
+	"compress/zlib"
 	"coordinator"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	. "launchpad.net/gocheck"
 	"net"
@@ -33,7 +36,8 @@ type ApiSuite struct {
 
 var _ = Suite(&ApiSuite{})
 
-func (self *MockCoordinator) RunQuery(_ User, _ string, query string, yield coordinator.SeriesWriter) error {
+func (self *MockCoordinator) RunQuery(_ User, _ string, query string, yield coordinator.SeriesWriter, timeout time.Duration, _ <-chan bool) error {
+	self.queryTimeout = timeout
 	if self.returnedError != nil {
 		return self.returnedError
 	}
@@ -93,17 +97,36 @@ func (self *MockCoordinator) RunQuery(_ User, _ string, query string, yield coor
 
 type MockCoordinator struct {
 	coordinator.Coordinator
-	series            []*protocol.Series
-	continuousQueries map[string][]*cluster.ContinuousQuery
-	deleteQueries     []*parser.DeleteQuery
-	db                string
-	droppedDb         string
-	returnedError     error
+	series               []*protocol.Series
+	continuousQueries    map[string][]*cluster.ContinuousQuery
+	indexedColumns       map[string]map[string][]string
+	deleteQueries        []*parser.DeleteQuery
+	db                   string
+	droppedDb            string
+	returnedError        error
+	queryTimeout         time.Duration
+	runningQueries       []*coordinator.RunningQuery
+	killedQueries        []uint32
+	writeLimits          map[string]*cluster.WriteLimit
+	rebalancedShards     [][]uint32
+	cancelledShardCopies []uint32
+	removedServers       [][]uint32
+	writeConsistency     string
 }
 
-func (self *MockCoordinator) WriteSeriesData(_ User, db string, series *protocol.Series) error {
-	self.series = append(self.series, series)
-	return nil
+func (self *MockCoordinator) WriteSeriesData(user User, db string, series *protocol.Series) error {
+	return self.NewWriteRequest(user, db, "")(series)
+}
+
+func (self *MockCoordinator) NewWriteRequest(_ User, db string, consistency string) func(*protocol.Series) error {
+	self.writeConsistency = consistency
+	return func(series *protocol.Series) error {
+		if self.returnedError != nil {
+			return self.returnedError
+		}
+		self.series = append(self.series, series)
+		return nil
+	}
 }
 
 func (self *MockCoordinator) DeleteSeriesData(_ User, db string, query *parser.DeleteQuery, localOnly bool) error {
@@ -161,6 +184,87 @@ func (self *MockCoordinator) DeleteContinuousQuery(_ User, db string, id uint32)
 	return nil
 }
 
+func (self *MockCoordinator) CreateIndexedColumn(_ User, db, series, column string) error {
+	if self.indexedColumns[db] == nil {
+		self.indexedColumns[db] = map[string][]string{}
+	}
+	self.indexedColumns[db][series] = append(self.indexedColumns[db][series], column)
+	return nil
+}
+
+func (self *MockCoordinator) DropIndexedColumn(_ User, db, series, column string) error {
+	columns := self.indexedColumns[db][series]
+	for idx, c := range columns {
+		if c == column {
+			self.indexedColumns[db][series] = append(columns[:idx], columns[idx+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("%s isn't indexed", column)
+}
+
+func (self *MockCoordinator) ListRunningQueries(_ User) []*coordinator.RunningQuery {
+	return self.runningQueries
+}
+
+func (self *MockCoordinator) KillQuery(_ User, id uint32) error {
+	for _, query := range self.runningQueries {
+		if query.Id == id {
+			self.killedQueries = append(self.killedQueries, id)
+			return nil
+		}
+	}
+	return fmt.Errorf("Query %d isn't running", id)
+}
+
+func (self *MockCoordinator) SetWriteLimit(_ User, db, username string, limit *cluster.WriteLimit) error {
+	if limit.PointsPerSecond < 0 || limit.RequestsPerSecond < 0 {
+		return fmt.Errorf("Write limits can't be negative")
+	}
+	self.writeLimits[db+"/"+username] = limit
+	return nil
+}
+
+func (self *MockCoordinator) GetWriteLimit(_ User, db, username string) (*cluster.WriteLimit, error) {
+	if limit := self.writeLimits[db+"/"+username]; limit != nil {
+		return limit, nil
+	}
+	return &cluster.WriteLimit{}, nil
+}
+
+func (self *MockCoordinator) GetDatabaseStats(_ User, db string) (*cluster.DatabaseStats, error) {
+	stats := cluster.NewDatabaseStats(db)
+	stats.Add(&cluster.SeriesStats{Name: "foo", Points: 10, Columns: 2, FirstTimestamp: 1000000, LastTimestamp: 2000000, Bytes: 400})
+	stats.Add(&cluster.SeriesStats{Name: "bar", Columns: 1, Bytes: 100})
+	return stats, nil
+}
+
+func (self *MockCoordinator) RebalanceShard(_ User, shardId, targetServerId, dropServerId uint32) error {
+	self.rebalancedShards = append(self.rebalancedShards, []uint32{shardId, targetServerId, dropServerId})
+	return nil
+}
+
+func (self *MockCoordinator) CancelShardCopy(_ User, shardId uint32) error {
+	self.cancelledShardCopies = append(self.cancelledShardCopies, shardId)
+	return nil
+}
+
+func (self *MockCoordinator) RemoveServer(_ User, serverId, replacementServerId uint32) error {
+	self.removedServers = append(self.removedServers, []uint32{serverId, replacementServerId})
+	return nil
+}
+
+func (self *MockCoordinator) GetHandoffStates(_ User) ([]*cluster.HandoffState, error) {
+	return []*cluster.HandoffState{
+		&cluster.HandoffState{ServerId: 1},
+		&cluster.HandoffState{ServerId: 2, QueuedRequests: 3, QueuedBytes: 300, OldestRequestNumber: 5, LastError: "connection refused", ShardsToRepair: []uint32{4}},
+	}, nil
+}
+
+func (self *MockCoordinator) ListIndexedColumns(_ User, db string) (map[string][]string, error) {
+	return self.indexedColumns[db], nil
+}
+
 func (self *ApiSuite) formatUrl(path string, args ...interface{}) string {
 	path = fmt.Sprintf(path, args...)
 	port := self.listener.Addr().(*net.TCPAddr).Port
@@ -174,6 +278,7 @@ func (self *ApiSuite) SetUpSuite(c *C) {
 				&cluster.ContinuousQuery{1, "select * from foo into bar;"},
 			},
 		},
+		indexedColumns: map[string]map[string][]string{},
 	}
 
 	self.manager = &MockUserManager{
@@ -294,6 +399,34 @@ func (self *ApiSuite) TestQueryErrorPropagatesProperly(c *C) {
 	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
 }
 
+func (self *ApiSuite) TestQueryWithTimeout(c *C) {
+	query := url.QueryEscape("select * from foo;")
+	addr := self.formatUrl("/db/foo/series?q=%s&timeout=30s&u=dbuser&p=password", query)
+	resp, err := libhttp.Get(addr)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(self.coordinator.queryTimeout, Equals, 30*time.Second)
+
+	for _, timeout := range []string{"foo", "-1s"} {
+		addr = self.formatUrl("/db/foo/series?q=%s&timeout=%s&u=dbuser&p=password", query, timeout)
+		resp, err = libhttp.Get(addr)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+	}
+}
+
+func (self *ApiSuite) TestQueryTimeoutError(c *C) {
+	self.coordinator.returnedError = NewQueryError(QueryTimedOut, "Query timed out after 30s")
+	query := url.QueryEscape("select * from foo;")
+	addr := self.formatUrl("/db/foo/series?q=%s&u=dbuser&p=password", query)
+	resp, err := libhttp.Get(addr)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusGatewayTimeout)
+}
+
 func (self *ApiSuite) TestQueryWithSecondsPrecision(c *C) {
 	query := "select * from foo where column_one == 'some_value';"
 	query = url.QueryEscape(query)
@@ -397,6 +530,52 @@ func (self *ApiSuite) TestChunkedQuery(c *C) {
 	}
 }
 
+func (self *ApiSuite) TestCsvQuery(c *C) {
+	query := "select * from foo where column_one == 'some_value';"
+	query = url.QueryEscape(query)
+	addr := self.formatUrl("/db/foo/series?q=%s&format=csv&time_precision=s&u=dbuser&p=password", query)
+	resp, err := libhttp.Get(addr)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(resp.Header.Get("content-type"), Equals, "text/csv")
+	data, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, `foo
+time,sequence_number,column_one,column_two
+1381346631,1,some_value,
+1381346632,2,some_value,2
+1381346633,1,some_value,3
+1381346634,2,some_value,4
+`)
+}
+
+func (self *ApiSuite) TestChunkedCsvQueryUsingAcceptHeader(c *C) {
+	query := "select * from foo where column_one == 'some_value';"
+	query = url.QueryEscape(query)
+	addr := self.formatUrl("/db/foo/series?q=%s&chunked=true&u=dbuser&p=password", query)
+	req, err := libhttp.NewRequest("GET", addr, nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Accept", "text/csv")
+	resp, err := libhttp.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.Header.Get("content-type"), Equals, "text/csv")
+	data, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	// one section per chunk
+	c.Assert(string(data), Equals, `foo
+time,sequence_number,column_one,column_two
+1381346631000,1,some_value,
+1381346632000,2,some_value,2
+
+foo
+time,sequence_number,column_one,column_two
+1381346633000,1,some_value,3
+1381346634000,2,some_value,4
+`)
+}
+
 func (self *ApiSuite) TestWriteDataWithTimeInSeconds(c *C) {
 	data := `
 [
@@ -550,6 +729,179 @@ func (self *ApiSuite) TestWriteData(c *C) {
 	c.Assert(*series.Points[0].Values[3].BoolValue, Equals, true)
 }
 
+func (self *ApiSuite) TestWriteMultipleSeries(c *C) {
+	data := `[
+  {"name": "foo", "columns": ["column_one"], "points": [[1], [2]]},
+  {"name": "bar", "columns": ["column_one"], "points": []},
+  {"name": "baz", "columns": ["column_one", "column_two"], "points": [["a string with } and \" in it", 3]]}
+]`
+
+	addr := self.formatUrl("/db/foo/series?u=dbuser&p=password")
+	resp, err := libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(self.coordinator.series, HasLen, 2)
+	c.Assert(*self.coordinator.series[0].Name, Equals, "foo")
+	c.Assert(self.coordinator.series[0].Points, HasLen, 2)
+	c.Assert(*self.coordinator.series[1].Name, Equals, "baz")
+	c.Assert(*self.coordinator.series[1].Points[0].Values[0].StringValue, Equals, `a string with } and " in it`)
+}
+
+func (self *ApiSuite) TestWriteInvalidJson(c *C) {
+	for _, data := range []string{"", "{}", `[{"name": "foo"`, `[{"name": "foo", "columns": [], "points": []} {}]`} {
+		addr := self.formatUrl("/db/foo/series?u=dbuser&p=password")
+		resp, err := libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+	}
+}
+
+// hides the length of the body, so the request is chunked
+type unknownLengthReader struct {
+	io.Reader
+}
+
+func (self *ApiSuite) TestWriteDataWithTooLargeBody(c *C) {
+	self.server.SetMaxBodySize(32)
+	defer self.server.SetMaxBodySize(0)
+
+	data := `[{"name": "foo", "columns": ["column_one"], "points": [[1], [2], [3]]}]`
+	addr := self.formatUrl("/db/foo/series?u=dbuser&p=password")
+	resp, err := libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusRequestEntityTooLarge)
+
+	resp, err = libhttp.Post(addr, "application/json", unknownLengthReader{bytes.NewBufferString(data)})
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusRequestEntityTooLarge)
+	c.Assert(self.coordinator.series, HasLen, 0)
+}
+
+func (self *ApiSuite) TestWriteCompressedData(c *C) {
+	data := `[{"name": "foo", "columns": ["column_one"], "points": [[1], [2], [3]]}]`
+
+	for _, encoding := range []string{"gzip", "deflate"} {
+		self.coordinator.series = nil
+		body := bytes.NewBuffer(nil)
+		var writer io.WriteCloser
+		if encoding == "gzip" {
+			writer = gzip.NewWriter(body)
+		} else {
+			writer = zlib.NewWriter(body)
+		}
+		writer.Write([]byte(data))
+		writer.Close()
+
+		addr := self.formatUrl("/db/foo/series?u=dbuser&p=password")
+		req, err := libhttp.NewRequest("POST", addr, body)
+		c.Assert(err, IsNil)
+		req.Header.Set("Content-Encoding", encoding)
+		resp, err := libhttp.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+		c.Assert(self.coordinator.series, HasLen, 1)
+		c.Assert(self.coordinator.series[0].Points, HasLen, 3)
+	}
+}
+
+func (self *ApiSuite) TestWriteCompressedDataWithTooLargeBody(c *C) {
+	self.server.SetMaxBodySize(1024)
+	defer self.server.SetMaxBodySize(0)
+
+	// compresses to a lot less than 1024 bytes
+	body := bytes.NewBuffer(nil)
+	writer := gzip.NewWriter(body)
+	writer.Write([]byte(`[{"name": "foo", "columns": ["column_one"], "points": [`))
+	for i := 0; i < 1000; i++ {
+		writer.Write([]byte("[1],"))
+	}
+	writer.Write([]byte(`[1]]}]`))
+	writer.Close()
+	c.Assert(body.Len() < 1024, Equals, true)
+
+	addr := self.formatUrl("/db/foo/series?u=dbuser&p=password")
+	req, err := libhttp.NewRequest("POST", addr, body)
+	c.Assert(err, IsNil)
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := libhttp.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusRequestEntityTooLarge)
+	c.Assert(self.coordinator.series, HasLen, 0)
+}
+
+func (self *ApiSuite) TestWriteDataWithInvalidEncoding(c *C) {
+	addr := self.formatUrl("/db/foo/series?u=dbuser&p=password")
+	for encoding, status := range map[string]int{"gzip": libhttp.StatusBadRequest, "compress": libhttp.StatusUnsupportedMediaType} {
+		req, err := libhttp.NewRequest("POST", addr, bytes.NewBufferString("[]"))
+		c.Assert(err, IsNil)
+		req.Header.Set("Content-Encoding", encoding)
+		resp, err := libhttp.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, status)
+	}
+}
+
+func (self *ApiSuite) TestWriteCsvData(c *C) {
+	data := `time,column_one,column_two,column_three
+1382131686,foo,1,1.5
+1382131687,bar,,true
+not_a_time,baz,3,3.5
+1382131688,"quoted, value",4
+2013-10-18T21:28:09Z,qux,5,5.5
+`
+
+	addr := self.formatUrl("/db/foo/series?format=csv&series=csv_series&u=dbuser&p=password")
+	resp, err := libhttp.Post(addr, "text/plain", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	result := map[string]interface{}{}
+	c.Assert(json.Unmarshal(body, &result), IsNil)
+	c.Assert(result["written"], Equals, 3.0)
+	c.Assert(result["failed"], Equals, 2.0)
+	c.Assert(result["errors"], HasLen, 2)
+
+	c.Assert(self.coordinator.series, HasLen, 1)
+	series := self.coordinator.series[0]
+	c.Assert(*series.Name, Equals, "csv_series")
+	c.Assert(series.Fields, DeepEquals, []string{"column_one", "column_two", "column_three"})
+	c.Assert(series.Points, HasLen, 3)
+
+	// the precision is guessed from the first timestamp
+	c.Assert(*series.Points[0].Timestamp, Equals, int64(1382131686000000))
+	c.Assert(*series.Points[0].Values[0].StringValue, Equals, "foo")
+	c.Assert(*series.Points[0].Values[1].Int64Value, Equals, int64(1))
+	c.Assert(*series.Points[0].Values[2].DoubleValue, Equals, 1.5)
+	c.Assert(series.Points[1].Values[1].GetIsNull(), Equals, true)
+	c.Assert(*series.Points[1].Values[2].BoolValue, Equals, true)
+	c.Assert(*series.Points[2].Timestamp, Equals, int64(1382131689000000))
+}
+
+func (self *ApiSuite) TestWriteCsvDataInBatches(c *C) {
+	data := bytes.NewBufferString("column_one\n")
+	for i := 0; i < CSV_IMPORT_BATCH_SIZE+1; i++ {
+		fmt.Fprintf(data, "%d\n", i)
+	}
+
+	addr := self.formatUrl("/db/foo/series?series=csv_series&u=dbuser&p=password")
+	resp, err := libhttp.Post(addr, "text/csv", data)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(self.coordinator.series, HasLen, 2)
+	c.Assert(self.coordinator.series[0].Points, HasLen, CSV_IMPORT_BATCH_SIZE)
+	c.Assert(self.coordinator.series[1].Points, HasLen, 1)
+}
+
 func (self *ApiSuite) TestWriteDataAsClusterAdmin(c *C) {
 	data := `
 [
@@ -863,3 +1215,222 @@ func (self *ApiSuite) TestContinuousQueryOperations(c *C) {
 	c.Assert(queries[0].Query, Equals, "select * from foo into bar;")
 	resp.Body.Close()
 }
+
+func (self *ApiSuite) TestIndexedColumnOperations(c *C) {
+	listIndexes := func() []IndexedColumn {
+		resp, err := libhttp.Get(self.formatUrl("/db/db1/indexes?u=root&p=root"))
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+		body, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, IsNil)
+		indexes := []IndexedColumn{}
+		c.Assert(json.Unmarshal(body, &indexes), IsNil)
+		return indexes
+	}
+
+	c.Assert(listIndexes(), HasLen, 0)
+
+	data := `{"series": "events", "column": "host"}`
+	resp, err := libhttp.Post(self.formatUrl("/db/db1/indexes?u=root&p=root"), "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(listIndexes(), DeepEquals, []IndexedColumn{{"events", "host"}})
+
+	req, err := libhttp.NewRequest("DELETE", self.formatUrl("/db/db1/indexes/events/host?u=root&p=root"), nil)
+	c.Assert(err, IsNil)
+	resp, err = libhttp.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(listIndexes(), HasLen, 0)
+
+	// dropping a column that isn't indexed should fail
+	resp, err = libhttp.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+}
+
+func (self *ApiSuite) TestRunningQueryOperations(c *C) {
+	registry := coordinator.NewQueryRegistry()
+	registry.Register(MockDbUser{Name: "db_user1"}, "db1", "select * from foo", NewQueryCancellation())
+	self.coordinator.runningQueries = registry.List(MockDbUser{Name: "db_user1"})
+
+	resp, err := libhttp.Get(self.formatUrl("/queries?u=root&p=root"))
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	queries := []map[string]interface{}{}
+	c.Assert(json.Unmarshal(body, &queries), IsNil)
+	c.Assert(queries, HasLen, 1)
+	c.Assert(queries[0]["id"], Equals, 1.0)
+	c.Assert(queries[0]["query"], Equals, "select * from foo")
+	c.Assert(queries[0]["database"], Equals, "db1")
+	c.Assert(queries[0]["user"], Equals, "db_user1")
+	c.Assert(queries[0]["pointsProcessed"], Equals, 0.0)
+
+	for id, status := range map[string]int{"1": libhttp.StatusNoContent, "2": libhttp.StatusNotFound, "foo": libhttp.StatusBadRequest} {
+		req, err := libhttp.NewRequest("DELETE", self.formatUrl("/queries/%s?u=root&p=root", id), nil)
+		c.Assert(err, IsNil)
+		resp, err := libhttp.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, status)
+	}
+	c.Assert(self.coordinator.killedQueries, DeepEquals, []uint32{1})
+}
+
+func (self *ApiSuite) TestWriteLimitExceeded(c *C) {
+	self.coordinator.returnedError = NewWriteLimitError(1500*time.Millisecond, "Write limit of database foo exceeded")
+	data := `[{"points": [[1]], "name": "foo", "columns": ["column_one"]}]`
+
+	addr := self.formatUrl("/db/foo/series?u=dbuser&p=password")
+	resp, err := libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, 429)
+	c.Assert(resp.Header.Get("Retry-After"), Equals, "2")
+	c.Assert(self.coordinator.series, HasLen, 0)
+}
+
+func (self *ApiSuite) TestWriteConsistency(c *C) {
+	data := `[{"points": [[1]], "name": "foo", "columns": ["column_one"]}]`
+
+	addr := self.formatUrl("/db/foo/series?u=dbuser&p=password&consistency=quorum")
+	resp, err := libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(self.coordinator.writeConsistency, Equals, "quorum")
+	c.Assert(self.coordinator.series, HasLen, 1)
+
+	self.coordinator.returnedError = NewPartialWriteError(1, 2, "Only 1 of the 2 replicas wrote to shard 1")
+	resp, err = libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusGatewayTimeout)
+	c.Assert(string(body), Equals, "Only 1 of the 2 replicas wrote to shard 1")
+}
+
+func (self *ApiSuite) TestWriteLimitOperations(c *C) {
+	self.coordinator.writeLimits = map[string]*cluster.WriteLimit{}
+
+	for _, path := range []string{"/db/db1/write_limits", "/db/db1/users/paul/write_limits"} {
+		data := `{"pointsPerSecond": 100, "requestsPerSecond": 10}`
+		resp, err := libhttp.Post(self.formatUrl("%s?u=root&p=root", path), "application/json", bytes.NewBufferString(data))
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+
+		resp, err = libhttp.Get(self.formatUrl("%s?u=root&p=root", path))
+		c.Assert(err, IsNil)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.Assert(err, IsNil)
+		c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+		limit := &cluster.WriteLimit{}
+		c.Assert(json.Unmarshal(body, limit), IsNil)
+		c.Assert(*limit, Equals, cluster.WriteLimit{PointsPerSecond: 100, RequestsPerSecond: 10})
+	}
+	c.Assert(self.coordinator.writeLimits, HasLen, 2)
+
+	resp, err := libhttp.Post(self.formatUrl("/db/db1/write_limits?u=root&p=root"), "application/json", bytes.NewBufferString(`{"pointsPerSecond": -1}`))
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+}
+
+func (self *ApiSuite) TestRebalanceShard(c *C) {
+	self.coordinator.rebalancedShards = nil
+	data := `{"targetServerId": 3, "dropServerId": 1}`
+	resp, err := libhttp.Post(self.formatUrl("/cluster/shards/2/rebalance?u=root&p=root"), "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusAccepted)
+	c.Assert(self.coordinator.rebalancedShards, DeepEquals, [][]uint32{{2, 3, 1}})
+
+	resp, err = libhttp.Post(self.formatUrl("/cluster/shards/2/rebalance?u=root&p=root"), "application/json", bytes.NewBufferString(`{}`))
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+	c.Assert(self.coordinator.rebalancedShards, HasLen, 1)
+
+	self.coordinator.cancelledShardCopies = nil
+	req, err := libhttp.NewRequest("DELETE", self.formatUrl("/cluster/shards/2/rebalance?u=root&p=root"), nil)
+	c.Assert(err, IsNil)
+	resp, err = libhttp.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(self.coordinator.cancelledShardCopies, DeepEquals, []uint32{2})
+}
+
+func (self *ApiSuite) TestRemoveAndReplaceServers(c *C) {
+	self.coordinator.removedServers = nil
+	req, err := libhttp.NewRequest("DELETE", self.formatUrl("/cluster/servers/2?u=root&p=root"), nil)
+	c.Assert(err, IsNil)
+	resp, err := libhttp.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusAccepted)
+
+	data := `{"replacementServerId": 4}`
+	resp, err = libhttp.Post(self.formatUrl("/cluster/servers/3/replace?u=root&p=root"), "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusAccepted)
+	c.Assert(self.coordinator.removedServers, DeepEquals, [][]uint32{{2, 0}, {3, 4}})
+
+	resp, err = libhttp.Post(self.formatUrl("/cluster/servers/3/replace?u=root&p=root"), "application/json", bytes.NewBufferString(`{}`))
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+}
+
+func (self *ApiSuite) TestDatabaseStats(c *C) {
+	resp, err := libhttp.Get(self.formatUrl("/db/db1/stats?u=dbuser&p=password"))
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	stats := map[string]interface{}{}
+	c.Assert(json.Unmarshal(body, &stats), IsNil)
+	c.Assert(stats["name"], Equals, "db1")
+	c.Assert(stats["points"], Equals, 10.0)
+	c.Assert(stats["bytes"], Equals, 500.0)
+	c.Assert(stats["firstTimestamp"], Equals, 1000000.0)
+	series := stats["series"].([]interface{})
+	c.Assert(series, HasLen, 2)
+	c.Assert(series[0].(map[string]interface{})["name"], Equals, "bar")
+	c.Assert(series[1].(map[string]interface{})["columns"], Equals, 2.0)
+}
+
+func (self *ApiSuite) TestHandoffStates(c *C) {
+	resp, err := libhttp.Get(self.formatUrl("/cluster/handoff?u=root&p=root"))
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	states := []map[string]interface{}{}
+	c.Assert(json.Unmarshal(body, &states), IsNil)
+	c.Assert(states, HasLen, 2)
+	c.Assert(states[1]["serverId"], Equals, 2.0)
+	c.Assert(states[1]["queuedRequests"], Equals, 3.0)
+	c.Assert(states[1]["queuedBytes"], Equals, 300.0)
+	c.Assert(states[1]["oldestRequestNumber"], Equals, 5.0)
+	c.Assert(states[1]["lastError"], Equals, "connection refused")
+	c.Assert(states[1]["shardsToRepair"], DeepEquals, []interface{}{4.0})
+
+	resp, err = libhttp.Get(self.formatUrl("/cluster/handoff?u=dbuser&p=password"))
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusUnauthorized)
+}
@@ -0,0 +1,261 @@
+package http
+
+// Imports points from a csv body, e.g. POST /db/:db/series?format=csv&series=name
+//
+// The first row is the header with the column names. A column named
+// `time` (or `timestamp`) is used as the timestamp of the points and
+// a column named `sequence_number` as the sequence number. The time
+// column can either contain RFC3339 times or integer epoch times. If
+// the time_precision parameter isn't given, the precision of integer
+// times is guessed from the first one.
+//
+// The body is read incrementally and the points are written in
+// batches. Rows that can't be parsed are skipped and reported back to
+// the client, the rest of the upload is still written.
+
+import (
+	. "common"
+	"encoding/csv"
+	"fmt"
+	"io"
+	libhttp "net/http"
+	"protocol"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CSV_IMPORT_BATCH_SIZE = 1000
+	// only the first errors are reported back to the client
+	CSV_IMPORT_MAX_REPORTED_ERRORS = 100
+)
+
+type csvImportResult struct {
+	Written int      `json:"written"`
+	Failed  int      `json:"failed"`
+	Errors  []string `json:"errors"`
+}
+
+func (self *csvImportResult) addError(row int, err error) {
+	self.Failed++
+	if len(self.Errors) < CSV_IMPORT_MAX_REPORTED_ERRORS {
+		self.Errors = append(self.Errors, fmt.Sprintf("row %d: %s", row, err))
+	}
+}
+
+func isCsvBody(r *libhttp.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "csv"
+	}
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv")
+}
+
+func (self *HttpServer) importCsv(w libhttp.ResponseWriter, r *libhttp.Request) {
+	db := r.URL.Query().Get(":db")
+	name := r.URL.Query().Get("series")
+	consistency := r.URL.Query().Get("consistency")
+
+	// nil means the precision will be guessed from the data
+	var precision *TimePrecision
+	if p := r.URL.Query().Get("time_precision"); p != "" {
+		parsedPrecision, err := TimePrecisionFromString(p)
+		if err != nil {
+			w.WriteHeader(libhttp.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		precision = &parsedPrecision
+	}
+
+	self.tryAsDbUserAndClusterAdmin(w, r, func(user User) (int, interface{}) {
+		if !VALID_TABLE_NAMES.MatchString(name) {
+			return libhttp.StatusBadRequest, fmt.Sprintf("%s is not a valid series name", name)
+		}
+
+		importer := &csvImporter{precision: precision}
+		writeSeries := self.coordinator.NewWriteRequest(user, db, consistency)
+		result, err := importer.run(r.Body, func(fields []string, points []*protocol.Point) error {
+			return writeSeries(&protocol.Series{Name: &name, Fields: fields, Points: points})
+		})
+		if err != nil {
+			setRetryAfter(w, err)
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, result
+	})
+}
+
+type csvImporter struct {
+	precision           *TimePrecision
+	timeIndex           int
+	sequenceNumberIndex int
+	fields              []string
+}
+
+// Reads the csv from the given reader and calls yield with every
+// batch of points. Errors returned by yield abort the import.
+func (self *csvImporter) run(body io.Reader, yield func([]string, []*protocol.Point) error) (*csvImportResult, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("Missing the header row")
+	}
+	if err != nil {
+		return nil, err
+	}
+	self.parseHeader(header)
+
+	result := &csvImportResult{Errors: []string{}}
+	points := make([]*protocol.Point, 0, CSV_IMPORT_BATCH_SIZE)
+	for row := 2; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); !ok {
+				return nil, err
+			}
+			result.addError(row, err)
+			continue
+		}
+
+		point, err := self.parseRecord(header, record)
+		if err != nil {
+			result.addError(row, err)
+			continue
+		}
+		points = append(points, point)
+		if len(points) < CSV_IMPORT_BATCH_SIZE {
+			continue
+		}
+
+		if err := yield(self.fields, points); err != nil {
+			return nil, err
+		}
+		result.Written += len(points)
+		points = make([]*protocol.Point, 0, CSV_IMPORT_BATCH_SIZE)
+	}
+
+	if len(points) > 0 {
+		if err := yield(self.fields, points); err != nil {
+			return nil, err
+		}
+		result.Written += len(points)
+	}
+	return result, nil
+}
+
+func (self *csvImporter) parseHeader(header []string) {
+	self.timeIndex = -1
+	self.sequenceNumberIndex = -1
+	self.fields = make([]string, 0, len(header))
+	for idx, column := range header {
+		column = strings.TrimSpace(column)
+		switch strings.ToLower(column) {
+		case "time", "timestamp":
+			self.timeIndex = idx
+		case "sequence_number":
+			self.sequenceNumberIndex = idx
+		default:
+			self.fields = append(self.fields, column)
+		}
+	}
+}
+
+func (self *csvImporter) parseRecord(header, record []string) (*protocol.Point, error) {
+	if len(record) != len(header) {
+		return nil, fmt.Errorf("expected %d columns but got %d", len(header), len(record))
+	}
+
+	point := &protocol.Point{Values: make([]*protocol.FieldValue, 0, len(self.fields))}
+	for idx, value := range record {
+		switch idx {
+		case self.timeIndex:
+			if value == "" {
+				continue
+			}
+			timestamp, err := self.parseTime(value)
+			if err != nil {
+				return nil, err
+			}
+			point.SetTimestampInMicroseconds(timestamp)
+		case self.sequenceNumberIndex:
+			if value == "" {
+				continue
+			}
+			sequenceNumber, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid sequence_number '%s'", value)
+			}
+			point.SequenceNumber = &sequenceNumber
+		default:
+			point.Values = append(point.Values, csvFieldValue(value))
+		}
+	}
+	return point, nil
+}
+
+// Returns the given time in microseconds
+func (self *csvImporter) parseTime(value string) (int64, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UnixNano() / int64(time.Microsecond), nil
+	}
+
+	timestamp, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time '%s'", value)
+	}
+	if self.precision == nil {
+		precision := guessTimePrecision(timestamp)
+		self.precision = &precision
+	}
+
+	switch *self.precision {
+	case SecondPrecision:
+		timestamp *= 1000
+		fallthrough
+	case MillisecondPrecision:
+		timestamp *= 1000
+	}
+	return timestamp, nil
+}
+
+// Epoch times in seconds have 10 digits and in milliseconds 13 digits
+// for any date we care about
+func guessTimePrecision(timestamp int64) TimePrecision {
+	if timestamp < 0 {
+		timestamp = -timestamp
+	}
+	switch {
+	case timestamp < 1e11:
+		return SecondPrecision
+	case timestamp < 1e14:
+		return MillisecondPrecision
+	default:
+		return MicrosecondPrecision
+	}
+}
+
+// Empty fields are null, everything that doesn't look like a number
+// or a boolean is a string
+func csvFieldValue(value string) *protocol.FieldValue {
+	if value == "" {
+		return &protocol.FieldValue{IsNull: &TRUE}
+	}
+	if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return &protocol.FieldValue{Int64Value: &i}
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		return &protocol.FieldValue{DoubleValue: &f}
+	}
+	switch value {
+	case "true", "false":
+		b := value == "true"
+		return &protocol.FieldValue{BoolValue: &b}
+	}
+	return &protocol.FieldValue{StringValue: &value}
+}
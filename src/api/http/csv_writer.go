@@ -0,0 +1,138 @@
+package http
+
+// Writes query results as csv. Every series is written as a section
+// that starts with a line containing the series name followed by a
+// header row (time, sequence_number and the fields of the series) and
+// the points of the series. Sections are separated by an empty line.
+
+import (
+	"bytes"
+	log "code.google.com/p/log4go"
+	. "common"
+	"encoding/csv"
+	"fmt"
+	"io"
+	libhttp "net/http"
+	"protocol"
+	"strconv"
+	"strings"
+)
+
+func isCsvRequest(r *libhttp.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "csv"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/csv")
+}
+
+type CsvWriter struct {
+	w                libhttp.ResponseWriter
+	precision        TimePrecision
+	chunked          bool
+	memSeries        map[string]*protocol.Series
+	wroteContentType bool
+	wroteSection     bool
+}
+
+func NewCsvWriter(w libhttp.ResponseWriter, precision TimePrecision, chunked bool) *CsvWriter {
+	return &CsvWriter{
+		w:         w,
+		precision: precision,
+		chunked:   chunked,
+		memSeries: map[string]*protocol.Series{},
+	}
+}
+
+func (self *CsvWriter) yield(series *protocol.Series) error {
+	if !self.chunked {
+		oldSeries := self.memSeries[*series.Name]
+		if oldSeries == nil {
+			self.memSeries[*series.Name] = series
+			return nil
+		}
+		oldSeries.Points = append(oldSeries.Points, series.Points...)
+		return nil
+	}
+
+	self.writeHeader()
+	if err := self.write(self.w, map[string]*protocol.Series{"": series}); err != nil {
+		return err
+	}
+	self.w.(libhttp.Flusher).Flush()
+	return nil
+}
+
+func (self *CsvWriter) done() {
+	if self.chunked {
+		return
+	}
+	// the series are written to a buffer first, so the status can still
+	// be changed if they can't be written
+	buffer := &bytes.Buffer{}
+	if err := self.write(buffer, self.memSeries); err != nil {
+		if self.wroteContentType {
+			log.Error("Cannot write the csv response: %s", err)
+			return
+		}
+		self.w.WriteHeader(libhttp.StatusInternalServerError)
+		self.w.Write([]byte(err.Error()))
+		return
+	}
+	self.writeHeader()
+	if _, err := buffer.WriteTo(self.w); err != nil {
+		log.Error("Cannot write the csv response: %s", err)
+	}
+}
+
+func (self *CsvWriter) writeHeader() {
+	if self.wroteContentType {
+		return
+	}
+	self.wroteContentType = true
+	self.w.Header().Add("content-type", "text/csv")
+	self.w.WriteHeader(libhttp.StatusOK)
+}
+
+func (self *CsvWriter) write(w io.Writer, memSeries map[string]*protocol.Series) error {
+	writer := csv.NewWriter(w)
+	for _, series := range SerializeSeries(memSeries, self.precision) {
+		if self.wroteSection {
+			if err := writer.Write([]string{}); err != nil {
+				return err
+			}
+		}
+		self.wroteSection = true
+
+		if err := writer.Write([]string{series.Name}); err != nil {
+			return err
+		}
+		if err := writer.Write(series.Columns); err != nil {
+			return err
+		}
+		for _, point := range series.Points {
+			record := make([]string, 0, len(point))
+			for _, value := range point {
+				record = append(record, csvValue(value))
+			}
+			if err := writer.Write(record); err != nil {
+				return err
+			}
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// null values are written as empty fields
+func csvValue(value interface{}) string {
+	switch x := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	default:
+		return fmt.Sprintf("%v", x)
+	}
+}
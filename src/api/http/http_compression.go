@@ -3,11 +3,18 @@ package http
 import (
 	"compress/gzip"
 	"compress/zlib"
+	"fmt"
 	"io"
 	libhttp "net/http"
 	"strings"
 )
 
+const (
+	// the maximum size of a decompressed request body if the server
+	// doesn't have a maximum body size
+	DEFAULT_MAX_DECOMPRESSED_BODY_SIZE = 256 * 1024 * 1024
+)
+
 type CompressedResponseWriter struct {
 	responseWriter libhttp.ResponseWriter
 	writer         io.Writer
@@ -46,6 +53,13 @@ func (self *CompressedResponseWriter) WriteHeader(responseCode int) {
 	self.responseWriter.WriteHeader(responseCode)
 }
 
+func (self *CompressedResponseWriter) CloseNotify() <-chan bool {
+	if notifier, ok := self.responseWriter.(libhttp.CloseNotifier); ok {
+		return notifier.CloseNotify()
+	}
+	return nil
+}
+
 func CompressionHandler(enableCompression bool, handler libhttp.HandlerFunc) libhttp.HandlerFunc {
 	if !enableCompression {
 		return handler
@@ -62,3 +76,45 @@ func CompressionHandler(enableCompression bool, handler libhttp.HandlerFunc) lib
 		}
 	}
 }
+
+// Transparently decompresses gzip and deflate request bodies. The
+// decompressed body is limited to the maximum body size of the server
+// to guard against small bodies that decompress to huge ones.
+func (self *HttpServer) DecompressionHandler(handler libhttp.HandlerFunc) libhttp.HandlerFunc {
+	return func(rw libhttp.ResponseWriter, req *libhttp.Request) {
+		encoding := strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding")))
+		if encoding == "" || encoding == "identity" {
+			handler(rw, req)
+			return
+		}
+
+		var body io.ReadCloser
+		var err error
+		switch encoding {
+		case "gzip":
+			body, err = gzip.NewReader(req.Body)
+		case "deflate":
+			body, err = zlib.NewReader(req.Body)
+		default:
+			rw.WriteHeader(libhttp.StatusUnsupportedMediaType)
+			rw.Write([]byte(fmt.Sprintf("Unsupported content encoding %s", encoding)))
+			return
+		}
+		if err != nil {
+			rw.WriteHeader(libhttp.StatusBadRequest)
+			rw.Write([]byte(fmt.Sprintf("Cannot decompress %s body: %s", encoding, err)))
+			return
+		}
+		defer body.Close()
+
+		maxSize := self.maxBodySize
+		if maxSize <= 0 {
+			maxSize = DEFAULT_MAX_DECOMPRESSED_BODY_SIZE
+		}
+		req.Body = newLimitedBody(body, maxSize)
+		req.Header.Del("Content-Encoding")
+		// the content length is the length of the compressed body
+		req.ContentLength = -1
+		handler(rw, req)
+	}
+}
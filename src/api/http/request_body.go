@@ -0,0 +1,170 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	. "common"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+type bodyTooLargeError struct {
+	limit int64
+}
+
+func (self bodyTooLargeError) Error() string {
+	return fmt.Sprintf("Request body is bigger than the maximum of %d bytes", self.limit)
+}
+
+// Like io.LimitedReader, but returns an error instead of io.EOF once
+// the limit is exceeded, so a truncated body can't be mistaken for a
+// complete one
+type limitedBody struct {
+	io.ReadCloser
+	limit     int64
+	remaining int64
+}
+
+func newLimitedBody(body io.ReadCloser, limit int64) *limitedBody {
+	return &limitedBody{body, limit, limit}
+}
+
+func (self *limitedBody) Read(p []byte) (int, error) {
+	// read one byte more than allowed to find out whether the body is
+	// too large
+	if int64(len(p)) > self.remaining+1 {
+		p = p[:self.remaining+1]
+	}
+	n, err := self.ReadCloser.Read(p)
+	self.remaining -= int64(n)
+	if self.remaining < 0 {
+		return n + int(self.remaining), bodyTooLargeError{self.limit}
+	}
+	return n, err
+}
+
+// Decodes a json array of series one series at a time, so only a
+// single series has to be kept in memory
+type seriesDecoder struct {
+	reader  *bufio.Reader
+	started bool
+	done    bool
+}
+
+func newSeriesDecoder(r io.Reader) *seriesDecoder {
+	return &seriesDecoder{reader: bufio.NewReader(r)}
+}
+
+// Returns the next series in the array or io.EOF after the last one
+func (self *seriesDecoder) Next() (*SerializedSeries, error) {
+	if self.done {
+		return nil, io.EOF
+	}
+
+	c, err := self.nextNonSpace()
+	if !self.started {
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if c != '[' {
+			return nil, fmt.Errorf("Expected a json array of series")
+		}
+		self.started = true
+		if c, err = self.nextNonSpace(); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if c == ']' {
+			self.done = true
+			return nil, io.EOF
+		}
+	} else {
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		switch c {
+		case ']':
+			self.done = true
+			return nil, io.EOF
+		case ',':
+			if c, err = self.nextNonSpace(); err != nil {
+				return nil, unexpectedEOF(err)
+			}
+		default:
+			return nil, fmt.Errorf("Expected ',' or ']' after a series but got '%c'", c)
+		}
+	}
+
+	if c != '{' {
+		return nil, fmt.Errorf("Expected a series object but got '%c'", c)
+	}
+	data, err := self.readObject()
+	if err != nil {
+		return nil, err
+	}
+	series := &SerializedSeries{}
+	if err := json.Unmarshal(data, series); err != nil {
+		return nil, err
+	}
+	return series, nil
+}
+
+func (self *seriesDecoder) nextNonSpace() (byte, error) {
+	for {
+		c, err := self.reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return c, nil
+	}
+}
+
+// Reads the rest of a json object whose opening brace was already
+// read
+func (self *seriesDecoder) readObject() ([]byte, error) {
+	buffer := bytes.NewBuffer([]byte{'{'})
+	depth := 1
+	inString, escaped := false, false
+	for {
+		c, err := self.reader.ReadByte()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		buffer.WriteByte(c)
+
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+
+		switch c {
+		case '"':
+			inString = true
+		case '{', '[':
+			depth++
+		case '}', ']':
+			depth--
+			if depth == 0 {
+				return buffer.Bytes(), nil
+			}
+		}
+	}
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
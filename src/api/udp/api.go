@@ -0,0 +1,173 @@
+package udp
+
+// This server accepts the same json payload as POST /db/:db/series
+// over udp. Each datagram should contain a complete json array of
+// series. There's no response, so errors are only logged.
+
+import (
+	log "code.google.com/p/log4go"
+	. "common"
+	"coordinator"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+)
+
+const (
+	// the maximum size of a udp datagram
+	MAX_DATAGRAM_SIZE = 65536
+)
+
+type Server struct {
+	listenAddress string
+	database      string
+	username      string
+	password      string
+	coordinator   coordinator.Coordinator
+	userManager   coordinator.UserManager
+	shutdown      chan bool
+	// guards the user, it's looked up again if it can't write
+	userLock sync.Mutex
+	user     User
+	// guards the connection, Close can be called before it's opened
+	connLock sync.Mutex
+	conn     *net.UDPConn
+	closed   bool
+}
+
+func NewServer(listenAddress, database, username, password string, coord coordinator.Coordinator, userManager coordinator.UserManager) *Server {
+	return &Server{
+		listenAddress: listenAddress,
+		database:      database,
+		username:      username,
+		password:      password,
+		coordinator:   coord,
+		userManager:   userManager,
+		shutdown:      make(chan bool, 1),
+	}
+}
+
+func (self *Server) ListenAndServe() {
+	defer func() { self.shutdown <- true }()
+
+	if self.listenAddress == "" {
+		return
+	}
+
+	// the database or the user may not exist yet, the datagrams are
+	// dropped until they do
+	if _, err := self.getUser(); err != nil {
+		log.Warn("UdpServer: cannot authenticate user %s on database %s yet: %s", self.username, self.database, err)
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", self.listenAddress)
+	if err != nil {
+		log.Error("UdpServer: cannot resolve address %s: %s", self.listenAddress, err)
+		return
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		log.Error("UdpServer: cannot listen on %s: %s", self.listenAddress, err)
+		return
+	}
+	self.connLock.Lock()
+	if self.closed {
+		self.connLock.Unlock()
+		conn.Close()
+		return
+	}
+	self.conn = conn
+	self.connLock.Unlock()
+
+	buffer := make([]byte, MAX_DATAGRAM_SIZE)
+	for {
+		n, _, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			if strings.Contains(err.Error(), "closed network") {
+				return
+			}
+			log.Error("UdpServer: error while reading datagram: %s", err)
+			continue
+		}
+		self.HandleDatagram(buffer[:n])
+	}
+}
+
+// Returns the user that writes the points, it's authenticated on the
+// first call and after the user couldn't write
+func (self *Server) getUser() (User, error) {
+	self.userLock.Lock()
+	defer self.userLock.Unlock()
+	if self.user != nil {
+		return self.user, nil
+	}
+	user, err := self.userManager.AuthenticateDbUser(self.database, self.username, self.password)
+	if err != nil {
+		return nil, err
+	}
+	self.user = user
+	return user, nil
+}
+
+func (self *Server) forgetUser() {
+	self.userLock.Lock()
+	defer self.userLock.Unlock()
+	self.user = nil
+}
+
+func (self *Server) HandleDatagram(datagram []byte) {
+	serializedSeries := []*SerializedSeries{}
+	err := json.Unmarshal(datagram, &serializedSeries)
+	if err != nil {
+		log.Error("UdpServer: cannot parse datagram: %s", err)
+		return
+	}
+
+	user, err := self.getUser()
+	if err != nil {
+		log.Error("UdpServer: cannot authenticate user %s on database %s: %s", self.username, self.database, err)
+		return
+	}
+
+	for _, s := range serializedSeries {
+		if len(s.Points) == 0 {
+			continue
+		}
+
+		series, err := ConvertToDataStoreSeries(s, MillisecondPrecision)
+		if err != nil {
+			log.Error("UdpServer: cannot convert series %s: %s", s.Name, err)
+			continue
+		}
+
+		err = self.coordinator.WriteSeriesData(user, self.database, series)
+		if err != nil {
+			log.Error("UdpServer: cannot write series %s: %s", s.Name, err)
+			if isAuthError(err) {
+				self.forgetUser()
+			}
+		}
+	}
+}
+
+func isAuthError(err error) bool {
+	switch err.(type) {
+	case AuthenticationError, AuthorizationError:
+		return true
+	}
+	return false
+}
+
+func (self *Server) Close() {
+	self.connLock.Lock()
+	self.closed = true
+	conn := self.conn
+	self.connLock.Unlock()
+	if conn == nil {
+		return
+	}
+	log.Info("Closing udp server")
+	conn.Close()
+	<-self.shutdown
+}
@@ -0,0 +1,124 @@
+package udp
+
+import (
+	"cluster"
+	. "common"
+	"coordinator"
+	. "launchpad.net/gocheck"
+	"protocol"
+	"testing"
+	"time"
+)
+
+// Hook up gocheck into the gotest runner.
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type UdpApiSuite struct{}
+
+var _ = Suite(&UdpApiSuite{})
+
+type MockCoordinator struct {
+	coordinator.Coordinator
+	db       string
+	series   []*protocol.Series
+	writeErr error
+}
+
+func (self *MockCoordinator) WriteSeriesData(_ User, db string, series *protocol.Series) error {
+	if self.writeErr != nil {
+		return self.writeErr
+	}
+	self.db = db
+	self.series = append(self.series, series)
+	return nil
+}
+
+type MockUserManager struct {
+	coordinator.UserManager
+	missing         bool
+	authentications int
+}
+
+func (self *MockUserManager) AuthenticateDbUser(db, username, password string) (User, error) {
+	self.authentications++
+	if self.missing {
+		return nil, NewAuthenticationError("Invalid username/password")
+	}
+	return &cluster.DbUser{CommonUser: cluster.CommonUser{Name: username}, Db: db}, nil
+}
+
+func (self *UdpApiSuite) TestWritingDatagram(c *C) {
+	coord := &MockCoordinator{}
+	server := NewServer("", "db1", "user", "pass", coord, &MockUserManager{})
+	server.HandleDatagram([]byte(`
+[
+  {
+    "points": [
+      [1382131686, "1"],
+      [1382131687, "2"]
+    ],
+    "name": "foo",
+    "columns": ["time", "column_one"]
+  },
+  {
+    "points": [],
+    "name": "bar",
+    "columns": ["column_one"]
+  }
+]
+`))
+	c.Assert(coord.db, Equals, "db1")
+	c.Assert(coord.series, HasLen, 1)
+	c.Assert(*coord.series[0].Name, Equals, "foo")
+	c.Assert(coord.series[0].Points, HasLen, 2)
+	c.Assert(*coord.series[0].Points[0].Timestamp, Equals, int64(1382131686000))
+}
+
+func (self *UdpApiSuite) TestIgnoringInvalidDatagram(c *C) {
+	coord := &MockCoordinator{}
+	server := NewServer("", "db1", "user", "pass", coord, &MockUserManager{})
+	server.HandleDatagram([]byte(`[{"name": "foo",`))
+	c.Assert(coord.series, HasLen, 0)
+}
+
+func (self *UdpApiSuite) TestUserIsAuthenticatedAgainUntilItCanWrite(c *C) {
+	coord := &MockCoordinator{}
+	userManager := &MockUserManager{missing: true}
+	server := NewServer("", "db1", "user", "pass", coord, userManager)
+	datagram := []byte(`[{"points": [[1382131686, "1"]], "name": "foo", "columns": ["time", "column_one"]}]`)
+
+	// the user doesn't exist yet
+	server.HandleDatagram(datagram)
+	c.Assert(coord.series, HasLen, 0)
+
+	userManager.missing = false
+	server.HandleDatagram(datagram)
+	server.HandleDatagram(datagram)
+	c.Assert(coord.series, HasLen, 2)
+	c.Assert(userManager.authentications, Equals, 2)
+
+	// the user is looked up again after it couldn't write
+	coord.writeErr = NewAuthorizationError("Insufficient permissions")
+	server.HandleDatagram(datagram)
+	coord.writeErr = nil
+	server.HandleDatagram(datagram)
+	c.Assert(coord.series, HasLen, 3)
+	c.Assert(userManager.authentications, Equals, 3)
+}
+
+func (self *UdpApiSuite) TestClosingBeforeListening(c *C) {
+	server := NewServer("localhost:0", "db1", "user", "pass", &MockCoordinator{}, &MockUserManager{})
+	server.Close()
+	done := make(chan bool)
+	go func() {
+		server.ListenAndServe()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatal("the server kept listening after it was closed")
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"fmt"
 	"math/rand"
 	"parser"
+	"path"
 	"protocol"
 	"sync"
 	"sync/atomic"
@@ -35,6 +36,9 @@ type WAL interface {
 	Commit(requestNumber uint32, serverId uint32) error
 	RecoverServerFromRequestNumber(requestNumber uint32, shardIds []uint32, yield func(request *protocol.Request, shardId uint32) error) error
 	RecoverServerFromLastCommit(serverId uint32, shardIds []uint32, yield func(request *protocol.Request, shardId uint32) error) error
+	RemoveServer(serverId uint32) error
+	LogAndWaitForCommits(request *protocol.Request, shard wal.Shard, serverIds []uint32) (uint32, <-chan uint32, error)
+	StopWaitingForCommits(requestNumber uint32)
 }
 
 type ShardCreator interface {
@@ -59,16 +63,24 @@ type ClusterConfiguration struct {
 	dbUsers                    map[string]map[string]*DbUser
 	servers                    []*ClusterServer
 	serversLock                sync.RWMutex
+	lastServerId               uint32
 	continuousQueries          map[string][]*ContinuousQuery
 	continuousQueriesLock      sync.RWMutex
 	ParsedContinuousQueries    map[string]map[uint32]*parser.SelectQuery
 	continuousQueryTimestamp   time.Time
+	indexedColumns             map[string]map[string][]*IndexedColumn
+	lastIndexedColumnId        uint32
+	indexedColumnsLock         sync.RWMutex
+	databaseWriteLimits        map[string]*WriteLimit
+	userWriteLimits            map[string]map[string]*WriteLimit
+	writeLimitsLock            sync.RWMutex
 	LocalServerId              uint32
 	config                     *configuration.Configuration
 	addedLocalServerWait       chan bool
 	addedLocalServer           bool
 	connectionCreator          func(string) ServerConnection
 	shardStore                 LocalShardStore
+	localWriteBuffer           *WriteBuffer
 	wal                        WAL
 	longTermShards             []*ShardData
 	shortTermShards            []*ShardData
@@ -87,6 +99,24 @@ type ContinuousQuery struct {
 	Query string
 }
 
+// Ids of indexed columns are never reused, so a shard can tell whether
+// its index of the column was built for the current declaration
+type IndexedColumn struct {
+	Id   uint32
+	Name string
+}
+
+// The rates at which a database or a db user can write. A rate of 0
+// means there's no limit.
+type WriteLimit struct {
+	PointsPerSecond   float64 `json:"pointsPerSecond"`
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+}
+
+func (self *WriteLimit) IsUnlimited() bool {
+	return self == nil || (self.PointsPerSecond <= 0 && self.RequestsPerSecond <= 0)
+}
+
 type Database struct {
 	Name              string `json:"name"`
 	ReplicationFactor uint8  `json:"replicationFactor"`
@@ -103,6 +133,9 @@ func NewClusterConfiguration(
 		dbUsers:                    make(map[string]map[string]*DbUser),
 		continuousQueries:          make(map[string][]*ContinuousQuery),
 		ParsedContinuousQueries:    make(map[string]map[uint32]*parser.SelectQuery),
+		indexedColumns:             make(map[string]map[string][]*IndexedColumn),
+		databaseWriteLimits:        make(map[string]*WriteLimit),
+		userWriteLimits:            make(map[string]map[string]*WriteLimit),
 		servers:                    make([]*ClusterServer, 0),
 		config:                     config,
 		addedLocalServerWait:       make(chan bool, 1),
@@ -201,7 +234,7 @@ func (self *ClusterConfiguration) AddPotentialServer(server *ClusterServer) {
 	defer self.serversLock.Unlock()
 	server.State = Potential
 	self.servers = append(self.servers, server)
-	server.Id = uint32(len(self.servers))
+	server.Id = self.nextServerId()
 	log.Info("Added server to cluster config: %d, %s, %s", server.Id, server.RaftConnectionString, server.ProtobufConnectionString)
 	log.Info("Checking whether this is the local server new: %s, local: %s\n", self.config.ProtobufConnectionString(), server.ProtobufConnectionString)
 	if server.RaftName != self.LocalRaftName {
@@ -210,7 +243,7 @@ func (self *ClusterConfiguration) AddPotentialServer(server *ClusterServer) {
 			server.connection = self.connectionCreator(server.ProtobufConnectionString)
 			server.Connect()
 		}
-		server.SetWriteBuffer(NewWriteBuffer(server, self.wal, server.Id, self.config.PerServerWriteBufferSize))
+		server.SetWriteBuffer(self.newWriteBuffer(server, server.Id, self.config.PerServerWriteBufferSize))
 		server.StartHeartbeat()
 	} else if !self.addedLocalServer {
 		log.Info("Added the local server")
@@ -220,6 +253,72 @@ func (self *ClusterConfiguration) AddPotentialServer(server *ClusterServer) {
 	}
 }
 
+// Ids of removed servers aren't reused, since the wal and the shards
+// still refer to them
+func (self *ClusterConfiguration) nextServerId() uint32 {
+	for _, server := range self.servers {
+		if server.Id > self.lastServerId {
+			self.lastServerId = server.Id
+		}
+	}
+	self.lastServerId++
+	return self.lastServerId
+}
+
+// Removes the server from the cluster and from the shards it has. The
+// writes to the server that are buffered or in the wal are dropped.
+func (self *ClusterConfiguration) RemoveServer(serverId uint32) error {
+	self.serversLock.Lock()
+	var server *ClusterServer
+	servers := make([]*ClusterServer, 0, len(self.servers))
+	for _, s := range self.servers {
+		if s.Id == serverId {
+			server = s
+			continue
+		}
+		servers = append(servers, s)
+	}
+	self.servers = servers
+	if server != nil && serverId > self.lastServerId {
+		self.lastServerId = serverId
+	}
+	self.serversLock.Unlock()
+	if server == nil {
+		return fmt.Errorf("Server %d doesn't exist", serverId)
+	}
+	if self.lastServerToGetShard == server {
+		self.lastServerToGetShard = nil
+	}
+
+	self.shardsByIdLock.Lock()
+	for _, shard := range self.GetAllShards() {
+		oldServerIds, oldPendingServerIds := shard.ServerIds(), shard.PendingServerIds()
+		serverIds := removeId(oldServerIds, serverId)
+		pendingServerIds := removeId(oldPendingServerIds, serverId)
+		if len(serverIds) == len(oldServerIds) && len(pendingServerIds) == len(oldPendingServerIds) {
+			continue
+		}
+		if err := self.setShardServers(shard, serverIds, pendingServerIds); err != nil {
+			log.Error("Couldn't remove server %d from shard %d: %s", serverId, shard.id, err)
+		}
+	}
+	self.shardsByIdLock.Unlock()
+
+	server.Stop()
+	log.Info("Removed server %d from the cluster", serverId)
+	return self.wal.RemoveServer(serverId)
+}
+
+func removeId(ids []uint32, id uint32) []uint32 {
+	newIds := make([]uint32, 0, len(ids))
+	for _, i := range ids {
+		if i != id {
+			newIds = append(newIds, i)
+		}
+	}
+	return newIds
+}
+
 func (self *ClusterConfiguration) GetDatabases() []*Database {
 	self.createDatabaseLock.RLock()
 	defer self.createDatabaseLock.RUnlock()
@@ -231,6 +330,14 @@ func (self *ClusterConfiguration) GetDatabases() []*Database {
 	return dbs
 }
 
+func (self *ClusterConfiguration) DatabaseExists(name string) bool {
+	self.createDatabaseLock.RLock()
+	defer self.createDatabaseLock.RUnlock()
+
+	_, ok := self.DatabaseReplicationFactors[name]
+	return ok
+}
+
 func (self *ClusterConfiguration) CreateDatabase(name string, replicationFactor uint8) error {
 	self.createDatabaseLock.Lock()
 	defer self.createDatabaseLock.Unlock()
@@ -256,6 +363,17 @@ func (self *ClusterConfiguration) DropDatabase(name string) error {
 	defer self.usersLock.Unlock()
 
 	delete(self.dbUsers, name)
+
+	self.indexedColumnsLock.Lock()
+	defer self.indexedColumnsLock.Unlock()
+
+	delete(self.indexedColumns, name)
+
+	self.writeLimitsLock.Lock()
+	defer self.writeLimitsLock.Unlock()
+
+	delete(self.databaseWriteLimits, name)
+	delete(self.userWriteLimits, name)
 	return nil
 }
 
@@ -320,6 +438,109 @@ func (self *ClusterConfiguration) DeleteContinuousQuery(db string, id uint32) er
 	return nil
 }
 
+// Indexed columns are string columns of a series that the shards keep
+// a secondary index for, so queries filtering on their value don't have
+// to scan the whole series
+func (self *ClusterConfiguration) CreateIndexedColumn(db, series, column string) error {
+	self.indexedColumnsLock.Lock()
+	defer self.indexedColumnsLock.Unlock()
+
+	seriesColumns := self.indexedColumns[db]
+	if seriesColumns == nil {
+		seriesColumns = map[string][]*IndexedColumn{}
+		self.indexedColumns[db] = seriesColumns
+	}
+	for _, c := range seriesColumns[series] {
+		if c.Name == column {
+			return fmt.Errorf("Column %s of series %s is already indexed", column, series)
+		}
+	}
+	self.lastIndexedColumnId++
+	seriesColumns[series] = append(seriesColumns[series], &IndexedColumn{self.lastIndexedColumnId, column})
+	return nil
+}
+
+func (self *ClusterConfiguration) DropIndexedColumn(db, series, column string) error {
+	self.indexedColumnsLock.Lock()
+	defer self.indexedColumnsLock.Unlock()
+
+	columns := self.indexedColumns[db][series]
+	for i, c := range columns {
+		if c.Name != column {
+			continue
+		}
+		// copy the columns, readers might still hold on to the old slice
+		columns = append(append(make([]*IndexedColumn, 0, len(columns)-1), columns[:i]...), columns[i+1:]...)
+		if len(columns) == 0 {
+			delete(self.indexedColumns[db], series)
+		} else {
+			self.indexedColumns[db][series] = columns
+		}
+		return nil
+	}
+	return fmt.Errorf("Column %s of series %s isn't indexed", column, series)
+}
+
+// Sets the write limit of the database, or of the db user if username
+// isn't empty. Unlimited limits remove the limit.
+func (self *ClusterConfiguration) SetWriteLimit(db, username string, limit *WriteLimit) error {
+	self.writeLimitsLock.Lock()
+	defer self.writeLimitsLock.Unlock()
+
+	if username == "" {
+		if limit.IsUnlimited() {
+			delete(self.databaseWriteLimits, db)
+		} else {
+			self.databaseWriteLimits[db] = limit
+		}
+		return nil
+	}
+
+	if limit.IsUnlimited() {
+		delete(self.userWriteLimits[db], username)
+		return nil
+	}
+	if self.userWriteLimits[db] == nil {
+		self.userWriteLimits[db] = map[string]*WriteLimit{}
+	}
+	self.userWriteLimits[db][username] = limit
+	return nil
+}
+
+// Returns the write limit of the database, or of the db user if
+// username isn't empty, or nil if there's no limit
+func (self *ClusterConfiguration) GetWriteLimit(db, username string) *WriteLimit {
+	self.writeLimitsLock.RLock()
+	defer self.writeLimitsLock.RUnlock()
+
+	if username == "" {
+		return self.databaseWriteLimits[db]
+	}
+	return self.userWriteLimits[db][username]
+}
+
+func (self *ClusterConfiguration) GetIndexedColumns(db, series string) []*IndexedColumn {
+	self.indexedColumnsLock.RLock()
+	defer self.indexedColumnsLock.RUnlock()
+
+	return self.indexedColumns[db][series]
+}
+
+// Returns the names of the indexed columns of the given database by
+// series name
+func (self *ClusterConfiguration) GetIndexedColumnsForDatabase(db string) map[string][]string {
+	self.indexedColumnsLock.RLock()
+	defer self.indexedColumnsLock.RUnlock()
+
+	seriesColumns := map[string][]string{}
+	for series, columns := range self.indexedColumns[db] {
+		for _, column := range columns {
+			seriesColumns[series] = append(seriesColumns[series], column.Name)
+		}
+	}
+	return seriesColumns
+}
+
 func (self *ClusterConfiguration) GetContinuousQueries(db string) []*ContinuousQuery {
 	self.continuousQueriesLock.Lock()
 	defer self.continuousQueriesLock.Unlock()
@@ -357,6 +578,8 @@ func (self *ClusterConfiguration) SaveDbUser(u *DbUser) {
 	db := u.GetDb()
 	dbUsers := self.dbUsers[db]
 	if u.IsDeleted() {
+		// a new user with the same name shouldn't get the old limit
+		self.SetWriteLimit(db, u.GetName(), nil)
 		if dbUsers == nil {
 			return
 		}
@@ -413,23 +636,38 @@ func (self *ClusterConfiguration) SaveClusterAdmin(u *ClusterAdmin) {
 }
 
 type SavedConfiguration struct {
-	Databases       map[string]uint8
-	Admins          map[string]*ClusterAdmin
-	DbUsers         map[string]map[string]*DbUser
-	Servers         []*ClusterServer
-	ShortTermShards []*NewShardData
-	LongTermShards  []*NewShardData
+	Databases           map[string]uint8
+	Admins              map[string]*ClusterAdmin
+	DbUsers             map[string]map[string]*DbUser
+	Servers             []*ClusterServer
+	LastServerId        uint32
+	ShortTermShards     []*NewShardData
+	LongTermShards      []*NewShardData
+	IndexedColumns      map[string]map[string][]*IndexedColumn
+	LastIndexedColumnId uint32
+	DatabaseWriteLimits map[string]*WriteLimit
+	UserWriteLimits     map[string]map[string]*WriteLimit
 }
 
 func (self *ClusterConfiguration) Save() ([]byte, error) {
 	log.Debug("Dumping the cluster configuration")
+	self.indexedColumnsLock.RLock()
+	defer self.indexedColumnsLock.RUnlock()
+	self.writeLimitsLock.RLock()
+	defer self.writeLimitsLock.RUnlock()
+
 	data := &SavedConfiguration{
-		Databases:       self.DatabaseReplicationFactors,
-		Admins:          self.clusterAdmins,
-		DbUsers:         self.dbUsers,
-		Servers:         self.servers,
-		ShortTermShards: self.convertShardsToNewShardData(self.shortTermShards),
-		LongTermShards:  self.convertShardsToNewShardData(self.longTermShards),
+		Databases:           self.DatabaseReplicationFactors,
+		Admins:              self.clusterAdmins,
+		DbUsers:             self.dbUsers,
+		Servers:             self.servers,
+		LastServerId:        self.lastServerId,
+		ShortTermShards:     self.convertShardsToNewShardData(self.shortTermShards),
+		LongTermShards:      self.convertShardsToNewShardData(self.longTermShards),
+		IndexedColumns:      self.indexedColumns,
+		LastIndexedColumnId: self.lastIndexedColumnId,
+		DatabaseWriteLimits: self.databaseWriteLimits,
+		UserWriteLimits:     self.userWriteLimits,
 	}
 
 	b := bytes.NewBuffer(nil)
@@ -444,7 +682,7 @@ func (self *ClusterConfiguration) Save() ([]byte, error) {
 func (self *ClusterConfiguration) convertShardsToNewShardData(shards []*ShardData) []*NewShardData {
 	newShardData := make([]*NewShardData, len(shards), len(shards))
 	for i, shard := range shards {
-		newShardData[i] = &NewShardData{Id: shard.id, Type: shard.shardType, StartTime: shard.startTime, EndTime: shard.endTime, ServerIds: shard.serverIds, DurationSplit: shard.durationIsSplit}
+		newShardData[i] = &NewShardData{Id: shard.id, Type: shard.shardType, StartTime: shard.startTime, EndTime: shard.endTime, ServerIds: shard.ServerIds(), DurationSplit: shard.durationIsSplit, PendingServerIds: shard.PendingServerIds()}
 	}
 	return newShardData
 }
@@ -466,6 +704,11 @@ func (self *ClusterConfiguration) convertNewShardDataToShards(newShards []*NewSh
 			}
 		}
 		shard.SetServers(servers)
+		if len(newShard.PendingServerIds) > 0 {
+			if err := self.setShardServers(shard, newShard.ServerIds, newShard.PendingServerIds); err != nil {
+				log.Error("ClusterConfig convertNewShardDataToShards: ", err)
+			}
+		}
 		shards[i] = shard
 	}
 	return shards
@@ -483,6 +726,24 @@ func (self *ClusterConfiguration) Recovery(b []byte) error {
 	self.DatabaseReplicationFactors = data.Databases
 	self.clusterAdmins = data.Admins
 	self.dbUsers = data.DbUsers
+	self.indexedColumnsLock.Lock()
+	self.indexedColumns = data.IndexedColumns
+	if self.indexedColumns == nil {
+		self.indexedColumns = make(map[string]map[string][]*IndexedColumn)
+	}
+	self.lastIndexedColumnId = data.LastIndexedColumnId
+	self.indexedColumnsLock.Unlock()
+
+	self.writeLimitsLock.Lock()
+	self.databaseWriteLimits = data.DatabaseWriteLimits
+	if self.databaseWriteLimits == nil {
+		self.databaseWriteLimits = make(map[string]*WriteLimit)
+	}
+	self.userWriteLimits = data.UserWriteLimits
+	if self.userWriteLimits == nil {
+		self.userWriteLimits = make(map[string]map[string]*WriteLimit)
+	}
+	self.writeLimitsLock.Unlock()
 
 	// copy the protobuf client from the old servers
 	oldServers := map[string]ServerConnection{}
@@ -491,6 +752,7 @@ func (self *ClusterConfiguration) Recovery(b []byte) error {
 	}
 
 	self.servers = data.Servers
+	self.lastServerId = data.LastServerId
 	for _, server := range self.servers {
 		if server.RaftName == self.LocalRaftName {
 			self.LocalServerId = server.Id
@@ -503,7 +765,7 @@ func (self *ClusterConfiguration) Recovery(b []byte) error {
 		if server.connection == nil {
 			server.connection = self.connectionCreator(server.ProtobufConnectionString)
 			if server.ProtobufConnectionString != self.config.ProtobufConnectionString() {
-				server.SetWriteBuffer(NewWriteBuffer(server, self.wal, server.Id, self.config.PerServerWriteBufferSize))
+				server.SetWriteBuffer(self.newWriteBuffer(server, server.Id, self.config.PerServerWriteBufferSize))
 				server.Connect()
 				server.StartHeartbeat()
 			}
@@ -528,6 +790,92 @@ func (self *ClusterConfiguration) Recovery(b []byte) error {
 	return nil
 }
 
+// Restores the databases, users and the given shards from a backup
+// of the cluster configuration. The shards are assigned to the given
+// server, since that's where their data was restored.
+func (self *ClusterConfiguration) RestoreFromBackup(b []byte, shardIds []uint32, serverId uint32) error {
+	log.Info("Restoring the cluster configuration from backup")
+	data := &SavedConfiguration{}
+
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&data)
+	if err != nil {
+		return err
+	}
+
+	self.createDatabaseLock.Lock()
+	for db, replicationFactor := range data.Databases {
+		self.DatabaseReplicationFactors[db] = replicationFactor
+	}
+	self.createDatabaseLock.Unlock()
+
+	self.usersLock.Lock()
+	for name, admin := range data.Admins {
+		self.clusterAdmins[name] = admin
+	}
+	for db, users := range data.DbUsers {
+		if self.dbUsers[db] == nil {
+			self.dbUsers[db] = map[string]*DbUser{}
+		}
+		for name, user := range users {
+			self.dbUsers[db][name] = user
+		}
+	}
+	self.usersLock.Unlock()
+
+	for db, seriesColumns := range data.IndexedColumns {
+		for series, columns := range seriesColumns {
+			for _, column := range columns {
+				// the column might already be indexed
+				self.CreateIndexedColumn(db, series, column.Name)
+			}
+		}
+	}
+
+	for db, limit := range data.DatabaseWriteLimits {
+		self.SetWriteLimit(db, "", limit)
+	}
+	for db, users := range data.UserWriteLimits {
+		for name, limit := range users {
+			self.SetWriteLimit(db, name, limit)
+		}
+	}
+
+	restored := map[uint32]bool{}
+	for _, id := range shardIds {
+		restored[id] = true
+	}
+	restoredShards := func(newShards []*NewShardData) []*NewShardData {
+		shards := make([]*NewShardData, 0)
+		for _, newShard := range newShards {
+			if restored[newShard.Id] {
+				newShard.ServerIds = []uint32{serverId}
+				shards = append(shards, newShard)
+			}
+		}
+		return shards
+	}
+
+	self.shardsByIdLock.Lock()
+	self.shardLock.Lock()
+	defer self.shardsByIdLock.Unlock()
+	defer self.shardLock.Unlock()
+	shortTermShards := self.convertNewShardDataToShards(restoredShards(data.ShortTermShards))
+	longTermShards := self.convertNewShardDataToShards(restoredShards(data.LongTermShards))
+	self.shortTermShards = append(self.shortTermShards, shortTermShards...)
+	self.longTermShards = append(self.longTermShards, longTermShards...)
+	SortShardsByTimeDescending(self.shortTermShards)
+	SortShardsByTimeDescending(self.longTermShards)
+	for _, s := range append(shortTermShards, longTermShards...) {
+		shard := s
+		self.shardsById[s.id] = shard
+		if s.id > self.lastShardId {
+			self.lastShardId = s.id
+		}
+	}
+
+	return nil
+}
+
 func (self *ClusterConfiguration) AuthenticateDbUser(db, username, password string) (common.User, error) {
 	dbUsers := self.dbUsers[db]
 	if dbUsers == nil || dbUsers[username] == nil {
@@ -736,6 +1084,26 @@ func (self *ClusterConfiguration) GetAllShards() []*ShardData {
 	return append(sh, self.longTermShards...)
 }
 
+// Returns the shards whose end time is older than the retention
+// period of their shard type (short term or long term) at now
+func (self *ClusterConfiguration) GetExpiredShards(now time.Time) []*ShardData {
+	shards := expiredShards(self.shortTermShards, self.config.ShortTermShard.ParsedRetention(), now)
+	return append(shards, expiredShards(self.longTermShards, self.config.LongTermShard.ParsedRetention(), now)...)
+}
+
+func expiredShards(shards []*ShardData, retention time.Duration, now time.Time) []*ShardData {
+	expired := make([]*ShardData, 0)
+	if retention == 0 {
+		return expired
+	}
+	for _, shard := range shards {
+		if shard.EndTime().Add(retention).Before(now) {
+			expired = append(expired, shard)
+		}
+	}
+	return expired
+}
+
 func (self *ClusterConfiguration) getShardRange(querySpec QuerySpec, shards []*ShardData) []*ShardData {
 	startTime := querySpec.GetStartTime().UnixNano() / 1000
 	endTime := querySpec.GetEndTime().UnixNano() / 1000
@@ -898,6 +1266,70 @@ func (self *ClusterConfiguration) GetLocalShardById(id uint32) *ShardData {
 	return shard
 }
 
+// Returns the shard with the given id or nil if it doesn't exist
+func (self *ClusterConfiguration) GetShard(id uint32) *ShardData {
+	self.shardsByIdLock.RLock()
+	shard := self.shardsById[id]
+	self.shardsByIdLock.RUnlock()
+	if shard != nil {
+		return shard
+	}
+
+	// may not be in the map, try to get it from the list
+	for _, s := range self.GetAllShards() {
+		if s.id == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// Sets the servers of the shard. The pending servers get the writes of
+// the shard but aren't queried until the shard's data was copied to them.
+func (self *ClusterConfiguration) SetShardServers(shardId uint32, serverIds, pendingServerIds []uint32) error {
+	shard := self.GetShard(shardId)
+	if shard == nil {
+		return fmt.Errorf("Shard %d doesn't exist", shardId)
+	}
+	self.shardsByIdLock.Lock()
+	defer self.shardsByIdLock.Unlock()
+	return self.setShardServers(shard, serverIds, pendingServerIds)
+}
+
+func (self *ClusterConfiguration) setShardServers(shard *ShardData, serverIds, pendingServerIds []uint32) error {
+	getServers := func(ids []uint32) ([]*ClusterServer, bool, error) {
+		servers := []*ClusterServer{}
+		isLocal := false
+		for _, id := range ids {
+			if id == self.LocalServerId {
+				isLocal = true
+				continue
+			}
+			server := self.GetServerById(&id)
+			if server == nil {
+				return nil, false, fmt.Errorf("Server %d doesn't exist", id)
+			}
+			servers = append(servers, server)
+		}
+		return servers, isLocal, nil
+	}
+
+	servers, isLocal, err := getServers(serverIds)
+	if err != nil {
+		return err
+	}
+	pendingServers, isLocalPending, err := getServers(pendingServerIds)
+	if err != nil {
+		return err
+	}
+
+	var store LocalShardStore
+	if isLocal || isLocalPending {
+		store = self.shardStore
+	}
+	return shard.updateServers(servers, pendingServers, store, self.LocalServerId, isLocalPending && !isLocal)
+}
+
 func (self *ClusterConfiguration) DropShard(shardId uint32, serverIds []uint32) error {
 	// take it out of the memory map so writes and queries stop going to it
 	self.updateOrRemoveShard(shardId, serverIds)
@@ -911,54 +1343,85 @@ func (self *ClusterConfiguration) DropShard(shardId uint32, serverIds []uint32)
 	return nil
 }
 
+// Replays the writes that the servers didn't get before this server
+// restarted. The writes to the other servers are replayed in the
+// background by their write buffers.
 func (self *ClusterConfiguration) RecoverFromWAL() error {
-	self.shardStore.SetWriteBuffer(NewWriteBuffer(self.shardStore, self.wal, self.LocalServerId, self.config.LocalStoreWriteBufferSize))
-	var waitForAll sync.WaitGroup
-	for _, server := range self.servers {
-		waitForAll.Add(1)
+	self.localWriteBuffer = self.newWriteBuffer(self.shardStore, self.LocalServerId, self.config.LocalStoreWriteBufferSize)
+	self.shardStore.SetWriteBuffer(self.localWriteBuffer)
+	var localRecovery <-chan bool
+	for _, server := range self.Servers() {
 		if server.RaftName == self.LocalRaftName {
 			self.LocalServerId = server.Id
-			go func(serverId uint32) {
-				self.recover(serverId, self.shardStore)
-				waitForAll.Done()
-			}(server.Id)
-		} else {
-			go func(serverId uint32) {
-				if server.connection == nil {
-					server.connection = self.connectionCreator(server.ProtobufConnectionString)
-					server.Connect()
-				}
-				self.recover(serverId, server)
-				waitForAll.Done()
-			}(server.Id)
+			done, err := self.localWriteBuffer.RecoverFromLastCommit(self.shardIdsForServerId(server.Id))
+			if err != nil {
+				log.Error("Couldn't recover the writes to the local server: %s", err)
+			}
+			localRecovery = done
+			continue
+		}
+		if server.connection == nil {
+			server.connection = self.connectionCreator(server.ProtobufConnectionString)
+			server.Connect()
 		}
+		if server.writeBuffer == nil {
+			server.SetWriteBuffer(self.newWriteBuffer(server, server.Id, self.config.PerServerWriteBufferSize))
+		}
+		if _, err := server.writeBuffer.RecoverFromLastCommit(self.shardIdsForServerId(server.Id)); err != nil {
+			log.Error("Couldn't recover the writes to server %d: %s", server.Id, err)
+		}
+	}
+	if localRecovery != nil {
+		<-localRecovery
 	}
-	waitForAll.Wait()
 	return nil
 }
 
-func (self *ClusterConfiguration) recover(serverId uint32, writer Writer) error {
-	return self.wal.RecoverServerFromLastCommit(serverId, self.shardIdsForServerId(serverId), func(request *protocol.Request, shardId uint32) error {
-		if request == nil {
-			log.Error("Error on recover, the wal yielded a nil request")
-			return nil
+func (self *ClusterConfiguration) newWriteBuffer(writer Writer, serverId uint32, bufferSize int) *WriteBuffer {
+	buffer := NewWriteBuffer(writer, self.wal, serverId, bufferSize, self.config.HandoffMaxAge.Duration, self.config.HandoffMaxSize)
+	if self.config.WalDir != "" {
+		repairsPath := path.Join(self.config.WalDir, fmt.Sprintf("shards_to_repair.%d", serverId))
+		if err := buffer.PersistShardsToRepair(repairsPath); err != nil {
+			log.Error("Couldn't load the shards to repair on server %d from %s: %s", serverId, repairsPath, err)
 		}
-		requestNumber := request.GetRequestNumber()
-		err := writer.Write(request)
-		if err != nil {
-			return err
+	}
+	return buffer
+}
+
+// The state of the writes that weren't written to the servers yet,
+// including the local server
+func (self *ClusterConfiguration) HandoffStates() []*HandoffState {
+	states := []*HandoffState{}
+	if self.localWriteBuffer != nil {
+		states = append(states, self.localWriteBuffer.HandoffState())
+	}
+	for _, server := range self.Servers() {
+		if server.writeBuffer != nil {
+			states = append(states, server.writeBuffer.HandoffState())
 		}
-		return self.wal.Commit(requestNumber, serverId)
-	})
+	}
+	return states
+}
+
+// Unmarks the shard for repair on the server once the server repaired
+// the writes that were dropped. The writes that were dropped after the
+// repair started still have to be repaired.
+func (self *ClusterConfiguration) ShardRepaired(serverId, shardId uint32, repairStart time.Time) {
+	if serverId == self.LocalServerId && self.localWriteBuffer != nil {
+		self.localWriteBuffer.RepairedShard(shardId, repairStart)
+		return
+	}
+	if server := self.GetServerById(&serverId); server != nil && server.writeBuffer != nil {
+		server.writeBuffer.RepairedShard(shardId, repairStart)
+	}
 }
 
 func (self *ClusterConfiguration) shardIdsForServerId(serverId uint32) []uint32 {
 	shardIds := make([]uint32, 0)
 	for _, shard := range self.GetAllShards() {
-		for _, id := range shard.serverIds {
+		for _, id := range append(append([]uint32{}, shard.ServerIds()...), shard.PendingServerIds()...) {
 			if id == serverId {
-				sid := id
-				shardIds = append(shardIds, sid)
+				shardIds = append(shardIds, shard.Id())
 				break
 			}
 		}
@@ -984,14 +1447,14 @@ func (self *ClusterConfiguration) updateOrRemoveShard(shardId uint32, serverIds
 		log.Error("Attempted to remove shard %d, which we couldn't find. %d shards currently loaded.", shardId, len(self.GetAllShards()))
 	}
 
-	if len(shard.serverIds) == len(serverIds) {
+	if len(shard.ServerIds()) == len(serverIds) {
 		self.removeShard(shardId)
 		return
 	}
 	self.shardsByIdLock.Lock()
 	defer self.shardsByIdLock.Unlock()
 	newIds := make([]uint32, 0)
-	for _, oldId := range shard.serverIds {
+	for _, oldId := range shard.ServerIds() {
 		include := true
 		for _, removeId := range serverIds {
 			if oldId == removeId {
@@ -1003,7 +1466,10 @@ func (self *ClusterConfiguration) updateOrRemoveShard(shardId uint32, serverIds
 			newIds = append(newIds, oldId)
 		}
 	}
-	shard.serverIds = newIds
+	// writes and queries stop going to the removed servers
+	if err := self.setShardServers(shard, newIds, shard.PendingServerIds()); err != nil {
+		log.Error("Couldn't remove servers %v from shard %d: %s", serverIds, shardId, err)
+	}
 }
 
 func (self *ClusterConfiguration) removeShard(shardId uint32) {
@@ -2,6 +2,7 @@ package cluster
 
 import (
 	log "code.google.com/p/log4go"
+	"common"
 	"errors"
 	"fmt"
 	"net"
@@ -27,6 +28,7 @@ type ClusterServer struct {
 	isUp                     bool
 	writeBuffer              *WriteBuffer
 	heartbeatStarted         bool
+	stopped                  bool
 }
 
 type ServerConnection interface {
@@ -72,6 +74,16 @@ func (self *ClusterServer) StartHeartbeat() {
 	go self.heartbeat()
 }
 
+// Stops the heartbeats and the buffered writes to the server once it
+// was removed from the cluster
+func (self *ClusterServer) Stop() {
+	self.stopped = true
+	self.isUp = false
+	if self.writeBuffer != nil {
+		self.writeBuffer.Stop()
+	}
+}
+
 func (self *ClusterServer) SetWriteBuffer(writeBuffer *WriteBuffer) {
 	self.writeBuffer = writeBuffer
 }
@@ -137,7 +149,7 @@ func (self *ClusterServer) heartbeat() {
 		Type:     &HEARTBEAT_TYPE,
 		Database: protocol.String(""),
 	}
-	for {
+	for !self.stopped {
 		heartbeatRequest.Id = nil
 		err := self.MakeRequest(heartbeatRequest, responseChan)
 		if err != nil {
@@ -151,7 +163,7 @@ func (self *ClusterServer) heartbeat() {
 		}
 
 		// otherwise, reset the backoff and mark the server as up
-		self.isUp = true
+		self.isUp = !self.stopped
 		self.Backoff = DEFAULT_BACKOFF
 		<-time.After(self.HeartbeatInterval)
 	}
@@ -175,6 +187,7 @@ func (self *ClusterServer) getHeartbeatResponse(responseChan <-chan *protocol.Re
 }
 
 func (self *ClusterServer) handleHeartbeatError(err error) {
+	common.InternalStats.Increment("cluster_server.heartbeat_failures")
 	self.isUp = false
 	self.Backoff *= 2
 	if self.Backoff > MAX_BACKOFF {
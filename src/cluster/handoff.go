@@ -0,0 +1,275 @@
+package cluster
+
+import (
+	log "code.google.com/p/log4go"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"protocol"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The state of the writes that a write buffer didn't get to its server
+// yet, e.g. because the server is down. Times are in seconds since the
+// epoch, 0 if they aren't set.
+type HandoffState struct {
+	ServerId       uint32 `json:"serverId"`
+	QueuedRequests int    `json:"queuedRequests"`
+	// estimated from the points of the requests
+	QueuedBytes         int64  `json:"queuedBytes"`
+	OldestRequestNumber uint32 `json:"oldestRequestNumber"`
+	OldestRequestTime   int64  `json:"oldestRequestTime"`
+	LastError           string `json:"lastError"`
+	LastErrorTime       int64  `json:"lastErrorTime"`
+	// the requests that were dropped because the queue got too old or
+	// too big
+	DroppedRequests int64 `json:"droppedRequests"`
+	// the shards that have to be repaired on the server since it missed
+	// the dropped requests
+	ShardsToRepair []uint32 `json:"shardsToRepair"`
+}
+
+type queuedRequest struct {
+	shardId  uint32
+	bytes    int64
+	queuedAt time.Time
+}
+
+// Keeps track of the requests that were given to a write buffer and
+// weren't written yet. The queued requests themselves are in the wal.
+type handoffQueue struct {
+	lock     sync.Mutex
+	maxAge   time.Duration
+	maxBytes int64
+	requests map[uint32]*queuedRequest
+	// the request numbers in the order they were queued, the ones that
+	// were written are removed lazily
+	order         []uint32
+	bytes         int64
+	lastError     error
+	lastErrorTime time.Time
+	dropped       int64
+	// the time the shards were marked for repair at, by shard id
+	shardsToRepair map[uint32]time.Time
+	// the file that the shards to repair are saved in, since the wal
+	// doesn't have the dropped requests anymore after a restart
+	repairsPath string
+}
+
+func newHandoffQueue(maxAge time.Duration, maxBytes int64) *handoffQueue {
+	return &handoffQueue{
+		maxAge:         maxAge,
+		maxBytes:       maxBytes,
+		requests:       make(map[uint32]*queuedRequest),
+		shardsToRepair: make(map[uint32]time.Time),
+	}
+}
+
+// Estimates the size of the request from its points, encoding every
+// request would be too expensive
+func requestSize(request *protocol.Request) int64 {
+	series := request.Series
+	if series == nil {
+		return 0
+	}
+	size := int64(len(series.GetName()))
+	for _, field := range series.Fields {
+		size += int64(len(field))
+	}
+	for _, point := range series.Points {
+		// the timestamp and the sequence number
+		size += 16
+		for _, value := range point.Values {
+			if value.StringValue != nil {
+				size += int64(len(*value.StringValue))
+			} else {
+				size += 8
+			}
+		}
+	}
+	return size
+}
+
+func (self *handoffQueue) add(request *protocol.Request) {
+	bytes := requestSize(request)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	requestNumber := request.GetRequestNumber()
+	if _, ok := self.requests[requestNumber]; ok {
+		return
+	}
+	self.requests[requestNumber] = &queuedRequest{request.GetShardId(), bytes, time.Now()}
+	self.order = append(self.order, requestNumber)
+	self.bytes += bytes
+}
+
+func (self *handoffQueue) written(requestNumber uint32) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if request, ok := self.requests[requestNumber]; ok {
+		self.bytes -= request.bytes
+		delete(self.requests, requestNumber)
+	}
+	// removes the written requests from the front of the order, the
+	// requests are usually written in order
+	self.oldest()
+}
+
+func (self *handoffQueue) failed(err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.lastError = err
+	self.lastErrorTime = time.Now()
+}
+
+// Returns the request number and the request that was queued first,
+// 0 and nil if the queue is empty. The lock has to be held.
+func (self *handoffQueue) oldest() (uint32, *queuedRequest) {
+	for len(self.order) > 0 {
+		if request, ok := self.requests[self.order[0]]; ok {
+			return self.order[0], request
+		}
+		self.order = self.order[1:]
+	}
+	return 0, nil
+}
+
+func (self *handoffQueue) isOverLimits() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.maxBytes > 0 && self.bytes > self.maxBytes {
+		return true
+	}
+	_, oldest := self.oldest()
+	return self.maxAge > 0 && oldest != nil && time.Since(oldest.queuedAt) > self.maxAge
+}
+
+// Empties the queue and marks the shards of the queued requests for
+// repair. Returns the highest queued request number and the number of
+// requests that were dropped.
+func (self *handoffQueue) drop(shardId uint32) (uint32, int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	now := time.Now()
+	self.shardsToRepair[shardId] = now
+	var lastRequestNumber uint32
+	for requestNumber, request := range self.requests {
+		self.shardsToRepair[request.shardId] = now
+		if requestNumber > lastRequestNumber {
+			lastRequestNumber = requestNumber
+		}
+	}
+	count := len(self.requests)
+	self.dropped += int64(count)
+	self.requests = make(map[uint32]*queuedRequest)
+	self.order = nil
+	self.bytes = 0
+	self.saveShardsToRepair()
+	return lastRequestNumber, count
+}
+
+// Unmarks the shard unless it was marked again after the repair started
+func (self *handoffQueue) repaired(shardId uint32, repairStart time.Time) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if markedAt, ok := self.shardsToRepair[shardId]; !ok || markedAt.After(repairStart) {
+		return
+	}
+	delete(self.shardsToRepair, shardId)
+	self.saveShardsToRepair()
+}
+
+// Saves the shards to repair to the file from now on and marks the ones
+// that were saved in it before
+func (self *handoffQueue) persistShardsToRepair(path string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.repairsPath = path
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	shardIds := []uint32{}
+	if err := json.Unmarshal(data, &shardIds); err != nil {
+		return err
+	}
+	for _, shardId := range shardIds {
+		if _, ok := self.shardsToRepair[shardId]; !ok {
+			self.shardsToRepair[shardId] = time.Now()
+		}
+	}
+	return nil
+}
+
+// The lock has to be held
+func (self *handoffQueue) saveShardsToRepair() {
+	if self.repairsPath == "" {
+		return
+	}
+	data, err := json.Marshal(self.sortedShardsToRepair())
+	if err == nil {
+		newPath := self.repairsPath + ".new"
+		if err = ioutil.WriteFile(newPath, data, 0644); err == nil {
+			err = os.Rename(newPath, self.repairsPath)
+		}
+	}
+	if err != nil {
+		log.Error("Couldn't save the shards to repair to %s: %s", self.repairsPath, err)
+	}
+}
+
+// Stops saving the shards to repair and deletes their file
+func (self *handoffQueue) deleteShardsToRepair() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.repairsPath == "" {
+		return
+	}
+	if err := os.Remove(self.repairsPath); err != nil && !os.IsNotExist(err) {
+		log.Error("Couldn't delete %s: %s", self.repairsPath, err)
+	}
+	self.repairsPath = ""
+}
+
+// The lock has to be held
+func (self *handoffQueue) sortedShardsToRepair() []uint32 {
+	shardIds := make([]uint32, 0, len(self.shardsToRepair))
+	for shardId, _ := range self.shardsToRepair {
+		shardIds = append(shardIds, shardId)
+	}
+	sort.Sort(uint32Slice(shardIds))
+	return shardIds
+}
+
+func (self *handoffQueue) state(serverId uint32) *HandoffState {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	state := &HandoffState{
+		ServerId:        serverId,
+		QueuedRequests:  len(self.requests),
+		QueuedBytes:     self.bytes,
+		DroppedRequests: self.dropped,
+		ShardsToRepair:  self.sortedShardsToRepair(),
+	}
+	if requestNumber, oldest := self.oldest(); oldest != nil {
+		state.OldestRequestNumber = requestNumber
+		state.OldestRequestTime = oldest.queuedAt.Unix()
+	}
+	if self.lastError != nil {
+		state.LastError = self.lastError.Error()
+		state.LastErrorTime = self.lastErrorTime.Unix()
+	}
+	return state
+}
+
+type uint32Slice []uint32
+
+func (self uint32Slice) Len() int           { return len(self) }
+func (self uint32Slice) Less(i, j int) bool { return self[i] < self[j] }
+func (self uint32Slice) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
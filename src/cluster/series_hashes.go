@@ -0,0 +1,125 @@
+package cluster
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"encoding/binary"
+	"hash/fnv"
+	"protocol"
+)
+
+// The anti-entropy repair splits the time range of a shard into this
+// many buckets and compares the hashes of the buckets of every series
+// between the replicas
+const HASH_BUCKETS_PER_SHARD = 64
+
+var (
+	seriesHashesColumns = []string{"name", "hash", "values"}
+	bucketHashesColumns = []string{"hash", "values"}
+)
+
+// The hash of the column values of a series with a timestamp in
+// [Start, Start + bucket size). Values is the number of column values.
+type BucketHash struct {
+	Start  int64
+	Values int64
+	Hash   uint64
+}
+
+// The hashes of a series. Hash is computed from the hashes of the
+// buckets, so two replicas only have to compare the buckets of a series
+// if its hashes differ. Buckets without values aren't included.
+type SeriesHash struct {
+	Name    string
+	Hash    uint64
+	Values  int64
+	Buckets []*BucketHash
+}
+
+func NewSeriesHash(name string, buckets []*BucketHash) *SeriesHash {
+	hash := fnv.New64a()
+	seriesHash := &SeriesHash{Name: name, Buckets: buckets}
+	for _, bucket := range buckets {
+		binary.Write(hash, binary.BigEndian, bucket.Start)
+		binary.Write(hash, binary.BigEndian, bucket.Hash)
+		seriesHash.Values += bucket.Values
+	}
+	seriesHash.Hash = hash.Sum64()
+	return seriesHash
+}
+
+// Returns the buckets that are missing from other or have a different
+// hash
+func (self *SeriesHash) DifferentBuckets(other *SeriesHash) []*BucketHash {
+	otherBuckets := map[int64]uint64{}
+	if other != nil {
+		for _, bucket := range other.Buckets {
+			otherBuckets[bucket.Start] = bucket.Hash
+		}
+	}
+
+	buckets := []*BucketHash{}
+	for _, bucket := range self.Buckets {
+		if hash, ok := otherBuckets[bucket.Start]; !ok || hash != bucket.Hash {
+			buckets = append(buckets, bucket)
+		}
+	}
+	return buckets
+}
+
+// Returns a series with a point for each of the series hashes, the
+// buckets aren't included
+func SeriesHashesToSeries(hashes []*SeriesHash) *protocol.Series {
+	points := make([]*protocol.Point, 0, len(hashes))
+	for _, hash := range hashes {
+		points = append(points, &protocol.Point{
+			Values: []*protocol.FieldValue{
+				&protocol.FieldValue{StringValue: proto.String(hash.Name)},
+				&protocol.FieldValue{Int64Value: proto.Int64(int64(hash.Hash))},
+				&protocol.FieldValue{Int64Value: proto.Int64(hash.Values)},
+			},
+			SequenceNumber: proto.Uint64(1),
+		})
+	}
+	return &protocol.Series{Name: proto.String("series_hashes"), Fields: seriesHashesColumns, Points: points}
+}
+
+func SeriesHashesFromSeries(series *protocol.Series) []*SeriesHash {
+	hashes := make([]*SeriesHash, 0, len(series.Points))
+	for _, point := range series.Points {
+		hashes = append(hashes, &SeriesHash{
+			Name:   point.Values[0].GetStringValue(),
+			Hash:   uint64(point.Values[1].GetInt64Value()),
+			Values: point.Values[2].GetInt64Value(),
+		})
+	}
+	return hashes
+}
+
+// Returns a series named after the series hash with a point for each
+// bucket, the timestamp of a point is the start of its bucket
+func BucketHashesToSeries(hash *SeriesHash) *protocol.Series {
+	points := make([]*protocol.Point, 0, len(hash.Buckets))
+	for _, bucket := range hash.Buckets {
+		points = append(points, &protocol.Point{
+			Values: []*protocol.FieldValue{
+				&protocol.FieldValue{Int64Value: proto.Int64(int64(bucket.Hash))},
+				&protocol.FieldValue{Int64Value: proto.Int64(bucket.Values)},
+			},
+			Timestamp:      proto.Int64(bucket.Start),
+			SequenceNumber: proto.Uint64(1),
+		})
+	}
+	return &protocol.Series{Name: proto.String(hash.Name), Fields: bucketHashesColumns, Points: points}
+}
+
+func BucketHashesFromSeries(series *protocol.Series) *SeriesHash {
+	buckets := make([]*BucketHash, 0, len(series.Points))
+	for _, point := range series.Points {
+		buckets = append(buckets, &BucketHash{
+			Start:  point.GetTimestamp(),
+			Hash:   uint64(point.Values[0].GetInt64Value()),
+			Values: point.Values[1].GetInt64Value(),
+		})
+	}
+	return NewSeriesHash(series.GetName(), buckets)
+}
@@ -0,0 +1,103 @@
+package cluster
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"protocol"
+	"sort"
+)
+
+// The columns of the points the shards send for list series stats
+var SeriesStatsColumns = []string{"points", "columns", "first_timestamp", "last_timestamp", "bytes"}
+
+// Statistics of a series. Points is an estimate for large series and
+// Bytes is the approximate size on disk. The timestamps are in
+// microseconds and are only set if the series has points.
+type SeriesStats struct {
+	Name           string `json:"name"`
+	Points         int64  `json:"points"`
+	Columns        int64  `json:"columns"`
+	FirstTimestamp int64  `json:"firstTimestamp"`
+	LastTimestamp  int64  `json:"lastTimestamp"`
+	Bytes          int64  `json:"bytes"`
+}
+
+func NewSeriesStatsFromPoint(name string, point *protocol.Point) *SeriesStats {
+	stats := &SeriesStats{
+		Name:    name,
+		Points:  point.Values[0].GetInt64Value(),
+		Columns: point.Values[1].GetInt64Value(),
+		Bytes:   point.Values[4].GetInt64Value(),
+	}
+	if stats.Points > 0 {
+		stats.FirstTimestamp = point.Values[2].GetInt64Value()
+		stats.LastTimestamp = point.Values[3].GetInt64Value()
+	}
+	return stats
+}
+
+func (self *SeriesStats) ToPoint() *protocol.Point {
+	values := []*protocol.FieldValue{
+		&protocol.FieldValue{Int64Value: proto.Int64(self.Points)},
+		&protocol.FieldValue{Int64Value: proto.Int64(self.Columns)},
+		&protocol.FieldValue{IsNull: proto.Bool(true)},
+		&protocol.FieldValue{IsNull: proto.Bool(true)},
+		&protocol.FieldValue{Int64Value: proto.Int64(self.Bytes)},
+	}
+	if self.Points > 0 {
+		values[2] = &protocol.FieldValue{Int64Value: proto.Int64(self.FirstTimestamp)}
+		values[3] = &protocol.FieldValue{Int64Value: proto.Int64(self.LastTimestamp)}
+	}
+	return &protocol.Point{Values: values, Timestamp: proto.Int64(self.LastTimestamp), SequenceNumber: proto.Uint64(1)}
+}
+
+// Adds the stats of the series in another shard. The column count is the
+// largest of the shards.
+func (self *SeriesStats) Merge(other *SeriesStats) {
+	if other.Points > 0 {
+		if self.Points == 0 || other.FirstTimestamp < self.FirstTimestamp {
+			self.FirstTimestamp = other.FirstTimestamp
+		}
+		if self.Points == 0 || other.LastTimestamp > self.LastTimestamp {
+			self.LastTimestamp = other.LastTimestamp
+		}
+	}
+	self.Points += other.Points
+	self.Bytes += other.Bytes
+	if other.Columns > self.Columns {
+		self.Columns = other.Columns
+	}
+}
+
+// The statistics of the series of a database, merged from all the shards
+type DatabaseStats struct {
+	Name           string         `json:"name"`
+	Points         int64          `json:"points"`
+	FirstTimestamp int64          `json:"firstTimestamp"`
+	LastTimestamp  int64          `json:"lastTimestamp"`
+	Bytes          int64          `json:"bytes"`
+	Series         []*SeriesStats `json:"series"`
+	seriesByName   map[string]*SeriesStats
+}
+
+func NewDatabaseStats(name string) *DatabaseStats {
+	return &DatabaseStats{Name: name, Series: []*SeriesStats{}, seriesByName: map[string]*SeriesStats{}}
+}
+
+func (self *DatabaseStats) Add(stats *SeriesStats) {
+	total := &SeriesStats{Points: self.Points, FirstTimestamp: self.FirstTimestamp, LastTimestamp: self.LastTimestamp, Bytes: self.Bytes}
+	total.Merge(stats)
+	self.Points, self.FirstTimestamp, self.LastTimestamp, self.Bytes = total.Points, total.FirstTimestamp, total.LastTimestamp, total.Bytes
+
+	if existing := self.seriesByName[stats.Name]; existing != nil {
+		existing.Merge(stats)
+		return
+	}
+	series := *stats
+	self.seriesByName[stats.Name] = &series
+
+	// keep the series ordered by name
+	index := sort.Search(len(self.Series), func(i int) bool { return self.Series[i].Name > stats.Name })
+	self.Series = append(self.Series, nil)
+	copy(self.Series[index+1:], self.Series[index:])
+	self.Series[index] = &series
+}
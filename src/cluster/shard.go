@@ -1,6 +1,8 @@
 package cluster
 
 import (
+	log "code.google.com/p/log4go"
+	"common"
 	"engine"
 	"errors"
 	"fmt"
@@ -8,6 +10,7 @@ import (
 	"protocol"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 	"wal"
 )
@@ -21,6 +24,7 @@ type Shard interface {
 	StartTime() time.Time
 	EndTime() time.Time
 	Write(*protocol.Request) error
+	WriteWithConsistency(request *protocol.Request, consistency WriteConsistency, timeout time.Duration) error
 	Query(querySpec *parser.QuerySpec, response chan *protocol.Response) error
 	IsMicrosecondInRange(t int64) bool
 }
@@ -40,6 +44,9 @@ type NewShardData struct {
 	ServerIds     []uint32
 	Type          ShardType
 	DurationSplit bool `json:",omitempty"`
+	// servers that get the writes of the shard while its data is copied
+	// to them, they aren't queried
+	PendingServerIds []uint32 `json:",omitempty"`
 }
 
 type ShardType int
@@ -65,6 +72,16 @@ type ShardData struct {
 	durationIsSplit bool
 	shardDuration   time.Duration
 	localServerId   uint32
+	// the servers that the data of the shard is being copied to
+	pendingServerIds []uint32
+	pendingServers   []*ClusterServer
+	localIsPending   bool
+	// guards the servers, the store and the local shard, they're
+	// replaced while the shard is written and queried
+	serversLock sync.RWMutex
+	// the repairs of the local copy that are running, by database
+	repairsLock sync.Mutex
+	repairs     map[string]*runningRepair
 }
 
 func NewShard(id uint32, startTime, endTime time.Time, shardType ShardType, durationIsSplit bool, wal WAL) *ShardData {
@@ -79,6 +96,7 @@ func NewShard(id uint32, startTime, endTime time.Time, shardType ShardType, dura
 		shardType:       shardType,
 		durationIsSplit: durationIsSplit,
 		shardDuration:   endTime.Sub(startTime),
+		repairs:         make(map[string]*runningRepair),
 	}
 }
 
@@ -92,12 +110,20 @@ var (
 	endStreamResponse   = protocol.Response_END_STREAM
 	queryRequest        = protocol.Request_QUERY
 	dropDatabaseRequest = protocol.Request_DROP_DATABASE
+	cancelQueryRequest  = protocol.Request_CANCEL_QUERY
 )
 
 type LocalShardDb interface {
 	Write(database string, series *protocol.Series) error
 	Query(*parser.QuerySpec, QueryProcessor) error
 	DropDatabase(database string) error
+	// The hashes of the series of the database ordered by name. The
+	// buckets start at startTime and are bucketSize microseconds long.
+	GetSeriesHashes(database string, startTime, bucketSize int64) ([]*SeriesHash, error)
+	GetSeriesHash(database, series string, startTime, bucketSize int64) (*SeriesHash, error)
+	// The time ranges of the series that deletes were applied to, the
+	// repair doesn't restore the points in them
+	GetDeletedRanges(database, series string) ([]*DeletedRange, error)
 }
 
 type LocalShardStore interface {
@@ -125,6 +151,8 @@ func (self *ShardData) IsMicrosecondInRange(t int64) bool {
 }
 
 func (self *ShardData) SetServers(servers []*ClusterServer) {
+	self.serversLock.Lock()
+	defer self.serversLock.Unlock()
 	self.clusterServers = servers
 	self.servers = make([]wal.Server, len(servers), len(servers))
 	for i, server := range servers {
@@ -135,6 +163,8 @@ func (self *ShardData) SetServers(servers []*ClusterServer) {
 }
 
 func (self *ShardData) SetLocalStore(store LocalShardStore, localServerId uint32) error {
+	self.serversLock.Lock()
+	defer self.serversLock.Unlock()
 	self.serverIds = append(self.serverIds, localServerId)
 	self.localServerId = localServerId
 	self.sortServerIds()
@@ -149,37 +179,196 @@ func (self *ShardData) SetLocalStore(store LocalShardStore, localServerId uint32
 	return nil
 }
 
+// Replaces the servers of the shard. The store is nil if the shard
+// doesn't live on this server. If localIsPending is true the local
+// shard gets the writes but isn't queried.
+func (self *ShardData) updateServers(servers, pendingServers []*ClusterServer, store LocalShardStore, localServerId uint32, localIsPending bool) error {
+	serverIds := make([]uint32, 0, len(servers)+1)
+	for _, server := range servers {
+		serverIds = append(serverIds, server.Id)
+	}
+	pendingServerIds := make([]uint32, 0, len(pendingServers)+1)
+	for _, server := range pendingServers {
+		pendingServerIds = append(pendingServerIds, server.Id)
+	}
+
+	self.serversLock.Lock()
+	defer self.serversLock.Unlock()
+	if store != nil {
+		if self.localShard == nil {
+			shard, err := store.GetOrCreateShard(self.id)
+			if err != nil {
+				return err
+			}
+			self.localShard = shard
+		}
+		self.localServerId = localServerId
+		if localIsPending {
+			pendingServerIds = append(pendingServerIds, localServerId)
+		} else {
+			serverIds = append(serverIds, localServerId)
+		}
+	} else {
+		self.localShard = nil
+		localIsPending = false
+	}
+	sortIds(serverIds)
+	sortIds(pendingServerIds)
+
+	// the slices are replaced instead of changed, the callers of
+	// ServerIds may still use the old ones
+	self.store = store
+	self.localIsPending = localIsPending
+	self.clusterServers = servers
+	self.pendingServers = pendingServers
+	self.servers = make([]wal.Server, len(servers), len(servers))
+	for i, server := range servers {
+		self.servers[i] = server
+	}
+	self.serverIds = serverIds
+	self.pendingServerIds = pendingServerIds
+	return nil
+}
+
 func (self *ShardData) IsLocal() bool {
-	return self.store != nil
+	return self.getStore() != nil
 }
 
 func (self *ShardData) ServerIds() []uint32 {
+	self.serversLock.RLock()
+	defer self.serversLock.RUnlock()
 	return self.serverIds
 }
 
+func (self *ShardData) PendingServerIds() []uint32 {
+	self.serversLock.RLock()
+	defer self.serversLock.RUnlock()
+	return self.pendingServerIds
+}
+
+func (self *ShardData) getStore() LocalShardStore {
+	self.serversLock.RLock()
+	defer self.serversLock.RUnlock()
+	return self.store
+}
+
+// The local copy of the shard, nil if it isn't on this server
+func (self *ShardData) getLocalShard() LocalShardDb {
+	self.serversLock.RLock()
+	defer self.serversLock.RUnlock()
+	return self.localShard
+}
+
+// The local copy of the shard if it can be queried, it can't while
+// it's still being copied to this server
+func (self *ShardData) queryableLocalShard() LocalShardDb {
+	self.serversLock.RLock()
+	defer self.serversLock.RUnlock()
+	if self.localIsPending {
+		return nil
+	}
+	return self.localShard
+}
+
+func (self *ShardData) getLocalServerId() uint32 {
+	self.serversLock.RLock()
+	defer self.serversLock.RUnlock()
+	return self.localServerId
+}
+
+// The remote servers that have a complete copy of the shard
+func (self *ShardData) remoteServers() []*ClusterServer {
+	self.serversLock.RLock()
+	defer self.serversLock.RUnlock()
+	return self.clusterServers
+}
+
+// The remote servers that get the writes of the shard, including the
+// pending ones
+func (self *ShardData) writeServers() []*ClusterServer {
+	self.serversLock.RLock()
+	defer self.serversLock.RUnlock()
+	if len(self.pendingServers) == 0 {
+		return self.clusterServers
+	}
+	return append(append([]*ClusterServer{}, self.clusterServers...), self.pendingServers...)
+}
+
 func (self *ShardData) Write(request *protocol.Request) error {
+	if _, err := self.logWrite(request); err != nil {
+		return err
+	}
+	self.bufferWrite(request)
+	return nil
+}
+
+// Writes the request like Write and waits until the replicas that the
+// consistency requires committed it. The write isn't undone if it times
+// out, the other replicas still get it from the wal.
+func (self *ShardData) WriteWithConsistency(request *protocol.Request, consistency WriteConsistency, timeout time.Duration) error {
+	serverIds := self.ServerIds()
+	required := consistency.RequiredAcknowledgements(len(serverIds))
+	if required == 0 {
+		return self.Write(request)
+	}
+
 	request.ShardId = &self.id
-	requestNumber, err := self.wal.AssignSequenceNumbersAndLog(request, self)
+	requestNumber, commits, err := self.wal.LogAndWaitForCommits(request, self, serverIds)
 	if err != nil {
 		return err
 	}
 	request.RequestNumber = &requestNumber
-	if self.store != nil {
-		self.store.BufferWrite(request)
+	defer self.wal.StopWaitingForCommits(requestNumber)
+	self.bufferWrite(request)
+
+	acknowledged := 0
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for acknowledged < required {
+		select {
+		case <-commits:
+			acknowledged++
+		case <-timer.C:
+			return common.NewPartialWriteError(acknowledged, required,
+				"Only %d of the %d replicas that the write consistency %s requires wrote to shard %d in %s",
+				acknowledged, required, consistency, self.id, timeout)
+		}
 	}
-	for _, server := range self.clusterServers {
+	return nil
+}
+
+func (self *ShardData) logWrite(request *protocol.Request) (uint32, error) {
+	request.ShardId = &self.id
+	requestNumber, err := self.wal.AssignSequenceNumbersAndLog(request, self)
+	if err != nil {
+		return 0, err
+	}
+	request.RequestNumber = &requestNumber
+	return requestNumber, nil
+}
+
+func (self *ShardData) bufferWrite(request *protocol.Request) {
+	if store := self.getStore(); store != nil {
+		store.BufferWrite(request)
+	}
+	for _, server := range self.writeServers() {
 		server.BufferWrite(request)
 	}
-	return nil
 }
 
 func (self *ShardData) WriteLocalOnly(request *protocol.Request) error {
+	// the change that adds this server to the shard may not be applied
+	// on this server yet
+	store := self.getStore()
+	if store == nil {
+		return fmt.Errorf("Shard %d isn't on this server", self.id)
+	}
 	requestNumber, err := self.wal.AssignSequenceNumbersAndLog(request, self)
 	if err != nil {
 		return err
 	}
 	request.RequestNumber = &requestNumber
-	self.store.BufferWrite(request)
+	store.BufferWrite(request)
 	return nil
 }
 
@@ -194,28 +383,32 @@ func (self *ShardData) Query(querySpec *parser.QuerySpec, response chan *protoco
 		}
 	}
 
-	if self.localShard != nil {
+	if localShard := self.queryableLocalShard(); localShard != nil {
 		var processor QueryProcessor
 		if querySpec.IsListSeriesQuery() {
 			processor = engine.NewListSeriesEngine(response)
-		} else if querySpec.IsDeleteFromSeriesQuery() || querySpec.IsDropSeriesQuery() || querySpec.IsSinglePointQuery() {
+		} else if querySpec.IsDeleteFromSeriesQuery() || querySpec.IsDropSeriesQuery() || querySpec.IsSinglePointQuery() || querySpec.IsListSeriesStatsQuery() {
 			maxDeleteResults := 10000
 			processor = engine.NewPassthroughEngine(response, maxDeleteResults)
 		} else {
-			if self.ShouldAggregateLocally(querySpec) {
+			if !querySpec.AggregateInCoordinator && self.ShouldAggregateLocally(querySpec) {
 				processor = engine.NewQueryEngine(querySpec.SelectQuery(), response)
+			} else if engine.CanAggregatePartially(querySpec.SelectQuery()) {
+				// the coordinator merges the partial aggregates of the shards
+				processor = engine.NewPartialQueryEngine(querySpec.SelectQuery(), response)
 			} else {
 				maxPointsToBufferBeforeSending := 1000
 				processor = engine.NewPassthroughEngine(response, maxPointsToBufferBeforeSending)
 			}
 		}
-		err := self.localShard.Query(querySpec, processor)
+		err := localShard.Query(querySpec, processor)
 		processor.Close()
 		return err
 	}
 
-	healthyServers := make([]*ClusterServer, 0, len(self.clusterServers))
-	for _, s := range self.clusterServers {
+	servers := self.remoteServers()
+	healthyServers := make([]*ClusterServer, 0, len(servers))
+	for _, s := range servers {
 		if !s.IsUp() {
 			continue
 		}
@@ -231,20 +424,40 @@ func (self *ShardData) Query(querySpec *parser.QuerySpec, response chan *protoco
 	server := healthyServers[randServerIndex]
 	request := self.createRequest(querySpec)
 
-	return server.MakeRequest(request, response)
+	err := server.MakeRequest(request, response)
+	if err == nil && request.Id != nil && querySpec.Cancellation() != nil {
+		go self.cancelRemoteQuery(querySpec, server, *request.Id)
+	}
+	return err
+}
+
+// Waits for the query to finish and tells the server to stop the query
+// if it was cancelled
+func (self *ShardData) cancelRemoteQuery(querySpec *parser.QuerySpec, server *ClusterServer, requestId uint32) {
+	<-querySpec.Cancellation().Done()
+	if !querySpec.IsCancelled() {
+		return
+	}
+
+	database := querySpec.Database()
+	request := &protocol.Request{Id: &requestId, Type: &cancelQueryRequest, Database: &database, ShardId: &self.id}
+	if err := server.MakeRequest(request, nil); err != nil {
+		log.Error("Couldn't cancel the query on shard %d of server %d: %s", self.id, server.GetId(), err)
+	}
 }
 
 func (self *ShardData) DropDatabase(database string, sendToServers bool) {
-	if self.localShard != nil {
-		self.localShard.DropDatabase(database)
+	if localShard := self.getLocalShard(); localShard != nil {
+		localShard.DropDatabase(database)
 	}
 
 	if !sendToServers {
 		return
 	}
 
-	responses := make([]chan *protocol.Response, len(self.clusterServers), len(self.clusterServers))
-	for i, server := range self.clusterServers {
+	servers := self.writeServers()
+	responses := make([]chan *protocol.Response, len(servers), len(servers))
+	for i, server := range servers {
 		responseChan := make(chan *protocol.Response, 1)
 		responses[i] = responseChan
 		request := &protocol.Request{Type: &dropDatabaseRequest, Database: &database, ShardId: &self.id}
@@ -257,6 +470,8 @@ func (self *ShardData) DropDatabase(database string, sendToServers bool) {
 }
 
 func (self *ShardData) String() string {
+	self.serversLock.RLock()
+	defer self.serversLock.RUnlock()
 	serversString := make([]string, 0)
 	for _, s := range self.servers {
 		serversString = append(serversString, fmt.Sprintf("%d", s.GetId()))
@@ -273,6 +488,15 @@ func (self *ShardData) ShouldAggregateLocally(querySpec *parser.QuerySpec) bool
 	if self.durationIsSplit && querySpec.ReadsFromMultipleSeries() {
 		return false
 	}
+	// the windows of these aggregates can span more than one shard
+	if querySpec.SelectQuery() != nil && engine.HasWindowAggregates(querySpec.SelectQuery()) {
+		return false
+	}
+	// the empty buckets are filled over the time range of the whole
+	// query, every shard would return all of them
+	if querySpec.SelectQuery() != nil && querySpec.SelectQuery().GetGroupByClause().FillWithZero {
+		return false
+	}
 	groupByInterval := querySpec.GetGroupByInterval()
 	if groupByInterval == nil {
 		if querySpec.HasAggregates() {
@@ -303,21 +527,22 @@ func (self *ShardData) LogAndHandleDestructiveQuery(querySpec *parser.QuerySpec,
 		return err
 	}
 	var localResponses chan *protocol.Response
-	if self.localShard != nil {
+	if localShard := self.getLocalShard(); localShard != nil {
 		localResponses = make(chan *protocol.Response, 1)
 
 		// this doesn't really apply at this point since destructive queries don't output anything, but it may later
 		maxPointsFromDestructiveQuery := 1000
 		processor := engine.NewPassthroughEngine(localResponses, maxPointsFromDestructiveQuery)
-		err := self.localShard.Query(querySpec, processor)
+		err := localShard.Query(querySpec, processor)
 		processor.Close()
 		if err != nil {
 			return err
 		}
 	}
 	if !runLocalOnly {
-		responses := make([]chan *protocol.Response, len(self.clusterServers), len(self.clusterServers))
-		for i, server := range self.clusterServers {
+		servers := self.writeServers()
+		responses := make([]chan *protocol.Response, len(servers), len(servers))
+		for i, server := range servers {
 			responseChan := make(chan *protocol.Response, 1)
 			responses[i] = responseChan
 			// do this so that a new id will get assigned
@@ -328,7 +553,7 @@ func (self *ShardData) LogAndHandleDestructiveQuery(querySpec *parser.QuerySpec,
 			for {
 				res := <-responseChan
 				if *res.Type == endStreamResponse {
-					self.wal.Commit(requestNumber, self.clusterServers[i].Id)
+					self.wal.Commit(requestNumber, servers[i].Id)
 					break
 				}
 				response <- res
@@ -340,7 +565,7 @@ func (self *ShardData) LogAndHandleDestructiveQuery(querySpec *parser.QuerySpec,
 		for {
 			res := <-localResponses
 			if *res.Type == endStreamResponse {
-				self.wal.Commit(requestNumber, self.localServerId)
+				self.wal.Commit(requestNumber, self.getLocalServerId())
 				break
 			}
 			response <- res
@@ -358,7 +583,7 @@ func (self *ShardData) createRequest(querySpec *parser.QuerySpec) *protocol.Requ
 	database := querySpec.Database()
 	isDbUser := !user.IsClusterAdmin()
 
-	return &protocol.Request{
+	request := &protocol.Request{
 		Type:     &queryRequest,
 		ShardId:  &self.id,
 		Query:    &queryString,
@@ -366,28 +591,37 @@ func (self *ShardData) createRequest(querySpec *parser.QuerySpec) *protocol.Requ
 		Database: &database,
 		IsDbUser: &isDbUser,
 	}
+	if querySpec.AggregateInCoordinator {
+		request.AggregateInCoordinator = &querySpec.AggregateInCoordinator
+	}
+	return request
 }
 
 // used to serialize shards when sending around in raft or when snapshotting in the log
 func (self *ShardData) ToNewShardData() *NewShardData {
 	return &NewShardData{
-		Id:        self.id,
-		StartTime: self.startTime,
-		EndTime:   self.endTime,
-		Type:      self.shardType,
-		ServerIds: self.serverIds,
+		Id:               self.id,
+		StartTime:        self.startTime,
+		EndTime:          self.endTime,
+		Type:             self.shardType,
+		ServerIds:        self.ServerIds(),
+		PendingServerIds: self.PendingServerIds(),
 	}
 }
 
 // server ids should always be returned in sorted order
 func (self *ShardData) sortServerIds() {
-	serverIdInts := make([]int, len(self.serverIds), len(self.serverIds))
-	for i, id := range self.serverIds {
-		serverIdInts[i] = int(id)
+	sortIds(self.serverIds)
+}
+
+func sortIds(ids []uint32) {
+	idInts := make([]int, len(ids), len(ids))
+	for i, id := range ids {
+		idInts[i] = int(id)
 	}
-	sort.Ints(serverIdInts)
-	for i, id := range serverIdInts {
-		self.serverIds[i] = uint32(id)
+	sort.Ints(idInts)
+	for i, id := range idInts {
+		ids[i] = uint32(id)
 	}
 }
 
@@ -0,0 +1,347 @@
+package cluster
+
+// Anti-entropy repair between the replicas of a shard. A server asks a
+// replica for the hashes of the series of the shard, and for every
+// series whose hash differs from its own it sends the hashes of its
+// buckets to the replica. The replica sends back the points of the
+// buckets that differ, which are written to the local shard. Every
+// replica repairs its own copy of the shard this way, so points are only
+// added. The shards keep the time ranges of the deletes they applied and
+// the points in them aren't written, so a replica that missed a delete
+// doesn't restore the deleted points on the others. It keeps them until
+// the delete is run again though. A server can also ask a replica to
+// repair its copy, e.g. when the replica missed writes that the server
+// couldn't hand off to it.
+
+import (
+	log "code.google.com/p/log4go"
+	"common"
+	"engine"
+	"errors"
+	"fmt"
+	"parser"
+	"protocol"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	REPAIR_RESPONSE_TIMEOUT = time.Minute
+	// the replica waits for the reads once the buffer is full, the points
+	// are written to the local shard between them
+	REPAIR_RESPONSE_BUFFER_SIZE = 10
+	// how often a server that repairs its copy of a shard tells the
+	// server that requested the repair that it's still running
+	REPAIR_KEEPALIVE_INTERVAL = 10 * time.Second
+)
+
+var (
+	seriesHashesRequest = protocol.Request_SERIES_HASHES
+	repairSeriesRequest = protocol.Request_REPAIR_SERIES
+	repairShardRequest  = protocol.Request_REPAIR_SHARD
+	writeRequest        = protocol.Request_WRITE
+
+	// the user that reads the points of the local shard for repairs
+	repairUser = &ClusterAdmin{CommonUser: CommonUser{Name: "anti_entropy"}}
+)
+
+func (self *ShardData) hashBucketSize() int64 {
+	bucketSize := (self.endMicro - self.startMicro) / HASH_BUCKETS_PER_SHARD
+	if bucketSize < 1 {
+		return 1
+	}
+	return bucketSize
+}
+
+// Copies the points that the local shard is missing from the replicas
+// that are up. Returns the number of points that were written.
+func (self *ShardData) Repair(database string) (int, error) {
+	localShard := self.queryableLocalShard()
+	if localShard == nil {
+		return 0, fmt.Errorf("Shard %d has no local copy to repair", self.id)
+	}
+
+	repaired := 0
+	for _, server := range self.remoteServers() {
+		if !server.IsUp() {
+			continue
+		}
+		count, err := self.repairFrom(server, localShard, database)
+		repaired += count
+		if err != nil {
+			return repaired, err
+		}
+	}
+	return repaired, nil
+}
+
+// Asks the server to repair its copy of the shard from the other
+// replicas and waits until it's done
+func (self *ShardData) RequestRepair(serverId uint32, database string) error {
+	if self.getLocalShard() != nil && serverId == self.getLocalServerId() {
+		_, err := self.Repair(database)
+		return err
+	}
+	for _, server := range self.remoteServers() {
+		if server.Id != serverId {
+			continue
+		}
+		if !server.IsUp() {
+			return fmt.Errorf("Server %d is down", serverId)
+		}
+		request := &protocol.Request{Type: &repairShardRequest, Database: &database, ShardId: &self.id}
+		return self.makeRepairRequest(server, request, func(*protocol.Series) error { return nil })
+	}
+	return fmt.Errorf("Server %d doesn't have shard %d", serverId, self.id)
+}
+
+func (self *ShardData) repairFrom(server *ClusterServer, localShard LocalShardDb, database string) (int, error) {
+	bucketSize := self.hashBucketSize()
+	localHashes, err := localShard.GetSeriesHashes(database, self.startMicro, bucketSize)
+	if err != nil {
+		return 0, err
+	}
+	localHashesByName := map[string]uint64{}
+	for _, hash := range localHashes {
+		localHashesByName[hash.Name] = hash.Hash
+	}
+
+	request := &protocol.Request{Type: &seriesHashesRequest, Database: &database, ShardId: &self.id}
+	remoteHashes := []*SeriesHash{}
+	err = self.makeRepairRequest(server, request, func(series *protocol.Series) error {
+		remoteHashes = append(remoteHashes, SeriesHashesFromSeries(series)...)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	repaired := 0
+	for _, remoteHash := range remoteHashes {
+		if hash, ok := localHashesByName[remoteHash.Name]; ok && hash == remoteHash.Hash {
+			continue
+		}
+		localHash, err := localShard.GetSeriesHash(database, remoteHash.Name, self.startMicro, bucketSize)
+		if err != nil {
+			return repaired, err
+		}
+
+		deletedRanges, err := localShard.GetDeletedRanges(database, remoteHash.Name)
+		if err != nil {
+			return repaired, err
+		}
+
+		log.Debug("Repairing series %s of shard %d from server %d", remoteHash.Name, self.id, server.Id)
+		request := &protocol.Request{Type: &repairSeriesRequest, Database: &database, ShardId: &self.id, Series: BucketHashesToSeries(localHash)}
+		err = self.makeRepairRequest(server, request, func(series *protocol.Series) error {
+			series = withoutDeletedPoints(series, deletedRanges)
+			if len(series.Points) == 0 {
+				return nil
+			}
+			write := &protocol.Request{Type: &writeRequest, Database: &database, ShardId: &self.id, Series: series}
+			if err := self.WriteLocalOnly(write); err != nil {
+				return err
+			}
+			repaired += len(series.Points)
+			return nil
+		})
+		if err != nil {
+			return repaired, err
+		}
+	}
+	return repaired, nil
+}
+
+// A time range of a series that a delete was applied to, in
+// microseconds. Both ends are included.
+type DeletedRange struct {
+	StartTime int64
+	EndTime   int64
+}
+
+func (self *DeletedRange) Contains(timestamp int64) bool {
+	return timestamp >= self.StartTime && timestamp <= self.EndTime
+}
+
+// Returns the series without the points in the deleted ranges
+func withoutDeletedPoints(series *protocol.Series, deletedRanges []*DeletedRange) *protocol.Series {
+	if len(deletedRanges) == 0 {
+		return series
+	}
+	points := make([]*protocol.Point, 0, len(series.Points))
+	for _, point := range series.Points {
+		deleted := false
+		for _, deletedRange := range deletedRanges {
+			if deletedRange.Contains(point.GetTimestamp()) {
+				deleted = true
+				break
+			}
+		}
+		if !deleted {
+			points = append(points, point)
+		}
+	}
+	if skipped := len(series.Points) - len(points); skipped > 0 {
+		common.InternalStats.Add("anti_entropy.deleted_points_skipped", int64(skipped))
+	}
+	return &protocol.Series{Name: series.Name, Fields: series.Fields, Points: points}
+}
+
+// Sends the request to the server and calls yield with the series of the
+// responses until the end of the stream
+func (self *ShardData) makeRepairRequest(server *ClusterServer, request *protocol.Request, yield func(*protocol.Series) error) error {
+	responses := make(chan *protocol.Response, REPAIR_RESPONSE_BUFFER_SIZE)
+	if err := server.MakeRequest(request, responses); err != nil {
+		return err
+	}
+
+	// the responses have to be read until the end even if yield fails
+	var yieldErr error
+	for {
+		select {
+		case response := <-responses:
+			if *response.Type == endStreamResponse {
+				if response.ErrorMessage != nil {
+					return errors.New(*response.ErrorMessage)
+				}
+				return yieldErr
+			}
+			if response.Series != nil && len(response.Series.Points) > 0 && yieldErr == nil {
+				yieldErr = yield(response.Series)
+			}
+		case <-time.After(REPAIR_RESPONSE_TIMEOUT):
+			return fmt.Errorf("Server %d didn't respond to the repair of shard %d in %s", server.Id, self.id, REPAIR_RESPONSE_TIMEOUT)
+		}
+	}
+}
+
+// Handles the repair requests of the other replicas. The responses end
+// with an end stream response, which has the error if there was one.
+func (self *ShardData) HandleRepairRequest(request *protocol.Request, response chan *protocol.Response) {
+	err := self.handleRepairRequest(request, response)
+	endStream := &protocol.Response{Type: &endStreamResponse}
+	if err != nil {
+		message := err.Error()
+		endStream.ErrorMessage = &message
+	}
+	response <- endStream
+}
+
+func (self *ShardData) handleRepairRequest(request *protocol.Request, response chan *protocol.Response) error {
+	localShard := self.queryableLocalShard()
+	if localShard == nil {
+		return fmt.Errorf("Shard %d has no local copy to repair from", self.id)
+	}
+
+	database := request.GetDatabase()
+	if *request.Type == repairShardRequest {
+		// the repair keeps running if the requester stops waiting, a
+		// request that's retried waits for the same repair
+		repair := self.startRepair(database)
+		for {
+			select {
+			case <-repair.done:
+				return repair.err
+			case <-time.After(REPAIR_KEEPALIVE_INTERVAL):
+				response <- &protocol.Response{Type: &queryResponse}
+			}
+		}
+	}
+
+	bucketSize := self.hashBucketSize()
+	if *request.Type == seriesHashesRequest {
+		hashes, err := localShard.GetSeriesHashes(database, self.startMicro, bucketSize)
+		if err != nil {
+			return err
+		}
+		// keep the responses small, there may be lots of series
+		for len(hashes) > 0 {
+			count := len(hashes)
+			if count > 1000 {
+				count = 1000
+			}
+			response <- &protocol.Response{Type: &queryResponse, Series: SeriesHashesToSeries(hashes[:count])}
+			hashes = hashes[count:]
+		}
+		return nil
+	}
+
+	if request.Series == nil {
+		return fmt.Errorf("The repair request of shard %d has no series", self.id)
+	}
+	remoteHash := BucketHashesFromSeries(request.Series)
+	localHash, err := localShard.GetSeriesHash(database, remoteHash.Name, self.startMicro, bucketSize)
+	if err != nil {
+		return err
+	}
+	for _, bucket := range localHash.DifferentBuckets(remoteHash) {
+		common.InternalStats.Increment("anti_entropy.buckets_sent")
+		if err := self.queryLocalPoints(localShard, database, remoteHash.Name, bucket.Start, bucket.Start+bucketSize, response); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type runningRepair struct {
+	// closed once the repair is done
+	done chan bool
+	err  error
+}
+
+// Repairs the database of the local copy in the background unless it's
+// being repaired already
+func (self *ShardData) startRepair(database string) *runningRepair {
+	self.repairsLock.Lock()
+	defer self.repairsLock.Unlock()
+	if repair, ok := self.repairs[database]; ok {
+		return repair
+	}
+
+	repair := &runningRepair{done: make(chan bool)}
+	self.repairs[database] = repair
+	go func() {
+		count, err := self.Repair(database)
+		if err != nil {
+			log.Error("Couldn't repair database %s of shard %d: %s", database, self.id, err)
+		} else {
+			log.Info("Repaired %d points of database %s of shard %d", count, database, self.id)
+		}
+		self.repairsLock.Lock()
+		delete(self.repairs, database)
+		self.repairsLock.Unlock()
+		repair.err = err
+		close(repair.done)
+	}()
+	return repair
+}
+
+// Sends the points of the series in [startTime, endTime) to the response
+// channel, without an end stream response
+func (self *ShardData) queryLocalPoints(localShard LocalShardDb, database, series string, startTime, endTime int64, response chan *protocol.Response) error {
+	// the series name is matched with a regex, since it may have
+	// characters that the query language doesn't allow in names
+	regex := strings.Replace(regexp.QuoteMeta(series), "/", "\\/", -1)
+	query := fmt.Sprintf("select * from /^%s$/ where time > %du and time < %du", regex, startTime-1, endTime)
+	queries, err := parser.ParseQuery(query)
+	if err != nil {
+		return err
+	}
+	querySpec := parser.NewQuerySpec(repairUser, database, queries[0])
+
+	responses := make(chan *protocol.Response, 1)
+	var queryErr error
+	go func() {
+		processor := engine.NewPassthroughEngine(responses, 1000)
+		queryErr = localShard.Query(querySpec, processor)
+		processor.Close()
+	}()
+	for {
+		r := <-responses
+		if *r.Type == endStreamResponse {
+			return queryErr
+		}
+		response <- r
+	}
+}
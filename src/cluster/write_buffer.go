@@ -2,10 +2,17 @@ package cluster
 
 import (
 	log "code.google.com/p/log4go"
+	"common"
+	"errors"
 	"protocol"
 	"time"
 )
 
+var (
+	errWriteBufferStopped = errors.New("The write buffer was stopped")
+	errHandoffDropped     = errors.New("The queued writes were dropped")
+)
+
 // Acts as a buffer for writes
 type WriteBuffer struct {
 	writer        Writer
@@ -15,13 +22,27 @@ type WriteBuffer struct {
 	stoppedWrites chan uint32
 	bufferSize    int
 	shardIds      map[uint32]bool
+	stopped       chan bool
+	handoff       *handoffQueue
+	recoveries    chan *recovery
+}
+
+// The writes that the server didn't get before this server restarted
+type recovery struct {
+	requestNumber uint32
+	shardIds      []uint32
+	// closed once the writes were replayed
+	done chan bool
 }
 
 type Writer interface {
 	Write(request *protocol.Request) error
 }
 
-func NewWriteBuffer(writer Writer, wal WAL, serverId uint32, bufferSize int) *WriteBuffer {
+// The writes that the server didn't get within handoffMaxAge, or once
+// they're bigger than handoffMaxSize bytes, are dropped and their shards
+// are marked for repair. A limit of 0 means there's no limit.
+func NewWriteBuffer(writer Writer, wal WAL, serverId uint32, bufferSize int, handoffMaxAge time.Duration, handoffMaxSize int64) *WriteBuffer {
 	log.Info("Initializing write buffer with buffer size of %d", bufferSize)
 	buff := &WriteBuffer{
 		writer:        writer,
@@ -31,6 +52,9 @@ func NewWriteBuffer(writer Writer, wal WAL, serverId uint32, bufferSize int) *Wr
 		stoppedWrites: make(chan uint32, 1),
 		bufferSize:    bufferSize,
 		shardIds:      make(map[uint32]bool),
+		stopped:       make(chan bool),
+		handoff:       newHandoffQueue(handoffMaxAge, handoffMaxSize),
+		recoveries:    make(chan *recovery, 1),
 	}
 	go buff.handleWrites()
 	return buff
@@ -39,10 +63,15 @@ func NewWriteBuffer(writer Writer, wal WAL, serverId uint32, bufferSize int) *Wr
 // This method never blocks. It'll buffer writes until they fill the buffer then drop the on the
 // floor and let the background goroutine replay from the WAL
 func (self *WriteBuffer) Write(request *protocol.Request) {
+	if self.isStopped() {
+		return
+	}
+	self.handoff.add(request)
 	select {
 	case self.writes <- request:
 		return
 	default:
+		common.InternalStats.Increment("write_buffer.dropped_writes")
 		select {
 		case self.stoppedWrites <- *request.RequestNumber:
 			return
@@ -52,9 +81,87 @@ func (self *WriteBuffer) Write(request *protocol.Request) {
 	}
 }
 
+// Drops the buffered writes and stops retrying the ones that failed.
+// This is used when the server was removed from the cluster.
+func (self *WriteBuffer) Stop() {
+	if !self.isStopped() {
+		close(self.stopped)
+		self.handoff.deleteShardsToRepair()
+	}
+}
+
+func (self *WriteBuffer) HandoffState() *HandoffState {
+	return self.handoff.state(self.serverId)
+}
+
+// Returns the shards that have to be repaired on the server because
+// the writes to them were dropped
+func (self *WriteBuffer) ShardsToRepair() []uint32 {
+	return self.HandoffState().ShardsToRepair
+}
+
+// Unmarks the shard for repair if it wasn't marked again after the
+// repair started
+func (self *WriteBuffer) RepairedShard(shardId uint32, repairStart time.Time) {
+	self.handoff.repaired(shardId, repairStart)
+}
+
+// Keeps the shards to repair in the file, so they're still repaired on
+// the server after a restart
+func (self *WriteBuffer) PersistShardsToRepair(path string) error {
+	return self.handoff.persistShardsToRepair(path)
+}
+
+// Queues the writes of the shards that the server didn't get before
+// this server restarted and replays them from the wal like the buffered
+// writes, so they count against the handoff limits. The returned channel
+// is closed once they were replayed. The wal is read twice, once to
+// queue the writes and once to replay them.
+func (self *WriteBuffer) RecoverFromLastCommit(shardIds []uint32) (<-chan bool, error) {
+	recovery := &recovery{shardIds: shardIds, done: make(chan bool)}
+	// the wal replays the writes of every shard if there are no shards
+	if len(shardIds) == 0 {
+		close(recovery.done)
+		return recovery.done, nil
+	}
+	err := self.wal.RecoverServerFromLastCommit(self.serverId, shardIds, func(request *protocol.Request, shardId uint32) error {
+		if request == nil {
+			log.Error("Error on recover, the wal yielded a nil request")
+			return nil
+		}
+		if recovery.requestNumber == 0 {
+			recovery.requestNumber = request.GetRequestNumber()
+		}
+		request.ShardId = &shardId
+		self.handoff.add(request)
+		return nil
+	})
+	if err != nil || recovery.requestNumber == 0 {
+		close(recovery.done)
+		return recovery.done, err
+	}
+	log.Info("WriteBuffer: recovering the writes to server %d from request %d", self.serverId, recovery.requestNumber)
+	self.recoveries <- recovery
+	return recovery.done, nil
+}
+
+func (self *WriteBuffer) isStopped() bool {
+	select {
+	case <-self.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
 func (self *WriteBuffer) handleWrites() {
 	for {
 		select {
+		case <-self.stopped:
+			log.Info("WriteBuffer: stopped writing to server %d", self.serverId)
+			return
+		case recovery := <-self.recoveries:
+			self.recover(recovery)
 		case requestDropped := <-self.stoppedWrites:
 			self.replayAndRecover(requestDropped)
 		case request := <-self.writes:
@@ -63,15 +170,21 @@ func (self *WriteBuffer) handleWrites() {
 	}
 }
 
-func (self *WriteBuffer) write(request *protocol.Request) {
+func (self *WriteBuffer) write(request *protocol.Request) error {
 	attempts := 0
-	for {
+	for !self.isStopped() {
 		self.shardIds[*request.ShardId] = true
 		requestNumber := *request.RequestNumber
 		err := self.writer.Write(request)
 		if err == nil {
 			self.wal.Commit(requestNumber, self.serverId)
-			return
+			self.handoff.written(requestNumber)
+			return nil
+		}
+		self.handoff.failed(err)
+		if self.handoff.isOverLimits() {
+			self.dropQueuedWrites(request)
+			return errHandoffDropped
 		}
 		if attempts%100 == 0 {
 			log.Error("WriteBuffer: error on write to server %d: %s", self.serverId, err)
@@ -80,11 +193,57 @@ func (self *WriteBuffer) write(request *protocol.Request) {
 		// backoff happens in the writer, just sleep for a small fixed amount of time before retrying
 		time.Sleep(time.Millisecond * 100)
 	}
+	return errWriteBufferStopped
+}
+
+// Gives up on the writes that the server didn't get yet, including the
+// buffered ones. They're committed so the wal can delete them, the
+// anti-entropy repair copies their points to the server instead.
+func (self *WriteBuffer) dropQueuedWrites(request *protocol.Request) {
+	for len(self.writes) > 0 {
+		<-self.writes
+	}
+	select {
+	case <-self.stoppedWrites:
+	default:
+	}
+
+	lastRequestNumber, count := self.handoff.drop(*request.ShardId)
+	if *request.RequestNumber > lastRequestNumber {
+		lastRequestNumber = *request.RequestNumber
+	}
+	common.InternalStats.Add("write_buffer.handoff_dropped_writes", int64(count))
+	log.Error("WriteBuffer: dropped %d writes to server %d, the shards have to be repaired: %v", count, self.serverId, self.ShardsToRepair())
+	self.wal.Commit(lastRequestNumber, self.serverId)
+}
+
+func (self *WriteBuffer) recover(recovery *recovery) {
+	defer close(recovery.done)
+	err := self.wal.RecoverServerFromRequestNumber(recovery.requestNumber, recovery.shardIds, func(request *protocol.Request, shardId uint32) error {
+		if self.isStopped() {
+			return errWriteBufferStopped
+		}
+		if request == nil {
+			return nil
+		}
+		request.ShardId = &shardId
+		return self.write(request)
+	})
+	switch err {
+	case nil:
+		log.Info("WriteBuffer: recovered the writes to server %d", self.serverId)
+	case errHandoffDropped:
+		log.Info("WriteBuffer: the recovered writes to server %d were dropped", self.serverId)
+	case errWriteBufferStopped:
+	default:
+		log.Error("WriteBuffer: couldn't recover the writes to server %d: %s", self.serverId, err)
+	}
 }
 
 func (self *WriteBuffer) replayAndRecover(missedRequest uint32) {
-	for {
+	for !self.isStopped() {
 		log.Info("REPLAY: Replaying dropped requests...")
+		common.InternalStats.Increment("write_buffer.replays")
 		// empty out the buffer before the replay so new writes can buffer while we're replaying
 		channelLen := len(self.writes)
 		var req *protocol.Request
@@ -109,12 +268,18 @@ func (self *WriteBuffer) replayAndRecover(missedRequest uint32) {
 		}
 
 		log.Info("REPLAY: Shards: ", shardIds)
-		self.wal.RecoverServerFromRequestNumber(*req.RequestNumber, shardIds, func(request *protocol.Request, shardId uint32) error {
+		err := self.wal.RecoverServerFromRequestNumber(*req.RequestNumber, shardIds, func(request *protocol.Request, shardId uint32) error {
+			if self.isStopped() {
+				return errWriteBufferStopped
+			}
 			req = request
 			request.ShardId = &shardId
-			self.write(request)
-			return nil
+			return self.write(request)
 		})
+		if err == errHandoffDropped {
+			log.Info("REPLAY: the queued writes were dropped.")
+			return
+		}
 
 		log.Info("REPLAY: Emptying out reqeusts from buffer that we've already replayed")
 	RequestLoop:
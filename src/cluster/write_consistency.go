@@ -0,0 +1,53 @@
+package cluster
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The number of replicas of a shard that have to acknowledge a write
+// before it succeeds
+type WriteConsistency int
+
+const (
+	// the write succeeds once it's in the wal of the server that got it,
+	// the replicas get it in the background
+	WriteConsistencyAny WriteConsistency = iota
+	WriteConsistencyOne
+	WriteConsistencyQuorum
+	WriteConsistencyAll
+)
+
+var writeConsistencyNames = map[WriteConsistency]string{
+	WriteConsistencyAny:    "any",
+	WriteConsistencyOne:    "one",
+	WriteConsistencyQuorum: "quorum",
+	WriteConsistencyAll:    "all",
+}
+
+func ParseWriteConsistency(name string) (WriteConsistency, error) {
+	for consistency, consistencyName := range writeConsistencyNames {
+		if strings.ToLower(name) == consistencyName {
+			return consistency, nil
+		}
+	}
+	return WriteConsistencyAny, fmt.Errorf("Unknown write consistency %q, it should be one of any, one, quorum or all", name)
+}
+
+func (self WriteConsistency) String() string {
+	return writeConsistencyNames[self]
+}
+
+// Returns how many of the replicas have to acknowledge a write
+func (self WriteConsistency) RequiredAcknowledgements(replicas int) int {
+	switch self {
+	case WriteConsistencyOne:
+		return 1
+	case WriteConsistencyQuorum:
+		return replicas/2 + 1
+	case WriteConsistencyAll:
+		return replicas
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,93 @@
+package common
+
+import (
+	"sync"
+)
+
+// Signals the goroutines that run a query that the query was cancelled,
+// because it timed out, its client went away or it was killed, or that
+// it finished. The methods can be called on a nil cancellation, which
+// is never cancelled.
+type QueryCancellation struct {
+	lock sync.Mutex
+	done chan bool
+	err  error
+}
+
+func NewQueryCancellation() *QueryCancellation {
+	return &QueryCancellation{done: make(chan bool)}
+}
+
+// Cancels the query with the given reason, unless it was already
+// cancelled or finished
+func (self *QueryCancellation) Cancel(reason error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.isDone() {
+		return
+	}
+	self.err = reason
+	close(self.done)
+}
+
+// Marks the query as finished, the goroutines that wait for it to be
+// cancelled can return
+func (self *QueryCancellation) Finish() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.isDone() {
+		return
+	}
+	close(self.done)
+}
+
+// Closed when the query is cancelled or finished
+func (self *QueryCancellation) Done() <-chan bool {
+	if self == nil {
+		return nil
+	}
+	return self.done
+}
+
+// Returns a cancellation that is cancelled when this one is, but that
+// can also be cancelled on its own, e.g. to stop the shards of a query
+// that doesn't need more points. It has to be finished once the query
+// is done.
+func (self *QueryCancellation) Child() *QueryCancellation {
+	child := NewQueryCancellation()
+	go func() {
+		select {
+		case <-self.Done():
+			if err := self.Err(); err != nil {
+				child.Cancel(err)
+			} else {
+				child.Finish()
+			}
+		case <-child.Done():
+		}
+	}()
+	return child
+}
+
+// Returns the reason the query was cancelled for, or nil
+func (self *QueryCancellation) Err() error {
+	if self == nil {
+		return nil
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.err
+}
+
+func (self *QueryCancellation) IsCancelled() bool {
+	return self.Err() != nil
+}
+
+func (self *QueryCancellation) isDone() bool {
+	select {
+	case <-self.done:
+		return true
+	default:
+		return false
+	}
+}
@@ -2,12 +2,15 @@ package common
 
 import (
 	"fmt"
+	"time"
 )
 
 const (
 	WrongNumberOfArguments = iota
 	InvalidArgument
 	InternalError
+	QueryTimedOut
+	QueryCancelled
 )
 
 type QueryError struct {
@@ -42,3 +45,35 @@ func (self AuthorizationError) Error() string {
 func NewAuthorizationError(formatStr string, args ...interface{}) AuthorizationError {
 	return AuthorizationError(fmt.Sprintf(formatStr, args...))
 }
+
+// Returned when a write exceeds the write limit of the database or of
+// the user. The write can be retried after RetryAfter.
+type WriteLimitError struct {
+	message    string
+	RetryAfter time.Duration
+}
+
+func (self *WriteLimitError) Error() string {
+	return self.message
+}
+
+func NewWriteLimitError(retryAfter time.Duration, formatStr string, args ...interface{}) *WriteLimitError {
+	return &WriteLimitError{fmt.Sprintf(formatStr, args...), retryAfter}
+}
+
+// Returned when fewer replicas than the write consistency requires
+// acknowledged a write in time. The points are in the wal and are still
+// written to the other replicas, so they may show up in queries.
+type PartialWriteError struct {
+	message      string
+	Acknowledged int
+	Required     int
+}
+
+func (self *PartialWriteError) Error() string {
+	return self.message
+}
+
+func NewPartialWriteError(acknowledged, required int, formatStr string, args ...interface{}) *PartialWriteError {
+	return &PartialWriteError{fmt.Sprintf(formatStr, args...), acknowledged, required}
+}
@@ -0,0 +1,56 @@
+package common
+
+import (
+	"sort"
+	"sync"
+)
+
+// Counters of what the local server is doing, e.g. the number of
+// writes, queries or heartbeat failures. They're periodically written
+// into the internal database by the coordinator.
+type Stats struct {
+	lock     sync.Mutex
+	counters map[string]int64
+}
+
+type StatsSnapshot struct {
+	Name  string
+	Value int64
+}
+
+var InternalStats = NewStats()
+
+func NewStats() *Stats {
+	return &Stats{counters: make(map[string]int64)}
+}
+
+func (self *Stats) Increment(name string) {
+	self.Add(name, 1)
+}
+
+func (self *Stats) Add(name string, delta int64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.counters[name] += delta
+}
+
+// Returns the current value of all the counters sorted by name and
+// resets them to zero
+func (self *Stats) SnapshotAndReset() []*StatsSnapshot {
+	self.lock.Lock()
+	counters := self.counters
+	self.counters = make(map[string]int64)
+	self.lock.Unlock()
+
+	names := make([]string, 0, len(counters))
+	for name := range counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	snapshots := make([]*StatsSnapshot, 0, len(names))
+	for _, name := range names {
+		snapshots = append(snapshots, &StatsSnapshot{name, counters[name]})
+	}
+	return snapshots
+}
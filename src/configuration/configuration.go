@@ -9,6 +9,8 @@ import (
 	"io/ioutil"
 	"os"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -22,6 +24,33 @@ func (d *duration) UnmarshalText(text []byte) error {
 	return err
 }
 
+// A size in bytes, e.g. "512", "100k" or "500m"
+type size struct {
+	Bytes int64
+}
+
+func (s *size) UnmarshalText(text []byte) error {
+	value := strings.ToLower(strings.TrimSpace(string(text)))
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(value, "k"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(value, "m"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(value, "g"):
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		value = value[:len(value)-1]
+	}
+	bytes, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid size %s", text)
+	}
+	s.Bytes = bytes * multiplier
+	return nil
+}
+
 type AdminConfig struct {
 	Port   int
 	Assets string
@@ -31,6 +60,30 @@ type ApiConfig struct {
 	SslPort     int    `toml:"ssl-port"`
 	SslCertPath string `toml:"ssl-cert"`
 	Port        int
+	MaxBodySize size `toml:"max-body-size"`
+}
+
+type UdpConfig struct {
+	Enabled  bool
+	Port     int
+	Database string
+	Username string
+	Password string
+}
+
+type GraphiteConfig struct {
+	Enabled       bool
+	Port          int
+	Database      string
+	Username      string
+	Password      string
+	BatchSize     int      `toml:"batch-size"`
+	FlushInterval duration `toml:"flush-interval"`
+}
+
+type MonitoringConfig struct {
+	Enabled       bool
+	WriteInterval duration `toml:"write-interval"`
 }
 
 type RaftConfig struct {
@@ -50,6 +103,12 @@ type ClusterConfig struct {
 	ProtobufHeartbeatInterval duration `toml:"protobuf_heartbeat"`
 	WriteBufferSize           int      `toml"write-buffer-size"`
 	QueryShardBufferSize      int      `toml:"query-shard-buffer-size"`
+	QueryTimeout              duration `toml:"query-timeout"`
+	AntiEntropyInterval       duration `toml:"anti-entropy-interval"`
+	WriteConsistency          string   `toml:"write-consistency"`
+	WriteConsistencyTimeout   duration `toml:"write-consistency-timeout"`
+	HandoffMaxAge             duration `toml:"handoff-max-age"`
+	HandoffMaxSize            size     `toml:"handoff-max-size"`
 }
 
 type LoggingConfig struct {
@@ -70,6 +129,8 @@ type ShardingDefinition struct {
 type ShardConfiguration struct {
 	Duration         string
 	parsedDuration   time.Duration
+	Retention        string
+	parsedRetention  time.Duration
 	Split            int
 	SplitRandom      string `toml:"split-random"`
 	splitRandomRegex *regexp.Regexp
@@ -90,6 +151,13 @@ func (self *ShardConfiguration) ParseAndValidate(defaultShardDuration time.Durat
 			return err
 		}
 	}
+	if self.Retention != "" {
+		val, err := common.ParseTimeDuration(self.Retention)
+		if err != nil {
+			return err
+		}
+		self.parsedRetention = time.Duration(val)
+	}
 	if self.Duration == "" {
 		self.parsedDuration = defaultShardDuration
 		return nil
@@ -106,6 +174,12 @@ func (self *ShardConfiguration) ParsedDuration() *time.Duration {
 	return &self.parsedDuration
 }
 
+// Returns the period of time shards are kept after their end time
+// before they get dropped, 0 if they should be kept forever
+func (self *ShardConfiguration) ParsedRetention() time.Duration {
+	return self.parsedRetention
+}
+
 func (self *ShardConfiguration) HasRandomSplit() bool {
 	return self.hasRandomSplit
 }
@@ -125,6 +199,9 @@ type WalConfig struct {
 type TomlConfiguration struct {
 	Admin       AdminConfig
 	Api         ApiConfig
+	Udp         UdpConfig
+	Graphite    GraphiteConfig
+	Monitoring  MonitoringConfig
 	Raft        RaftConfig
 	Storage     StorageConfig
 	Cluster     ClusterConfig
@@ -142,6 +219,21 @@ type Configuration struct {
 	ApiHttpSslPort            int
 	ApiHttpCertPath           string
 	ApiHttpPort               int
+	ApiMaxBodySize            int64
+	UdpServerEnabled          bool
+	UdpServerPort             int
+	UdpServerDatabase         string
+	UdpServerUsername         string
+	UdpServerPassword         string
+	GraphiteEnabled           bool
+	GraphitePort              int
+	GraphiteDatabase          string
+	GraphiteUsername          string
+	GraphitePassword          string
+	GraphiteBatchSize         int
+	GraphiteFlushInterval     duration
+	MonitoringEnabled         bool
+	MonitoringWriteInterval   duration
 	RaftServerPort            int
 	SeedServers               []string
 	DataDir                   string
@@ -165,6 +257,12 @@ type Configuration struct {
 	LocalStoreWriteBufferSize int
 	PerServerWriteBufferSize  int
 	QueryShardBufferSize      int
+	QueryTimeout              duration
+	AntiEntropyInterval       duration
+	WriteConsistency          string
+	WriteConsistencyTimeout   duration
+	HandoffMaxAge             duration
+	HandoffMaxSize            int64
 }
 
 func LoadConfiguration(fileName string) *Configuration {
@@ -214,6 +312,21 @@ func parseTomlConfiguration(filename string) (*Configuration, error) {
 		ApiHttpPort:               tomlConfiguration.Api.Port,
 		ApiHttpCertPath:           tomlConfiguration.Api.SslCertPath,
 		ApiHttpSslPort:            tomlConfiguration.Api.SslPort,
+		ApiMaxBodySize:            tomlConfiguration.Api.MaxBodySize.Bytes,
+		UdpServerEnabled:          tomlConfiguration.Udp.Enabled,
+		UdpServerPort:             tomlConfiguration.Udp.Port,
+		UdpServerDatabase:         tomlConfiguration.Udp.Database,
+		UdpServerUsername:         tomlConfiguration.Udp.Username,
+		UdpServerPassword:         tomlConfiguration.Udp.Password,
+		GraphiteEnabled:           tomlConfiguration.Graphite.Enabled,
+		GraphitePort:              tomlConfiguration.Graphite.Port,
+		GraphiteDatabase:          tomlConfiguration.Graphite.Database,
+		GraphiteUsername:          tomlConfiguration.Graphite.Username,
+		GraphitePassword:          tomlConfiguration.Graphite.Password,
+		GraphiteBatchSize:         tomlConfiguration.Graphite.BatchSize,
+		GraphiteFlushInterval:     tomlConfiguration.Graphite.FlushInterval,
+		MonitoringEnabled:         tomlConfiguration.Monitoring.Enabled,
+		MonitoringWriteInterval:   tomlConfiguration.Monitoring.WriteInterval,
 		RaftServerPort:            tomlConfiguration.Raft.Port,
 		RaftDir:                   tomlConfiguration.Raft.Dir,
 		ProtobufPort:              tomlConfiguration.Cluster.ProtobufPort,
@@ -237,6 +350,12 @@ func parseTomlConfiguration(filename string) (*Configuration, error) {
 		LocalStoreWriteBufferSize: tomlConfiguration.Storage.WriteBufferSize,
 		PerServerWriteBufferSize:  tomlConfiguration.Cluster.WriteBufferSize,
 		QueryShardBufferSize:      defaultQueryShardBufferSize,
+		QueryTimeout:              tomlConfiguration.Cluster.QueryTimeout,
+		AntiEntropyInterval:       tomlConfiguration.Cluster.AntiEntropyInterval,
+		WriteConsistency:          tomlConfiguration.Cluster.WriteConsistency,
+		WriteConsistencyTimeout:   tomlConfiguration.Cluster.WriteConsistencyTimeout,
+		HandoffMaxAge:             tomlConfiguration.Cluster.HandoffMaxAge,
+		HandoffMaxSize:            tomlConfiguration.Cluster.HandoffMaxSize.Bytes,
 	}
 
 	if config.LocalStoreWriteBufferSize == 0 {
@@ -246,6 +365,29 @@ func parseTomlConfiguration(filename string) (*Configuration, error) {
 		config.PerServerWriteBufferSize = 1000
 	}
 
+	if config.WriteConsistency == "" {
+		config.WriteConsistency = "any"
+	}
+	switch strings.ToLower(config.WriteConsistency) {
+	case "any", "one", "quorum", "all":
+	default:
+		return nil, fmt.Errorf("Unknown write consistency %q, it should be one of any, one, quorum or all", config.WriteConsistency)
+	}
+	if config.WriteConsistencyTimeout.Duration == 0 {
+		config.WriteConsistencyTimeout.Duration = 10 * time.Second
+	}
+
+	if config.GraphiteBatchSize == 0 {
+		config.GraphiteBatchSize = 1000
+	}
+	if config.GraphiteFlushInterval.Duration == 0 {
+		config.GraphiteFlushInterval.Duration = time.Second
+	}
+
+	if config.MonitoringWriteInterval.Duration == 0 {
+		config.MonitoringWriteInterval.Duration = 10 * time.Second
+	}
+
 	// if it wasn't set, set it to 100
 	if config.LevelDbMaxOpenFiles == 0 {
 		config.LevelDbMaxOpenFiles = 100
@@ -292,6 +434,22 @@ func (self *Configuration) ApiHttpSslPortString() string {
 	return fmt.Sprintf("%s:%d", self.BindAddress, self.ApiHttpSslPort)
 }
 
+func (self *Configuration) UdpServerPortString() string {
+	if !self.UdpServerEnabled || self.UdpServerPort <= 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("%s:%d", self.BindAddress, self.UdpServerPort)
+}
+
+func (self *Configuration) GraphitePortString() string {
+	if !self.GraphiteEnabled || self.GraphitePort <= 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("%s:%d", self.BindAddress, self.GraphitePort)
+}
+
 func (self *Configuration) ProtobufPortString() string {
 	return fmt.Sprintf("%s:%d", self.BindAddress, self.ProtobufPort)
 }
@@ -1,7 +1,10 @@
 package configuration
 
 import (
+	"io/ioutil"
 	. "launchpad.net/gocheck"
+	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -32,8 +35,28 @@ func (self *LoadConfigurationSuite) TestConfig(c *C) {
 	c.Assert(config.ApiHttpPort, Equals, 0)
 	c.Assert(config.ApiHttpSslPort, Equals, 8087)
 	c.Assert(config.ApiHttpCertPath, Equals, "../cert.pem")
+	c.Assert(config.ApiMaxBodySize, Equals, int64(100*1024*1024))
 	c.Assert(config.ApiHttpPortString(), Equals, "")
 
+	c.Assert(config.UdpServerEnabled, Equals, true)
+	c.Assert(config.UdpServerPort, Equals, 4444)
+	c.Assert(config.UdpServerDatabase, Equals, "udpdb")
+	c.Assert(config.UdpServerUsername, Equals, "udpuser")
+	c.Assert(config.UdpServerPassword, Equals, "udppass")
+	c.Assert(config.UdpServerPortString(), Equals, ":4444")
+
+	c.Assert(config.GraphiteEnabled, Equals, true)
+	c.Assert(config.GraphitePort, Equals, 2003)
+	c.Assert(config.GraphiteDatabase, Equals, "graphitedb")
+	c.Assert(config.GraphiteUsername, Equals, "graphiteuser")
+	c.Assert(config.GraphitePassword, Equals, "graphitepass")
+	c.Assert(config.GraphiteBatchSize, Equals, 500)
+	c.Assert(config.GraphiteFlushInterval.Duration, Equals, time.Second)
+	c.Assert(config.GraphitePortString(), Equals, ":2003")
+
+	c.Assert(config.MonitoringEnabled, Equals, true)
+	c.Assert(config.MonitoringWriteInterval.Duration, Equals, 5*time.Second)
+
 	c.Assert(config.RaftDir, Equals, "/tmp/influxdb/development/raft")
 	c.Assert(config.RaftServerPort, Equals, 8090)
 
@@ -43,6 +66,15 @@ func (self *LoadConfigurationSuite) TestConfig(c *C) {
 	c.Assert(config.ProtobufHeartbeatInterval.Duration, Equals, 200*time.Millisecond)
 	c.Assert(config.ProtobufTimeout.Duration, Equals, 2*time.Second)
 	c.Assert(config.SeedServers, DeepEquals, []string{"hosta:8090", "hostb:8090"})
+	c.Assert(config.QueryTimeout.Duration, Equals, 5*time.Minute)
+	c.Assert(config.AntiEntropyInterval.Duration, Equals, 24*time.Hour)
+	c.Assert(config.WriteConsistency, Equals, "any")
+	c.Assert(config.WriteConsistencyTimeout.Duration, Equals, 10*time.Second)
+	c.Assert(config.HandoffMaxAge.Duration, Equals, 6*time.Hour)
+	c.Assert(config.HandoffMaxSize, Equals, int64(1024*1024*1024))
+
+	c.Assert(config.ShortTermShard.ParsedRetention(), Equals, 30*24*time.Hour)
+	c.Assert(config.LongTermShard.ParsedRetention(), Equals, time.Duration(0))
 
 	c.Assert(config.WalDir, Equals, "/tmp/influxdb/development/wal")
 	c.Assert(config.WalFlushAfterRequests, Equals, 0)
@@ -50,3 +82,18 @@ func (self *LoadConfigurationSuite) TestConfig(c *C) {
 	c.Assert(config.WalIndexAfterRequests, Equals, 1000)
 	c.Assert(config.WalRequestsPerLogFile, Equals, 10000)
 }
+
+func (self *LoadConfigurationSuite) TestUnknownWriteConsistencyIsRefused(c *C) {
+	body, err := ioutil.ReadFile("config.toml")
+	c.Assert(err, IsNil)
+	body = []byte(strings.Replace(string(body), `write-consistency = "any"`, `write-consistency = "most"`, 1))
+	file, err := ioutil.TempFile("", "influxdb_config")
+	c.Assert(err, IsNil)
+	defer os.Remove(file.Name())
+	_, err = file.Write(body)
+	c.Assert(err, IsNil)
+	file.Close()
+
+	_, err = parseTomlConfiguration(file.Name())
+	c.Assert(err, ErrorMatches, ".*Unknown write consistency \"most\".*")
+}
@@ -0,0 +1,113 @@
+package coordinator
+
+// Periodically repairs the local shards from their replicas, so the
+// points that a server missed beyond what the wal keeps are copied to
+// it eventually. See cluster/shard_repair.go for how the replicas are
+// compared. The shards of the writes that couldn't be handed off to a
+// server are repaired on it as soon as it's up.
+
+import (
+	"cluster"
+	log "code.google.com/p/log4go"
+	"common"
+	"time"
+)
+
+// how often the servers are asked to repair the shards of the writes
+// that were dropped from their handoff queues
+const HANDOFF_REPAIR_INTERVAL = time.Minute
+
+type AntiEntropy struct {
+	clusterConfiguration *cluster.ClusterConfiguration
+	interval             time.Duration
+	stop                 chan bool
+}
+
+func NewAntiEntropy(clusterConfiguration *cluster.ClusterConfiguration, interval time.Duration) *AntiEntropy {
+	return &AntiEntropy{
+		clusterConfiguration: clusterConfiguration,
+		interval:             interval,
+		stop:                 make(chan bool),
+	}
+}
+
+// The shards are only compared with their replicas periodically if the
+// interval is set
+func (self *AntiEntropy) Run() {
+	var repairTicks <-chan time.Time
+	if self.interval > 0 {
+		ticker := time.NewTicker(self.interval)
+		defer ticker.Stop()
+		repairTicks = ticker.C
+	}
+	handoffTicker := time.NewTicker(HANDOFF_REPAIR_INTERVAL)
+	defer handoffTicker.Stop()
+	for {
+		select {
+		case <-self.stop:
+			return
+		case <-repairTicks:
+			self.repair()
+		case <-handoffTicker.C:
+			self.repairDroppedWrites()
+		}
+	}
+}
+
+func (self *AntiEntropy) Close() {
+	close(self.stop)
+}
+
+func (self *AntiEntropy) repair() {
+	start := time.Now()
+	repaired := 0
+	for _, shard := range self.clusterConfiguration.GetAllShards() {
+		if !shard.IsLocal() || len(shard.ServerIds()) < 2 {
+			continue
+		}
+		for _, database := range self.clusterConfiguration.GetDatabases() {
+			select {
+			case <-self.stop:
+				return
+			default:
+			}
+
+			count, err := shard.Repair(database.Name)
+			repaired += count
+			if err != nil {
+				log.Error("AntiEntropy: couldn't repair database %s of shard %d: %s", database.Name, shard.Id(), err)
+			}
+		}
+	}
+	common.InternalStats.Add("anti_entropy.repaired_points", int64(repaired))
+	log.Info("AntiEntropy: repaired %d points in %s", repaired, time.Since(start))
+}
+
+func (self *AntiEntropy) repairDroppedWrites() {
+	for _, state := range self.clusterConfiguration.HandoffStates() {
+		for _, shardId := range state.ShardsToRepair {
+			shard := self.clusterConfiguration.GetShard(shardId)
+			if shard == nil || !containsServerId(shard.ServerIds(), state.ServerId) {
+				// the server doesn't have the shard anymore
+				self.clusterConfiguration.ShardRepaired(state.ServerId, shardId, time.Now())
+				continue
+			}
+
+			// the server repaired the writes that were dropped before the
+			// repair started once it returns
+			repairStart := time.Now()
+			var err error
+			for _, database := range self.clusterConfiguration.GetDatabases() {
+				if err = shard.RequestRepair(state.ServerId, database.Name); err != nil {
+					break
+				}
+			}
+			if err != nil {
+				log.Warn("AntiEntropy: couldn't repair the dropped writes of shard %d on server %d: %s", shardId, state.ServerId, err)
+				continue
+			}
+			log.Info("AntiEntropy: repaired the dropped writes of shard %d on server %d", shardId, state.ServerId)
+			self.clusterConfiguration.ShardRepaired(state.ServerId, shardId, repairStart)
+		}
+	}
+}
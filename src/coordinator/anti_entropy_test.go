@@ -0,0 +1,206 @@
+package coordinator
+
+import (
+	"cluster"
+	"configuration"
+	"fmt"
+	. "launchpad.net/gocheck"
+	"protocol"
+	"sync/atomic"
+	"time"
+)
+
+type AntiEntropySuite struct{}
+
+var _ = Suite(&AntiEntropySuite{})
+
+// Passes the repair requests on to the shards of the replica's cluster
+// configuration like the request handler does. The responses are read
+// by a protobuf client, as fast as it gives credit for them.
+type ReplicaConnectionMock struct {
+	replica *cluster.ClusterConfiguration
+	client  *ProtobufClient
+}
+
+func newReplicaConnectionMock(replica *cluster.ClusterConfiguration) *ReplicaConnectionMock {
+	return &ReplicaConnectionMock{replica, NewProtobufClient("localhost:0", 0)}
+}
+
+func (self *ReplicaConnectionMock) Connect() {}
+
+func (self *ReplicaConnectionMock) MakeRequest(request *protocol.Request, responseStream chan *protocol.Response) error {
+	if *request.Type == protocol.Request_HEARTBEAT {
+		go func() {
+			responseStream <- &protocol.Response{Type: &heartbeatResponse, RequestId: request.Id}
+		}()
+		return nil
+	}
+
+	id := atomic.AddUint32(&self.client.lastRequestId, 1)
+	window := newResponseWindow()
+	self.client.requestBufferLock.Lock()
+	self.client.requestBuffer[id] = newRunningRequest(responseStream, window.give)
+	self.client.requestBufferLock.Unlock()
+
+	responses := make(chan *protocol.Response)
+	shard := self.replica.GetShard(request.GetShardId())
+	if shard == nil || !shard.IsLocal() {
+		message := fmt.Sprintf("Shard %d isn't on this server", request.GetShardId())
+		go func() {
+			responses <- &protocol.Response{Type: &endStreamResponse, ErrorMessage: &message}
+		}()
+	} else {
+		go shard.HandleRepairRequest(request, responses)
+	}
+	go func() {
+		for {
+			response := <-responses
+			response.RequestId = &id
+			if *response.Type != endStreamResponse && !window.take(nil, time.Second) {
+				panic("the client didn't give credit for the repair responses")
+			}
+			self.client.sendResponse(response)
+			if *response.Type == endStreamResponse {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (self *AntiEntropySuite) TestRepairCopiesTheMissingPointsFromTheReplicas(c *C) {
+	// the replica has the points of the first shard and doesn't have the
+	// second one. It can't repair its copy since its other replica
+	// doesn't have the shard.
+	replicaDb := &ShardDbMock{
+		series: stringToSeries(`{
+			"name": "foo",
+			"fields": ["value"],
+			"points": [
+				{"values": [{"int64_value": 1}], "timestamp": 2, "sequence_number": 1},
+				{"values": [{"int64_value": 2}], "timestamp": 1, "sequence_number": 1}
+			]
+		}`, c),
+		hashes: []*cluster.SeriesHash{cluster.NewSeriesHash("foo", []*cluster.BucketHash{{Start: 0, Values: 2, Hash: 1}})},
+	}
+	empty := cluster.NewClusterConfiguration(&configuration.Configuration{}, &WALMock{}, nil, nil)
+	replica := cluster.NewClusterConfiguration(&configuration.Configuration{}, &WALMock{}, &ShardStoreMock{db: replicaDb}, func(string) cluster.ServerConnection {
+		return newReplicaConnectionMock(empty)
+	})
+	replica.LocalRaftName = "local"
+	replica.AddPotentialServer(&cluster.ClusterServer{RaftName: "local"})
+	replica.AddPotentialServer(&cluster.ClusterServer{
+		RaftName:                 "other",
+		ProtobufConnectionString: "localhost:0",
+		HeartbeatInterval:        time.Second,
+	})
+	defer stopServers(replica.Servers())
+	addShard(c, replica, 0, 1, 2)
+
+	store := &ShardStoreMock{db: &ShardDbMock{series: &protocol.Series{}}}
+	config := cluster.NewClusterConfiguration(&configuration.Configuration{}, &WALMock{}, store, func(string) cluster.ServerConnection {
+		return newReplicaConnectionMock(replica)
+	})
+	config.LocalRaftName = "local"
+	config.AddPotentialServer(&cluster.ClusterServer{RaftName: "local"})
+	config.AddPotentialServer(&cluster.ClusterServer{RaftName: "replica", ProtobufConnectionString: "localhost:0", HeartbeatInterval: time.Second})
+	defer stopServers(config.Servers())
+	shard := addShard(c, config, 0, 1, 2)
+	missingShard := addShard(c, config, 1, 1, 2)
+
+	count, err := shard.Repair("db1")
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 2)
+	c.Assert(store.writes, HasLen, 1)
+	c.Assert(store.writes[0].GetShardId(), Equals, shard.Id())
+	c.Assert(store.writes[0].Series.GetName(), Equals, "foo")
+	c.Assert(store.writes[0].Series.Points, HasLen, 2)
+
+	// the request waits until the replica repaired its copy
+	message := fmt.Sprintf("Shard %d isn't on this server", shard.Id())
+	c.Assert(shard.RequestRepair(2, "db1"), ErrorMatches, message)
+
+	message = fmt.Sprintf("Shard %d isn't on this server", missingShard.Id())
+	_, err = missingShard.Repair("db1")
+	c.Assert(err, ErrorMatches, message)
+	c.Assert(missingShard.RequestRepair(2, "db1"), ErrorMatches, message)
+}
+
+func (self *AntiEntropySuite) TestRepairReadsMoreResponsesThanItBuffers(c *C) {
+	// every bucket that differs is sent in its own response
+	buckets := []*cluster.BucketHash{}
+	for i := 0; i < 3*RESPONSE_WINDOW_SIZE; i++ {
+		buckets = append(buckets, &cluster.BucketHash{Start: int64(i), Values: 1, Hash: 1})
+	}
+	replicaDb := &ShardDbMock{
+		series: stringToSeries(`{
+			"name": "foo",
+			"fields": ["value"],
+			"points": [{"values": [{"int64_value": 1}], "timestamp": 1, "sequence_number": 1}]
+		}`, c),
+		hashes: []*cluster.SeriesHash{cluster.NewSeriesHash("foo", buckets)},
+	}
+	replica := cluster.NewClusterConfiguration(&configuration.Configuration{}, &WALMock{}, &ShardStoreMock{db: replicaDb}, nil)
+	replica.LocalRaftName = "local"
+	replica.AddPotentialServer(&cluster.ClusterServer{RaftName: "local"})
+	addShard(c, replica, 0, 1)
+
+	store := &ShardStoreMock{db: &ShardDbMock{series: &protocol.Series{}}}
+	config := cluster.NewClusterConfiguration(&configuration.Configuration{}, &WALMock{}, store, func(string) cluster.ServerConnection {
+		return newReplicaConnectionMock(replica)
+	})
+	config.LocalRaftName = "local"
+	config.AddPotentialServer(&cluster.ClusterServer{RaftName: "local"})
+	config.AddPotentialServer(&cluster.ClusterServer{RaftName: "replica", ProtobufConnectionString: "localhost:0", HeartbeatInterval: time.Second})
+	defer stopServers(config.Servers())
+	shard := addShard(c, config, 0, 1, 2)
+
+	count, err := shard.Repair("db1")
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 3*RESPONSE_WINDOW_SIZE)
+	c.Assert(store.writes, HasLen, 3*RESPONSE_WINDOW_SIZE)
+}
+
+func (self *AntiEntropySuite) TestRepairDoesntRestoreDeletedPoints(c *C) {
+	// the replica missed the delete of the point at 2
+	replicaDb := &ShardDbMock{
+		series: stringToSeries(`{
+			"name": "foo",
+			"fields": ["value"],
+			"points": [
+				{"values": [{"int64_value": 1}], "timestamp": 2, "sequence_number": 1},
+				{"values": [{"int64_value": 2}], "timestamp": 1, "sequence_number": 1}
+			]
+		}`, c),
+		hashes: []*cluster.SeriesHash{cluster.NewSeriesHash("foo", []*cluster.BucketHash{{Start: 0, Values: 2, Hash: 1}})},
+	}
+	replica := cluster.NewClusterConfiguration(&configuration.Configuration{}, &WALMock{}, &ShardStoreMock{db: replicaDb}, nil)
+	replica.LocalRaftName = "local"
+	replica.AddPotentialServer(&cluster.ClusterServer{RaftName: "local"})
+	addShard(c, replica, 0, 1)
+
+	localDb := &ShardDbMock{series: &protocol.Series{}, deletedRanges: []*cluster.DeletedRange{{StartTime: 2, EndTime: 3}}}
+	store := &ShardStoreMock{db: localDb}
+	config := cluster.NewClusterConfiguration(&configuration.Configuration{}, &WALMock{}, store, func(string) cluster.ServerConnection {
+		return newReplicaConnectionMock(replica)
+	})
+	config.LocalRaftName = "local"
+	config.AddPotentialServer(&cluster.ClusterServer{RaftName: "local"})
+	config.AddPotentialServer(&cluster.ClusterServer{RaftName: "replica", ProtobufConnectionString: "localhost:0", HeartbeatInterval: time.Second})
+	defer stopServers(config.Servers())
+	shard := addShard(c, config, 0, 1, 2)
+
+	count, err := shard.Repair("db1")
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 1)
+	c.Assert(store.writes, HasLen, 1)
+	c.Assert(store.writes[0].Series.Points, HasLen, 1)
+	c.Assert(store.writes[0].Series.Points[0].GetTimestamp(), Equals, int64(1))
+
+	// nothing is written if all the points were deleted
+	localDb.deletedRanges = []*cluster.DeletedRange{{StartTime: 0, EndTime: 2}}
+	count, err = shard.Repair("db1")
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 0)
+	c.Assert(store.writes, HasLen, 1)
+}
@@ -77,3 +77,82 @@ func (self *ClientServerSuite) TestServerExecutesReplayRequestIfWriteIsOutOfSequ
 func (self *ClientServerSuite) TestServerKillsOldHandlerWhenClientReconnects(c *C) {
 
 }
+
+func (self *ClientServerSuite) TestFullResponseBufferFailsTheRequest(c *C) {
+	protobufClient := NewProtobufClient("localhost:8091", 0)
+	responseStream := make(chan *protocol.Response, 1)
+	id := uint32(1)
+	protobufClient.requestBuffer[id] = newRunningRequest(responseStream, func(uint32) {})
+
+	// a server that doesn't wait for credit
+	query := protocol.Response_QUERY
+	for i := 0; i < RESPONSE_WINDOW_SIZE+10; i++ {
+		protobufClient.sendResponse(&protocol.Response{Type: &query, RequestId: &id})
+	}
+	c.Assert(protobufClient.requestBuffer, HasLen, 0)
+	for {
+		response := <-responseStream
+		if response.GetType() == protocol.Response_END_STREAM {
+			c.Assert(response.ErrorMessage, NotNil)
+			break
+		}
+	}
+}
+
+// Sends the responses of a remote shard to the client as fast as the
+// client gives credit for them, like the request handler does
+func sendRemoteShardResponses(c *C, client *ProtobufClient, id uint32, window *responseWindow, points int) {
+	query := protocol.Response_QUERY
+	for i := 0; i < points; i++ {
+		if !window.take(nil, 5*time.Second) {
+			c.Error("The client didn't give credit")
+			return
+		}
+		timestamp := int64(i)
+		series := &protocol.Series{Name: protocol.String("foo"), Fields: []string{"val"}, Points: []*protocol.Point{{Timestamp: &timestamp}}}
+		client.sendResponse(&protocol.Response{Type: &query, RequestId: &id, Series: series})
+	}
+	client.sendResponse(&protocol.Response{Type: &endStreamResponse, RequestId: &id})
+}
+
+func (self *ClientServerSuite) TestRemoteShardsAreReadWithSmallBuffers(c *C) {
+	protobufClient := NewProtobufClient("localhost:8091", 0)
+	points := 3 * RESPONSE_WINDOW_SIZE
+
+	// the shards are read one after the other, the second one sends its
+	// responses while the first one is read
+	streams := []chan *protocol.Response{}
+	for id := uint32(1); id <= 2; id++ {
+		responseStream := make(chan *protocol.Response, 1)
+		streams = append(streams, responseStream)
+		window := newResponseWindow()
+		protobufClient.requestBufferLock.Lock()
+		protobufClient.requestBuffer[id] = newRunningRequest(responseStream, window.give)
+		protobufClient.requestBufferLock.Unlock()
+		go sendRemoteShardResponses(c, protobufClient, id, window, points)
+	}
+
+	merger := NewShardResponseMerger(streams, false, true, nil)
+	count := 0
+	err := merger.Merge(func(*protocol.Series, *protocol.Point) bool {
+		count++
+		return true
+	}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 2*points)
+}
+
+func (self *ClientServerSuite) TestResponsesWaitForCredit(c *C) {
+	window := newResponseWindow()
+	for i := 0; i < RESPONSE_WINDOW_SIZE; i++ {
+		c.Assert(window.take(nil, time.Millisecond), Equals, true)
+	}
+	c.Assert(window.take(nil, 10*time.Millisecond), Equals, false)
+
+	window.give(1)
+	c.Assert(window.take(nil, time.Millisecond), Equals, true)
+
+	done := make(chan bool)
+	close(done)
+	c.Assert(window.take(done, time.Minute), Equals, false)
+}
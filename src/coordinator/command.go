@@ -3,7 +3,9 @@ package coordinator
 import (
 	"cluster"
 	log "code.google.com/p/log4go"
+	"fmt"
 	"github.com/goraft/raft"
+	"strings"
 	"time"
 )
 
@@ -21,8 +23,14 @@ func init() {
 		&CreateContinuousQueryCommand{},
 		&DeleteContinuousQueryCommand{},
 		&SetContinuousQueryTimestampCommand{},
+		&CreateIndexedColumnCommand{},
+		&DropIndexedColumnCommand{},
+		&SetWriteLimitCommand{},
 		&CreateShardsCommand{},
 		&DropShardCommand{},
+		&SetShardServersCommand{},
+		&RemoveServerCommand{},
+		&RestoreClusterConfigurationCommand{},
 	} {
 		internalRaftCommands[command.CommandName()] = command
 	}
@@ -84,6 +92,66 @@ func (c *DeleteContinuousQueryCommand) Apply(server raft.Server) (interface{}, e
 	return nil, err
 }
 
+type CreateIndexedColumnCommand struct {
+	Database string `json:"database"`
+	Series   string `json:"series"`
+	Column   string `json:"column"`
+}
+
+func NewCreateIndexedColumnCommand(database, series, column string) *CreateIndexedColumnCommand {
+	return &CreateIndexedColumnCommand{database, series, column}
+}
+
+func (c *CreateIndexedColumnCommand) CommandName() string {
+	return "create_indexed_column"
+}
+
+func (c *CreateIndexedColumnCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	err := config.CreateIndexedColumn(c.Database, c.Series, c.Column)
+	return nil, err
+}
+
+type DropIndexedColumnCommand struct {
+	Database string `json:"database"`
+	Series   string `json:"series"`
+	Column   string `json:"column"`
+}
+
+func NewDropIndexedColumnCommand(database, series, column string) *DropIndexedColumnCommand {
+	return &DropIndexedColumnCommand{database, series, column}
+}
+
+func (c *DropIndexedColumnCommand) CommandName() string {
+	return "drop_indexed_column"
+}
+
+func (c *DropIndexedColumnCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	err := config.DropIndexedColumn(c.Database, c.Series, c.Column)
+	return nil, err
+}
+
+type SetWriteLimitCommand struct {
+	Database string              `json:"database"`
+	User     string              `json:"user"`
+	Limit    *cluster.WriteLimit `json:"limit"`
+}
+
+func NewSetWriteLimitCommand(database, user string, limit *cluster.WriteLimit) *SetWriteLimitCommand {
+	return &SetWriteLimitCommand{database, user, limit}
+}
+
+func (c *SetWriteLimitCommand) CommandName() string {
+	return "set_write_limit"
+}
+
+func (c *SetWriteLimitCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	err := config.SetWriteLimit(c.Database, c.User, c.Limit)
+	return nil, err
+}
+
 type DropDatabaseCommand struct {
 	Name string `json:"name"`
 }
@@ -268,3 +336,74 @@ func (c *DropShardCommand) Apply(server raft.Server) (interface{}, error) {
 	err := config.DropShard(c.ShardId, c.ServerIds)
 	return nil, err
 }
+
+type SetShardServersCommand struct {
+	ShardId          uint32
+	ServerIds        []uint32
+	PendingServerIds []uint32
+}
+
+func NewSetShardServersCommand(id uint32, serverIds, pendingServerIds []uint32) *SetShardServersCommand {
+	return &SetShardServersCommand{ShardId: id, ServerIds: serverIds, PendingServerIds: pendingServerIds}
+}
+
+func (c *SetShardServersCommand) CommandName() string {
+	return "set_shard_servers"
+}
+
+func (c *SetShardServersCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	err := config.SetShardServers(c.ShardId, c.ServerIds, c.PendingServerIds)
+	return nil, err
+}
+
+type RemoveServerCommand struct {
+	ServerId uint32
+}
+
+func NewRemoveServerCommand(id uint32) *RemoveServerCommand {
+	return &RemoveServerCommand{ServerId: id}
+}
+
+func (c *RemoveServerCommand) CommandName() string {
+	return "remove_server"
+}
+
+func (c *RemoveServerCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	clusterServer := config.GetServerById(&c.ServerId)
+	if clusterServer == nil {
+		return nil, fmt.Errorf("Server %d doesn't exist", c.ServerId)
+	}
+	// the server is removed from the configuration even if raft doesn't
+	// know the peer, e.g. because it never joined or it's removed already
+	peerErr := server.RemovePeer(clusterServer.RaftName)
+	if peerErr != nil && strings.Contains(peerErr.Error(), "Peer not found") {
+		log.Warn("Server %d isn't a raft peer: %s", c.ServerId, peerErr)
+		peerErr = nil
+	}
+	if err := config.RemoveServer(c.ServerId); err != nil {
+		return nil, err
+	}
+	return nil, peerErr
+}
+
+type RestoreClusterConfigurationCommand struct {
+	Configuration []byte
+	ShardIds      []uint32
+	ServerId      uint32
+}
+
+func NewRestoreClusterConfigurationCommand(configuration []byte, shardIds []uint32, serverId uint32) *RestoreClusterConfigurationCommand {
+	return &RestoreClusterConfigurationCommand{Configuration: configuration, ShardIds: shardIds, ServerId: serverId}
+}
+
+func (c *RestoreClusterConfigurationCommand) CommandName() string {
+	return "restore_cluster_configuration"
+}
+
+func (c *RestoreClusterConfigurationCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	err := config.RestoreFromBackup(c.Configuration, c.ShardIds, c.ServerId)
+	return nil, err
+}
@@ -22,6 +22,9 @@ type CoordinatorImpl struct {
 	clusterConfiguration *cluster.ClusterConfiguration
 	raftServer           ClusterConsensus
 	config               *configuration.Configuration
+	runningQueries       *QueryRegistry
+	writeLimiter         *WriteLimiter
+	writeConsistency     cluster.WriteConsistency
 }
 
 const (
@@ -33,6 +36,9 @@ const (
 	HOST_ID_OFFSET = uint64(10000)
 
 	SHARDS_TO_QUERY_FOR_LIST_SERIES = 10
+
+	// queries that are run with this timeout are never timed out
+	NO_QUERY_TIMEOUT = time.Duration(-1)
 )
 
 var (
@@ -74,26 +80,51 @@ func NewCoordinatorImpl(config *configuration.Configuration, raftServer ClusterC
 		config:               config,
 		clusterConfiguration: clusterConfiguration,
 		raftServer:           raftServer,
+		runningQueries:       NewQueryRegistry(),
+		writeLimiter:         NewWriteLimiter(clusterConfiguration),
+	}
+
+	// the configuration refuses unknown write consistencies when it's loaded
+	if config.WriteConsistency != "" {
+		consistency, err := cluster.ParseWriteConsistency(config.WriteConsistency)
+		if err != nil {
+			panic(err)
+		}
+		coordinator.writeConsistency = consistency
 	}
 
 	return coordinator
 }
 
-func (self *CoordinatorImpl) RunQuery(user common.User, database string, queryString string, seriesWriter SeriesWriter) (err error) {
+func (self *CoordinatorImpl) RunQuery(user common.User, database string, queryString string, seriesWriter SeriesWriter, timeout time.Duration, cancelled <-chan bool) (err error) {
 	log.Debug("COORD: RunQuery: ", queryString)
 	// don't let a panic pass beyond RunQuery
 	defer recoverFunc(database, queryString)
 
+	common.InternalStats.Increment("coordinator.queries")
+	defer func() {
+		if err != nil {
+			common.InternalStats.Increment("coordinator.query_errors")
+		}
+	}()
+
 	q, err := parser.ParseQuery(queryString)
 	if err != nil {
 		return err
 	}
 
+	cancellation := common.NewQueryCancellation()
+	defer cancellation.Finish()
+	self.cancelQueryWhenDone(cancellation, self.queryTimeout(timeout), cancelled)
+	runningQuery := self.runningQueries.Register(user, database, queryString, cancellation)
+	defer self.runningQueries.Remove(runningQuery.Id)
+
 	for _, query := range q {
 		querySpec := parser.NewQuerySpec(user, database, query)
+		querySpec.SetCancellation(cancellation)
 
 		if query.DeleteQuery != nil {
-			if err := self.runDeleteQuery(querySpec, seriesWriter); err != nil {
+			if err := self.runDeleteQuery(querySpec, seriesWriter, runningQuery); err != nil {
 				return err
 			}
 			continue
@@ -106,9 +137,30 @@ func (self *CoordinatorImpl) RunQuery(user common.User, database string, querySt
 			continue
 		}
 
+		if query.KillQuery != nil {
+			if err := self.KillQuery(user, uint32(query.KillQuery.Id)); err != nil {
+				return err
+			}
+			continue
+		}
+
 		if query.IsListQuery() {
 			if query.IsListSeriesQuery() {
-				self.runListSeriesQuery(querySpec, seriesWriter)
+				self.runListSeriesQuery(querySpec, seriesWriter, runningQuery)
+			} else if query.IsListSeriesStatsQuery() {
+				stats, err := self.getDatabaseStats(querySpec, runningQuery)
+				if err != nil {
+					return err
+				}
+				for _, series := range databaseStatsSeries(stats) {
+					if err := seriesWriter.Write(series); err != nil {
+						return err
+					}
+				}
+			} else if query.IsListRunningQueriesQuery() {
+				if err := seriesWriter.Write(self.runningQueriesSeries(user)); err != nil {
+					return err
+				}
 			} else if query.IsListContinuousQueriesQuery() {
 				queries, err := self.ListContinuousQueries(user, database)
 				if err != nil {
@@ -124,7 +176,7 @@ func (self *CoordinatorImpl) RunQuery(user common.User, database string, querySt
 		}
 
 		if query.DropSeriesQuery != nil {
-			err := self.runDropSeriesQuery(querySpec, seriesWriter)
+			err := self.runDropSeriesQuery(querySpec, seriesWriter, runningQuery)
 			if err != nil {
 				return err
 			}
@@ -137,19 +189,98 @@ func (self *CoordinatorImpl) RunQuery(user common.User, database string, querySt
 			return self.CreateContinuousQuery(user, database, queryString)
 		}
 
-		return self.runQuery(query, user, database, seriesWriter)
+		if err := self.runQuerySpec(querySpec, seriesWriter, runningQuery); err != nil {
+			return err
+		}
+		return cancellation.Err()
 	}
 	seriesWriter.Close()
 	return nil
 }
 
-// This should only get run for SelectQuery types
-func (self *CoordinatorImpl) runQuery(query *parser.Query, user common.User, database string, seriesWriter SeriesWriter) error {
-	querySpec := parser.NewQuerySpec(user, database, query)
-	return self.runQuerySpec(querySpec, seriesWriter)
+// Returns the timeout of a query that asked for the given timeout. The
+// default timeout of the server can't be exceeded.
+func (self *CoordinatorImpl) queryTimeout(timeout time.Duration) time.Duration {
+	if timeout == NO_QUERY_TIMEOUT {
+		return 0
+	}
+	defaultTimeout := self.config.QueryTimeout.Duration
+	if timeout <= 0 || (defaultTimeout > 0 && defaultTimeout < timeout) {
+		return defaultTimeout
+	}
+	return timeout
+}
+
+// Cancels the query once the timeout passes or cancelled is closed,
+// unless the query finishes first
+func (self *CoordinatorImpl) cancelQueryWhenDone(cancellation *common.QueryCancellation, timeout time.Duration, cancelled <-chan bool) {
+	if timeout <= 0 && cancelled == nil {
+		return
+	}
+
+	go func() {
+		var deadline <-chan time.Time
+		if timeout > 0 {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+
+		select {
+		case <-deadline:
+			common.InternalStats.Increment("coordinator.query_timeouts")
+			cancellation.Cancel(common.NewQueryError(common.QueryTimedOut, "Query timed out after %s", timeout))
+		case <-cancelled:
+			common.InternalStats.Increment("coordinator.query_cancellations")
+			cancellation.Cancel(common.NewQueryError(common.QueryCancelled, "Query was cancelled"))
+		case <-cancellation.Done():
+		}
+	}()
+}
+
+func (self *CoordinatorImpl) ListRunningQueries(user common.User) []*RunningQuery {
+	return self.runningQueries.List(user)
+}
+
+func (self *CoordinatorImpl) KillQuery(user common.User, id uint32) error {
+	return self.runningQueries.Kill(user, id)
+}
+
+func (self *CoordinatorImpl) GetHandoffStates(user common.User) ([]*cluster.HandoffState, error) {
+	if !user.IsClusterAdmin() {
+		return nil, common.NewAuthorizationError("Insufficient permissions to list the handoff queues")
+	}
+	return self.clusterConfiguration.HandoffStates(), nil
+}
+
+func (self *CoordinatorImpl) runningQueriesSeries(user common.User) *protocol.Series {
+	points := []*protocol.Point{}
+	for _, query := range self.ListRunningQueries(user) {
+		id := int64(query.Id)
+		pointsProcessed := query.PointsProcessed()
+		timestamp := common.TimeToMicroseconds(query.StartTime)
+		sequenceNumber := uint64(1)
+		points = append(points, &protocol.Point{
+			Values: []*protocol.FieldValue{
+				&protocol.FieldValue{Int64Value: &id},
+				&protocol.FieldValue{StringValue: protocol.String(query.Query)},
+				&protocol.FieldValue{StringValue: protocol.String(query.Database)},
+				&protocol.FieldValue{StringValue: protocol.String(query.UserName())},
+				&protocol.FieldValue{StringValue: protocol.String(query.shardsString())},
+				&protocol.FieldValue{Int64Value: &pointsProcessed},
+			},
+			Timestamp:      &timestamp,
+			SequenceNumber: &sequenceNumber,
+		})
+	}
+	return &protocol.Series{
+		Name:   protocol.String("queries"),
+		Fields: []string{"id", "query", "database", "user", "shards", "points_processed"},
+		Points: points,
+	}
 }
 
-func (self *CoordinatorImpl) runListSeriesQuery(querySpec *parser.QuerySpec, seriesWriter SeriesWriter) error {
+func (self *CoordinatorImpl) runListSeriesQuery(querySpec *parser.QuerySpec, seriesWriter SeriesWriter, runningQuery *RunningQuery) error {
 	shortTermShards := self.clusterConfiguration.GetShortTermShards()
 	if len(shortTermShards) > SHARDS_TO_QUERY_FOR_LIST_SERIES {
 		shortTermShards = shortTermShards[:SHARDS_TO_QUERY_FOR_LIST_SERIES]
@@ -162,11 +293,13 @@ func (self *CoordinatorImpl) runListSeriesQuery(querySpec *parser.QuerySpec, ser
 
 	responses := make([]chan *protocol.Response, 0)
 	for _, shard := range shortTermShards {
+		runningQuery.addShard(shard.Id())
 		responseChan := make(chan *protocol.Response, self.config.QueryShardBufferSize)
 		go shard.Query(querySpec, responseChan)
 		responses = append(responses, responseChan)
 	}
 	for _, shard := range longTermShards {
+		runningQuery.addShard(shard.Id())
 		responseChan := make(chan *protocol.Response, self.config.QueryShardBufferSize)
 		go shard.Query(querySpec, responseChan)
 		responses = append(responses, responseChan)
@@ -193,16 +326,105 @@ func (self *CoordinatorImpl) runListSeriesQuery(querySpec *parser.QuerySpec, ser
 	return nil
 }
 
-func (self *CoordinatorImpl) runDeleteQuery(querySpec *parser.QuerySpec, seriesWriter SeriesWriter) error {
+// Returns the stats of the series of the database that the user can
+// read, merged from all the shards
+func (self *CoordinatorImpl) GetDatabaseStats(user common.User, db string) (*cluster.DatabaseStats, error) {
+	query := &parser.Query{QueryString: "list series stats", ListQuery: &parser.ListQuery{Type: parser.SeriesStats}}
+	cancellation := common.NewQueryCancellation()
+	defer cancellation.Finish()
+	self.cancelQueryWhenDone(cancellation, self.queryTimeout(0), nil)
+	runningQuery := self.runningQueries.Register(user, db, query.QueryString, cancellation)
+	defer self.runningQueries.Remove(runningQuery.Id)
+
+	querySpec := parser.NewQuerySpec(user, db, query)
+	querySpec.SetCancellation(cancellation)
+	return self.getDatabaseStats(querySpec, runningQuery)
+}
+
+func (self *CoordinatorImpl) getDatabaseStats(querySpec *parser.QuerySpec, runningQuery *RunningQuery) (*cluster.DatabaseStats, error) {
+	shards := self.clusterConfiguration.GetAllShards()
+	responses := make([]chan *protocol.Response, 0, len(shards))
+	for _, shard := range shards {
+		runningQuery.addShard(shard.Id())
+		responseChan := make(chan *protocol.Response, self.config.QueryShardBufferSize)
+		go shard.Query(querySpec, responseChan)
+		responses = append(responses, responseChan)
+	}
+
+	// every shard has to be read until the end, so the errors are only
+	// returned once all the shards are done
+	var shardError error
+	stats := cluster.NewDatabaseStats(querySpec.Database())
+	for _, responseChan := range responses {
+		for {
+			response := <-responseChan
+			if *response.Type == endStreamResponse || *response.Type == accessDeniedResponse {
+				if response.ErrorMessage != nil && shardError == nil {
+					shardError = fmt.Errorf("%s", *response.ErrorMessage)
+				}
+				break
+			}
+			if response.Series == nil {
+				continue
+			}
+			runningQuery.addPoints(int64(len(response.Series.Points)))
+			for _, point := range response.Series.Points {
+				stats.Add(cluster.NewSeriesStatsFromPoint(*response.Series.Name, point))
+			}
+		}
+	}
+
+	if err := querySpec.Cancellation().Err(); err != nil {
+		return nil, err
+	}
+	if shardError != nil {
+		return nil, shardError
+	}
+	return stats, nil
+}
+
+// Returns the series stats and the database stats series that list
+// series stats returns
+func databaseStatsSeries(stats *cluster.DatabaseStats) []*protocol.Series {
+	seriesStats := &protocol.Series{
+		Name:   protocol.String("series_stats"),
+		Fields: append([]string{"series"}, cluster.SeriesStatsColumns...),
+		Points: []*protocol.Point{},
+	}
+	for _, series := range stats.Series {
+		point := series.ToPoint()
+		point.Values = append([]*protocol.FieldValue{&protocol.FieldValue{StringValue: protocol.String(series.Name)}}, point.Values...)
+		seriesStats.Points = append(seriesStats.Points, point)
+	}
+
+	// the column count of the database is the number of series
+	total := &cluster.SeriesStats{
+		Points:         stats.Points,
+		Columns:        int64(len(stats.Series)),
+		FirstTimestamp: stats.FirstTimestamp,
+		LastTimestamp:  stats.LastTimestamp,
+		Bytes:          stats.Bytes,
+	}
+	point := total.ToPoint()
+	point.Values = append([]*protocol.FieldValue{&protocol.FieldValue{StringValue: protocol.String(stats.Name)}}, point.Values...)
+	databaseStats := &protocol.Series{
+		Name:   protocol.String("database_stats"),
+		Fields: []string{"database", "points", "series", "first_timestamp", "last_timestamp", "bytes"},
+		Points: []*protocol.Point{point},
+	}
+	return []*protocol.Series{seriesStats, databaseStats}
+}
+
+func (self *CoordinatorImpl) runDeleteQuery(querySpec *parser.QuerySpec, seriesWriter SeriesWriter, runningQuery *RunningQuery) error {
 	db := querySpec.Database()
 	if !querySpec.User().IsDbAdmin(db) {
 		return common.NewAuthorizationError("Insufficient permission to write to %s", db)
 	}
 	querySpec.RunAgainstAllServersInShard = true
-	return self.runQuerySpec(querySpec, seriesWriter)
+	return self.runQuerySpec(querySpec, seriesWriter, runningQuery)
 }
 
-func (self *CoordinatorImpl) runDropSeriesQuery(querySpec *parser.QuerySpec, seriesWriter SeriesWriter) error {
+func (self *CoordinatorImpl) runDropSeriesQuery(querySpec *parser.QuerySpec, seriesWriter SeriesWriter, runningQuery *RunningQuery) error {
 	user := querySpec.User()
 	db := querySpec.Database()
 	series := querySpec.Query().DropSeriesQuery.GetTableName()
@@ -210,25 +432,36 @@ func (self *CoordinatorImpl) runDropSeriesQuery(querySpec *parser.QuerySpec, ser
 		return common.NewAuthorizationError("Insufficient permissions to drop series")
 	}
 	querySpec.RunAgainstAllServersInShard = true
-	return self.runQuerySpec(querySpec, seriesWriter)
+	return self.runQuerySpec(querySpec, seriesWriter, runningQuery)
 }
 
-func (self *CoordinatorImpl) runQuerySpec(querySpec *parser.QuerySpec, seriesWriter SeriesWriter) error {
+func (self *CoordinatorImpl) runQuerySpec(querySpec *parser.QuerySpec, seriesWriter SeriesWriter, runningQuery *RunningQuery) error {
 	shards := self.clusterConfiguration.GetShards(querySpec)
 
+	// the shards are stopped once the query has all the points it needs
+	shardsCancellation := querySpec.Cancellation().Child()
+	defer shardsCancellation.Finish()
+	querySpec.SetCancellation(shardsCancellation)
+
 	shouldAggregateLocally := true
 	var processor cluster.QueryProcessor
 	var responseChan chan *protocol.Response
 	var seriesClosed chan bool
 	for _, s := range shards {
 		// If the aggregation is done at the shard level, we don't need to
-		// do it here at the coordinator level.
+		// do it here at the coordinator level. If any shard can't do it,
+		// none of them does, so the coordinator gets the same kind of
+		// response from all of them.
 		if !s.ShouldAggregateLocally(querySpec) {
 			seriesClosed = make(chan bool)
 			shouldAggregateLocally = false
+			querySpec.AggregateInCoordinator = true
 			responseChan = make(chan *protocol.Response)
 
-			if querySpec.SelectQuery() != nil {
+			if querySpec.SelectQuery() != nil && engine.CanAggregatePartially(querySpec.SelectQuery()) {
+				// the shards send the partial aggregates instead of the points
+				processor = engine.NewMergingQueryEngine(querySpec.SelectQuery(), responseChan)
+			} else if querySpec.SelectQuery() != nil {
 				processor = engine.NewQueryEngine(querySpec.SelectQuery(), responseChan)
 			} else {
 				bufferSize := 100
@@ -253,44 +486,47 @@ func (self *CoordinatorImpl) runQuerySpec(querySpec *parser.QuerySpec, seriesWri
 
 	responses := make([]chan *protocol.Response, 0)
 	for _, shard := range shards {
+		runningQuery.addShard(shard.Id())
 		responseChan := make(chan *protocol.Response, self.config.QueryShardBufferSize)
 		go shard.Query(querySpec, responseChan)
 		responses = append(responses, responseChan)
 	}
 
-	for i, responseChan := range responses {
-		log.Debug("READING: shard: ", shards[i].String())
-		for {
-			response := <-responseChan
-			log.Debug("GOT RESPONSE: ", response.Type, response.Series)
-			if *response.Type == endStreamResponse || *response.Type == accessDeniedResponse {
-				break
-			}
-			if shouldAggregateLocally {
-				log.Debug("WRITING: ", len(response.Series.Points))
-				seriesWriter.Write(response.Series)
-				log.Debug("WRITING (done)")
-				continue
-			}
-
-			// if the data wasn't aggregated at the shard level, aggregate
-			// the data here
-			log.Debug("YIELDING: ", len(response.Series.Points))
-			if response.Series != nil {
-				for _, p := range response.Series.Points {
-					processor.YieldPoint(response.Series.Name, response.Series.Fields, p)
-				}
-			}
+	// the streams of the shards are only time ordered if every shard
+	// yields a single series
+	timeOrdered := querySpec.SelectQuery() != nil && !querySpec.IsRegex() && !querySpec.ReadsFromMultipleSeries()
+	merger := NewShardResponseMerger(responses, timeOrdered, querySpec.IsAscending(), shardsCancellation)
+
+	if shouldAggregateLocally {
+		// the shards apply the limit of the query on their own, but it
+		// has to be applied to the merged points as well
+		limit := 0
+		if querySpec.SelectQuery() != nil && !querySpec.HasAggregates() {
+			limit = querySpec.SelectQuery().Limit
 		}
-		log.Debug("DONE: shard: ", shards[i].String())
-	}
-	if !shouldAggregateLocally {
-		processor.Close()
-		<-seriesClosed
-		return nil
+		writer := newMergedSeriesWriter(seriesWriter, limit, timeOrdered)
+		err := merger.Merge(func(series *protocol.Series, point *protocol.Point) bool {
+			runningQuery.addPoints(1)
+			return !querySpec.IsCancelled() && writer.yield(series, point)
+		}, writer.yieldEmpty)
+		writer.flush()
+		seriesWriter.Close()
+		return err
 	}
-	seriesWriter.Close()
-	return nil
+
+	// if the data wasn't aggregated at the shard level, aggregate
+	// the data here
+	err := merger.Merge(func(series *protocol.Series, point *protocol.Point) bool {
+		runningQuery.addPoints(1)
+		if querySpec.IsCancelled() {
+			return false
+		}
+		// the limit of one series doesn't stop the other ones
+		return processor.YieldPoint(series.Name, series.Fields, point) || !timeOrdered
+	}, nil)
+	processor.Close()
+	<-seriesClosed
+	return err
 }
 
 func recoverFunc(database, query string) {
@@ -314,17 +550,57 @@ func (self *CoordinatorImpl) ForceCompaction(user common.User) error {
 }
 
 func (self *CoordinatorImpl) WriteSeriesData(user common.User, db string, series *protocol.Series) error {
+	return self.NewWriteRequest(user, db, "")(series)
+}
+
+func (self *CoordinatorImpl) NewWriteRequest(user common.User, db string, consistencyName string) func(*protocol.Series) error {
+	admitted := false
+	return func(series *protocol.Series) error {
+		return self.writeSeriesData(user, db, series, consistencyName, &admitted)
+	}
+}
+
+// Writes a series of a write request. The request has to get through the
+// write limits with its first series, which sets admitted. The points of
+// the later series are charged to the limits without refusing them.
+func (self *CoordinatorImpl) writeSeriesData(user common.User, db string, series *protocol.Series, consistencyName string, admitted *bool) error {
 	if !user.HasWriteAccess(db) {
 		return common.NewAuthorizationError("Insufficient permissions to write to %s", db)
 	}
 	if len(series.Points) == 0 {
 		return fmt.Errorf("Can't write series with zero points.")
 	}
+	consistency := self.writeConsistency
+	if consistencyName != "" {
+		var err error
+		if consistency, err = cluster.ParseWriteConsistency(consistencyName); err != nil {
+			return err
+		}
+	}
 
-	err := self.CommitSeriesData(db, series)
-	if err != nil {
+	// cluster admins are only limited by the limit of the database
+	username := ""
+	if !user.IsClusterAdmin() {
+		username = user.GetName()
+	}
+	if *admitted {
+		self.writeLimiter.Charge(db, username, len(series.Points))
+	} else if err := self.writeLimiter.Take(db, username, len(series.Points)); err != nil {
 		return err
 	}
+	*admitted = true
+
+	common.InternalStats.Increment("coordinator.writes")
+	common.InternalStats.Add("coordinator.points_written", int64(len(series.Points)))
+
+	err := self.commitSeriesData(db, series, consistency)
+	if err != nil {
+		common.InternalStats.Increment("coordinator.write_errors")
+		// the points of a partial write still get to all the replicas
+		if _, ok := err.(*common.PartialWriteError); !ok {
+			return err
+		}
+	}
 
 	self.ProcessContinuousQueries(db, series)
 
@@ -422,6 +698,13 @@ func (self *CoordinatorImpl) InterpolateValuesAndCommit(db string, series *proto
 }
 
 func (self *CoordinatorImpl) CommitSeriesData(db string, series *protocol.Series) error {
+	return self.commitSeriesData(db, series, cluster.WriteConsistencyAny)
+}
+
+func (self *CoordinatorImpl) commitSeriesData(db string, series *protocol.Series, consistency cluster.WriteConsistency) error {
+	// the points of the other shards are written even if the write to a
+	// shard fails, the first error is returned
+	var writeErr error
 	lastTime := int64(0)
 	lastPointIndex := 0
 	now := common.CurrentTime()
@@ -440,7 +723,9 @@ func (self *CoordinatorImpl) CommitSeriesData(db string, series *protocol.Series
 			} else if shardToWrite.Id() != shard.Id() {
 				newIndex := i + 1
 				newSeries := &protocol.Series{Name: series.Name, Fields: series.Fields, Points: series.Points[lastPointIndex:newIndex]}
-				self.write(db, newSeries, shardToWrite)
+				if err := self.write(db, newSeries, shardToWrite, consistency); err != nil && writeErr == nil {
+					writeErr = err
+				}
 				lastPointIndex = newIndex
 				shardToWrite = shard
 			}
@@ -455,21 +740,22 @@ func (self *CoordinatorImpl) CommitSeriesData(db string, series *protocol.Series
 			shardToWrite, _ = self.clusterConfiguration.GetShardToWriteToBySeriesAndTime(db, *series.Name, *series.Points[0].Timestamp)
 		}
 
-		err := self.write(db, series, shardToWrite)
+		err := self.write(db, series, shardToWrite, consistency)
 
 		if err != nil {
 			log.Error("COORD error writing: ", err)
+			if writeErr == nil {
+				writeErr = err
+			}
 		}
-
-		return err
 	}
 
-	return nil
+	return writeErr
 }
 
-func (self *CoordinatorImpl) write(db string, series *protocol.Series, shard cluster.Shard) error {
+func (self *CoordinatorImpl) write(db string, series *protocol.Series, shard cluster.Shard, consistency cluster.WriteConsistency) error {
 	request := &protocol.Request{Type: &write, Database: &db, Series: series}
-	return shard.Write(request)
+	return shard.WriteWithConsistency(request, consistency, self.config.WriteConsistencyTimeout.Duration)
 }
 
 func (self *CoordinatorImpl) CreateContinuousQuery(user common.User, db string, query string) error {
@@ -496,6 +782,69 @@ func (self *CoordinatorImpl) DeleteContinuousQuery(user common.User, db string,
 	return nil
 }
 
+func (self *CoordinatorImpl) CreateIndexedColumn(user common.User, db, series, column string) error {
+	if !user.IsClusterAdmin() && !user.IsDbAdmin(db) {
+		return common.NewAuthorizationError("Insufficient permissions to create an index")
+	}
+
+	if !common.VALID_TABLE_NAMES.MatchString(series) {
+		return fmt.Errorf("%s isn't a valid series name", series)
+	}
+	if column == "" || column == "time" || column == "sequence_number" {
+		return fmt.Errorf("%s can't be indexed", column)
+	}
+
+	return self.raftServer.CreateIndexedColumn(db, series, column)
+}
+
+func (self *CoordinatorImpl) DropIndexedColumn(user common.User, db, series, column string) error {
+	if !user.IsClusterAdmin() && !user.IsDbAdmin(db) {
+		return common.NewAuthorizationError("Insufficient permissions to drop an index")
+	}
+
+	return self.raftServer.DropIndexedColumn(db, series, column)
+}
+
+func (self *CoordinatorImpl) ListIndexedColumns(user common.User, db string) (map[string][]string, error) {
+	if !user.IsClusterAdmin() && !user.IsDbAdmin(db) {
+		return nil, common.NewAuthorizationError("Insufficient permissions to list indexes")
+	}
+
+	return self.clusterConfiguration.GetIndexedColumnsForDatabase(db), nil
+}
+
+// Sets the write limit of the database, or of the db user if username
+// isn't empty. A nil limit removes the limit.
+func (self *CoordinatorImpl) SetWriteLimit(user common.User, db, username string, limit *cluster.WriteLimit) error {
+	if !user.IsClusterAdmin() {
+		return common.NewAuthorizationError("Insufficient permissions to set write limits")
+	}
+
+	if !self.clusterConfiguration.DatabaseExists(db) {
+		return fmt.Errorf("Database %s doesn't exist", db)
+	}
+	if username != "" && self.clusterConfiguration.GetDbUser(db, username) == nil {
+		return fmt.Errorf("User %s doesn't exist", username)
+	}
+	if limit != nil && (limit.PointsPerSecond < 0 || limit.RequestsPerSecond < 0) {
+		return fmt.Errorf("Write limits can't be negative")
+	}
+
+	return self.raftServer.SetWriteLimit(db, username, limit)
+}
+
+func (self *CoordinatorImpl) GetWriteLimit(user common.User, db, username string) (*cluster.WriteLimit, error) {
+	if !user.IsClusterAdmin() {
+		return nil, common.NewAuthorizationError("Insufficient permissions to get write limits")
+	}
+
+	limit := self.clusterConfiguration.GetWriteLimit(db, username)
+	if limit == nil {
+		limit = &cluster.WriteLimit{}
+	}
+	return limit, nil
+}
+
 func (self *CoordinatorImpl) ListContinuousQueries(user common.User, db string) ([]*protocol.Series, error) {
 	if !user.IsClusterAdmin() && !user.IsDbAdmin(db) {
 		return nil, common.NewAuthorizationError("Insufficient permissions to list continuous queries")
@@ -51,6 +51,10 @@ func (self *WALMock) AssignSequenceNumbersAndLog(request *protocol.Request, shar
 	return uint32(1), nil
 }
 
+func (self *WALMock) RemoveServer(serverId uint32) error {
+	return nil
+}
+
 func stringToSeries(seriesString string, c *C) *protocol.Series {
 	series := &protocol.Series{}
 	err := json.Unmarshal([]byte(seriesString), &series)
@@ -128,6 +132,40 @@ func (self *CoordinatorSuite) TestCanCreateCoordinatorWithNoSeed(c *C) {
 	defer clean(server)
 }
 
+func (self *CoordinatorSuite) TestQueryTimeouts(c *C) {
+	config := &configuration.Configuration{}
+	coordinator := NewCoordinatorImpl(config, nil, nil)
+	c.Assert(coordinator.queryTimeout(0), Equals, time.Duration(0))
+	c.Assert(coordinator.queryTimeout(time.Hour), Equals, time.Hour)
+
+	// the default timeout of the server can't be exceeded
+	config.QueryTimeout.Duration = time.Minute
+	c.Assert(coordinator.queryTimeout(0), Equals, time.Minute)
+	c.Assert(coordinator.queryTimeout(time.Second), Equals, time.Second)
+	c.Assert(coordinator.queryTimeout(time.Hour), Equals, time.Minute)
+	c.Assert(coordinator.queryTimeout(NO_QUERY_TIMEOUT), Equals, time.Duration(0))
+
+	cancellation := NewQueryCancellation()
+	coordinator.cancelQueryWhenDone(cancellation, 10*time.Millisecond, nil)
+	<-cancellation.Done()
+	c.Assert(cancellation.Err().(*QueryError).ErrorCode, Equals, QueryTimedOut)
+
+	cancelled := make(chan bool)
+	cancellation = NewQueryCancellation()
+	coordinator.cancelQueryWhenDone(cancellation, time.Minute, cancelled)
+	close(cancelled)
+	<-cancellation.Done()
+	c.Assert(cancellation.Err().(*QueryError).ErrorCode, Equals, QueryCancelled)
+
+	// finished queries aren't cancelled
+	cancelled = make(chan bool)
+	cancellation = NewQueryCancellation()
+	coordinator.cancelQueryWhenDone(cancellation, time.Minute, cancelled)
+	cancellation.Finish()
+	close(cancelled)
+	c.Assert(cancellation.IsCancelled(), Equals, false)
+}
+
 func (self *CoordinatorSuite) TestCanRecover(c *C) {
 	server := startAndVerifyCluster(1, c)[0]
 	defer clean(server)
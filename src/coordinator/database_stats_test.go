@@ -0,0 +1,54 @@
+package coordinator
+
+import (
+	"cluster"
+	. "launchpad.net/gocheck"
+)
+
+type DatabaseStatsSuite struct{}
+
+var _ = Suite(&DatabaseStatsSuite{})
+
+func (self *DatabaseStatsSuite) TestMergeStatsOfShards(c *C) {
+	stats := cluster.NewDatabaseStats("db1")
+	stats.Add(&cluster.SeriesStats{Name: "foo", Points: 10, Columns: 2, FirstTimestamp: 5, LastTimestamp: 20, Bytes: 100})
+	stats.Add(&cluster.SeriesStats{Name: "bar", Columns: 3, Bytes: 10})
+	stats.Add(&cluster.SeriesStats{Name: "foo", Points: 5, Columns: 3, FirstTimestamp: 1, LastTimestamp: 4, Bytes: 50})
+	stats.Add(&cluster.SeriesStats{Name: "bar", Points: 1, Columns: 1, FirstTimestamp: 30, LastTimestamp: 30, Bytes: 10})
+
+	c.Assert(stats.Series, HasLen, 2)
+	c.Assert(*stats.Series[0], Equals, cluster.SeriesStats{Name: "bar", Points: 1, Columns: 3, FirstTimestamp: 30, LastTimestamp: 30, Bytes: 20})
+	c.Assert(*stats.Series[1], Equals, cluster.SeriesStats{Name: "foo", Points: 15, Columns: 3, FirstTimestamp: 1, LastTimestamp: 20, Bytes: 150})
+	c.Assert(stats.Points, Equals, int64(16))
+	c.Assert(stats.Bytes, Equals, int64(170))
+	c.Assert(stats.FirstTimestamp, Equals, int64(1))
+	c.Assert(stats.LastTimestamp, Equals, int64(30))
+
+	// the stats the shards send can be read back
+	empty := &cluster.SeriesStats{Name: "baz", Columns: 1}
+	c.Assert(*cluster.NewSeriesStatsFromPoint("baz", empty.ToPoint()), Equals, *empty)
+	c.Assert(*cluster.NewSeriesStatsFromPoint("foo", stats.Series[1].ToPoint()), Equals, *stats.Series[1])
+}
+
+func (self *DatabaseStatsSuite) TestDatabaseStatsSeries(c *C) {
+	stats := cluster.NewDatabaseStats("db1")
+	stats.Add(&cluster.SeriesStats{Name: "foo", Points: 10, Columns: 2, FirstTimestamp: 5, LastTimestamp: 20, Bytes: 100})
+	stats.Add(&cluster.SeriesStats{Name: "bar", Columns: 1, Bytes: 10})
+
+	series := databaseStatsSeries(stats)
+	c.Assert(series, HasLen, 2)
+	c.Assert(*series[0].Name, Equals, "series_stats")
+	c.Assert(series[0].Fields, DeepEquals, []string{"series", "points", "columns", "first_timestamp", "last_timestamp", "bytes"})
+	c.Assert(series[0].Points, HasLen, 2)
+	c.Assert(series[0].Points[0].Values[0].GetStringValue(), Equals, "bar")
+	c.Assert(series[0].Points[0].Values[3].GetIsNull(), Equals, true)
+	c.Assert(series[0].Points[1].Values[1].GetInt64Value(), Equals, int64(10))
+
+	c.Assert(*series[1].Name, Equals, "database_stats")
+	c.Assert(series[1].Points, HasLen, 1)
+	values := series[1].Points[0].Values
+	c.Assert(values[0].GetStringValue(), Equals, "db1")
+	c.Assert(values[1].GetInt64Value(), Equals, int64(10))
+	c.Assert(values[2].GetInt64Value(), Equals, int64(2))
+	c.Assert(values[5].GetInt64Value(), Equals, int64(110))
+}
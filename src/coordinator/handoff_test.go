@@ -0,0 +1,174 @@
+package coordinator
+
+import (
+	"cluster"
+	"errors"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"os"
+	"path"
+	"protocol"
+	"time"
+)
+
+type HandoffSuite struct{}
+
+var _ = Suite(&HandoffSuite{})
+
+// Has the requests that weren't committed before the restart
+type BacklogWALMock struct {
+	CommitsWALMock
+	requests []*protocol.Request
+}
+
+func (self *BacklogWALMock) RecoverServerFromLastCommit(serverId uint32, shardIds []uint32, yield func(*protocol.Request, uint32) error) error {
+	return self.RecoverServerFromRequestNumber(0, shardIds, yield)
+}
+
+func (self *BacklogWALMock) RecoverServerFromRequestNumber(requestNumber uint32, shardIds []uint32, yield func(*protocol.Request, uint32) error) error {
+	for _, request := range self.requests {
+		if request.GetRequestNumber() < requestNumber {
+			continue
+		}
+		for _, shardId := range shardIds {
+			if shardId != request.GetShardId() {
+				continue
+			}
+			if err := yield(request, shardId); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func newBacklogWALMock(shardIds ...uint32) *BacklogWALMock {
+	wal := &BacklogWALMock{CommitsWALMock: CommitsWALMock{commits: make(chan uint32, 10)}}
+	for i, shardId := range shardIds {
+		shardId, requestNumber := shardId, uint32(i+1)
+		request := newWriteRequest()
+		request.ShardId = &shardId
+		request.RequestNumber = &requestNumber
+		wal.requests = append(wal.requests, request)
+	}
+	return wal
+}
+
+func (self *HandoffSuite) TestQueuedWritesAreDroppedAfterTheMaxAge(c *C) {
+	wal := &CommitsWALMock{commits: make(chan uint32, 10)}
+	writer := &WriterMock{err: errors.New("connection refused")}
+	buffer := cluster.NewWriteBuffer(writer, wal, 2, 10, 200*time.Millisecond, 0)
+	defer buffer.Stop()
+
+	for i := uint32(1); i <= 3; i++ {
+		shardId, requestNumber := i, i
+		request := newWriteRequest()
+		request.ShardId = &shardId
+		request.RequestNumber = &requestNumber
+		buffer.Write(request)
+	}
+	state := buffer.HandoffState()
+	c.Assert(state.ServerId, Equals, uint32(2))
+	c.Assert(state.QueuedRequests, Equals, 3)
+	c.Assert(state.OldestRequestNumber, Equals, uint32(1))
+	c.Assert(state.ShardsToRepair, HasLen, 0)
+
+	// the dropped requests are committed, so the wal can delete them
+	select {
+	case serverId := <-wal.commits:
+		c.Assert(serverId, Equals, uint32(2))
+	case <-time.After(5 * time.Second):
+		c.Fatal("the queued writes weren't dropped")
+	}
+	state = buffer.HandoffState()
+	c.Assert(state.QueuedRequests, Equals, 0)
+	c.Assert(state.DroppedRequests, Equals, int64(3))
+	c.Assert(state.LastError, Equals, "connection refused")
+	c.Assert(state.ShardsToRepair, DeepEquals, []uint32{1, 2, 3})
+
+	buffer.RepairedShard(2, time.Now())
+	c.Assert(buffer.ShardsToRepair(), DeepEquals, []uint32{1, 3})
+}
+
+func (self *HandoffSuite) TestShardsToRepairAreSaved(c *C) {
+	dir, err := ioutil.TempDir(os.TempDir(), "influxdb")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	repairsPath := path.Join(dir, "shards_to_repair.2")
+
+	wal := &CommitsWALMock{commits: make(chan uint32, 10)}
+	writer := &WriterMock{err: errors.New("connection refused")}
+	buffer := cluster.NewWriteBuffer(writer, wal, 2, 10, 200*time.Millisecond, 0)
+	defer buffer.Stop()
+	c.Assert(buffer.PersistShardsToRepair(repairsPath), IsNil)
+	beforeTheDrop := time.Now()
+	for i := uint32(1); i <= 2; i++ {
+		shardId, requestNumber := i, i
+		request := newWriteRequest()
+		request.ShardId = &shardId
+		request.RequestNumber = &requestNumber
+		buffer.Write(request)
+	}
+	select {
+	case <-wal.commits:
+	case <-time.After(5 * time.Second):
+		c.Fatal("the queued writes weren't dropped")
+	}
+
+	// the repair has to start after the writes were dropped
+	buffer.RepairedShard(2, beforeTheDrop)
+	c.Assert(buffer.ShardsToRepair(), DeepEquals, []uint32{1, 2})
+	buffer.RepairedShard(2, time.Now())
+	c.Assert(buffer.ShardsToRepair(), DeepEquals, []uint32{1})
+
+	restarted := cluster.NewWriteBuffer(writer, wal, 2, 10, 200*time.Millisecond, 0)
+	c.Assert(restarted.PersistShardsToRepair(repairsPath), IsNil)
+	c.Assert(restarted.ShardsToRepair(), DeepEquals, []uint32{1})
+
+	// the server was removed, its shards don't have to be repaired
+	restarted.Stop()
+	_, err = os.Stat(repairsPath)
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (self *HandoffSuite) TestRecoveredWritesAreQueued(c *C) {
+	wal := newBacklogWALMock(1, 2, 1, 3)
+	writer := &WriterMock{err: errors.New("connection refused")}
+	buffer := cluster.NewWriteBuffer(writer, wal, 2, 10, 200*time.Millisecond, 0)
+	defer buffer.Stop()
+
+	// the server doesn't have shard 3
+	done, err := buffer.RecoverFromLastCommit([]uint32{1, 2})
+	c.Assert(err, IsNil)
+	state := buffer.HandoffState()
+	c.Assert(state.QueuedRequests, Equals, 3)
+	c.Assert(state.OldestRequestNumber, Equals, uint32(1))
+	c.Assert(state.QueuedBytes > 0, Equals, true)
+
+	// the recovered writes are dropped after the max age too
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatal("the recovered writes weren't dropped")
+	}
+	state = buffer.HandoffState()
+	c.Assert(state.QueuedRequests, Equals, 0)
+	c.Assert(state.DroppedRequests, Equals, int64(3))
+	c.Assert(state.ShardsToRepair, DeepEquals, []uint32{1, 2})
+}
+
+func (self *HandoffSuite) TestRecoveredWritesAreReplayed(c *C) {
+	wal := newBacklogWALMock(1, 2, 1)
+	buffer := cluster.NewWriteBuffer(&WriterMock{}, wal, 2, 10, 0, 0)
+	defer buffer.Stop()
+
+	done, err := buffer.RecoverFromLastCommit([]uint32{1, 2})
+	c.Assert(err, IsNil)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatal("the recovered writes weren't replayed")
+	}
+	c.Assert(wal.commits, HasLen, 3)
+	c.Assert(buffer.HandoffState().QueuedRequests, Equals, 0)
+}
@@ -5,6 +5,7 @@ import (
 	"common"
 	"net"
 	"protocol"
+	"time"
 )
 
 type Coordinator interface {
@@ -17,6 +18,14 @@ type Coordinator interface {
 	//   4. The end of a time series is signaled by returning a series with no data points
 	//   5. TODO: Aggregation on the nodes
 	WriteSeriesData(user common.User, db string, series *protocol.Series) error
+	// Returns a function that writes the series of one write request,
+	// e.g. of an http request. Every write waits until the number of
+	// replicas that the consistency (any, one, quorum or all) requires
+	// wrote the points, an empty consistency uses the default of the
+	// server. The request counts once against the write limits: it's
+	// refused before its first series is written if a limit is exceeded,
+	// the points of the later series are charged without refusing them.
+	NewWriteRequest(user common.User, db string, consistency string) func(*protocol.Series) error
 	DropDatabase(user common.User, db string) error
 	CreateDatabase(user common.User, db string, replicationFactor uint8) error
 	ForceCompaction(user common.User) error
@@ -24,9 +33,41 @@ type Coordinator interface {
 	DeleteContinuousQuery(user common.User, db string, id uint32) error
 	CreateContinuousQuery(user common.User, db string, query string) error
 	ListContinuousQueries(user common.User, db string) ([]*protocol.Series, error)
+	CreateIndexedColumn(user common.User, db, series, column string) error
+	DropIndexedColumn(user common.User, db, series, column string) error
+	ListIndexedColumns(user common.User, db string) (map[string][]string, error)
+	// An empty username sets the limit of the database, a nil limit
+	// removes it. Only cluster admins can change the write limits.
+	SetWriteLimit(user common.User, db, username string, limit *cluster.WriteLimit) error
+	GetWriteLimit(user common.User, db, username string) (*cluster.WriteLimit, error)
 
-	// v2 clustering, based on sharding instead of the circular hash ring
-	RunQuery(user common.User, db, query string, seriesWriter SeriesWriter) error
+	// v2 clustering, based on sharding instead of the circular hash ring.
+	// The query is stopped on all the servers once cancelled is closed or
+	// the timeout passes. A timeout of 0 uses the default of the server,
+	// NO_QUERY_TIMEOUT runs the query without any timeout.
+	RunQuery(user common.User, db, query string, seriesWriter SeriesWriter, timeout time.Duration, cancelled <-chan bool) error
+
+	// The queries this server coordinates that the user can see. Killing
+	// a query cancels it on all the servers that run it.
+	ListRunningQueries(user common.User) []*RunningQuery
+	KillQuery(user common.User, id uint32) error
+
+	// The stats of the series of the database that the user can read
+	GetDatabaseStats(user common.User, db string) (*cluster.DatabaseStats, error)
+
+	// Copies the shard to the target server in the background and drops
+	// it from dropServerId afterwards, unless dropServerId is 0
+	RebalanceShard(user common.User, shardId, targetServerId, dropServerId uint32) error
+	// Stops copying the shard to its pending servers, e.g. if the server
+	// that ran the copy was restarted
+	CancelShardCopy(user common.User, shardId uint32) error
+	// Removes a failed server from the cluster. Its shards are copied to
+	// the replacement server or, if replacementServerId is 0, to the
+	// servers with the fewest shards.
+	RemoveServer(user common.User, serverId, replacementServerId uint32) error
+	// The writes that this server didn't get to the other servers yet,
+	// by server
+	GetHandoffStates(user common.User) ([]*cluster.HandoffState, error)
 }
 
 type UserManager interface {
@@ -63,6 +104,15 @@ type ClusterConsensus interface {
 	DropDatabase(name string) error
 	CreateContinuousQuery(db string, query string) error
 	DeleteContinuousQuery(db string, id uint32) error
+	CreateIndexedColumn(db, series, column string) error
+	DropIndexedColumn(db, series, column string) error
+	// an empty user sets the limit of the database, a nil limit removes it
+	SetWriteLimit(db, user string, limit *cluster.WriteLimit) error
+	// pending servers get the writes of the shard but aren't queried
+	SetShardServers(shardId uint32, serverIds, pendingServerIds []uint32) error
+	DropShard(id uint32, serverIds []uint32) error
+	// removes the server from the raft peers, the cluster and its shards
+	RemoveServer(id uint32) error
 	SaveClusterAdminUser(u *cluster.ClusterAdmin) error
 	SaveDbUser(user *cluster.DbUser) error
 	ChangeDbUserPassword(db, username string, hash []byte) error
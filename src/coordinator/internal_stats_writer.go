@@ -0,0 +1,108 @@
+package coordinator
+
+// Periodically writes the counters in common.InternalStats into the
+// internal database. Each counter is written to a series with the
+// same name (e.g. `coordinator.writes`) with the columns `value`,
+// which is the count since the last write, and `server_id`, so the
+// stats of every server in the cluster can be queried like any other
+// series.
+
+import (
+	log "code.google.com/p/log4go"
+	"common"
+	"protocol"
+	"time"
+)
+
+const (
+	INTERNAL_DATABASE                    = "_internal"
+	INTERNAL_DATABASE_REPLICATION_FACTOR = 1
+)
+
+type InternalStatsWriter struct {
+	coordinator *CoordinatorImpl
+	stats       *common.Stats
+	interval    time.Duration
+	stop        chan bool
+	shutdown    chan bool
+}
+
+func NewInternalStatsWriter(coordinator *CoordinatorImpl, stats *common.Stats, interval time.Duration) *InternalStatsWriter {
+	return &InternalStatsWriter{
+		coordinator: coordinator,
+		stats:       stats,
+		interval:    interval,
+		stop:        make(chan bool),
+		shutdown:    make(chan bool, 1),
+	}
+}
+
+func (self *InternalStatsWriter) Run() {
+	defer func() { self.shutdown <- true }()
+
+	ticker := time.NewTicker(self.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-self.stop:
+			return
+		case <-ticker.C:
+			if err := self.write(); err != nil {
+				log.Error("InternalStatsWriter: cannot write stats: %s", err)
+			}
+		}
+	}
+}
+
+func (self *InternalStatsWriter) write() error {
+	snapshots := self.stats.SnapshotAndReset()
+	if len(snapshots) == 0 {
+		return nil
+	}
+
+	if !self.coordinator.clusterConfiguration.DatabaseExists(INTERNAL_DATABASE) {
+		err := self.coordinator.raftServer.CreateDatabase(INTERNAL_DATABASE, INTERNAL_DATABASE_REPLICATION_FACTOR)
+		// another server might have created the database in the meantime
+		if err != nil && !self.coordinator.clusterConfiguration.DatabaseExists(INTERNAL_DATABASE) {
+			return err
+		}
+	}
+
+	serverId := self.coordinator.clusterConfiguration.LocalServerId
+	for _, series := range internalStatsToSeries(snapshots, serverId, common.CurrentTime()) {
+		if err := self.coordinator.CommitSeriesData(INTERNAL_DATABASE, series); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func internalStatsToSeries(snapshots []*common.StatsSnapshot, serverId uint32, timestamp int64) []*protocol.Series {
+	id := int64(serverId)
+	series := make([]*protocol.Series, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		value := snapshot.Value
+		point := &protocol.Point{
+			Values: []*protocol.FieldValue{
+				&protocol.FieldValue{Int64Value: &value},
+				&protocol.FieldValue{Int64Value: &id},
+			},
+		}
+		point.SetTimestampInMicroseconds(timestamp)
+		series = append(series, &protocol.Series{
+			Name:   protocol.String(snapshot.Name),
+			Fields: []string{"value", "server_id"},
+			Points: []*protocol.Point{point},
+		})
+	}
+	return series
+}
+
+func (self *InternalStatsWriter) Close() {
+	close(self.stop)
+	select {
+	case <-time.After(5 * time.Second):
+		log.Error("InternalStatsWriter: timed out waiting for the writer to stop")
+	case <-self.shutdown:
+	}
+}
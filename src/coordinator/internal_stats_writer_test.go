@@ -0,0 +1,31 @@
+package coordinator
+
+import (
+	"common"
+	. "launchpad.net/gocheck"
+)
+
+type InternalStatsSuite struct{}
+
+var _ = Suite(&InternalStatsSuite{})
+
+func (self *InternalStatsSuite) TestStatsAreConvertedToSeries(c *C) {
+	stats := common.NewStats()
+	stats.Increment("coordinator.writes")
+	stats.Add("coordinator.writes", 2)
+	stats.Increment("wal.commits")
+
+	series := internalStatsToSeries(stats.SnapshotAndReset(), 3, 1382131686000000)
+	c.Assert(series, HasLen, 2)
+	c.Assert(*series[0].Name, Equals, "coordinator.writes")
+	c.Assert(series[0].Fields, DeepEquals, []string{"value", "server_id"})
+	c.Assert(series[0].Points, HasLen, 1)
+	c.Assert(*series[0].Points[0].Values[0].Int64Value, Equals, int64(3))
+	c.Assert(*series[0].Points[0].Values[1].Int64Value, Equals, int64(3))
+	c.Assert(*series[0].Points[0].Timestamp, Equals, int64(1382131686000000))
+	c.Assert(*series[1].Name, Equals, "wal.commits")
+	c.Assert(*series[1].Points[0].Values[0].Int64Value, Equals, int64(1))
+
+	// the counters are reset after a snapshot
+	c.Assert(stats.SnapshotAndReset(), HasLen, 0)
+}
@@ -3,6 +3,7 @@ package coordinator
 import (
 	"bytes"
 	log "code.google.com/p/log4go"
+	"common"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -25,9 +26,18 @@ type ProtobufClient struct {
 	writeTimeout      time.Duration
 }
 
+// The responses of a request are read from the connection into pending
+// and passed on to the response channel as fast as it's read. The
+// server sends at most RESPONSE_WINDOW_SIZE responses that weren't
+// passed on yet, the client gives it credit for more once they are, so
+// a slow reader doesn't block the other requests on the connection.
 type runningRequest struct {
 	timeMade     time.Time
 	responseChan chan *protocol.Response
+	pending      chan *protocol.Response
+	credit       func(uint32)
+	// set before pending is closed if the request failed
+	errorMessage *string
 }
 
 const (
@@ -35,8 +45,60 @@ const (
 	MAX_RESPONSE_SIZE      = MAX_REQUEST_SIZE
 	MAX_REQUEST_TIME       = time.Second * 1200
 	RECONNECT_RETRY_WAIT   = time.Millisecond * 100
+	RESPONSE_WINDOW_SIZE   = 100
+	// the client gives the credit for the responses in batches
+	RESPONSE_CREDIT_BATCH = RESPONSE_WINDOW_SIZE / 2
 )
 
+var responseCreditRequest = protocol.Request_RESPONSE_CREDIT
+
+func newRunningRequest(responseChan chan *protocol.Response, credit func(uint32)) *runningRequest {
+	// the last response of a request doesn't need credit
+	req := &runningRequest{
+		timeMade:     time.Now(),
+		responseChan: responseChan,
+		pending:      make(chan *protocol.Response, RESPONSE_WINDOW_SIZE+1),
+		credit:       credit,
+	}
+	go req.forwardResponses()
+	return req
+}
+
+func (self *runningRequest) forwardResponses() {
+	read := uint32(0)
+	for response := range self.pending {
+		self.responseChan <- response
+		if isLastResponse(response) {
+			return
+		}
+		read++
+		if read == RESPONSE_CREDIT_BATCH {
+			self.credit(read)
+			read = 0
+		}
+	}
+	// pending is closed when the request failed or timed out
+	if self.errorMessage != nil {
+		self.responseChan <- &protocol.Response{Type: &endStreamResponse, ErrorMessage: self.errorMessage}
+	}
+}
+
+// Stops passing on the responses of the request after the ones that are
+// pending, it ends with an end stream response with the message if
+// there is one. Has to be called with the request buffer locked.
+func (self *runningRequest) fail(message *string) {
+	self.errorMessage = message
+	close(self.pending)
+}
+
+func isLastResponse(response *protocol.Response) bool {
+	switch response.GetType() {
+	case protocol.Response_END_STREAM, protocol.Response_WRITE_OK, protocol.Response_ACCESS_DENIED, protocol.Response_HEARTBEAT:
+		return true
+	}
+	return false
+}
+
 func NewProtobufClient(hostAndPort string, writeTimeout time.Duration) *ProtobufClient {
 	log.Debug("NewProtobufClient: ", hostAndPort)
 	return &ProtobufClient{
@@ -91,9 +153,12 @@ func (self *ProtobufClient) MakeRequest(request *protocol.Request, responseStrea
 		if oldReq, alreadyHasRequestById := self.requestBuffer[*request.Id]; alreadyHasRequestById {
 			message := "already has a request with this id, must have timed out"
 			log.Error(message)
-			oldReq.responseChan <- &protocol.Response{Type: &endStreamResponse, ErrorMessage: &message}
+			oldReq.fail(&message)
 		}
-		self.requestBuffer[*request.Id] = &runningRequest{time.Now(), responseStream}
+		id, database := *request.Id, request.GetDatabase()
+		self.requestBuffer[id] = newRunningRequest(responseStream, func(credit uint32) {
+			self.giveCredit(id, database, credit)
+		})
 		self.requestBufferLock.Unlock()
 	}
 
@@ -121,14 +186,29 @@ func (self *ProtobufClient) MakeRequest(request *protocol.Request, responseStrea
 		return nil
 	}
 
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		common.InternalStats.Increment("protobuf_client.timeouts")
+	}
+
 	// if we got here it errored out, clear out the request
 	self.requestBufferLock.Lock()
-	delete(self.requestBuffer, *request.Id)
+	if req, ok := self.requestBuffer[*request.Id]; ok {
+		delete(self.requestBuffer, *request.Id)
+		req.fail(nil)
+	}
 	self.requestBufferLock.Unlock()
 	self.reconnect()
 	return err
 }
 
+// Tells the server that the client read more responses of the request
+func (self *ProtobufClient) giveCredit(requestId uint32, database string, credit uint32) {
+	request := &protocol.Request{Id: &requestId, Type: &responseCreditRequest, Database: &database, Credit: &credit}
+	if err := self.MakeRequest(request, nil); err != nil {
+		log.Error("ProtobufClient: couldn't give credit for request %d to %s: %s", requestId, self.hostAndPort, err)
+	}
+}
+
 func (self *ProtobufClient) readResponses() {
 	message := make([]byte, 0, MAX_RESPONSE_SIZE)
 	buff := bytes.NewBuffer(message)
@@ -160,26 +240,27 @@ func (self *ProtobufClient) readResponses() {
 }
 
 func (self *ProtobufClient) sendResponse(response *protocol.Response) {
-	self.requestBufferLock.RLock()
+	self.requestBufferLock.Lock()
+	defer self.requestBufferLock.Unlock()
 	req, ok := self.requestBuffer[*response.RequestId]
-	self.requestBufferLock.RUnlock()
-	if ok {
-		if *response.Type == protocol.Response_END_STREAM || *response.Type == protocol.Response_WRITE_OK {
-			self.requestBufferLock.Lock()
+	if !ok {
+		return
+	}
+	select {
+	case req.pending <- response:
+		if isLastResponse(response) {
 			delete(self.requestBuffer, *response.RequestId)
-			self.requestBufferLock.Unlock()
-		}
-		select {
-		case req.responseChan <- response:
-		default:
-			log.Error("ProtobufClient: Response buffer full! ", self.hostAndPort, response)
-			// if it's an end stream response, we have to send it so start it in a goroutine so we can make sure it gets through without blocking the reading of responses.
-			if *response.Type == protocol.Response_END_STREAM || *response.Type == protocol.Response_WRITE_OK || *response.Type == protocol.Response_ACCESS_DENIED {
-				go func() {
-					req.responseChan <- response
-				}()
-			}
 		}
+	default:
+		// the server sent more responses than it had credit for. The
+		// responses of the other requests on the connection can't wait
+		// until this one is read, and dropping the response would lose
+		// data silently, so the request fails
+		log.Error("ProtobufClient: Response buffer full! Failing request %d to %s", *response.RequestId, self.hostAndPort)
+		common.InternalStats.Increment("protobuf_client.full_response_buffers")
+		delete(self.requestBuffer, *response.RequestId)
+		message := fmt.Sprintf("%s sent more responses than the client had room for", self.hostAndPort)
+		req.fail(&message)
 	}
 }
 
@@ -208,6 +289,8 @@ func (self *ProtobufClient) peridicallySweepTimedOutRequests() {
 		for k, req := range self.requestBuffer {
 			if req.timeMade.Before(maxAge) {
 				delete(self.requestBuffer, k)
+				req.fail(nil)
+				common.InternalStats.Increment("protobuf_client.timeouts")
 				log.Warn("Request timed out.")
 			}
 		}
@@ -11,12 +11,64 @@ import (
 	"net"
 	"parser"
 	"protocol"
+	"sync"
+	"time"
 )
 
 type ProtobufRequestHandler struct {
-	coordinator   Coordinator
-	clusterConfig *cluster.ClusterConfiguration
-	writeOk       protocol.Response_Type
+	coordinator        Coordinator
+	clusterConfig      *cluster.ClusterConfiguration
+	writeOk            protocol.Response_Type
+	runningQueriesLock sync.Mutex
+	runningQueries     map[runningQueryKey]*common.QueryCancellation
+	responseWindows    map[runningQueryKey]*responseWindow
+}
+
+// The request ids are only unique per connection
+type runningQueryKey struct {
+	conn net.Conn
+	id   uint32
+}
+
+// The number of responses that can be sent to the client before it
+// gives credit for more, see runningRequest
+type responseWindow struct {
+	available uint32
+	credits   chan uint32
+}
+
+// how long the responses wait for the client to give credit, the client
+// gives up on the request by then
+const RESPONSE_CREDIT_TIMEOUT = MAX_REQUEST_TIME
+
+func newResponseWindow() *responseWindow {
+	return &responseWindow{available: RESPONSE_WINDOW_SIZE, credits: make(chan uint32, RESPONSE_WINDOW_SIZE)}
+}
+
+func (self *responseWindow) give(credit uint32) {
+	select {
+	case self.credits <- credit:
+	default:
+		log.Error("The client gave more credit than it had responses")
+	}
+}
+
+// Takes the credit for a response, waits until the client gives some if
+// there's none. Returns false if it doesn't before the timeout or before
+// done is closed.
+func (self *responseWindow) take(done <-chan bool, timeout time.Duration) bool {
+	for self.available == 0 {
+		select {
+		case credit := <-self.credits:
+			self.available += credit
+		case <-done:
+			return false
+		case <-time.After(timeout):
+			return false
+		}
+	}
+	self.available--
+	return true
 }
 
 var (
@@ -25,7 +77,13 @@ var (
 )
 
 func NewProtobufRequestHandler(coordinator Coordinator, clusterConfig *cluster.ClusterConfiguration) *ProtobufRequestHandler {
-	return &ProtobufRequestHandler{coordinator: coordinator, writeOk: protocol.Response_WRITE_OK, clusterConfig: clusterConfig}
+	return &ProtobufRequestHandler{
+		coordinator:     coordinator,
+		writeOk:         protocol.Response_WRITE_OK,
+		clusterConfig:   clusterConfig,
+		runningQueries:  make(map[runningQueryKey]*common.QueryCancellation),
+		responseWindows: make(map[runningQueryKey]*responseWindow),
+	}
 }
 
 func (self *ProtobufRequestHandler) HandleRequest(request *protocol.Request, conn net.Conn) error {
@@ -34,8 +92,11 @@ func (self *ProtobufRequestHandler) HandleRequest(request *protocol.Request, con
 		log.Debug("HANDLE: ", shard)
 		err := shard.WriteLocalOnly(request)
 		if err != nil {
+			// the sender retries the write
 			log.Error("ProtobufRequestHandler: error writing local shard: ", err)
-			return err
+			errorMsg := err.Error()
+			response := &protocol.Response{RequestId: request.Id, Type: &endStreamResponse, ErrorMessage: &errorMsg}
+			return self.WriteResponse(conn, response)
 		}
 		response := &protocol.Response{RequestId: request.Id, Type: &self.writeOk}
 		return self.WriteResponse(conn, response)
@@ -43,7 +104,40 @@ func (self *ProtobufRequestHandler) HandleRequest(request *protocol.Request, con
 		go self.handleDropDatabase(request, conn)
 		return nil
 	} else if *request.Type == protocol.Request_QUERY {
-		go self.handleQuery(request, conn)
+		// register the query before a cancel request or credit for it can
+		// be read
+		cancellation := common.NewQueryCancellation()
+		key := runningQueryKey{conn, request.GetId()}
+		window := self.addResponseWindow(key)
+		self.runningQueriesLock.Lock()
+		self.runningQueries[key] = cancellation
+		self.runningQueriesLock.Unlock()
+		go func() {
+			defer self.removeRunningQuery(key)
+			self.handleQuery(request, conn, cancellation, window)
+		}()
+	} else if *request.Type == protocol.Request_CANCEL_QUERY {
+		self.runningQueriesLock.Lock()
+		cancellation := self.runningQueries[runningQueryKey{conn, request.GetId()}]
+		self.runningQueriesLock.Unlock()
+		if cancellation != nil {
+			log.Debug("Cancelling query %d of %s", request.GetId(), conn.RemoteAddr())
+			cancellation.Cancel(common.NewQueryError(common.QueryCancelled, "Query was cancelled"))
+		}
+	} else if *request.Type == protocol.Request_RESPONSE_CREDIT {
+		self.runningQueriesLock.Lock()
+		window := self.responseWindows[runningQueryKey{conn, request.GetId()}]
+		self.runningQueriesLock.Unlock()
+		if window != nil {
+			window.give(request.GetCredit())
+		}
+	} else if *request.Type == protocol.Request_SERIES_HASHES || *request.Type == protocol.Request_REPAIR_SERIES || *request.Type == protocol.Request_REPAIR_SHARD {
+		key := runningQueryKey{conn, request.GetId()}
+		window := self.addResponseWindow(key)
+		go func() {
+			defer self.removeRunningQuery(key)
+			self.handleRepair(request, conn, window)
+		}()
 	} else if *request.Type == protocol.Request_HEARTBEAT {
 		response := &protocol.Response{RequestId: request.Id, Type: &heartbeatResponse}
 		return self.WriteResponse(conn, response)
@@ -54,7 +148,25 @@ func (self *ProtobufRequestHandler) HandleRequest(request *protocol.Request, con
 	return nil
 }
 
-func (self *ProtobufRequestHandler) handleQuery(request *protocol.Request, conn net.Conn) {
+func (self *ProtobufRequestHandler) addResponseWindow(key runningQueryKey) *responseWindow {
+	window := newResponseWindow()
+	self.runningQueriesLock.Lock()
+	defer self.runningQueriesLock.Unlock()
+	self.responseWindows[key] = window
+	return window
+}
+
+func (self *ProtobufRequestHandler) removeRunningQuery(key runningQueryKey) {
+	self.runningQueriesLock.Lock()
+	defer self.runningQueriesLock.Unlock()
+	if cancellation := self.runningQueries[key]; cancellation != nil {
+		cancellation.Finish()
+		delete(self.runningQueries, key)
+	}
+	delete(self.responseWindows, key)
+}
+
+func (self *ProtobufRequestHandler) handleQuery(request *protocol.Request, conn net.Conn, cancellation *common.QueryCancellation, window *responseWindow) {
 	// the query should always parse correctly since it was parsed at the originating server.
 	queries, err := parser.ParseQuery(*request.Query)
 	if err != nil || len(queries) < 1 {
@@ -81,6 +193,8 @@ func (self *ProtobufRequestHandler) handleQuery(request *protocol.Request, conn
 
 	shard := self.clusterConfig.GetLocalShardById(*request.ShardId)
 	querySpec := parser.NewQuerySpec(user, *request.Database, query)
+	querySpec.SetCancellation(cancellation)
+	querySpec.AggregateInCoordinator = request.GetAggregateInCoordinator()
 
 	responseChan := make(chan *protocol.Response)
 	if querySpec.IsDestructiveQuery() {
@@ -88,11 +202,46 @@ func (self *ProtobufRequestHandler) handleQuery(request *protocol.Request, conn
 	} else {
 		go shard.Query(querySpec, responseChan)
 	}
+	self.writeResponses(conn, request, responseChan, window, cancellation.Done(), func() {
+		cancellation.Cancel(common.NewQueryError(common.QueryCancelled, "The client didn't read the responses"))
+	})
+}
+
+func (self *ProtobufRequestHandler) handleRepair(request *protocol.Request, conn net.Conn, window *responseWindow) {
+	// unlike GetLocalShardById this doesn't create shards that this
+	// server doesn't have
+	shard := self.clusterConfig.GetShard(request.GetShardId())
+	if shard == nil || !shard.IsLocal() {
+		errorMsg := fmt.Sprintf("Shard %d isn't on this server", request.GetShardId())
+		response := &protocol.Response{Type: &endStreamResponse, ErrorMessage: &errorMsg, RequestId: request.Id}
+		self.WriteResponse(conn, response)
+		return
+	}
+
+	responseChan := make(chan *protocol.Response)
+	go shard.HandleRepairRequest(request, responseChan)
+	self.writeResponses(conn, request, responseChan, window, nil, func() {})
+}
+
+// Writes the responses to the connection until the end of the stream,
+// as fast as the client gives credit for them. If it doesn't, stop is
+// called and the rest of the responses are dropped, the stream still
+// ends with the end stream response.
+func (self *ProtobufRequestHandler) writeResponses(conn net.Conn, request *protocol.Request, responses chan *protocol.Response, window *responseWindow, done <-chan bool, stop func()) {
+	stopped := false
 	for {
-		response := <-responseChan
+		response := <-responses
 		response.RequestId = request.Id
-		self.WriteResponse(conn, response)
-		if response.Type == &endStreamResponse || response.Type == &accessDeniedResponse {
+		last := *response.Type == endStreamResponse || *response.Type == accessDeniedResponse
+		if !last && !stopped && !window.take(done, RESPONSE_CREDIT_TIMEOUT) {
+			log.Warn("Dropping the rest of the responses of request %d of %s", request.GetId(), conn.RemoteAddr())
+			stopped = true
+			stop()
+		}
+		if last || !stopped {
+			self.WriteResponse(conn, response)
+		}
+		if last {
 			return
 		}
 	}
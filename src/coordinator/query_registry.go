@@ -0,0 +1,146 @@
+package coordinator
+
+import (
+	"common"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Keeps track of the queries that this server coordinates, so they can
+// be listed and killed. Killing a query cancels it on all the servers
+// that run one of its shards.
+type QueryRegistry struct {
+	lock    sync.Mutex
+	lastId  uint32
+	queries map[uint32]*RunningQuery
+}
+
+type RunningQuery struct {
+	Id              uint32
+	Query           string
+	Database        string
+	StartTime       time.Time
+	user            common.User
+	cancellation    *common.QueryCancellation
+	pointsProcessed int64
+	shardsLock      sync.Mutex
+	shards          map[uint32]bool
+}
+
+func NewQueryRegistry() *QueryRegistry {
+	return &QueryRegistry{queries: make(map[uint32]*RunningQuery)}
+}
+
+func (self *QueryRegistry) Register(user common.User, database, query string, cancellation *common.QueryCancellation) *RunningQuery {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.lastId++
+	runningQuery := &RunningQuery{
+		Id:           self.lastId,
+		Query:        query,
+		Database:     database,
+		StartTime:    time.Now(),
+		user:         user,
+		cancellation: cancellation,
+		shards:       make(map[uint32]bool),
+	}
+	self.queries[runningQuery.Id] = runningQuery
+	return runningQuery
+}
+
+func (self *QueryRegistry) Remove(id uint32) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.queries, id)
+}
+
+// Returns the queries that the user can see ordered by id. Cluster
+// admins see all the queries, db admins the ones of their db and
+// other users their own queries.
+func (self *QueryRegistry) List(user common.User) []*RunningQuery {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	queries := make([]*RunningQuery, 0, len(self.queries))
+	for _, query := range self.queries {
+		if query.isVisibleTo(user) {
+			queries = append(queries, query)
+		}
+	}
+	sort.Sort(runningQueries(queries))
+	return queries
+}
+
+func (self *QueryRegistry) Kill(user common.User, id uint32) error {
+	self.lock.Lock()
+	query := self.queries[id]
+	self.lock.Unlock()
+
+	if query == nil || !query.isVisibleTo(user) {
+		return fmt.Errorf("Query %d isn't running", id)
+	}
+	query.cancellation.Cancel(common.NewQueryError(common.QueryCancelled, "Query %d was killed", id))
+	return nil
+}
+
+func (self *RunningQuery) isVisibleTo(user common.User) bool {
+	if user.IsClusterAdmin() || user.IsDbAdmin(self.Database) {
+		return true
+	}
+	return !self.user.IsClusterAdmin() && self.user.GetDb() == user.GetDb() && self.user.GetName() == user.GetName()
+}
+
+func (self *RunningQuery) UserName() string {
+	return self.user.GetName()
+}
+
+func (self *RunningQuery) addShard(id uint32) {
+	self.shardsLock.Lock()
+	defer self.shardsLock.Unlock()
+	self.shards[id] = true
+}
+
+// Returns the ids of the shards the query read from
+func (self *RunningQuery) Shards() []uint32 {
+	self.shardsLock.Lock()
+	defer self.shardsLock.Unlock()
+	ids := make([]uint32, 0, len(self.shards))
+	for id, _ := range self.shards {
+		ids = append(ids, id)
+	}
+	sort.Sort(shardIds(ids))
+	return ids
+}
+
+func (self *RunningQuery) shardsString() string {
+	ids := self.Shards()
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = fmt.Sprintf("%d", id)
+	}
+	return strings.Join(strs, ",")
+}
+
+func (self *RunningQuery) addPoints(count int64) {
+	atomic.AddInt64(&self.pointsProcessed, count)
+}
+
+// Returns the number of points the shards sent for the query
+func (self *RunningQuery) PointsProcessed() int64 {
+	return atomic.LoadInt64(&self.pointsProcessed)
+}
+
+type runningQueries []*RunningQuery
+
+func (self runningQueries) Len() int           { return len(self) }
+func (self runningQueries) Less(i, j int) bool { return self[i].Id < self[j].Id }
+func (self runningQueries) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+type shardIds []uint32
+
+func (self shardIds) Len() int           { return len(self) }
+func (self shardIds) Less(i, j int) bool { return self[i] < self[j] }
+func (self shardIds) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
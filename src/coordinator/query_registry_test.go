@@ -0,0 +1,52 @@
+package coordinator
+
+import (
+	"cluster"
+	"common"
+	. "launchpad.net/gocheck"
+)
+
+type QueryRegistrySuite struct{}
+
+var _ = Suite(&QueryRegistrySuite{})
+
+func queryIds(queries []*RunningQuery) []uint32 {
+	ids := []uint32{}
+	for _, query := range queries {
+		ids = append(ids, query.Id)
+	}
+	return ids
+}
+
+func (self *QueryRegistrySuite) TestListAndKillQueries(c *C) {
+	root := &cluster.ClusterAdmin{CommonUser: cluster.CommonUser{Name: "root"}}
+	paul := &cluster.DbUser{CommonUser: cluster.CommonUser{Name: "paul"}, Db: "db1"}
+	todd := &cluster.DbUser{CommonUser: cluster.CommonUser{Name: "todd"}, Db: "db1"}
+	admin := &cluster.DbUser{CommonUser: cluster.CommonUser{Name: "admin"}, Db: "db1", IsAdmin: true}
+
+	registry := NewQueryRegistry()
+	first := common.NewQueryCancellation()
+	registry.Register(paul, "db1", "select * from foo", first)
+	registry.Register(todd, "db1", "select * from bar", common.NewQueryCancellation())
+	query := registry.Register(root, "db2", "select * from /.*/", common.NewQueryCancellation())
+	query.addShard(3)
+	query.addShard(1)
+	query.addShard(3)
+	query.addPoints(10)
+	c.Assert(query.Shards(), DeepEquals, []uint32{1, 3})
+	c.Assert(query.PointsProcessed(), Equals, int64(10))
+
+	c.Assert(queryIds(registry.List(root)), DeepEquals, []uint32{1, 2, 3})
+	c.Assert(queryIds(registry.List(admin)), DeepEquals, []uint32{1, 2})
+	c.Assert(queryIds(registry.List(paul)), DeepEquals, []uint32{1})
+
+	// users can't kill the queries of the other users
+	c.Assert(registry.Kill(todd, 1), NotNil)
+	c.Assert(first.IsCancelled(), Equals, false)
+	c.Assert(registry.Kill(paul, 1), IsNil)
+	c.Assert(first.Err().(*common.QueryError).ErrorCode, Equals, common.QueryCancelled)
+
+	registry.Remove(1)
+	c.Assert(queryIds(registry.List(root)), DeepEquals, []uint32{2, 3})
+	c.Assert(registry.Kill(root, 1), NotNil)
+}
@@ -254,6 +254,24 @@ func (s *RaftServer) DeleteContinuousQuery(db string, id uint32) error {
 	return err
 }
 
+func (s *RaftServer) CreateIndexedColumn(db, series, column string) error {
+	command := NewCreateIndexedColumnCommand(db, series, column)
+	_, err := s.doOrProxyCommand(command, "create_indexed_column")
+	return err
+}
+
+func (s *RaftServer) DropIndexedColumn(db, series, column string) error {
+	command := NewDropIndexedColumnCommand(db, series, column)
+	_, err := s.doOrProxyCommand(command, "drop_indexed_column")
+	return err
+}
+
+func (s *RaftServer) SetWriteLimit(db, user string, limit *cluster.WriteLimit) error {
+	command := NewSetWriteLimitCommand(db, user, limit)
+	_, err := s.doOrProxyCommand(command, "set_write_limit")
+	return err
+}
+
 func (s *RaftServer) ActivateServer(server *cluster.ClusterServer) error {
 	return errors.New("not implemented")
 }
@@ -407,6 +425,7 @@ func (s *RaftServer) raftLeaderLoop(loopTimer *time.Ticker) {
 		case <-loopTimer.C:
 			log.Debug("(raft:%s) Executing leader loop.", s.raftServer.Name())
 			s.checkContinuousQueries()
+			s.dropExpiredShards()
 			break
 		case <-s.notLeader:
 			log.Debug("(raft:%s) Exiting leader loop.", s.raftServer.Name())
@@ -455,6 +474,15 @@ func (s *RaftServer) checkContinuousQueries() {
 	}
 }
 
+func (s *RaftServer) dropExpiredShards() {
+	for _, shard := range s.clusterConfig.GetExpiredShards(time.Now()) {
+		log.Info("Dropping shard %d since it's older than the retention period. end: %s", shard.Id(), shard.EndTime().Format("Mon Jan 2 15:04:05 -0700 MST 2006"))
+		if err := s.DropShard(shard.Id(), shard.ServerIds()); err != nil {
+			log.Error("Couldn't drop expired shard %d: %s", shard.Id(), err)
+		}
+	}
+}
+
 func (s *RaftServer) runContinuousQuery(db string, query *parser.SelectQuery, start time.Time, end time.Time) {
 	adminName := s.clusterConfig.GetClusterAdmins()[0]
 	clusterAdmin := s.clusterConfig.GetClusterAdmin(adminName)
@@ -466,8 +494,9 @@ func (s *RaftServer) runContinuousQuery(db string, query *parser.SelectQuery, st
 		return s.coordinator.InterpolateValuesAndCommit(db, series, targetName, true)
 	}
 
+	// continuous queries aren't limited by the query timeout of the server
 	writer := NewContinuousQueryWriter(f)
-	s.coordinator.RunQuery(clusterAdmin, db, queryString, writer)
+	s.coordinator.RunQuery(clusterAdmin, db, queryString, writer, NO_QUERY_TIMEOUT, nil)
 }
 
 func (s *RaftServer) ListenAndServe() error {
@@ -679,3 +708,21 @@ func (self *RaftServer) DropShard(id uint32, serverIds []uint32) error {
 	_, err := self.doOrProxyCommand(command, "drop_shard")
 	return err
 }
+
+func (self *RaftServer) SetShardServers(id uint32, serverIds, pendingServerIds []uint32) error {
+	command := NewSetShardServersCommand(id, serverIds, pendingServerIds)
+	_, err := self.doOrProxyCommand(command, "set_shard_servers")
+	return err
+}
+
+func (self *RaftServer) RemoveServer(id uint32) error {
+	command := NewRemoveServerCommand(id)
+	_, err := self.doOrProxyCommand(command, "remove_server")
+	return err
+}
+
+func (self *RaftServer) RestoreClusterConfiguration(configuration []byte, shardIds []uint32) error {
+	command := NewRestoreClusterConfigurationCommand(configuration, shardIds, self.clusterConfig.LocalServerId)
+	_, err := self.doOrProxyCommand(command, "restore_cluster_configuration")
+	return err
+}
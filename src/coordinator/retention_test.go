@@ -0,0 +1,95 @@
+package coordinator
+
+import (
+	"cluster"
+	"configuration"
+	. "launchpad.net/gocheck"
+	"time"
+)
+
+type RetentionSuite struct{}
+
+var _ = Suite(&RetentionSuite{})
+
+// Returns a cluster configuration of the local server 1 with the given
+// retentions of the short term and long term shards, a retention of ""
+// keeps the shards forever
+func newClusterWithRetention(c *C, store *ShardStoreMock, shortTerm, longTerm string) *cluster.ClusterConfiguration {
+	config := &configuration.Configuration{
+		ShortTermShard: &configuration.ShardConfiguration{Retention: shortTerm},
+		LongTermShard:  &configuration.ShardConfiguration{Retention: longTerm},
+	}
+	c.Assert(config.ShortTermShard.ParseAndValidate(time.Hour), IsNil)
+	c.Assert(config.LongTermShard.ParseAndValidate(time.Hour), IsNil)
+	clusterConfig := cluster.NewClusterConfiguration(config, &WALMock{}, store, nil)
+	clusterConfig.LocalRaftName = "local"
+	clusterConfig.AddPotentialServer(&cluster.ClusterServer{RaftName: "local"})
+	c.Assert(clusterConfig.CreateDatabase("db1", 1), IsNil)
+	return clusterConfig
+}
+
+func addShardOfType(c *C, config *cluster.ClusterConfiguration, shardType cluster.ShardType, start, end time.Time) *cluster.ShardData {
+	shards, err := config.AddShards([]*cluster.NewShardData{{
+		StartTime: start,
+		EndTime:   end,
+		ServerIds: []uint32{1},
+		Type:      shardType,
+	}})
+	c.Assert(err, IsNil)
+	return shards[0]
+}
+
+func idsOfShards(shards []*cluster.ShardData) []uint32 {
+	ids := []uint32{}
+	for _, shard := range shards {
+		ids = append(ids, shard.Id())
+	}
+	return ids
+}
+
+func (self *RetentionSuite) TestExpiredShards(c *C) {
+	config := newClusterWithRetention(c, &ShardStoreMock{}, "1h", "1d")
+	now := time.Unix(100*24*3600, 0)
+
+	// the short term shards expire an hour after their end time
+	expiredShortTerm := addShardOfType(c, config, cluster.SHORT_TERM, now.Add(-3*time.Hour), now.Add(-2*time.Hour))
+	addShardOfType(c, config, cluster.SHORT_TERM, now.Add(-2*time.Hour), now.Add(-time.Hour))
+	addShardOfType(c, config, cluster.SHORT_TERM, now.Add(-time.Hour), now)
+
+	// the long term shards expire a day after their end time
+	expiredLongTerm := addShardOfType(c, config, cluster.LONG_TERM, now.Add(-3*24*time.Hour), now.Add(-2*24*time.Hour))
+	addShardOfType(c, config, cluster.LONG_TERM, now.Add(-2*24*time.Hour), now.Add(-24*time.Hour))
+	addShardOfType(c, config, cluster.LONG_TERM, now.Add(-2*time.Hour), now.Add(-time.Hour))
+
+	// the shards that end exactly at the cutoff are kept
+	c.Assert(idsOfShards(config.GetExpiredShards(now)), DeepEquals, []uint32{expiredShortTerm.Id(), expiredLongTerm.Id()})
+	c.Assert(idsOfShards(config.GetExpiredShards(now.Add(time.Nanosecond))), HasLen, 4)
+}
+
+func (self *RetentionSuite) TestShardsWithoutRetentionAreKeptForever(c *C) {
+	config := newClusterWithRetention(c, &ShardStoreMock{}, "", "1d")
+	now := time.Unix(100*24*3600, 0)
+	addShardOfType(c, config, cluster.SHORT_TERM, time.Unix(0, 0), time.Unix(3600, 0))
+	expired := addShardOfType(c, config, cluster.LONG_TERM, time.Unix(0, 0), time.Unix(3600, 0))
+	c.Assert(idsOfShards(config.GetExpiredShards(now)), DeepEquals, []uint32{expired.Id()})
+
+	config = newClusterWithRetention(c, &ShardStoreMock{}, "", "")
+	addShardOfType(c, config, cluster.SHORT_TERM, time.Unix(0, 0), time.Unix(3600, 0))
+	addShardOfType(c, config, cluster.LONG_TERM, time.Unix(0, 0), time.Unix(3600, 0))
+	c.Assert(config.GetExpiredShards(now), HasLen, 0)
+}
+
+func (self *RetentionSuite) TestDropExpiredShards(c *C) {
+	store := &ShardStoreMock{}
+	config := newClusterWithRetention(c, store, "1h", "")
+	now := time.Now()
+	expired := addShardOfType(c, config, cluster.SHORT_TERM, now.Add(-3*time.Hour), now.Add(-2*time.Hour))
+	kept := addShardOfType(c, config, cluster.SHORT_TERM, now.Add(-time.Hour), now)
+	longTerm := addShardOfType(c, config, cluster.LONG_TERM, now.Add(-3*time.Hour), now.Add(-2*time.Hour))
+
+	server := &RaftServer{clusterConfig: config, raftServer: &RaftServerMock{config: config}}
+	server.dropExpiredShards()
+
+	c.Assert(store.deletedShards, DeepEquals, []uint32{expired.Id()})
+	c.Assert(idsOfShards(config.GetAllShards()), DeepEquals, []uint32{kept.Id(), longTerm.Id()})
+}
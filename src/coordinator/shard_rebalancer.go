@@ -0,0 +1,297 @@
+package coordinator
+
+import (
+	"cluster"
+	log "code.google.com/p/log4go"
+	"common"
+	"errors"
+	"fmt"
+	"parser"
+	"protocol"
+	"time"
+)
+
+const (
+	// the target may not have applied the change that adds it to the
+	// shard when the copy starts, so its writes are retried
+	SHARD_COPY_WRITE_RETRIES    = 10
+	SHARD_COPY_WRITE_RETRY_WAIT = time.Second
+)
+
+var errShardCopyCancelled = errors.New("the copy was cancelled")
+
+// Copies the shard to the target server. The target gets the writes of
+// the shard while the data of a healthy replica is copied to it, so it's
+// caught up once the copy is done and it's queried like the other
+// replicas from then on. The replica on dropServerId is dropped
+// afterwards, unless dropServerId is 0. The copy runs in the background.
+func (self *CoordinatorImpl) RebalanceShard(user common.User, shardId, targetServerId, dropServerId uint32) error {
+	if !user.IsClusterAdmin() {
+		return common.NewAuthorizationError("Insufficient permissions to rebalance shards")
+	}
+
+	shard := self.clusterConfiguration.GetShard(shardId)
+	if shard == nil {
+		return fmt.Errorf("Shard %d doesn't exist", shardId)
+	}
+	if len(shard.PendingServerIds()) > 0 {
+		return fmt.Errorf("Shard %d is already being copied to servers %v, cancel the copy if it doesn't run anymore", shardId, shard.PendingServerIds())
+	}
+	if self.clusterConfiguration.GetServerById(&targetServerId) == nil {
+		return fmt.Errorf("Server %d doesn't exist", targetServerId)
+	}
+	if containsServerId(shard.ServerIds(), targetServerId) {
+		return fmt.Errorf("Server %d already has shard %d", targetServerId, shardId)
+	}
+	if dropServerId != 0 && !containsServerId(shard.ServerIds(), dropServerId) {
+		return fmt.Errorf("Server %d doesn't have shard %d", dropServerId, shardId)
+	}
+
+	serverIds := append([]uint32{}, shard.ServerIds()...)
+	if err := self.raftServer.SetShardServers(shardId, serverIds, []uint32{targetServerId}); err != nil {
+		return err
+	}
+	go self.rebalanceShard(user, shard, serverIds, targetServerId, dropServerId)
+	return nil
+}
+
+// Stops sending the writes of the shard to the servers it's being copied
+// to. The copy stops when it sees that it was cancelled. A copy that
+// doesn't run anymore, e.g. because its server was restarted, has to be
+// cancelled before the shard can be copied again.
+func (self *CoordinatorImpl) CancelShardCopy(user common.User, shardId uint32) error {
+	if !user.IsClusterAdmin() {
+		return common.NewAuthorizationError("Insufficient permissions to rebalance shards")
+	}
+
+	shard := self.clusterConfiguration.GetShard(shardId)
+	if shard == nil {
+		return fmt.Errorf("Shard %d doesn't exist", shardId)
+	}
+	if len(shard.PendingServerIds()) == 0 {
+		return fmt.Errorf("Shard %d isn't being copied", shardId)
+	}
+	return self.raftServer.SetShardServers(shardId, shard.ServerIds(), nil)
+}
+
+// Returns true if the shard is still being copied to the server
+func (self *CoordinatorImpl) isCopyingShard(shardId, targetServerId uint32) bool {
+	shard := self.clusterConfiguration.GetShard(shardId)
+	return shard != nil && containsServerId(shard.PendingServerIds(), targetServerId)
+}
+
+func (self *CoordinatorImpl) RemoveServer(user common.User, serverId, replacementServerId uint32) error {
+	if !user.IsClusterAdmin() {
+		return common.NewAuthorizationError("Insufficient permissions to remove servers")
+	}
+
+	if self.clusterConfiguration.GetServerById(&serverId) == nil {
+		return fmt.Errorf("Server %d doesn't exist", serverId)
+	}
+	if serverId == self.clusterConfiguration.LocalServerId {
+		return fmt.Errorf("Server %d can't remove itself, send the request to another server", serverId)
+	}
+	if replacementServerId != 0 {
+		if replacementServerId == serverId {
+			return fmt.Errorf("Server %d can't replace itself", serverId)
+		}
+		if self.clusterConfiguration.GetServerById(&replacementServerId) == nil {
+			return fmt.Errorf("Server %d doesn't exist", replacementServerId)
+		}
+	}
+
+	shards := []*cluster.ShardData{}
+	for _, shard := range self.clusterConfiguration.GetAllShards() {
+		if containsServerId(shard.ServerIds(), serverId) || containsServerId(shard.PendingServerIds(), serverId) {
+			shards = append(shards, shard)
+		}
+	}
+	if err := self.raftServer.RemoveServer(serverId); err != nil {
+		return err
+	}
+	go self.replaceShards(user, serverId, shards, replacementServerId)
+	return nil
+}
+
+// Copies the shards of the removed server to the replacement server or
+// to the servers with the fewest shards, one shard at a time
+func (self *CoordinatorImpl) replaceShards(user common.User, removedServerId uint32, shards []*cluster.ShardData, replacementServerId uint32) {
+	for _, shard := range shards {
+		// the removal may not be applied to the local configuration yet
+		serverIds := withoutServerId(shard.ServerIds(), removedServerId)
+		if pendingServerIds := withoutServerId(shard.PendingServerIds(), removedServerId); len(pendingServerIds) > 0 {
+			log.Warn("Shard %d is being copied to servers %v, not replacing server %d", shard.Id(), pendingServerIds, removedServerId)
+			continue
+		}
+
+		targetServerId := replacementServerId
+		if targetServerId == 0 || containsServerId(serverIds, targetServerId) {
+			excludedIds := append([]uint32{removedServerId}, serverIds...)
+			targetServerId = leastLoadedServer(self.clusterConfiguration.Servers(), self.clusterConfiguration.GetAllShards(), excludedIds)
+		}
+		if targetServerId == 0 {
+			log.Warn("All the servers have shard %d, not replacing server %d", shard.Id(), removedServerId)
+			continue
+		}
+
+		if len(serverIds) == 0 {
+			log.Error("Server %d had the only copy of shard %d, its data is lost", removedServerId, shard.Id())
+			if err := self.raftServer.SetShardServers(shard.Id(), []uint32{targetServerId}, nil); err != nil {
+				log.Error("Couldn't add server %d to shard %d: %s", targetServerId, shard.Id(), err)
+			}
+			continue
+		}
+
+		if err := self.raftServer.SetShardServers(shard.Id(), serverIds, []uint32{targetServerId}); err != nil {
+			log.Error("Couldn't copy shard %d to server %d: %s", shard.Id(), targetServerId, err)
+			continue
+		}
+		self.rebalanceShard(user, shard, serverIds, targetServerId, 0)
+	}
+	log.Info("Replaced the shards of server %d", removedServerId)
+}
+
+// Returns the id of the server that has the fewest shards, ignoring the
+// servers in excludedIds. Returns 0 if all the servers are excluded.
+func leastLoadedServer(servers []*cluster.ClusterServer, shards []*cluster.ShardData, excludedIds []uint32) uint32 {
+	shardCount := map[uint32]int{}
+	for _, shard := range shards {
+		for _, id := range shard.ServerIds() {
+			shardCount[id]++
+		}
+		for _, id := range shard.PendingServerIds() {
+			shardCount[id]++
+		}
+	}
+
+	var serverId uint32
+	for _, server := range servers {
+		if containsServerId(excludedIds, server.Id) {
+			continue
+		}
+		if serverId == 0 || shardCount[server.Id] < shardCount[serverId] ||
+			(shardCount[server.Id] == shardCount[serverId] && server.Id < serverId) {
+			serverId = server.Id
+		}
+	}
+	return serverId
+}
+
+func (self *CoordinatorImpl) rebalanceShard(user common.User, shard *cluster.ShardData, serverIds []uint32, targetServerId, dropServerId uint32) {
+	log.Info("Copying shard %d to server %d", shard.Id(), targetServerId)
+	err := self.copyShard(user, shard, targetServerId)
+	if err == nil && !self.isCopyingShard(shard.Id(), targetServerId) {
+		err = errShardCopyCancelled
+	}
+	if err == errShardCopyCancelled {
+		log.Info("Stopped copying shard %d to server %d: %s", shard.Id(), targetServerId, err)
+		return
+	}
+	if err != nil {
+		log.Error("Couldn't copy shard %d to server %d: %s", shard.Id(), targetServerId, err)
+		// the target stops getting the writes of the shard
+		if err := self.raftServer.SetShardServers(shard.Id(), serverIds, nil); err != nil {
+			log.Error("Couldn't remove server %d from shard %d: %s", targetServerId, shard.Id(), err)
+		}
+		return
+	}
+
+	newServerIds := append(append([]uint32{}, serverIds...), targetServerId)
+	if err := self.raftServer.SetShardServers(shard.Id(), newServerIds, nil); err != nil {
+		log.Error("Couldn't add server %d to shard %d: %s", targetServerId, shard.Id(), err)
+		return
+	}
+	log.Info("Copied shard %d to server %d", shard.Id(), targetServerId)
+
+	if dropServerId == 0 {
+		return
+	}
+	if err := self.raftServer.DropShard(shard.Id(), []uint32{dropServerId}); err != nil {
+		log.Error("Couldn't drop shard %d from server %d: %s", shard.Id(), dropServerId, err)
+	}
+}
+
+// Reads the points of every database from a healthy replica of the shard
+// and writes them to the target server
+func (self *CoordinatorImpl) copyShard(user common.User, shard *cluster.ShardData, targetServerId uint32) error {
+	queryString := fmt.Sprintf("select * from /.*/ where time > %du and time < %du",
+		common.TimeToMicroseconds(shard.StartTime())-1, common.TimeToMicroseconds(shard.EndTime()))
+	queries, err := parser.ParseQuery(queryString)
+	if err != nil {
+		return err
+	}
+
+	for _, database := range self.clusterConfiguration.GetDatabases() {
+		querySpec := parser.NewQuerySpec(user, database.Name, queries[0])
+		responses := make(chan *protocol.Response, self.config.QueryShardBufferSize)
+		go shard.Query(querySpec, responses)
+
+		// the responses have to be read until the end even if a write fails
+		var copyErr error
+		for {
+			response := <-responses
+			if *response.Type == endStreamResponse || *response.Type == accessDeniedResponse {
+				if response.ErrorMessage != nil && copyErr == nil {
+					copyErr = fmt.Errorf("%s", *response.ErrorMessage)
+				}
+				break
+			}
+			if copyErr != nil || response.Series == nil || len(response.Series.Points) == 0 {
+				continue
+			}
+			if !self.isCopyingShard(shard.Id(), targetServerId) {
+				copyErr = errShardCopyCancelled
+				continue
+			}
+			copyErr = self.copyToServer(targetServerId, database.Name, shard.Id(), response.Series)
+		}
+		if copyErr != nil {
+			return copyErr
+		}
+	}
+	return nil
+}
+
+func (self *CoordinatorImpl) copyToServer(serverId uint32, database string, shardId uint32, series *protocol.Series) error {
+	var err error
+	for i := 0; i < SHARD_COPY_WRITE_RETRIES; i++ {
+		if i > 0 {
+			time.Sleep(SHARD_COPY_WRITE_RETRY_WAIT)
+			if !self.isCopyingShard(shardId, serverId) {
+				return errShardCopyCancelled
+			}
+		}
+		if err = self.writeToServer(serverId, database, shardId, series); err == nil {
+			return nil
+		}
+		log.Warn("Couldn't copy the points of shard %d to server %d, retrying: %s", shardId, serverId, err)
+	}
+	return err
+}
+
+func (self *CoordinatorImpl) writeToServer(serverId uint32, database string, shardId uint32, series *protocol.Series) error {
+	request := &protocol.Request{Type: &write, Database: &database, ShardId: &shardId, Series: series}
+	if serverId == self.clusterConfiguration.LocalServerId {
+		return self.clusterConfiguration.GetLocalShardById(shardId).WriteLocalOnly(request)
+	}
+	return self.clusterConfiguration.GetServerById(&serverId).Write(request)
+}
+
+func withoutServerId(ids []uint32, id uint32) []uint32 {
+	newIds := make([]uint32, 0, len(ids))
+	for _, i := range ids {
+		if i != id {
+			newIds = append(newIds, i)
+		}
+	}
+	return newIds
+}
+
+func containsServerId(ids []uint32, id uint32) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
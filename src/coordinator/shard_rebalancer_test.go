@@ -0,0 +1,348 @@
+package coordinator
+
+import (
+	"cluster"
+	"configuration"
+	"errors"
+	"github.com/goraft/raft"
+	. "launchpad.net/gocheck"
+	"parser"
+	"protocol"
+	"time"
+)
+
+type ShardRebalancerSuite struct{}
+
+var _ = Suite(&ShardRebalancerSuite{})
+
+// Applies the changes to the cluster configuration right away, like raft
+// does once they're committed
+type ConsensusMock struct {
+	ClusterConsensus
+	config *cluster.ClusterConfiguration
+}
+
+func (self *ConsensusMock) RemoveServer(id uint32) error {
+	return self.config.RemoveServer(id)
+}
+
+func (self *ConsensusMock) SetShardServers(id uint32, serverIds, pendingServerIds []uint32) error {
+	return self.config.SetShardServers(id, serverIds, pendingServerIds)
+}
+
+// Gives the commands the cluster configuration to apply themselves to.
+// Removing peers fails with peerErr if it's set.
+type RaftServerMock struct {
+	raft.Server
+	config       *cluster.ClusterConfiguration
+	peerErr      error
+	removedPeers []string
+}
+
+func (self *RaftServerMock) Context() interface{} {
+	return self.config
+}
+
+func (self *RaftServerMock) RemovePeer(name string) error {
+	self.removedPeers = append(self.removedPeers, name)
+	return self.peerErr
+}
+
+// The commands are applied right away, like the leader applies them
+// once they're committed
+func (self *RaftServerMock) State() string {
+	return raft.Leader
+}
+
+func (self *RaftServerMock) Do(command raft.Command) (interface{}, error) {
+	return command.Apply(self)
+}
+
+type ShardStoreMock struct {
+	cluster.LocalShardStore
+	db            *ShardDbMock
+	writes        []*protocol.Request
+	deletedShards []uint32
+}
+
+func (self *ShardStoreMock) GetOrCreateShard(id uint32) (cluster.LocalShardDb, error) {
+	return self.db, nil
+}
+
+func (self *ShardStoreMock) BufferWrite(request *protocol.Request) {
+	self.writes = append(self.writes, request)
+}
+
+func (self *ShardStoreMock) DeleteShard(shardId uint32) error {
+	self.deletedShards = append(self.deletedShards, shardId)
+	return nil
+}
+
+// Returns the points of its series to every query
+type ShardDbMock struct {
+	cluster.LocalShardDb
+	series        *protocol.Series
+	hashes        []*cluster.SeriesHash
+	deletedRanges []*cluster.DeletedRange
+}
+
+func (self *ShardDbMock) GetSeriesHashes(database string, startTime, bucketSize int64) ([]*cluster.SeriesHash, error) {
+	return self.hashes, nil
+}
+
+func (self *ShardDbMock) GetSeriesHash(database, series string, startTime, bucketSize int64) (*cluster.SeriesHash, error) {
+	for _, hash := range self.hashes {
+		if hash.Name == series {
+			return hash, nil
+		}
+	}
+	return cluster.NewSeriesHash(series, nil), nil
+}
+
+func (self *ShardDbMock) GetDeletedRanges(database, series string) ([]*cluster.DeletedRange, error) {
+	return self.deletedRanges, nil
+}
+
+func (self *ShardDbMock) Query(querySpec *parser.QuerySpec, processor cluster.QueryProcessor) error {
+	for _, point := range self.series.Points {
+		if !processor.YieldPoint(self.series.Name, self.series.Fields, point) {
+			break
+		}
+	}
+	return nil
+}
+
+// Answers the heartbeats and passes the writes on to the test. The
+// writes fail with err if it's set.
+type ConnectionMock struct {
+	writes chan *protocol.Request
+	err    error
+}
+
+func (self *ConnectionMock) Connect() {}
+
+func (self *ConnectionMock) MakeRequest(request *protocol.Request, responseStream chan *protocol.Response) error {
+	responseType := heartbeatResponse
+	if *request.Type == write {
+		self.writes <- request
+		if self.err != nil {
+			return self.err
+		}
+		responseType = protocol.Response_WRITE_OK
+	}
+	go func() {
+		responseStream <- &protocol.Response{Type: &responseType, RequestId: request.Id}
+	}()
+	return nil
+}
+
+func newShardOnServers(id uint32, servers ...*cluster.ClusterServer) *cluster.ShardData {
+	shard := cluster.NewShard(id, time.Now(), time.Now(), cluster.SHORT_TERM, false, nil)
+	shard.SetServers(servers)
+	return shard
+}
+
+// Returns a cluster configuration of the local server 1 and the remote
+// servers 2 and 3. The local copies of the shards have a series of two
+// points.
+func newCluster(c *C, connection *ConnectionMock) *cluster.ClusterConfiguration {
+	series := stringToSeries(`{
+		"name": "foo",
+		"fields": ["value"],
+		"points": [
+			{"values": [{"int64_value": 1}], "timestamp": 2, "sequence_number": 1},
+			{"values": [{"int64_value": 2}], "timestamp": 1, "sequence_number": 1}
+		]
+	}`, c)
+	store := &ShardStoreMock{db: &ShardDbMock{series: series}}
+	config := cluster.NewClusterConfiguration(&configuration.Configuration{}, &WALMock{}, store, func(string) cluster.ServerConnection {
+		return connection
+	})
+	config.LocalRaftName = "local"
+	config.AddPotentialServer(&cluster.ClusterServer{RaftName: "local"})
+	for _, name := range []string{"remote2", "remote3"} {
+		config.AddPotentialServer(&cluster.ClusterServer{RaftName: name, ProtobufConnectionString: "localhost:0", HeartbeatInterval: time.Second})
+	}
+	c.Assert(config.CreateDatabase("db1", 1), IsNil)
+	return config
+}
+
+// Adds a shard of the hour that starts at the given hour since the epoch
+func addShard(c *C, config *cluster.ClusterConfiguration, hour int64, serverIds ...uint32) *cluster.ShardData {
+	shards, err := config.AddShards([]*cluster.NewShardData{{
+		StartTime: time.Unix(hour*3600, 0),
+		EndTime:   time.Unix((hour+1)*3600, 0),
+		ServerIds: serverIds,
+		Type:      cluster.SHORT_TERM,
+	}})
+	c.Assert(err, IsNil)
+	return shards[0]
+}
+
+func getServer(config *cluster.ClusterConfiguration, id uint32) *cluster.ClusterServer {
+	return config.GetServerById(&id)
+}
+
+// Waits until the shard isn't being copied anymore
+func waitForShardCopy(c *C, shard *cluster.ShardData) {
+	for i := 0; i < 100 && len(shard.PendingServerIds()) > 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.Assert(shard.PendingServerIds(), HasLen, 0)
+}
+
+func (self *ShardRebalancerSuite) TestLeastLoadedServer(c *C) {
+	servers := []*cluster.ClusterServer{}
+	for i := 1; i <= 4; i++ {
+		servers = append(servers, &cluster.ClusterServer{Id: uint32(i)})
+	}
+	shards := []*cluster.ShardData{
+		newShardOnServers(1, servers[0], servers[1]),
+		newShardOnServers(2, servers[0], servers[2]),
+		newShardOnServers(3, servers[1], servers[3]),
+	}
+
+	c.Assert(leastLoadedServer(servers, shards, nil), Equals, uint32(3))
+	c.Assert(leastLoadedServer(servers, shards, []uint32{3}), Equals, uint32(4))
+	c.Assert(leastLoadedServer(servers, shards, []uint32{3, 4}), Equals, uint32(1))
+	c.Assert(leastLoadedServer(servers, shards, []uint32{1, 2, 3, 4}), Equals, uint32(0))
+}
+
+func (self *ShardRebalancerSuite) TestSetShardServersCommand(c *C) {
+	connection := &ConnectionMock{writes: make(chan *protocol.Request, 10)}
+	config := newCluster(c, connection)
+	shard := addShard(c, config, 0, 2)
+	defer stopServers(config.Servers())
+	server := &RaftServerMock{config: config}
+	request := &protocol.Request{Type: &write, Database: protocol.String("db1"), Series: &protocol.Series{}}
+
+	// the shard isn't on this server yet, the copy has to be retried
+	c.Assert(shard.IsLocal(), Equals, false)
+	c.Assert(shard.WriteLocalOnly(request), NotNil)
+
+	// the local copy gets the writes while it's pending
+	_, err := NewSetShardServersCommand(shard.Id(), []uint32{2}, []uint32{1}).Apply(server)
+	c.Assert(err, IsNil)
+	c.Assert(shard.IsLocal(), Equals, true)
+	c.Assert(shard.ServerIds(), DeepEquals, []uint32{2})
+	c.Assert(shard.PendingServerIds(), DeepEquals, []uint32{1})
+	c.Assert(shard.WriteLocalOnly(request), IsNil)
+
+	_, err = NewSetShardServersCommand(shard.Id(), []uint32{1, 2}, nil).Apply(server)
+	c.Assert(err, IsNil)
+	c.Assert(shard.IsLocal(), Equals, true)
+	c.Assert(shard.ServerIds(), DeepEquals, []uint32{1, 2})
+	c.Assert(shard.PendingServerIds(), HasLen, 0)
+
+	_, err = NewSetShardServersCommand(shard.Id(), []uint32{2}, nil).Apply(server)
+	c.Assert(err, IsNil)
+	c.Assert(shard.IsLocal(), Equals, false)
+	c.Assert(shard.WriteLocalOnly(request), NotNil)
+
+	_, err = NewSetShardServersCommand(shard.Id(), []uint32{2, 4}, nil).Apply(server)
+	c.Assert(err, ErrorMatches, "Server 4 doesn't exist")
+}
+
+func (self *ShardRebalancerSuite) TestRebalanceShardCopiesThePoints(c *C) {
+	connection := &ConnectionMock{writes: make(chan *protocol.Request, 10)}
+	config := newCluster(c, connection)
+	shard := addShard(c, config, 0, 1)
+	defer stopServers(config.Servers())
+	coordinator := NewCoordinatorImpl(&configuration.Configuration{}, &ConsensusMock{config: config}, config)
+	root := &cluster.ClusterAdmin{CommonUser: cluster.CommonUser{Name: "root"}}
+
+	c.Assert(coordinator.RebalanceShard(root, shard.Id(), 2, 0), IsNil)
+	waitForShardCopy(c, shard)
+	c.Assert(shard.ServerIds(), DeepEquals, []uint32{1, 2})
+
+	c.Assert(connection.writes, HasLen, 1)
+	request := <-connection.writes
+	c.Assert(request.GetDatabase(), Equals, "db1")
+	c.Assert(request.GetShardId(), Equals, shard.Id())
+	c.Assert(request.Series.GetName(), Equals, "foo")
+	c.Assert(request.Series.Points, HasLen, 2)
+}
+
+func (self *ShardRebalancerSuite) TestCancelledShardCopiesStop(c *C) {
+	connection := &ConnectionMock{writes: make(chan *protocol.Request, 10), err: errors.New("server is down")}
+	config := newCluster(c, connection)
+	shard := addShard(c, config, 0, 1)
+	defer stopServers(config.Servers())
+	coordinator := NewCoordinatorImpl(&configuration.Configuration{}, &ConsensusMock{config: config}, config)
+	root := &cluster.ClusterAdmin{CommonUser: cluster.CommonUser{Name: "root"}}
+
+	c.Assert(coordinator.CancelShardCopy(root, shard.Id()), ErrorMatches, ".*isn't being copied")
+	c.Assert(coordinator.RebalanceShard(root, shard.Id(), 2, 0), IsNil)
+	c.Assert(shard.PendingServerIds(), DeepEquals, []uint32{2})
+	c.Assert(coordinator.RebalanceShard(root, shard.Id(), 2, 0), ErrorMatches, ".*is already being copied.*")
+
+	// the first write fails, the copy stops instead of retrying it
+	select {
+	case <-connection.writes:
+	case <-time.After(5 * time.Second):
+		c.Fatal("the shard wasn't copied")
+	}
+	c.Assert(coordinator.CancelShardCopy(root, shard.Id()), IsNil)
+	c.Assert(shard.PendingServerIds(), HasLen, 0)
+	c.Assert(shard.ServerIds(), DeepEquals, []uint32{1})
+	time.Sleep(SHARD_COPY_WRITE_RETRY_WAIT + 100*time.Millisecond)
+	c.Assert(connection.writes, HasLen, 0)
+}
+
+func (self *ShardRebalancerSuite) TestRemoveServerCommand(c *C) {
+	connection := &ConnectionMock{writes: make(chan *protocol.Request, 10)}
+	config := newCluster(c, connection)
+	defer stopServers(config.Servers())
+	first := addShard(c, config, 0, 1, 2)
+	second := addShard(c, config, 1, 3)
+	c.Assert(config.SetShardServers(second.Id(), []uint32{3}, []uint32{2}), IsNil)
+	removedServer := getServer(config, 2)
+	server := &RaftServerMock{config: config, peerErr: errors.New("raft: Peer not found: remote2")}
+
+	// raft may not know the peer, the server is removed anyway
+	_, err := NewRemoveServerCommand(2).Apply(server)
+	c.Assert(err, IsNil)
+	c.Assert(server.removedPeers, DeepEquals, []string{"remote2"})
+	c.Assert(getServer(config, 2), IsNil)
+	c.Assert(removedServer.IsUp(), Equals, false)
+	c.Assert(first.ServerIds(), DeepEquals, []uint32{1})
+	c.Assert(second.ServerIds(), DeepEquals, []uint32{3})
+	c.Assert(second.PendingServerIds(), HasLen, 0)
+
+	_, err = NewRemoveServerCommand(2).Apply(server)
+	c.Assert(err, ErrorMatches, "Server 2 doesn't exist")
+
+	// other raft errors are returned after the server is removed
+	server.peerErr = errors.New("raft is stopped")
+	_, err = NewRemoveServerCommand(3).Apply(server)
+	c.Assert(err, ErrorMatches, "raft is stopped")
+	c.Assert(getServer(config, 3), IsNil)
+	c.Assert(second.ServerIds(), HasLen, 0)
+}
+
+func (self *ShardRebalancerSuite) TestRemoveServerReplacesItsShards(c *C) {
+	connection := &ConnectionMock{writes: make(chan *protocol.Request, 10)}
+	config := newCluster(c, connection)
+	defer stopServers(config.Servers())
+	onlyCopy := addShard(c, config, 0, 2)
+	replicated := addShard(c, config, 1, 1, 2)
+	coordinator := NewCoordinatorImpl(&configuration.Configuration{}, &ConsensusMock{config: config}, config)
+	root := &cluster.ClusterAdmin{CommonUser: cluster.CommonUser{Name: "root"}}
+
+	c.Assert(coordinator.RemoveServer(root, 1, 0), ErrorMatches, ".*can't remove itself.*")
+	c.Assert(coordinator.RemoveServer(root, 2, 4), ErrorMatches, "Server 4 doesn't exist")
+	c.Assert(coordinator.RemoveServer(root, 2, 3), IsNil)
+	c.Assert(getServer(config, 2), IsNil)
+
+	// the shard that had a copy on another server is copied from it
+	select {
+	case request := <-connection.writes:
+		c.Assert(request.GetShardId(), Equals, replicated.Id())
+	case <-time.After(5 * time.Second):
+		c.Fatal("the shard wasn't copied")
+	}
+	waitForShardCopy(c, replicated)
+	c.Assert(replicated.ServerIds(), DeepEquals, []uint32{1, 3})
+	c.Assert(onlyCopy.ServerIds(), DeepEquals, []uint32{3})
+	c.Assert(connection.writes, HasLen, 0)
+}
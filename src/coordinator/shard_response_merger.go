@@ -0,0 +1,281 @@
+package coordinator
+
+import (
+	"common"
+	"container/heap"
+	"fmt"
+	"protocol"
+)
+
+// Merges the response streams of the shards of a query. The streams of
+// queries that read from a single series are merged in time order, so
+// the shards can run in parallel and the first points of the query are
+// yielded as soon as every shard has sent its first response. The
+// response channels of the shards are bounded, a shard that is ahead of
+// the others blocks until the merge catches up with it. The streams of
+// other queries can't be merged by time, since the shards yield their
+// series one after the other, so they are read in the order of the
+// shards. If the merge stops before the end of the streams, the shards
+// are stopped with the given cancellation.
+type ShardResponseMerger struct {
+	streams      []*shardStream
+	timeOrdered  bool
+	ascending    bool
+	cancellation *common.QueryCancellation
+}
+
+type shardStream struct {
+	index     int
+	responses chan *protocol.Response
+	series    *protocol.Series
+	position  int
+	done      bool
+	err       error
+}
+
+// Returns the next point of the stream and its series, or nil at the
+// end of the stream. Series without points are passed to yieldEmpty.
+// The error the shard ended the stream with is kept in err.
+func (self *shardStream) next(yieldEmpty func(*protocol.Series)) (*protocol.Series, *protocol.Point) {
+	for !self.done {
+		if self.series != nil && self.position < len(self.series.Points) {
+			point := self.series.Points[self.position]
+			self.position++
+			return self.series, point
+		}
+
+		response := <-self.responses
+		if *response.Type == endStreamResponse || *response.Type == accessDeniedResponse {
+			if response.ErrorMessage != nil {
+				self.err = fmt.Errorf("%s", *response.ErrorMessage)
+			}
+			self.done = true
+			self.series = nil
+			break
+		}
+
+		self.series, self.position = response.Series, 0
+		if self.series != nil && len(self.series.Points) == 0 && yieldEmpty != nil {
+			yieldEmpty(self.series)
+		}
+	}
+	return nil, nil
+}
+
+// Reads the rest of the stream in the background, so the shard doesn't
+// block on the full response channel
+func (self *shardStream) discard() {
+	if self.done {
+		return
+	}
+	self.done = true
+	go func() {
+		for {
+			response := <-self.responses
+			if *response.Type == endStreamResponse || *response.Type == accessDeniedResponse {
+				return
+			}
+		}
+	}()
+}
+
+type streamHead struct {
+	stream *shardStream
+	series *protocol.Series
+	point  *protocol.Point
+}
+
+// The next point of every stream that hasn't ended, ordered by time
+type streamHeads struct {
+	ascending bool
+	heads     []*streamHead
+}
+
+func (self *streamHeads) Len() int {
+	return len(self.heads)
+}
+
+func (self *streamHeads) Less(i, j int) bool {
+	left, right := *self.heads[i].point.Timestamp, *self.heads[j].point.Timestamp
+	if left == right {
+		return self.heads[i].stream.index < self.heads[j].stream.index
+	}
+	if self.ascending {
+		return left < right
+	}
+	return left > right
+}
+
+func (self *streamHeads) Swap(i, j int) {
+	self.heads[i], self.heads[j] = self.heads[j], self.heads[i]
+}
+
+func (self *streamHeads) Push(x interface{}) {
+	self.heads = append(self.heads, x.(*streamHead))
+}
+
+func (self *streamHeads) Pop() interface{} {
+	last := len(self.heads) - 1
+	head := self.heads[last]
+	self.heads = self.heads[:last]
+	return head
+}
+
+func NewShardResponseMerger(responses []chan *protocol.Response, timeOrdered, ascending bool, cancellation *common.QueryCancellation) *ShardResponseMerger {
+	streams := make([]*shardStream, 0, len(responses))
+	for i, responseChan := range responses {
+		streams = append(streams, &shardStream{index: i, responses: responseChan})
+	}
+	return &ShardResponseMerger{streams, timeOrdered, ascending, cancellation}
+}
+
+// Yields the points of all the shards until yield returns false or all
+// the streams end. Series without points are passed to yieldEmpty when
+// they're read. Returns the first error a shard ended its stream with,
+// the points of that shard are incomplete.
+func (self *ShardResponseMerger) Merge(yield func(*protocol.Series, *protocol.Point) bool, yieldEmpty func(*protocol.Series)) error {
+	self.merge(yield, yieldEmpty)
+
+	stopped := false
+	for _, stream := range self.streams {
+		if !stream.done {
+			stopped = true
+		}
+		stream.discard()
+	}
+	if stopped && self.cancellation != nil {
+		self.cancellation.Cancel(common.NewQueryError(common.QueryCancelled, "The query doesn't need more points"))
+	}
+
+	for _, stream := range self.streams {
+		if stream.err != nil {
+			return stream.err
+		}
+	}
+	return nil
+}
+
+func (self *ShardResponseMerger) merge(yield func(*protocol.Series, *protocol.Point) bool, yieldEmpty func(*protocol.Series)) {
+	if !self.timeOrdered {
+		for _, stream := range self.streams {
+			for {
+				series, point := stream.next(yieldEmpty)
+				if point == nil {
+					if stream.err != nil {
+						return
+					}
+					break
+				}
+				if !yield(series, point) {
+					return
+				}
+			}
+		}
+		return
+	}
+
+	heads := &streamHeads{ascending: self.ascending}
+	for _, stream := range self.streams {
+		series, point := stream.next(yieldEmpty)
+		if stream.err != nil {
+			return
+		}
+		if point != nil {
+			heads.heads = append(heads.heads, &streamHead{stream, series, point})
+		}
+	}
+	heap.Init(heads)
+
+	for heads.Len() > 0 {
+		head := heads.heads[0]
+		if !yield(head.series, head.point) {
+			return
+		}
+
+		head.series, head.point = head.stream.next(yieldEmpty)
+		if head.point == nil {
+			if head.stream.err != nil {
+				return
+			}
+			heap.Pop(heads)
+			continue
+		}
+		heap.Fix(heads, 0)
+	}
+}
+
+// Writes the merged points in batches of up to MERGED_POINTS_BATCH_SIZE
+// points per series and applies the limit of the query to every series
+type mergedSeriesWriter struct {
+	writer      SeriesWriter
+	limit       int
+	stopAtLimit bool
+	counts      map[string]int
+	batches     map[string]*protocol.Series
+}
+
+const MERGED_POINTS_BATCH_SIZE = 100
+
+func newMergedSeriesWriter(writer SeriesWriter, limit int, stopAtLimit bool) *mergedSeriesWriter {
+	return &mergedSeriesWriter{
+		writer:      writer,
+		limit:       limit,
+		stopAtLimit: stopAtLimit,
+		counts:      make(map[string]int),
+		batches:     make(map[string]*protocol.Series),
+	}
+}
+
+// Returns false if no more points should be read
+func (self *mergedSeriesWriter) yield(series *protocol.Series, point *protocol.Point) bool {
+	name := *series.Name
+	if self.limit > 0 && self.counts[name] >= self.limit {
+		return !self.stopAtLimit
+	}
+	self.counts[name]++
+
+	batch := self.batches[name]
+	if batch != nil && !equalFields(batch.Fields, series.Fields) {
+		self.writer.Write(batch)
+		batch = nil
+	}
+	if batch == nil {
+		batch = &protocol.Series{Name: series.Name, Fields: series.Fields, Points: make([]*protocol.Point, 0, MERGED_POINTS_BATCH_SIZE)}
+		self.batches[name] = batch
+	}
+	batch.Points = append(batch.Points, point)
+	if len(batch.Points) >= MERGED_POINTS_BATCH_SIZE {
+		self.writer.Write(batch)
+		delete(self.batches, name)
+	}
+
+	return !self.stopAtLimit || self.limit <= 0 || self.counts[name] < self.limit
+}
+
+func (self *mergedSeriesWriter) yieldEmpty(series *protocol.Series) {
+	// the points of the series that were merged before go first
+	if batch := self.batches[*series.Name]; batch != nil {
+		self.writer.Write(batch)
+		delete(self.batches, *series.Name)
+	}
+	self.writer.Write(series)
+}
+
+func (self *mergedSeriesWriter) flush() {
+	for _, batch := range self.batches {
+		self.writer.Write(batch)
+	}
+	self.batches = make(map[string]*protocol.Series)
+}
+
+func equalFields(left, right []string) bool {
+	if len(left) != len(right) {
+		return false
+	}
+	for i := range left {
+		if left[i] != right[i] {
+			return false
+		}
+	}
+	return true
+}
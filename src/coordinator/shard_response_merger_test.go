@@ -0,0 +1,152 @@
+package coordinator
+
+import (
+	"common"
+	. "launchpad.net/gocheck"
+	"protocol"
+)
+
+type ShardResponseMergerSuite struct{}
+
+var _ = Suite(&ShardResponseMergerSuite{})
+
+type collectingSeriesWriter struct {
+	series []*protocol.Series
+}
+
+func (self *collectingSeriesWriter) Write(series *protocol.Series) error {
+	self.series = append(self.series, series)
+	return nil
+}
+
+func (self *collectingSeriesWriter) Close() {}
+
+// Starts a shard that sends the given timestamps in responses of
+// batchSize points and returns its response channel
+func startShard(name string, batchSize int, timestamps ...int64) chan *protocol.Response {
+	responses := make(chan *protocol.Response, 1)
+	go func() {
+		responseType := protocol.Response_QUERY
+		for len(timestamps) > 0 {
+			size := batchSize
+			if size > len(timestamps) {
+				size = len(timestamps)
+			}
+			series := &protocol.Series{Name: protocol.String(name), Fields: []string{"value"}}
+			for _, timestamp := range timestamps[:size] {
+				t := timestamp
+				series.Points = append(series.Points, &protocol.Point{Timestamp: &t})
+			}
+			timestamps = timestamps[size:]
+			responses <- &protocol.Response{Type: &responseType, Series: series}
+		}
+		responses <- &protocol.Response{Type: &endStreamResponse}
+	}()
+	return responses
+}
+
+func timestamps(series []*protocol.Series) []int64 {
+	result := []int64{}
+	for _, s := range series {
+		for _, point := range s.Points {
+			result = append(result, *point.Timestamp)
+		}
+	}
+	return result
+}
+
+func (self *ShardResponseMergerSuite) TestMergeInTimeOrder(c *C) {
+	responses := []chan *protocol.Response{
+		startShard("foo", 2, 1, 4, 5, 9),
+		startShard("foo", 1, 2, 3, 8),
+		startShard("foo", 3),
+		startShard("foo", 3, 6, 7, 10),
+	}
+	writer := &collectingSeriesWriter{}
+	merged := newMergedSeriesWriter(writer, 0, true)
+	NewShardResponseMerger(responses, true, true, nil).Merge(merged.yield, merged.yieldEmpty)
+	merged.flush()
+	c.Assert(timestamps(writer.series), DeepEquals, []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10})
+
+	responses = []chan *protocol.Response{
+		startShard("foo", 2, 9, 5, 4, 1),
+		startShard("foo", 1, 8, 3, 2),
+	}
+	writer = &collectingSeriesWriter{}
+	merged = newMergedSeriesWriter(writer, 0, true)
+	NewShardResponseMerger(responses, true, false, nil).Merge(merged.yield, merged.yieldEmpty)
+	merged.flush()
+	c.Assert(timestamps(writer.series), DeepEquals, []int64{9, 8, 5, 4, 3, 2, 1})
+}
+
+func (self *ShardResponseMergerSuite) TestMergeStopsAtLimit(c *C) {
+	first := startShard("foo", 1, 1, 3, 5, 7, 9)
+	second := startShard("foo", 1, 2, 4, 6, 8, 10)
+	writer := &collectingSeriesWriter{}
+	merged := newMergedSeriesWriter(writer, 3, true)
+	NewShardResponseMerger([]chan *protocol.Response{first, second}, true, true, nil).Merge(merged.yield, merged.yieldEmpty)
+	merged.flush()
+	c.Assert(timestamps(writer.series), DeepEquals, []int64{1, 2, 3})
+}
+
+func (self *ShardResponseMergerSuite) TestShardsAreReadInOrderIfNotTimeOrdered(c *C) {
+	responses := []chan *protocol.Response{
+		startShard("foo", 2, 5, 6),
+		startShard("bar", 2, 1, 2, 3),
+	}
+	writer := &collectingSeriesWriter{}
+	merged := newMergedSeriesWriter(writer, 2, false)
+	NewShardResponseMerger(responses, false, true, nil).Merge(merged.yield, merged.yieldEmpty)
+	merged.flush()
+
+	// the limit applies to every series
+	points := map[string][]int64{}
+	for _, series := range writer.series {
+		points[*series.Name] = append(points[*series.Name], timestamps([]*protocol.Series{series})...)
+	}
+	c.Assert(points, DeepEquals, map[string][]int64{"foo": {5, 6}, "bar": {1, 2}})
+}
+
+func (self *ShardResponseMergerSuite) TestMergeStopsTheShardsAtLimit(c *C) {
+	first := startShard("foo", 1, 1, 3, 5, 7, 9)
+	second := startShard("foo", 1, 2, 4, 6, 8, 10)
+	cancellation := common.NewQueryCancellation()
+	merged := newMergedSeriesWriter(&collectingSeriesWriter{}, 3, true)
+	err := NewShardResponseMerger([]chan *protocol.Response{first, second}, true, true, cancellation).Merge(merged.yield, merged.yieldEmpty)
+	c.Assert(err, IsNil)
+	c.Assert(cancellation.IsCancelled(), Equals, true)
+
+	// the shards aren't cancelled if they sent all their points
+	cancellation = common.NewQueryCancellation()
+	merged = newMergedSeriesWriter(&collectingSeriesWriter{}, 0, true)
+	err = NewShardResponseMerger([]chan *protocol.Response{startShard("foo", 1, 1, 2)}, true, true, cancellation).Merge(merged.yield, merged.yieldEmpty)
+	c.Assert(err, IsNil)
+	c.Assert(cancellation.IsCancelled(), Equals, false)
+}
+
+func (self *ShardResponseMergerSuite) TestMergeReturnsTheErrorsOfTheShards(c *C) {
+	failing := make(chan *protocol.Response, 1)
+	message := "Response buffer full"
+	failing <- &protocol.Response{Type: &endStreamResponse, ErrorMessage: &message}
+	cancellation := common.NewQueryCancellation()
+	merged := newMergedSeriesWriter(&collectingSeriesWriter{}, 0, true)
+	err := NewShardResponseMerger([]chan *protocol.Response{startShard("foo", 1, 1, 2, 3), failing}, true, true, cancellation).Merge(merged.yield, merged.yieldEmpty)
+	c.Assert(err, ErrorMatches, message)
+	c.Assert(cancellation.IsCancelled(), Equals, true)
+}
+
+func (self *ShardResponseMergerSuite) TestEmptySeriesAreWrittenAfterTheMergedPoints(c *C) {
+	responses := make(chan *protocol.Response, 3)
+	responseType := protocol.Response_QUERY
+	t := int64(1)
+	responses <- &protocol.Response{Type: &responseType, Series: &protocol.Series{Name: protocol.String("foo"), Points: []*protocol.Point{&protocol.Point{Timestamp: &t}}}}
+	responses <- &protocol.Response{Type: &responseType, Series: &protocol.Series{Name: protocol.String("foo")}}
+	responses <- &protocol.Response{Type: &endStreamResponse}
+	writer := &collectingSeriesWriter{}
+	merged := newMergedSeriesWriter(writer, 0, true)
+	NewShardResponseMerger([]chan *protocol.Response{responses}, true, true, nil).Merge(merged.yield, merged.yieldEmpty)
+	merged.flush()
+	c.Assert(writer.series, HasLen, 2)
+	c.Assert(writer.series[0].Points, HasLen, 1)
+	c.Assert(writer.series[1].Points, HasLen, 0)
+}
@@ -0,0 +1,97 @@
+package coordinator
+
+import (
+	"cluster"
+	"common"
+	"errors"
+	. "launchpad.net/gocheck"
+	"protocol"
+	"time"
+	"wal"
+)
+
+type WriteConsistencySuite struct{}
+
+var _ = Suite(&WriteConsistencySuite{})
+
+// Passes the commits of the write buffers on to the shard that waits
+// for them
+type CommitsWALMock struct {
+	WALMock
+	commits chan uint32
+}
+
+func (self *CommitsWALMock) Commit(requestNumber, serverId uint32) error {
+	self.commits <- serverId
+	return nil
+}
+
+func (self *CommitsWALMock) LogAndWaitForCommits(request *protocol.Request, shard wal.Shard, serverIds []uint32) (uint32, <-chan uint32, error) {
+	return 1, self.commits, nil
+}
+
+func (self *CommitsWALMock) StopWaitingForCommits(requestNumber uint32) {}
+
+type WriterMock struct {
+	err error
+}
+
+func (self *WriterMock) Write(request *protocol.Request) error {
+	return self.err
+}
+
+// Returns a shard on three servers, the last one fails all the writes
+func newShardWithFailingServer() (*cluster.ShardData, []*cluster.ClusterServer) {
+	wal := &CommitsWALMock{commits: make(chan uint32, 10)}
+	servers := []*cluster.ClusterServer{}
+	for i := 1; i <= 3; i++ {
+		writer := &WriterMock{}
+		if i == 3 {
+			writer.err = errors.New("server is down")
+		}
+		server := &cluster.ClusterServer{Id: uint32(i)}
+		server.SetWriteBuffer(cluster.NewWriteBuffer(writer, wal, server.Id, 10, 0, 0))
+		servers = append(servers, server)
+	}
+	shard := cluster.NewShard(1, time.Now(), time.Now(), cluster.SHORT_TERM, false, wal)
+	shard.SetServers(servers)
+	return shard, servers
+}
+
+func stopServers(servers []*cluster.ClusterServer) {
+	for _, server := range servers {
+		server.Stop()
+	}
+}
+
+func newWriteRequest() *protocol.Request {
+	series := &protocol.Series{Name: protocol.String("foo"), Fields: []string{"value"}}
+	return &protocol.Request{Type: &write, Database: protocol.String("db1"), Series: series}
+}
+
+func (self *WriteConsistencySuite) TestRequiredAcknowledgements(c *C) {
+	for name, required := range map[string][]int{"any": {0, 0, 0}, "one": {1, 1, 1}, "quorum": {1, 2, 2}, "ALL": {1, 2, 3}} {
+		consistency, err := cluster.ParseWriteConsistency(name)
+		c.Assert(err, IsNil)
+		for i, r := range required {
+			c.Assert(consistency.RequiredAcknowledgements(i+1), Equals, r, Commentf("%s with %d replicas", name, i+1))
+		}
+	}
+	_, err := cluster.ParseWriteConsistency("two")
+	c.Assert(err, NotNil)
+}
+
+func (self *WriteConsistencySuite) TestWritesWaitForTheReplicas(c *C) {
+	shard, servers := newShardWithFailingServer()
+	defer stopServers(servers)
+	c.Assert(shard.WriteWithConsistency(newWriteRequest(), cluster.WriteConsistencyQuorum, time.Second), IsNil)
+}
+
+func (self *WriteConsistencySuite) TestWritesTimeOutWithoutEnoughReplicas(c *C) {
+	shard, servers := newShardWithFailingServer()
+	defer stopServers(servers)
+	err := shard.WriteWithConsistency(newWriteRequest(), cluster.WriteConsistencyAll, 100*time.Millisecond)
+	c.Assert(err, FitsTypeOf, &common.PartialWriteError{})
+	c.Assert(err.(*common.PartialWriteError).Acknowledged, Equals, 2)
+	c.Assert(err.(*common.PartialWriteError).Required, Equals, 3)
+}
@@ -0,0 +1,167 @@
+package coordinator
+
+import (
+	"cluster"
+	"common"
+	"sync"
+	"time"
+)
+
+// A token bucket that refills at rate tokens per second and holds up to
+// a second worth of tokens. A full bucket can go into debt, so requests
+// that are larger than the bucket aren't rejected forever. A rate of 0
+// means there's no limit.
+type tokenBucket struct {
+	rate       float64
+	tokens     float64
+	lastRefill time.Time
+}
+
+func newTokenBucket(rate float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: rate, lastRefill: now}
+}
+
+func (self *tokenBucket) refill(now time.Time) {
+	self.tokens += now.Sub(self.lastRefill).Seconds() * self.rate
+	if self.tokens > self.rate {
+		self.tokens = self.rate
+	}
+	self.lastRefill = now
+}
+
+// Returns how long to wait before count tokens can be taken, or 0 if
+// they can be taken now
+func (self *tokenBucket) wait(count float64, now time.Time) time.Duration {
+	if self.rate <= 0 {
+		return 0
+	}
+	self.refill(now)
+	if self.tokens >= count || self.tokens >= self.rate {
+		return 0
+	}
+	needed := count
+	if needed > self.rate {
+		needed = self.rate
+	}
+	return time.Duration((needed - self.tokens) / self.rate * float64(time.Second))
+}
+
+func (self *tokenBucket) take(count float64) {
+	if self.rate <= 0 {
+		return
+	}
+	self.tokens -= count
+}
+
+type writeBuckets struct {
+	// the user the limit applies to, empty for the limit of the database
+	username string
+	limit    cluster.WriteLimit
+	points   *tokenBucket
+	requests *tokenBucket
+}
+
+// Enforces the write limits of the cluster configuration. The buckets are
+// local to the server, every server enforces the limits on the writes it
+// receives.
+type WriteLimiter struct {
+	clusterConfiguration *cluster.ClusterConfiguration
+	lock                 sync.Mutex
+	buckets              map[string]*writeBuckets
+	now                  func() time.Time
+}
+
+func NewWriteLimiter(clusterConfiguration *cluster.ClusterConfiguration) *WriteLimiter {
+	return &WriteLimiter{
+		clusterConfiguration: clusterConfiguration,
+		buckets:              make(map[string]*writeBuckets),
+		now:                  time.Now,
+	}
+}
+
+// Takes a request and the given number of points from the buckets of the
+// database and of the user. If any of the limits is exceeded nothing is
+// taken and a WriteLimitError is returned. The user limit doesn't apply
+// if username is empty.
+func (self *WriteLimiter) Take(db, username string, points int) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	now := self.now()
+	buckets := self.getAllBuckets(db, username, now)
+
+	var retryAfter time.Duration
+	var exceeded *writeBuckets
+	for _, b := range buckets {
+		for _, wait := range []time.Duration{b.requests.wait(1, now), b.points.wait(float64(points), now)} {
+			if wait > retryAfter {
+				retryAfter = wait
+				exceeded = b
+			}
+		}
+	}
+	if exceeded != nil {
+		common.InternalStats.Increment("coordinator.writes_limited")
+		if exceeded.username == "" {
+			return common.NewWriteLimitError(retryAfter, "Write limit of database %s exceeded", db)
+		}
+		return common.NewWriteLimitError(retryAfter, "Write limit of user %s on database %s exceeded", username, db)
+	}
+
+	for _, b := range buckets {
+		b.requests.take(1)
+		b.points.take(float64(points))
+	}
+	return nil
+}
+
+// Takes the given number of points of a request that Take already let
+// through. The points are never refused, the buckets go into debt
+// instead, so the next requests have to wait longer.
+func (self *WriteLimiter) Charge(db, username string, points int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	now := self.now()
+	for _, b := range self.getAllBuckets(db, username, now) {
+		b.points.refill(now)
+		b.points.take(float64(points))
+	}
+}
+
+// Returns the buckets of the database and of the user that have a limit
+func (self *WriteLimiter) getAllBuckets(db, username string, now time.Time) []*writeBuckets {
+	buckets := []*writeBuckets{}
+	if b := self.getBuckets(db, "", now); b != nil {
+		buckets = append(buckets, b)
+	}
+	if username != "" {
+		if b := self.getBuckets(db, username, now); b != nil {
+			buckets = append(buckets, b)
+		}
+	}
+	return buckets
+}
+
+// Returns the buckets for the current limit, or nil if there's no limit.
+// The buckets are reset when the limit changes.
+func (self *WriteLimiter) getBuckets(db, username string, now time.Time) *writeBuckets {
+	key := db + "/" + username
+	limit := self.clusterConfiguration.GetWriteLimit(db, username)
+	if limit.IsUnlimited() {
+		delete(self.buckets, key)
+		return nil
+	}
+
+	b := self.buckets[key]
+	if b == nil || b.limit != *limit {
+		b = &writeBuckets{
+			username: username,
+			limit:    *limit,
+			points:   newTokenBucket(limit.PointsPerSecond, now),
+			requests: newTokenBucket(limit.RequestsPerSecond, now),
+		}
+		self.buckets[key] = b
+	}
+	return b
+}
@@ -0,0 +1,101 @@
+package coordinator
+
+import (
+	"cluster"
+	"common"
+	"configuration"
+	. "launchpad.net/gocheck"
+	"time"
+)
+
+type WriteLimiterSuite struct{}
+
+var _ = Suite(&WriteLimiterSuite{})
+
+func newTestWriteLimiter(now *time.Time) (*WriteLimiter, *cluster.ClusterConfiguration) {
+	config := cluster.NewClusterConfiguration(&configuration.Configuration{}, &WALMock{}, nil, newProtobufClient)
+	limiter := NewWriteLimiter(config)
+	limiter.now = func() time.Time { return *now }
+	return limiter, config
+}
+
+func (self *WriteLimiterSuite) TestDatabaseAndUserLimits(c *C) {
+	now := time.Now()
+	limiter, config := newTestWriteLimiter(&now)
+
+	// no limits
+	for i := 0; i < 100; i++ {
+		c.Assert(limiter.Take("db1", "paul", 1000), IsNil)
+	}
+
+	config.SetWriteLimit("db1", "", &cluster.WriteLimit{PointsPerSecond: 100})
+	config.SetWriteLimit("db1", "paul", &cluster.WriteLimit{RequestsPerSecond: 2})
+
+	c.Assert(limiter.Take("db1", "paul", 10), IsNil)
+	c.Assert(limiter.Take("db1", "paul", 10), IsNil)
+	err := limiter.Take("db1", "paul", 10)
+	c.Assert(err, FitsTypeOf, &common.WriteLimitError{})
+	c.Assert(err.(*common.WriteLimitError).RetryAfter, Equals, 500*time.Millisecond)
+
+	// the rejected request didn't take any points from the database
+	c.Assert(limiter.Take("db1", "todd", 80), IsNil)
+	err = limiter.Take("db1", "", 1)
+	c.Assert(err, NotNil)
+	c.Assert(err.(*common.WriteLimitError).RetryAfter, Equals, 10*time.Millisecond)
+
+	now = now.Add(time.Second)
+	c.Assert(limiter.Take("db1", "paul", 10), IsNil)
+	c.Assert(limiter.Take("db2", "paul", 1000), IsNil)
+
+	// removing the limits
+	config.SetWriteLimit("db1", "", nil)
+	config.SetWriteLimit("db1", "paul", &cluster.WriteLimit{})
+	for i := 0; i < 10; i++ {
+		c.Assert(limiter.Take("db1", "paul", 1000), IsNil)
+	}
+}
+
+func (self *WriteLimiterSuite) TestLargeWritesAreAllowedWhenTheBucketIsFull(c *C) {
+	now := time.Now()
+	limiter, config := newTestWriteLimiter(&now)
+	config.SetWriteLimit("db1", "", &cluster.WriteLimit{PointsPerSecond: 100})
+
+	c.Assert(limiter.Take("db1", "", 250), IsNil)
+	now = now.Add(time.Second)
+	err := limiter.Take("db1", "", 1)
+	c.Assert(err, NotNil)
+	c.Assert(err.(*common.WriteLimitError).RetryAfter, Equals, 510*time.Millisecond)
+	now = now.Add(2 * time.Second)
+	c.Assert(limiter.Take("db1", "", 250), IsNil)
+}
+
+func (self *WriteLimiterSuite) TestTheErrorNamesTheExceededLimit(c *C) {
+	now := time.Now()
+	limiter, config := newTestWriteLimiter(&now)
+	config.SetWriteLimit("db1", "", &cluster.WriteLimit{PointsPerSecond: 100})
+	config.SetWriteLimit("db1", "paul", &cluster.WriteLimit{PointsPerSecond: 1000})
+
+	c.Assert(limiter.Take("db1", "paul", 100), IsNil)
+	err := limiter.Take("db1", "paul", 10)
+	c.Assert(err, ErrorMatches, "Write limit of database db1 exceeded")
+
+	config.SetWriteLimit("db1", "", &cluster.WriteLimit{PointsPerSecond: 1000})
+	config.SetWriteLimit("db1", "paul", &cluster.WriteLimit{PointsPerSecond: 100})
+	c.Assert(limiter.Take("db1", "paul", 100), IsNil)
+	err = limiter.Take("db1", "paul", 10)
+	c.Assert(err, ErrorMatches, "Write limit of user paul on database db1 exceeded")
+}
+
+func (self *WriteLimiterSuite) TestChargedPointsAreNeverRefused(c *C) {
+	now := time.Now()
+	limiter, config := newTestWriteLimiter(&now)
+	config.SetWriteLimit("db1", "", &cluster.WriteLimit{PointsPerSecond: 100})
+
+	// the rest of an admitted request goes through, the next request waits
+	c.Assert(limiter.Take("db1", "", 50), IsNil)
+	limiter.Charge("db1", "", 100)
+	limiter.Charge("db1", "", 100)
+	err := limiter.Take("db1", "", 1)
+	c.Assert(err, NotNil)
+	c.Assert(err.(*common.WriteLimitError).RetryAfter, Equals, 1510*time.Millisecond)
+}
@@ -61,6 +61,7 @@ func main() {
 	wantsVersion := flag.Bool("v", false, "Get version number")
 	resetRootPassword := flag.Bool("reset-root", false, "Reset root password")
 	pidFile := flag.String("pidfile", "", "the pid file")
+	restoreFile := flag.String("restore", "", "Restore the server from the given backup archive. The raft and data directories must be empty")
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	flag.Parse()
@@ -97,6 +98,14 @@ func main() {
 +---------------------------------------------+
 
 `)
+	if *restoreFile != "" {
+		if _, err := os.Stat(filepath.Join(config.RaftDir, "log")); err == nil {
+			log.Error("Cannot restore from backup since the raft directory %s isn't empty", config.RaftDir)
+			time.Sleep(time.Second)
+			os.Exit(1)
+		}
+	}
+
 	os.MkdirAll(config.RaftDir, 0744)
 	os.MkdirAll(config.DataDir, 0744)
 	server, err := server.NewServer(config)
@@ -106,6 +115,21 @@ func main() {
 		panic(err)
 	}
 
+	if *restoreFile != "" {
+		log.Info("Restoring from backup %s", *restoreFile)
+		backup, err := os.Open(*restoreFile)
+		if err != nil {
+			time.Sleep(time.Second)
+			panic(err)
+		}
+		err = server.Restore(backup)
+		backup.Close()
+		if err != nil {
+			time.Sleep(time.Second)
+			panic(err)
+		}
+	}
+
 	if *resetRootPassword {
 		// TODO: make this not suck
 		// This is ghetto as hell, but it'll work for now.
@@ -0,0 +1,266 @@
+package datastore
+
+// A backup is a tar archive with the following entries:
+//
+//   cluster_configuration  the output of ClusterConfiguration.Save()
+//   shards/<shard id>      every key/value pair of the shard as of the
+//                          time the shard was backed up
+//
+// Each key/value pair of a shard is written as a little endian uint32
+// length followed by the key, then a uint32 length followed by the
+// value.
+
+import (
+	"archive/tar"
+	"bufio"
+	log "code.google.com/p/log4go"
+	"encoding/binary"
+	"fmt"
+	"github.com/jmhodges/levigo"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+const (
+	BACKUP_CLUSTER_CONFIGURATION_ENTRY = "cluster_configuration"
+	BACKUP_SHARDS_DIR                  = "shards"
+	RESTORE_BATCH_SIZE                 = 1000
+)
+
+// Writes a backup of the given cluster configuration and all the
+// local shards to the given writer
+func (self *LevelDbShardDatastore) Backup(w io.Writer, clusterConfiguration []byte) error {
+	shardIds, err := self.localShardIds()
+	if err != nil {
+		return err
+	}
+
+	archive := tar.NewWriter(w)
+	err = archive.WriteHeader(&tar.Header{
+		Name:    BACKUP_CLUSTER_CONFIGURATION_ENTRY,
+		Mode:    0644,
+		Size:    int64(len(clusterConfiguration)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := archive.Write(clusterConfiguration); err != nil {
+		return err
+	}
+
+	for _, id := range shardIds {
+		log.Info("DATASTORE: backing up shard %d", id)
+		if err := self.backupShard(archive, id); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// The size of the tar entry has to be known before writing it, so the
+// shard is dumped to a temporary file first
+func (self *LevelDbShardDatastore) backupShard(archive *tar.Writer, id uint32) error {
+	db, err := self.GetOrCreateShard(id)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile("", "influxdb-backup")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	buffered := bufio.NewWriter(f)
+	if err := db.(*LevelDbShard).backup(buffered); err != nil {
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+
+	size, err := f.Seek(0, os.SEEK_CUR)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		return err
+	}
+
+	err = archive.WriteHeader(&tar.Header{
+		Name:    path.Join(BACKUP_SHARDS_DIR, fmt.Sprintf("%.5d", id)),
+		Mode:    0644,
+		Size:    size,
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(archive, f)
+	return err
+}
+
+// Restores the shards in the given backup and returns the cluster
+// configuration and the ids of the restored shards. The shard
+// directory must be empty.
+func (self *LevelDbShardDatastore) Restore(r io.Reader) ([]byte, []uint32, error) {
+	shardIds, err := self.localShardIds()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(shardIds) > 0 {
+		return nil, nil, fmt.Errorf("Cannot restore into %s since it already has shards", self.baseDbDir)
+	}
+
+	var clusterConfiguration []byte
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if header.Name == BACKUP_CLUSTER_CONFIGURATION_ENTRY {
+			clusterConfiguration, err = ioutil.ReadAll(archive)
+			if err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+
+		dir, name := path.Split(header.Name)
+		if path.Clean(dir) != BACKUP_SHARDS_DIR {
+			return nil, nil, fmt.Errorf("Unknown entry %s in backup", header.Name)
+		}
+		id, err := strconv.ParseUint(name, 10, 32)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid shard entry %s in backup", header.Name)
+		}
+
+		log.Info("DATASTORE: restoring shard %d", id)
+		if err := self.restoreShard(uint32(id), bufio.NewReader(archive)); err != nil {
+			return nil, nil, err
+		}
+		shardIds = append(shardIds, uint32(id))
+	}
+
+	if clusterConfiguration == nil {
+		return nil, nil, fmt.Errorf("Backup doesn't contain the cluster configuration")
+	}
+	return clusterConfiguration, shardIds, nil
+}
+
+func (self *LevelDbShardDatastore) restoreShard(id uint32, r io.Reader) error {
+	db, err := levigo.Open(self.shardDir(id), self.levelDbOptions)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	wo := levigo.NewWriteOptions()
+	defer wo.Close()
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+
+	count := 0
+	for {
+		key, err := readBackupRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		value, err := readBackupRecord(r)
+		if err != nil {
+			return err
+		}
+
+		wb.Put(key, value)
+		count++
+		if count < RESTORE_BATCH_SIZE {
+			continue
+		}
+		if err := db.Write(wo, wb); err != nil {
+			return err
+		}
+		wb.Clear()
+		count = 0
+	}
+	return db.Write(wo, wb)
+}
+
+func (self *LevelDbShardDatastore) localShardIds() ([]uint32, error) {
+	infos, err := ioutil.ReadDir(self.baseDbDir)
+	if err != nil {
+		return nil, err
+	}
+	shardIds := make([]uint32, 0, len(infos))
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		id, err := strconv.ParseUint(info.Name(), 10, 32)
+		if err != nil {
+			log.Warn("DATASTORE: ignoring unknown directory %s in %s", info.Name(), self.baseDbDir)
+			continue
+		}
+		shardIds = append(shardIds, uint32(id))
+	}
+	return shardIds, nil
+}
+
+// Writes all key/value pairs of the shard to the given writer. The
+// shard is read from a snapshot so writes can continue while the
+// backup is running.
+func (self *LevelDbShard) backup(w io.Writer) error {
+	snapshot := self.db.NewSnapshot()
+	defer self.db.ReleaseSnapshot(snapshot)
+
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetSnapshot(snapshot)
+	ro.SetFillCache(false)
+
+	it := self.db.NewIterator(ro)
+	defer it.Close()
+
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if err := writeBackupRecord(w, it.Key()); err != nil {
+			return err
+		}
+		if err := writeBackupRecord(w, it.Value()); err != nil {
+			return err
+		}
+	}
+	return it.GetError()
+}
+
+func writeBackupRecord(w io.Writer, data []byte) error {
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func readBackupRecord(r io.Reader) ([]byte, error) {
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return nil, err
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
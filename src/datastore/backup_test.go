@@ -0,0 +1,72 @@
+package datastore
+
+import (
+	"bytes"
+	"configuration"
+	. "launchpad.net/gocheck"
+	"os"
+	"protocol"
+)
+
+type BackupSuite struct{}
+
+var _ = Suite(&BackupSuite{})
+
+const BACKUP_TEST_DIR = "/tmp/influxdb/datastore_backup_test"
+
+func newShardDatastore(c *C, dir string) *LevelDbShardDatastore {
+	config := &configuration.Configuration{DataDir: dir, LevelDbMaxOpenFiles: 100}
+	store, err := NewLevelDbShardDatastore(config)
+	c.Assert(err, IsNil)
+	return store
+}
+
+func (self *BackupSuite) SetUpTest(c *C) {
+	os.RemoveAll(BACKUP_TEST_DIR)
+}
+
+func (self *BackupSuite) TearDownTest(c *C) {
+	os.RemoveAll(BACKUP_TEST_DIR)
+}
+
+func (self *BackupSuite) TestBackupAndRestore(c *C) {
+	store := newShardDatastore(c, BACKUP_TEST_DIR+"/original")
+	defer store.Close()
+
+	shard, err := store.GetOrCreateShard(3)
+	c.Assert(err, IsNil)
+	value := int64(42)
+	timestamp := int64(1382131686000000)
+	sequenceNumber := uint64(1)
+	err = shard.Write("db1", &protocol.Series{
+		Name:   protocol.String("foo"),
+		Fields: []string{"value"},
+		Points: []*protocol.Point{
+			&protocol.Point{
+				Values:         []*protocol.FieldValue{&protocol.FieldValue{Int64Value: &value}},
+				Timestamp:      &timestamp,
+				SequenceNumber: &sequenceNumber,
+			},
+		},
+	})
+	c.Assert(err, IsNil)
+
+	archive := bytes.NewBuffer(nil)
+	c.Assert(store.Backup(archive, []byte("cluster configuration")), IsNil)
+
+	restoredStore := newShardDatastore(c, BACKUP_TEST_DIR+"/restored")
+	defer restoredStore.Close()
+	clusterConfiguration, shardIds, err := restoredStore.Restore(archive)
+	c.Assert(err, IsNil)
+	c.Assert(string(clusterConfiguration), Equals, "cluster configuration")
+	c.Assert(shardIds, DeepEquals, []uint32{3})
+
+	restoredShard, err := restoredStore.GetOrCreateShard(3)
+	c.Assert(err, IsNil)
+	c.Assert(restoredShard.(*LevelDbShard).getSeriesForDatabase("db1"), DeepEquals, []string{"foo"})
+	c.Assert(restoredShard.(*LevelDbShard).getColumnNamesForSeries("db1", "foo"), DeepEquals, []string{"value"})
+
+	// restoring into a store that has shards should fail
+	_, _, err = store.Restore(bytes.NewBuffer(nil))
+	c.Assert(err, NotNil)
+}
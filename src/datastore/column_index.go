@@ -0,0 +1,326 @@
+package datastore
+
+// Secondary index for the indexed string columns of a series. For
+// every point of an indexed column the shard keeps the empty key
+//
+//   COLUMN_VALUE_INDEX_PREFIX + column id + length of value + value + time + sequence
+//
+// so all the points that have a given value can be found with a single
+// range scan, ordered by time. The key COLUMN_VALUE_INDEX_PREFIX +
+// column id holds the id of the column declaration the index was built
+// for. Points written before the column was declared as indexed are
+// indexed the first time the column is written to or queried after the
+// declaration. Indexes of dropped declarations are left behind until
+// the series is dropped or the column is indexed again.
+
+import (
+	"bytes"
+	"cluster"
+	"code.google.com/p/goprotobuf/proto"
+	log "code.google.com/p/log4go"
+	"encoding/binary"
+	"github.com/jmhodges/levigo"
+	"parser"
+	"protocol"
+)
+
+const COLUMN_INDEX_BATCH_SIZE = 1000
+
+type IndexedColumnLookup interface {
+	GetIndexedColumns(database, series string) []*cluster.IndexedColumn
+}
+
+func (self *LevelDbShard) SetIndexedColumnLookup(lookup IndexedColumnLookup) {
+	self.indexedColumns = lookup
+}
+
+// Returns the indexed fields of the series by name. The indexes of
+// fields that were indexed after points were written are built first.
+func (self *LevelDbShard) getIndexedFields(database, series string) (map[string]*Field, error) {
+	if self.indexedColumns == nil {
+		return nil, nil
+	}
+
+	fields := map[string]*Field{}
+	for _, column := range self.indexedColumns.GetIndexedColumns(database, series) {
+		name := column.Name
+		id, err := self.getIdForDbSeriesColumn(&database, &series, &name)
+		if err != nil {
+			return nil, err
+		}
+		// the column doesn't exist in this shard yet, the index will
+		// be built after the first write
+		if id == nil {
+			continue
+		}
+		if err := self.ensureColumnIndex(id, column.Id); err != nil {
+			return nil, err
+		}
+		fields[name] = &Field{Id: id, Name: name}
+	}
+	return fields, nil
+}
+
+func (self *LevelDbShard) ensureColumnIndex(columnId []byte, declarationId uint32) error {
+	markerKey := append(COLUMN_VALUE_INDEX_PREFIX, columnId...)
+	declaration := make([]byte, 4)
+	binary.BigEndian.PutUint32(declaration, declarationId)
+
+	isBuilt := func() (bool, error) {
+		data, err := self.db.Get(self.readOptions, markerKey)
+		return bytes.Equal(data, declaration), err
+	}
+
+	if built, err := isBuilt(); err != nil || built {
+		return err
+	}
+
+	self.indexLock.Lock()
+	defer self.indexLock.Unlock()
+
+	// the index might have been built while we were waiting for the lock
+	if built, err := isBuilt(); err != nil || built {
+		return err
+	}
+
+	log.Info("Building the index of column %v", columnId)
+	// remove the index of an earlier declaration of the column
+	if err := self.deleteColumnIndex(columnId); err != nil {
+		return err
+	}
+
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetFillCache(false)
+	it := self.db.NewIterator(ro)
+	defer it.Close()
+
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+	count := 0
+	for it.Seek(columnId); it.Valid(); it.Next() {
+		key := it.Key()
+		if len(key) < 24 || !bytes.Equal(key[:8], columnId) {
+			break
+		}
+
+		value := &protocol.FieldValue{}
+		if err := proto.Unmarshal(it.Value(), value); err != nil {
+			return err
+		}
+		if value.StringValue == nil {
+			continue
+		}
+		wb.Put(columnIndexKey(columnId, *value.StringValue, key[8:24]), []byte{})
+
+		count++
+		if count%COLUMN_INDEX_BATCH_SIZE != 0 {
+			continue
+		}
+		if err := self.db.Write(self.writeOptions, wb); err != nil {
+			return err
+		}
+		wb.Clear()
+	}
+
+	wb.Put(markerKey, declaration)
+	return self.db.Write(self.writeOptions, wb)
+}
+
+// Deletes the index of the given column including its marker, the
+// caller has to hold the index lock
+func (self *LevelDbShard) deleteColumnIndex(columnId []byte) error {
+	prefix := append(COLUMN_VALUE_INDEX_PREFIX, columnId...)
+
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetFillCache(false)
+	it := self.db.NewIterator(ro)
+	defer it.Close()
+
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+	for it.Seek(prefix); it.Valid(); it.Next() {
+		key := it.Key()
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		wb.Delete(key)
+	}
+	return self.db.Write(self.writeOptions, wb)
+}
+
+// Adds the index changes for writing the value (or deleting it, if the
+// value is null) of the point with the given key to the batch
+func (self *LevelDbShard) updateColumnIndex(wb *levigo.WriteBatch, columnId, pointKey []byte, value *protocol.FieldValue) error {
+	timeAndSequence := pointKey[8:]
+	newValue := value.StringValue
+	if value.GetIsNull() {
+		newValue = nil
+	}
+
+	data, err := self.db.Get(self.readOptions, pointKey)
+	if err != nil {
+		return err
+	}
+	if data != nil {
+		oldValue := &protocol.FieldValue{}
+		if err := proto.Unmarshal(data, oldValue); err != nil {
+			return err
+		}
+		if oldValue.StringValue != nil && (newValue == nil || *newValue != *oldValue.StringValue) {
+			wb.Delete(columnIndexKey(columnId, *oldValue.StringValue, timeAndSequence))
+		}
+	}
+
+	if newValue != nil {
+		wb.Put(columnIndexKey(columnId, *newValue, timeAndSequence), []byte{})
+	}
+	return nil
+}
+
+// Yields the points of the series that have the given value in the
+// indexed field, in the order of the query
+func (self *LevelDbShard) executeIndexedQueryForSeries(querySpec *parser.QuerySpec, aliases []string, fields []*Field,
+	indexedField *Field, value string, startTimeBytes, endTimeBytes []byte, processor cluster.QueryProcessor) error {
+
+	query := querySpec.SelectQuery()
+	prefix := columnIndexKey(indexedField.Id, value, nil)
+	it := self.db.NewIterator(self.readOptions)
+	defer it.Close()
+
+	if query.Ascending {
+		it.Seek(columnIndexKey(indexedField.Id, value, startTimeBytes))
+	} else {
+		it.Seek(columnIndexKey(indexedField.Id, value, append(append([]byte{}, endTimeBytes...), MAX_SEQUENCE...)))
+		if it.Valid() {
+			it.Prev()
+		}
+	}
+
+	fieldNames := make([]string, len(fields))
+	for i, field := range fields {
+		fieldNames[i] = field.Name
+	}
+
+	for ; it.Valid() && !querySpec.IsCancelled(); self.advance(it, query.Ascending) {
+		key := it.Key()
+		if len(key) != len(prefix)+16 || !bytes.Equal(key[:len(prefix)], prefix) {
+			break
+		}
+		timeAndSequence := key[len(prefix):]
+		rawTime := timeAndSequence[:8]
+		if bytes.Compare(rawTime, startTimeBytes) == -1 || bytes.Compare(rawTime, endTimeBytes) == 1 {
+			break
+		}
+
+		point, err := self.fetchPoint(fields, timeAndSequence)
+		if err != nil {
+			return err
+		}
+		// the index entry is stale
+		if point == nil {
+			continue
+		}
+
+		shouldContinue := true
+		for _, alias := range aliases {
+			_alias := alias
+			if !processor.YieldPoint(&_alias, fieldNames, point) {
+				shouldContinue = false
+			}
+		}
+		if !shouldContinue {
+			break
+		}
+	}
+	return nil
+}
+
+func (self *LevelDbShard) advance(it *levigo.Iterator, isAscendingQuery bool) {
+	if isAscendingQuery {
+		it.Next()
+	} else {
+		it.Prev()
+	}
+}
+
+// Returns the point with the given time and sequence number or nil if
+// none of the fields have a value for it
+func (self *LevelDbShard) fetchPoint(fields []*Field, timeAndSequence []byte) (*protocol.Point, error) {
+	point := &protocol.Point{Values: make([]*protocol.FieldValue, len(fields))}
+	found := false
+	for i, field := range fields {
+		data, err := self.db.Get(self.readOptions, append(field.Id, timeAndSequence...))
+		if err != nil {
+			return nil, err
+		}
+		if data == nil {
+			point.Values[i] = &protocol.FieldValue{IsNull: &TRUE}
+			continue
+		}
+
+		fieldValue := &protocol.FieldValue{}
+		if err := proto.Unmarshal(data, fieldValue); err != nil {
+			return nil, err
+		}
+		point.Values[i] = fieldValue
+		found = true
+	}
+
+	if !found {
+		return nil, nil
+	}
+
+	var t, sequence uint64
+	binary.Read(bytes.NewBuffer(timeAndSequence[:8]), binary.BigEndian, &t)
+	binary.Read(bytes.NewBuffer(timeAndSequence[8:]), binary.BigEndian, &sequence)
+	point.SetTimestampInMicroseconds(self.convertUintTimestampToInt64(&t))
+	point.SequenceNumber = &sequence
+	return point, nil
+}
+
+func columnIndexKey(columnId []byte, value string, timeAndSequence []byte) []byte {
+	keyBuffer := bytes.NewBuffer(make([]byte, 0, len(COLUMN_VALUE_INDEX_PREFIX)+len(columnId)+4+len(value)+len(timeAndSequence)))
+	keyBuffer.Write(COLUMN_VALUE_INDEX_PREFIX)
+	keyBuffer.Write(columnId)
+	binary.Write(keyBuffer, binary.BigEndian, uint32(len(value)))
+	keyBuffer.WriteString(value)
+	keyBuffer.Write(timeAndSequence)
+	return keyBuffer.Bytes()
+}
+
+// Returns the values of the `column = 'value'` conditions that every
+// point matching the where condition has to satisfy by column name
+func getEqualityConditions(condition *parser.WhereCondition) map[string]string {
+	conditions := map[string]string{}
+	addEqualityConditions(condition, conditions)
+	return conditions
+}
+
+func addEqualityConditions(condition *parser.WhereCondition, conditions map[string]string) {
+	if condition == nil {
+		return
+	}
+
+	if expression, ok := condition.GetBoolExpression(); ok {
+		if expression.Name != "=" || len(expression.Elems) != 2 {
+			return
+		}
+		left, right := expression.Elems[0], expression.Elems[1]
+		if left.Type == parser.ValueString {
+			left, right = right, left
+		}
+		if left.Type == parser.ValueSimpleName && right.Type == parser.ValueString {
+			conditions[left.Name] = right.Name
+		}
+		return
+	}
+
+	if condition.Operation != "AND" {
+		return
+	}
+	left, _ := condition.GetLeftWhereCondition()
+	addEqualityConditions(left, conditions)
+	addEqualityConditions(condition.Right, conditions)
+}
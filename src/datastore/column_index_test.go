@@ -0,0 +1,110 @@
+package datastore
+
+import (
+	"cluster"
+	. "launchpad.net/gocheck"
+	"os"
+	"parser"
+	"protocol"
+)
+
+type ColumnIndexSuite struct{}
+
+var _ = Suite(&ColumnIndexSuite{})
+
+const COLUMN_INDEX_TEST_DIR = "/tmp/influxdb/datastore_column_index_test"
+
+type mockIndexedColumnLookup map[string][]*cluster.IndexedColumn
+
+func (self mockIndexedColumnLookup) GetIndexedColumns(database, series string) []*cluster.IndexedColumn {
+	return self[database+"."+series]
+}
+
+type mockQueryProcessor struct {
+	points []*protocol.Point
+}
+
+func (self *mockQueryProcessor) YieldPoint(seriesName *string, columnNames []string, point *protocol.Point) bool {
+	self.points = append(self.points, point)
+	return true
+}
+
+func (self *mockQueryProcessor) Close() {}
+
+func (self *ColumnIndexSuite) SetUpTest(c *C) {
+	os.RemoveAll(COLUMN_INDEX_TEST_DIR)
+}
+
+func (self *ColumnIndexSuite) TearDownTest(c *C) {
+	os.RemoveAll(COLUMN_INDEX_TEST_DIR)
+}
+
+func writeHosts(c *C, shard cluster.LocalShardDb, firstSequenceNumber uint64, hosts ...string) {
+	points := []*protocol.Point{}
+	for idx, host := range hosts {
+		timestamp := int64(1382131686000000 + idx)
+		sequenceNumber := firstSequenceNumber + uint64(idx)
+		value := int64(idx)
+		points = append(points, &protocol.Point{
+			Values: []*protocol.FieldValue{
+				&protocol.FieldValue{StringValue: protocol.String(host)},
+				&protocol.FieldValue{Int64Value: &value},
+			},
+			Timestamp:      &timestamp,
+			SequenceNumber: &sequenceNumber,
+		})
+	}
+	err := shard.Write("db1", &protocol.Series{
+		Name:   protocol.String("events"),
+		Fields: []string{"host", "value"},
+		Points: points,
+	})
+	c.Assert(err, IsNil)
+}
+
+func queryHosts(c *C, shard cluster.LocalShardDb, query string) []string {
+	queries, err := parser.ParseQuery(query)
+	c.Assert(err, IsNil)
+	processor := &mockQueryProcessor{}
+	err = shard.Query(parser.NewQuerySpec(&MockUser{}, "db1", queries[0]), processor)
+	c.Assert(err, IsNil)
+	hosts := []string{}
+	for _, point := range processor.points {
+		hosts = append(hosts, point.Values[0].GetStringValue())
+	}
+	return hosts
+}
+
+func (self *ColumnIndexSuite) TestQueryUsingIndex(c *C) {
+	store := newShardDatastore(c, COLUMN_INDEX_TEST_DIR)
+	defer store.Close()
+	lookup := mockIndexedColumnLookup{}
+	store.SetIndexedColumnLookup(lookup)
+
+	shard, err := store.GetOrCreateShard(1)
+	c.Assert(err, IsNil)
+
+	// points written before the column was indexed should be indexed as well
+	writeHosts(c, shard, 1, "a", "b", "a")
+	lookup["db1.events"] = []*cluster.IndexedColumn{&cluster.IndexedColumn{1, "host"}}
+	writeHosts(c, shard, 4, "b", "a")
+
+	query := "select host, value from events where host = 'a' and value >= 0"
+	c.Assert(queryHosts(c, shard, query), DeepEquals, []string{"a", "a", "a"})
+	c.Assert(queryHosts(c, shard, query+" order asc"), DeepEquals, []string{"a", "a", "a"})
+
+	// overwriting a point should remove it from the index of its old value
+	writeHosts(c, shard, 4, "a", "c")
+	c.Assert(queryHosts(c, shard, "select host from events where host = 'b'"), DeepEquals, []string{"b"})
+	c.Assert(queryHosts(c, shard, "select host from events where host = 'c'"), DeepEquals, []string{"c"})
+}
+
+func (self *ColumnIndexSuite) TestEqualityConditions(c *C) {
+	query, err := parser.ParseSelectQuery("select * from foo where host = 'a' and 'b' = region and value > 1")
+	c.Assert(err, IsNil)
+	c.Assert(getEqualityConditions(query.GetWhereCondition()), DeepEquals, map[string]string{"host": "a", "region": "b"})
+
+	query, err = parser.ParseSelectQuery("select * from foo where host = 'a' or region = 'b'")
+	c.Assert(err, IsNil)
+	c.Assert(getEqualityConditions(query.GetWhereCondition()), HasLen, 0)
+}
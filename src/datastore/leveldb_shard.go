@@ -25,6 +25,10 @@ type LevelDbShard struct {
 	writeOptions  *levigo.WriteOptions
 	lastIdUsed    uint64
 	columnIdMutex sync.Mutex
+	// writes hold the read lock while the indexes of the indexed
+	// columns are built
+	indexLock      sync.RWMutex
+	indexedColumns IndexedColumnLookup
 }
 
 func NewLevelDbShard(db *levigo.DB) (*LevelDbShard, error) {
@@ -58,6 +62,13 @@ func (self *LevelDbShard) Write(database string, series *protocol.Series) error
 		return errors.New("Unable to write no data. Series was nil or had no points.")
 	}
 
+	indexedFields, err := self.getIndexedFields(database, *series.Name)
+	if err != nil {
+		return err
+	}
+	self.indexLock.RLock()
+	defer self.indexLock.RUnlock()
+
 	for fieldIndex, field := range series.Fields {
 		temp := field
 		id, err := self.createIdForDbSeriesColumn(&database, series.Name, &temp)
@@ -71,6 +82,12 @@ func (self *LevelDbShard) Write(database string, series *protocol.Series) error
 			binary.Write(keyBuffer, binary.BigEndian, *point.SequenceNumber)
 			pointKey := keyBuffer.Bytes()
 
+			if indexedFields[field] != nil {
+				if err := self.updateColumnIndex(wb, id, pointKey, point.Values[fieldIndex]); err != nil {
+					return err
+				}
+			}
+
 			if point.Values[fieldIndex].GetIsNull() {
 				wb.Delete(pointKey)
 				continue
@@ -90,6 +107,8 @@ func (self *LevelDbShard) Write(database string, series *protocol.Series) error
 func (self *LevelDbShard) Query(querySpec *parser.QuerySpec, processor cluster.QueryProcessor) error {
 	if querySpec.IsListSeriesQuery() {
 		return self.executeListSeriesQuery(querySpec, processor)
+	} else if querySpec.IsListSeriesStatsQuery() {
+		return self.executeListSeriesStatsQuery(querySpec, processor)
 	} else if querySpec.IsDeleteFromSeriesQuery() {
 		return self.executeDeleteQuery(querySpec, processor)
 	} else if querySpec.IsDropSeriesQuery() {
@@ -106,6 +125,9 @@ func (self *LevelDbShard) Query(querySpec *parser.QuerySpec, processor cluster.Q
 		if regex, ok := series.GetCompiledRegex(); ok {
 			seriesNames := self.getSeriesForDbAndRegex(querySpec.Database(), regex)
 			for _, name := range seriesNames {
+				if querySpec.IsCancelled() {
+					return nil
+				}
 				if !querySpec.HasReadAccess(name) {
 					continue
 				}
@@ -137,6 +159,7 @@ func (self *LevelDbShard) DropDatabase(database string) error {
 		seriesKey := append(DATABASE_SERIES_INDEX_PREFIX, []byte(database+"~")...)
 		wb.Delete(seriesKey)
 	}
+	self.deleteDeletedRanges(database, wb)
 
 	return self.db.Write(self.writeOptions, wb)
 }
@@ -172,11 +195,25 @@ func (self *LevelDbShard) executeQueryForSeries(querySpec *parser.QuerySpec, ser
 		return nil
 	}
 
+	if query.GetFromClause().Type == parser.FromClauseArray {
+		if conditions := getEqualityConditions(query.GetWhereCondition()); len(conditions) > 0 {
+			indexedFields, err := self.getIndexedFields(querySpec.Database(), seriesName)
+			if err != nil {
+				return err
+			}
+			for name, indexedField := range indexedFields {
+				if value, ok := conditions[name]; ok {
+					return self.executeIndexedQueryForSeries(querySpec, aliases, fields, indexedField, value, startTimeBytes, endTimeBytes, processor)
+				}
+			}
+		}
+	}
+
 	fieldNames, iterators := self.getIterators(fields, startTimeBytes, endTimeBytes, query.Ascending)
 
 	// TODO: clean up, this is super gnarly
 	// optimize for the case where we're pulling back only a single column or aggregate
-	for {
+	for !querySpec.IsCancelled() {
 		isValid := false
 		point := &protocol.Point{Values: make([]*protocol.FieldValue, fieldCount, fieldCount)}
 
@@ -347,6 +384,20 @@ func (self *LevelDbShard) dropSeries(database, series string) error {
 			return err
 		}
 
+		temp := name
+		id, err := self.getIdForDbSeriesColumn(&database, &series, &temp)
+		if err != nil {
+			return err
+		}
+		if id != nil {
+			self.indexLock.Lock()
+			err = self.deleteColumnIndex(id)
+			self.indexLock.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+
 		indexKey := append(SERIES_COLUMN_INDEX_PREFIX, []byte(database+"~"+series+"~"+name)...)
 		wb.Delete(indexKey)
 	}
@@ -367,6 +418,12 @@ func (self *LevelDbShard) byteArraysForStartAndEndTimes(startTime, endTime int64
 }
 
 func (self *LevelDbShard) deleteRangeOfSeriesCommon(database, series string, startTimeBytes, endTimeBytes []byte) error {
+	// the range is kept even if this server doesn't have the series, its
+	// replicas may have the points
+	if err := self.addDeletedRange(database, series, startTimeBytes, endTimeBytes); err != nil {
+		return err
+	}
+
 	columns := self.getColumnNamesForSeries(database, series)
 	fields, err := self.getFieldsForSeries(database, series, columns)
 	if err != nil {
@@ -378,6 +435,13 @@ func (self *LevelDbShard) deleteRangeOfSeriesCommon(database, series string, sta
 			return err
 		}
 	}
+	indexedFields, err := self.getIndexedFields(database, series)
+	if err != nil {
+		return err
+	}
+	self.indexLock.RLock()
+	defer self.indexLock.RUnlock()
+
 	ro := levigo.NewReadOptions()
 	defer ro.Close()
 	ro.SetFillCache(false)
@@ -404,6 +468,15 @@ func (self *LevelDbShard) deleteRangeOfSeriesCommon(database, series string, sta
 			if len(k) < 16 || !bytes.Equal(k[:8], field.Id) || bytes.Compare(k[8:16], endTimeBytes) == 1 {
 				break
 			}
+			if indexedFields[field.Name] != nil {
+				value := &protocol.FieldValue{}
+				if err := proto.Unmarshal(it.Value(), value); err != nil {
+					return err
+				}
+				if value.StringValue != nil {
+					wb.Delete(columnIndexKey(field.Id, *value.StringValue, k[8:]))
+				}
+			}
 			wb.Delete(k)
 			endKey = k
 		}
@@ -20,6 +20,7 @@ type LevelDbShardDatastore struct {
 	shardsLock     sync.RWMutex
 	levelDbOptions *levigo.Options
 	writeBuffer    *cluster.WriteBuffer
+	indexedColumns IndexedColumnLookup
 }
 
 const (
@@ -38,10 +39,15 @@ var (
 	// This datastore implements the PersistentAtomicInteger interface. All of the persistent
 	// integers start with this prefix, followed by their name
 	ATOMIC_INCREMENT_PREFIX = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFD}
+	// COLUMN_VALUE_INDEX_PREFIX is the prefix of the index of the indexed columns
+	COLUMN_VALUE_INDEX_PREFIX = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFC}
 	// NEXT_ID_KEY holds the next id. ids are used to "intern" timeseries and column names
 	NEXT_ID_KEY = []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
 	// SERIES_COLUMN_INDEX_PREFIX is the prefix of the series to column names index
 	SERIES_COLUMN_INDEX_PREFIX = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFE}
+	// DELETED_RANGE_PREFIX is the prefix of the time ranges that were deleted from the series, followed by
+	// the database, the series and the start and end time
+	DELETED_RANGE_PREFIX = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFB}
 	// DATABASE_SERIES_INDEX_PREFIX is the prefix of the database to series names index
 	DATABASE_SERIES_INDEX_PREFIX = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
 	MAX_SEQUENCE                 = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
@@ -122,6 +128,7 @@ func (self *LevelDbShardDatastore) GetOrCreateShard(id uint32) (cluster.LocalSha
 	if err != nil {
 		return nil, err
 	}
+	db.SetIndexedColumnLookup(self.indexedColumns)
 	self.shards[id] = db
 	return db, nil
 }
@@ -142,6 +149,16 @@ func (self *LevelDbShardDatastore) SetWriteBuffer(writeBuffer *cluster.WriteBuff
 	self.writeBuffer = writeBuffer
 }
 
+// Sets the lookup of the columns the shards should keep an index for
+func (self *LevelDbShardDatastore) SetIndexedColumnLookup(lookup IndexedColumnLookup) {
+	self.shardsLock.Lock()
+	defer self.shardsLock.Unlock()
+	self.indexedColumns = lookup
+	for _, shard := range self.shards {
+		shard.SetIndexedColumnLookup(lookup)
+	}
+}
+
 func (self *LevelDbShardDatastore) DeleteShard(shardId uint32) error {
 	self.shardsLock.Lock()
 	shardDb := self.shards[shardId]
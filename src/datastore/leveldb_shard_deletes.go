@@ -0,0 +1,57 @@
+package datastore
+
+// The time ranges that deletes were applied to. The anti-entropy repair
+// doesn't write the points of a replica that missed the delete in them.
+
+import (
+	"bytes"
+	"cluster"
+	"encoding/binary"
+	"github.com/jmhodges/levigo"
+)
+
+func deletedRangesPrefix(database, series string) []byte {
+	return append(DELETED_RANGE_PREFIX, []byte(database+"~"+series+"~")...)
+}
+
+func (self *LevelDbShard) addDeletedRange(database, series string, startTimeBytes, endTimeBytes []byte) error {
+	key := deletedRangesPrefix(database, series)
+	key = append(key, startTimeBytes...)
+	key = append(key, endTimeBytes...)
+	return self.db.Put(self.writeOptions, key, []byte{})
+}
+
+func (self *LevelDbShard) GetDeletedRanges(database, series string) ([]*cluster.DeletedRange, error) {
+	prefix := deletedRangesPrefix(database, series)
+	it := self.db.NewIterator(self.readOptions)
+	defer it.Close()
+
+	ranges := []*cluster.DeletedRange{}
+	for it.Seek(prefix); it.Valid() && bytes.HasPrefix(it.Key(), prefix); it.Next() {
+		key := it.Key()
+		// the key of a series whose name starts with the name of this
+		// series and a ~ has the same prefix
+		if len(key) != len(prefix)+16 {
+			continue
+		}
+		startTime := binary.BigEndian.Uint64(key[len(prefix):])
+		endTime := binary.BigEndian.Uint64(key[len(prefix)+8:])
+		ranges = append(ranges, &cluster.DeletedRange{
+			StartTime: self.convertUintTimestampToInt64(&startTime),
+			EndTime:   self.convertUintTimestampToInt64(&endTime),
+		})
+	}
+	return ranges, it.GetError()
+}
+
+// Removes the deleted ranges of the series of the database, e.g. when the
+// database is dropped
+func (self *LevelDbShard) deleteDeletedRanges(database string, wb *levigo.WriteBatch) {
+	prefix := append(DELETED_RANGE_PREFIX, []byte(database+"~")...)
+	it := self.db.NewIterator(self.readOptions)
+	defer it.Close()
+
+	for it.Seek(prefix); it.Valid() && bytes.HasPrefix(it.Key(), prefix); it.Next() {
+		wb.Delete(it.Key())
+	}
+}
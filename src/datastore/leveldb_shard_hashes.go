@@ -0,0 +1,88 @@
+package datastore
+
+// Hashes of the series of a shard for the anti-entropy repair. Column
+// ids are assigned by every server on its own, so the hashes are
+// computed from the column names, the timestamps, the sequence numbers
+// and the encoded values.
+
+import (
+	"bytes"
+	"cluster"
+	"hash"
+	"hash/fnv"
+	"sort"
+)
+
+func (self *LevelDbShard) GetSeriesHashes(database string, startTime, bucketSize int64) ([]*cluster.SeriesHash, error) {
+	names := self.getSeriesForDatabase(database)
+	sort.Strings(names)
+
+	hashes := make([]*cluster.SeriesHash, 0, len(names))
+	for _, name := range names {
+		seriesHash, err := self.GetSeriesHash(database, name, startTime, bucketSize)
+		if err != nil {
+			return nil, err
+		}
+		// a series without values is the same as a missing series
+		if seriesHash.Values == 0 {
+			continue
+		}
+		hashes = append(hashes, seriesHash)
+	}
+	return hashes, nil
+}
+
+func (self *LevelDbShard) GetSeriesHash(database, series string, startTime, bucketSize int64) (*cluster.SeriesHash, error) {
+	columns := self.getColumnNamesForSeries(database, series)
+	sort.Strings(columns)
+
+	hashes := map[int64]hash.Hash64{}
+	buckets := map[int64]*cluster.BucketHash{}
+	it := self.db.NewIterator(self.readOptions)
+	defer it.Close()
+
+	// the columns are hashed in the order of their names, so the values
+	// of a bucket are always hashed in the same order
+	for _, column := range columns {
+		id, err := self.getIdForDbSeriesColumn(&database, &series, &column)
+		if err != nil {
+			return nil, err
+		}
+		if id == nil {
+			continue
+		}
+
+		for it.Seek(id); it.Valid() && bytes.HasPrefix(it.Key(), id); it.Next() {
+			key := it.Key()
+			if len(key) < 24 {
+				continue
+			}
+			start := startTime + (self.timestampFromKey(key)-startTime)/bucketSize*bucketSize
+			bucket := buckets[start]
+			if bucket == nil {
+				bucket = &cluster.BucketHash{Start: start}
+				buckets[start] = bucket
+				hashes[start] = fnv.New64a()
+			}
+			bucket.Values++
+			h := hashes[start]
+			h.Write([]byte(column))
+			h.Write(key[8:24])
+			h.Write(it.Value())
+		}
+	}
+
+	sortedBuckets := make([]*cluster.BucketHash, 0, len(buckets))
+	for start, bucket := range buckets {
+		bucket.Hash = hashes[start].Sum64()
+		sortedBuckets = append(sortedBuckets, bucket)
+	}
+	sort.Sort(bucketHashes(sortedBuckets))
+	return cluster.NewSeriesHash(series, sortedBuckets), nil
+}
+
+type bucketHashes []*cluster.BucketHash
+
+func (self bucketHashes) Len() int           { return len(self) }
+func (self bucketHashes) Less(i, j int) bool { return self[i].Start < self[j].Start }
+func (self bucketHashes) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
@@ -0,0 +1,134 @@
+package datastore
+
+// Statistics of the series of a shard for list series stats. The sizes
+// come from GetApproximateSizes, so points that are still in the
+// memtable don't count. The number of points of a column is counted
+// exactly up to STATS_SAMPLE_SIZE points and estimated from the size of
+// the sampled keys beyond that. A series has as many points as its
+// largest column.
+
+import (
+	"bytes"
+	"cluster"
+	"encoding/binary"
+	"github.com/jmhodges/levigo"
+	"parser"
+)
+
+const STATS_SAMPLE_SIZE = 1000
+
+func (self *LevelDbShard) executeListSeriesStatsQuery(querySpec *parser.QuerySpec, processor cluster.QueryProcessor) error {
+	database := querySpec.Database()
+	for _, name := range self.getSeriesForDatabase(database) {
+		if querySpec.IsCancelled() {
+			return nil
+		}
+		if !querySpec.HasReadAccess(name) {
+			continue
+		}
+		stats, err := self.getSeriesStats(database, name)
+		if err != nil {
+			return err
+		}
+		seriesName := name
+		if !processor.YieldPoint(&seriesName, cluster.SeriesStatsColumns, stats.ToPoint()) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (self *LevelDbShard) getSeriesStats(database, series string) (*cluster.SeriesStats, error) {
+	stats := &cluster.SeriesStats{Name: series}
+	for _, column := range self.getColumnNamesForSeries(database, series) {
+		id, err := self.getIdForDbSeriesColumn(&database, &series, &column)
+		if err != nil {
+			return nil, err
+		}
+		if id == nil {
+			continue
+		}
+		stats.Columns++
+
+		indexPrefix := append(append([]byte{}, COLUMN_VALUE_INDEX_PREFIX...), id...)
+		sizes := self.db.GetApproximateSizes([]levigo.Range{
+			{Start: id, Limit: prefixLimit(id)},
+			{Start: indexPrefix, Limit: prefixLimit(indexPrefix)},
+		})
+		stats.Bytes += int64(sizes[0] + sizes[1])
+
+		columnStats := self.getColumnStats(id, int64(sizes[0]))
+		if columnStats.Points == 0 {
+			continue
+		}
+		if stats.Points == 0 || columnStats.FirstTimestamp < stats.FirstTimestamp {
+			stats.FirstTimestamp = columnStats.FirstTimestamp
+		}
+		if stats.Points == 0 || columnStats.LastTimestamp > stats.LastTimestamp {
+			stats.LastTimestamp = columnStats.LastTimestamp
+		}
+		if columnStats.Points > stats.Points {
+			stats.Points = columnStats.Points
+		}
+	}
+	return stats, nil
+}
+
+// Returns the number of points and the first and last timestamps of the
+// column with the given id, which uses size bytes on disk
+func (self *LevelDbShard) getColumnStats(id []byte, size int64) *cluster.SeriesStats {
+	stats := &cluster.SeriesStats{}
+	it := self.db.NewIterator(self.readOptions)
+	defer it.Close()
+
+	limit := prefixLimit(id)
+	it.Seek(limit)
+	if it.Valid() {
+		it.Prev()
+	} else {
+		it.SeekToLast()
+	}
+	if !it.Valid() || !bytes.HasPrefix(it.Key(), id) {
+		return stats
+	}
+	stats.LastTimestamp = self.timestampFromKey(it.Key())
+
+	it.Seek(id)
+	stats.FirstTimestamp = self.timestampFromKey(it.Key())
+	for ; it.Valid() && bytes.HasPrefix(it.Key(), id); it.Next() {
+		stats.Points++
+		if stats.Points != STATS_SAMPLE_SIZE {
+			continue
+		}
+
+		// the sample has to be on disk to be compared with the size of
+		// the column, otherwise all the points are counted
+		key := append([]byte{}, it.Key()...)
+		sampleSize := self.db.GetApproximateSizes([]levigo.Range{{Start: id, Limit: key}})[0]
+		if sampleSize > 0 {
+			stats.Points = stats.Points * size / int64(sampleSize)
+			break
+		}
+	}
+	return stats
+}
+
+func (self *LevelDbShard) timestampFromKey(key []byte) int64 {
+	var t uint64
+	binary.Read(bytes.NewBuffer(key[8:16]), binary.BigEndian, &t)
+	return self.convertUintTimestampToInt64(&t)
+}
+
+// Returns the smallest key that is greater than all the keys that start
+// with prefix
+func prefixLimit(prefix []byte) []byte {
+	limit := append([]byte{}, prefix...)
+	for i := len(limit) - 1; i >= 0; i-- {
+		if limit[i] < 0xFF {
+			limit[i]++
+			return limit[:i+1]
+		}
+	}
+	// all the keys start with prefix
+	return nil
+}
@@ -0,0 +1,155 @@
+package datastore
+
+import (
+	"cluster"
+	"common"
+	. "launchpad.net/gocheck"
+	"os"
+	"parser"
+	"protocol"
+)
+
+type LevelDbShardSuite struct{}
+
+var _ = Suite(&LevelDbShardSuite{})
+
+const LEVELDB_SHARD_TEST_DIR = "/tmp/influxdb/datastore_leveldb_shard_test"
+
+// Cancels the query after the first point
+type cancellingQueryProcessor struct {
+	mockQueryProcessor
+	cancellation *common.QueryCancellation
+}
+
+func (self *cancellingQueryProcessor) YieldPoint(seriesName *string, columnNames []string, point *protocol.Point) bool {
+	self.cancellation.Cancel(common.NewQueryError(common.QueryCancelled, "Query was cancelled"))
+	return self.mockQueryProcessor.YieldPoint(seriesName, columnNames, point)
+}
+
+func (self *LevelDbShardSuite) SetUpTest(c *C) {
+	os.RemoveAll(LEVELDB_SHARD_TEST_DIR)
+}
+
+func (self *LevelDbShardSuite) TearDownTest(c *C) {
+	os.RemoveAll(LEVELDB_SHARD_TEST_DIR)
+}
+
+func (self *LevelDbShardSuite) TestCancelledQueryStops(c *C) {
+	store := newShardDatastore(c, LEVELDB_SHARD_TEST_DIR)
+	defer store.Close()
+	shard, err := store.GetOrCreateShard(1)
+	c.Assert(err, IsNil)
+	writeHosts(c, shard, 1, "a", "b", "c", "d")
+
+	for _, query := range []string{"select * from events", "select * from /.*/"} {
+		queries, err := parser.ParseQuery(query)
+		c.Assert(err, IsNil)
+		querySpec := parser.NewQuerySpec(&MockUser{}, "db1", queries[0])
+		processor := &cancellingQueryProcessor{cancellation: common.NewQueryCancellation()}
+		querySpec.SetCancellation(processor.cancellation)
+
+		c.Assert(shard.Query(querySpec, processor), IsNil)
+		c.Assert(processor.points, HasLen, 1, Commentf(query))
+	}
+}
+
+func (self *LevelDbShardSuite) TestListSeriesStats(c *C) {
+	store := newShardDatastore(c, LEVELDB_SHARD_TEST_DIR)
+	defer store.Close()
+	shard, err := store.GetOrCreateShard(1)
+	c.Assert(err, IsNil)
+	writeHosts(c, shard, 1, "a", "b", "c", "d")
+
+	queries, err := parser.ParseQuery("list series stats")
+	c.Assert(err, IsNil)
+	processor := &mockQueryProcessor{}
+	c.Assert(shard.Query(parser.NewQuerySpec(&MockUser{}, "db1", queries[0]), processor), IsNil)
+	c.Assert(processor.points, HasLen, 1)
+
+	stats := cluster.NewSeriesStatsFromPoint("events", processor.points[0])
+	c.Assert(stats.Points, Equals, int64(4))
+	c.Assert(stats.Columns, Equals, int64(2))
+	c.Assert(stats.FirstTimestamp, Equals, int64(1382131686000000))
+	c.Assert(stats.LastTimestamp, Equals, int64(1382131686000003))
+}
+
+func (self *LevelDbShardSuite) TestSeriesHashes(c *C) {
+	store := newShardDatastore(c, LEVELDB_SHARD_TEST_DIR)
+	defer store.Close()
+	shard, err := store.GetOrCreateShard(1)
+	c.Assert(err, IsNil)
+	writeHosts(c, shard, 1, "a", "b", "c", "d")
+	replica, err := store.GetOrCreateShard(2)
+	c.Assert(err, IsNil)
+	writeHosts(c, replica, 1, "a", "b", "c")
+
+	startTime := int64(1382131686000000)
+	hashes, err := shard.GetSeriesHashes("db1", startTime, 2)
+	c.Assert(err, IsNil)
+	c.Assert(hashes, HasLen, 1)
+	c.Assert(hashes[0].Name, Equals, "events")
+	c.Assert(hashes[0].Values, Equals, int64(8))
+	c.Assert(hashes[0].Buckets, HasLen, 2)
+	c.Assert(hashes[0].Buckets[1].Start, Equals, startTime+2)
+
+	replicaHash, err := replica.GetSeriesHash("db1", "events", startTime, 2)
+	c.Assert(err, IsNil)
+	c.Assert(replicaHash.Hash, Not(Equals), hashes[0].Hash)
+	buckets := hashes[0].DifferentBuckets(replicaHash)
+	c.Assert(buckets, HasLen, 1)
+	c.Assert(buckets[0].Start, Equals, startTime+2)
+
+	// the point that the replica missed
+	timestamp := startTime + 3
+	sequenceNumber := uint64(4)
+	value := int64(3)
+	err = replica.Write("db1", &protocol.Series{
+		Name:   protocol.String("events"),
+		Fields: []string{"host", "value"},
+		Points: []*protocol.Point{
+			&protocol.Point{
+				Values: []*protocol.FieldValue{
+					&protocol.FieldValue{StringValue: protocol.String("d")},
+					&protocol.FieldValue{Int64Value: &value},
+				},
+				Timestamp:      &timestamp,
+				SequenceNumber: &sequenceNumber,
+			},
+		},
+	})
+	c.Assert(err, IsNil)
+	replicaHash, err = replica.GetSeriesHash("db1", "events", startTime, 2)
+	c.Assert(err, IsNil)
+	c.Assert(replicaHash.Hash, Equals, hashes[0].Hash)
+}
+
+func (self *LevelDbShardSuite) TestDeletedRanges(c *C) {
+	store := newShardDatastore(c, LEVELDB_SHARD_TEST_DIR)
+	defer store.Close()
+	localShard, err := store.GetOrCreateShard(1)
+	c.Assert(err, IsNil)
+	writeHosts(c, localShard, 1, "a", "b", "c", "d")
+	shard := localShard.(*LevelDbShard)
+
+	startTime := int64(1382131686000000)
+	start, end := shard.byteArraysForStartAndEndTimes(startTime+1, startTime+2)
+	c.Assert(shard.deleteRangeOfSeriesCommon("db1", "events", start, end), IsNil)
+	// the range is kept for series that the shard doesn't have too
+	start, end = shard.byteArraysForStartAndEndTimes(startTime, startTime+3)
+	c.Assert(shard.deleteRangeOfSeriesCommon("db1", "events~other", start, end), IsNil)
+
+	ranges, err := shard.GetDeletedRanges("db1", "events")
+	c.Assert(err, IsNil)
+	c.Assert(ranges, HasLen, 1)
+	c.Assert(ranges[0].StartTime, Equals, startTime+1)
+	c.Assert(ranges[0].EndTime, Equals, startTime+2)
+
+	ranges, err = shard.GetDeletedRanges("db1", "events~other")
+	c.Assert(err, IsNil)
+	c.Assert(ranges, HasLen, 1)
+
+	c.Assert(shard.DropDatabase("db1"), IsNil)
+	ranges, err = shard.GetDeletedRanges("db1", "events")
+	c.Assert(err, IsNil)
+	c.Assert(ranges, HasLen, 0)
+}
@@ -1,7 +1,9 @@
 package engine
 
 import (
+	"bytes"
 	"common"
+	"encoding/binary"
 	"fmt"
 	"math"
 	"parser"
@@ -20,6 +22,38 @@ type Aggregator interface {
 	ColumnNames() []string
 }
 
+// Aggregators that can be computed in two phases. The shards compute
+// the partial state of every group, the coordinator merges the states
+// of all the shards and computes the values.
+type PartialAggregator interface {
+	Aggregator
+	GetPartialState(series string, group interface{}) ([]byte, error)
+	MergePartialState(series string, group interface{}, state []byte) error
+}
+
+// Returns the partial state made of the given fixed size values
+func encodePartialState(values ...interface{}) []byte {
+	buffer := bytes.NewBuffer(nil)
+	for _, value := range values {
+		binary.Write(buffer, binary.BigEndian, value)
+	}
+	return buffer.Bytes()
+}
+
+// Reads the partial state into the given pointers to fixed size values
+func decodePartialState(state []byte, values ...interface{}) error {
+	reader := bytes.NewReader(state)
+	for _, value := range values {
+		if err := binary.Read(reader, binary.BigEndian, value); err != nil {
+			return fmt.Errorf("Invalid partial state: %s", err)
+		}
+	}
+	if reader.Len() != 0 {
+		return fmt.Errorf("Invalid partial state: %d unexpected bytes", reader.Len())
+	}
+	return nil
+}
+
 // Initialize a new aggregator given the query, the function call of
 // the aggregator and the default value that should be returned if
 // the bucket doesn't have any points
@@ -139,6 +173,39 @@ func (self *StandardDeviationAggregator) AggregatePoint(series string, group int
 	return nil
 }
 
+func (self *StandardDeviationAggregator) GetPartialState(series string, group interface{}) ([]byte, error) {
+	r := self.running[series][group]
+	if r == nil {
+		r = &StandardDeviationRunning{}
+	}
+	return encodePartialState(int64(r.count), r.totalX, r.totalX2), nil
+}
+
+func (self *StandardDeviationAggregator) MergePartialState(series string, group interface{}, state []byte) error {
+	var count int64
+	var totalX, totalX2 float64
+	if err := decodePartialState(state, &count, &totalX, &totalX2); err != nil {
+		return err
+	}
+
+	running := self.running[series]
+	if running == nil {
+		running = make(map[interface{}]*StandardDeviationRunning)
+		self.running[series] = running
+	}
+
+	r := running[group]
+	if r == nil {
+		r = &StandardDeviationRunning{}
+		running[group] = r
+	}
+
+	r.count += int(count)
+	r.totalX += totalX
+	r.totalX2 += totalX2
+	return nil
+}
+
 func (self *StandardDeviationAggregator) ColumnNames() []string {
 	return []string{"stddev"}
 }
@@ -172,6 +239,9 @@ func wrapDefaultValue(defaultValue *parser.Value) (*protocol.FieldValue, error)
 		v, _ := strconv.Atoi(defaultValue.Name)
 		value := int64(v)
 		return &protocol.FieldValue{Int64Value: &value}, nil
+	case parser.ValueFloat:
+		value, _ := strconv.ParseFloat(defaultValue.Name, 64)
+		return &protocol.FieldValue{DoubleValue: &value}, nil
 	default:
 		return nil, fmt.Errorf("Unknown type %s", defaultValue.Type)
 	}
@@ -419,6 +489,25 @@ func (self *CountAggregator) AggregatePoint(series string, group interface{}, p
 	return nil
 }
 
+func (self *CountAggregator) GetPartialState(series string, group interface{}) ([]byte, error) {
+	return encodePartialState(int64(self.counts[series][group])), nil
+}
+
+func (self *CountAggregator) MergePartialState(series string, group interface{}, state []byte) error {
+	var count int64
+	if err := decodePartialState(state, &count); err != nil {
+		return err
+	}
+
+	counts := self.counts[series]
+	if counts == nil {
+		counts = make(map[interface{}]int32)
+		self.counts[series] = counts
+	}
+	counts[group] += int32(count)
+	return nil
+}
+
 func (self *CountAggregator) ColumnNames() []string {
 	return []string{"count"}
 }
@@ -573,6 +662,37 @@ func (self *MeanAggregator) AggregatePoint(series string, group interface{}, p *
 	return nil
 }
 
+func (self *MeanAggregator) GetPartialState(series string, group interface{}) ([]byte, error) {
+	return encodePartialState(self.means[series][group], int64(self.counts[series][group])), nil
+}
+
+func (self *MeanAggregator) MergePartialState(series string, group interface{}, state []byte) error {
+	var mean float64
+	var count int64
+	if err := decodePartialState(state, &mean, &count); err != nil {
+		return err
+	}
+	if count == 0 {
+		return nil
+	}
+
+	means := self.means[series]
+	counts := self.counts[series]
+
+	if means == nil && counts == nil {
+		means = make(map[interface{}]float64)
+		self.means[series] = means
+
+		counts = make(map[interface{}]int)
+		self.counts[series] = counts
+	}
+
+	currentCount := counts[group] + int(count)
+	means[group] = means[group]*float64(counts[group])/float64(currentCount) + mean*float64(count)/float64(currentCount)
+	counts[group] = currentCount
+	return nil
+}
+
 func (self *MeanAggregator) ColumnNames() []string {
 	return []string{"mean"}
 }
@@ -943,6 +1063,34 @@ func (self *CumulativeArithmeticAggregator) AggregatePoint(series string, group
 	return nil
 }
 
+func (self *CumulativeArithmeticAggregator) GetPartialState(series string, group interface{}) ([]byte, error) {
+	value, ok := self.values[series][group]
+	if !ok {
+		value = self.initialValue
+	}
+	return encodePartialState(value), nil
+}
+
+// The max, min or sum of the partial values is the one of all the values
+func (self *CumulativeArithmeticAggregator) MergePartialState(series string, group interface{}, state []byte) error {
+	var partialValue float64
+	if err := decodePartialState(state, &partialValue); err != nil {
+		return err
+	}
+
+	values := self.values[series]
+	if values == nil {
+		values = make(map[interface{}]float64)
+		self.values[series] = values
+	}
+	currentValue, ok := values[group]
+	if !ok {
+		currentValue = self.initialValue
+	}
+	values[group] = self.operation(currentValue, &protocol.FieldValue{DoubleValue: &partialValue})
+	return nil
+}
+
 func (self *CumulativeArithmeticAggregator) ColumnNames() []string {
 	return []string{self.name}
 }
@@ -0,0 +1,54 @@
+package engine
+
+import (
+	. "launchpad.net/gocheck"
+	"parser"
+	"protocol"
+)
+
+type AggregatorSuite struct{}
+
+var _ = Suite(&AggregatorSuite{})
+
+func newTestAggregator(c *C, name string) Aggregator {
+	value := &parser.Value{Name: name, Elems: []*parser.Value{
+		&parser.Value{Name: "column_one", Type: parser.ValueSimpleName},
+	}}
+	aggregator, err := registeredAggregators[name](nil, value, nil)
+	c.Assert(err, IsNil)
+	c.Assert(aggregator.InitializeFieldsMetadata(&protocol.Series{Fields: []string{"column_one"}}), IsNil)
+	return aggregator
+}
+
+func (self *AggregatorSuite) TestMergingPartialStates(c *C) {
+	values := []float64{3, 1, 4, 1, 5, 9, 2, 6}
+
+	for _, name := range []string{"count", "sum", "max", "min", "mean", "stddev"} {
+		all := newTestAggregator(c, name)
+		merged := newTestAggregator(c, name)
+
+		// every shard aggregates a part of the points
+		for _, part := range [][]float64{values[:3], values[3:]} {
+			shard := newTestAggregator(c, name)
+			for _, value := range part {
+				v := value
+				point := &protocol.Point{Values: []*protocol.FieldValue{&protocol.FieldValue{DoubleValue: &v}}}
+				c.Assert(shard.AggregatePoint("foo", ALL_GROUP_IDENTIFIER, point), IsNil)
+				c.Assert(all.AggregatePoint("foo", ALL_GROUP_IDENTIFIER, point), IsNil)
+			}
+
+			state, err := shard.(PartialAggregator).GetPartialState("foo", ALL_GROUP_IDENTIFIER)
+			c.Assert(err, IsNil)
+			c.Assert(merged.(PartialAggregator).MergePartialState("foo", ALL_GROUP_IDENTIFIER, state), IsNil)
+		}
+
+		expected := all.GetValues("foo", ALL_GROUP_IDENTIFIER)[0][0].GetValue()
+		actual := merged.GetValues("foo", ALL_GROUP_IDENTIFIER)[0][0].GetValue()
+		c.Assert(actual, Equals, expected, Commentf("function %s", name))
+	}
+}
+
+func (self *AggregatorSuite) TestInvalidPartialState(c *C) {
+	aggregator := newTestAggregator(c, "mean").(PartialAggregator)
+	c.Assert(aggregator.MergePartialState("foo", ALL_GROUP_IDENTIFIER, []byte{1, 2, 3}), NotNil)
+}
@@ -31,6 +31,11 @@ type QueryEngine struct {
 	pointsRange         map[string]*PointRange
 	groupBy             *parser.GroupByClause
 	aggregateYield      func(*protocol.Series) error
+
+	// variables for aggregate queries that are computed in two phases,
+	// see PartialAggregator
+	yieldPartialStates bool
+	mergePartialStates bool
 }
 
 const (
@@ -92,6 +97,50 @@ func NewQueryEngine(query *parser.SelectQuery, responseChan chan *protocol.Respo
 	return queryEngine
 }
 
+// Returns a query engine that yields the partial states of the
+// aggregates of every group instead of their values. The query must be
+// one that CanAggregatePartially returns true for.
+func NewPartialQueryEngine(query *parser.SelectQuery, responseChan chan *protocol.Response) *QueryEngine {
+	queryEngine := NewQueryEngine(query, responseChan)
+	queryEngine.yieldPartialStates = true
+	return queryEngine
+}
+
+// Returns a query engine that merges the partial states yielded by the
+// engines of NewPartialQueryEngine and yields the aggregated values
+func NewMergingQueryEngine(query *parser.SelectQuery, responseChan chan *protocol.Response) *QueryEngine {
+	queryEngine := NewQueryEngine(query, responseChan)
+	queryEngine.mergePartialStates = true
+	return queryEngine
+}
+
+// Returns true if all the aggregates of the query can be computed in
+// two phases. Merge and join queries need the points of all the series
+// in one place, so they can't be.
+func CanAggregatePartially(query *parser.SelectQuery) bool {
+	if !query.HasAggregates() || query.GetFromClause().Type != parser.FromClauseArray {
+		return false
+	}
+
+	for _, value := range query.GetColumnNames() {
+		if !value.IsFunctionCall() {
+			continue
+		}
+		initializer := registeredAggregators[strings.ToLower(value.Name)]
+		if initializer == nil {
+			return false
+		}
+		aggregator, err := initializer(query, value, query.GetGroupByClause().FillValue)
+		if err != nil {
+			return false
+		}
+		if _, ok := aggregator.(PartialAggregator); !ok {
+			return false
+		}
+	}
+	return true
+}
+
 // Returns false if the query should be stopped (either because of limit or error)
 func (self *QueryEngine) YieldPoint(seriesName *string, fieldNames []string, point *protocol.Point) (shouldContinue bool) {
 	shouldContinue = true
@@ -111,7 +160,8 @@ func (self *QueryEngine) YieldPoint(seriesName *string, fieldNames []string, poi
 
 func (self *QueryEngine) yieldSeriesData(series *protocol.Series) bool {
 	var err error
-	if self.where != nil {
+	// the partial states were computed from the filtered points
+	if self.where != nil && !self.mergePartialStates {
 		serieses, err := self.filter(series)
 		if err != nil {
 			log.Error("Error while filtering points: %s\n", err)
@@ -216,7 +266,9 @@ func (self *QueryEngine) Close() {
 		}
 	}
 
-	if self.isAggregateQuery {
+	if self.isAggregateQuery && self.yieldPartialStates {
+		self.yieldPartialAggregates()
+	} else if self.isAggregateQuery {
 		self.runAggregates()
 	}
 	response := &protocol.Response{Type: &responseEndStream}
@@ -420,8 +472,16 @@ func (self *QueryEngine) executeCountQueryWithGroupBy(query *parser.SelectQuery,
 		currentRange := self.pointsRange[*series.Name]
 		for _, point := range series.Points {
 			value := mapper(point)
-			for _, aggregator := range self.aggregators {
-				err := aggregator.AggregatePoint(*series.Name, value, point)
+			if self.mergePartialStates && len(point.PartialStates) != len(self.aggregators) {
+				return fmt.Errorf("Expected the partial states of %d aggregates, got %d", len(self.aggregators), len(point.PartialStates))
+			}
+			for idx, aggregator := range self.aggregators {
+				var err error
+				if self.mergePartialStates {
+					err = aggregator.(PartialAggregator).MergePartialState(*series.Name, value, point.PartialStates[idx])
+				} else {
+					err = aggregator.AggregatePoint(*series.Name, value, point)
+				}
 				if err != nil {
 					return err
 				}
@@ -459,6 +519,7 @@ func (self *QueryEngine) runAggregates() {
 		columnNames := aggregator.ColumnNames()
 		fields = append(fields, columnNames...)
 	}
+	aggregatorColumns := len(fields)
 
 	for _, value := range self.groupBy.Elems {
 		if value.IsFunctionCall() {
@@ -484,10 +545,8 @@ func (self *QueryEngine) runAggregates() {
 
 		} else {
 			groupsWithTime := map[Group]bool{}
-			timeRange, ok := self.pointsRange[table]
+			first, end, ok := self.getFillRange(table)
 			if ok {
-				first := timeRange.startTime * 1000 / int64(*duration) * int64(*duration)
-				end := timeRange.endTime * 1000 / int64(*duration) * int64(*duration)
 				for i := 0; ; i++ {
 					timestamp := first + int64(i)*int64(*duration)
 					if end < timestamp {
@@ -522,52 +581,53 @@ func (self *QueryEngine) runAggregates() {
 		}
 		sort.Sort(sortedGroups)
 
+		groupValues := map[Group][][]*protocol.FieldValue{}
 		for _, groupId := range sortedGroups.GetSortedGroups() {
-			var timestamp int64
-			if groupId.HasTimestamp() {
-				timestamp = groupId.GetTimestamp()
-			} else {
-				timestamp = *self.timestampAggregator.GetValues(table, groupId)[0][0].Int64Value
+			if !tableGroups[groupId] {
+				continue
 			}
-			values := [][][]*protocol.FieldValue{}
 
+			values := [][][]*protocol.FieldValue{}
 			for _, aggregator := range self.aggregators {
 				values = append(values, aggregator.GetValues(table, groupId))
 			}
 
 			// do cross product of all the values
-			_values := crossProduct(values)
+			groupValues[groupId] = crossProduct(values)
+		}
 
-			for _, v := range _values {
+		if fillWithZero {
+			self.fillEmptyGroups(table, sortedGroups.GetSortedGroups(), groupValues, aggregatorColumns)
+		}
+
+		for _, groupId := range sortedGroups.GetSortedGroups() {
+			var timestamp int64
+			if groupId.HasTimestamp() {
+				timestamp = groupId.GetTimestamp()
+			} else if timestamps, values := self.getPointValues(table, groupId); timestamps != nil {
+				for idx, timestamp := range timestamps {
+					for _, v := range values[idx] {
+						point := &protocol.Point{
+							Values: v,
+						}
+						point.SetTimestampInMicroseconds(timestamp)
+						point.Values = append(point.Values, self.getGroupByValues(groupId)...)
+						points = append(points, point)
+					}
+				}
+				continue
+			} else {
+				timestamp = *self.timestampAggregator.GetValues(table, groupId)[0][0].Int64Value
+			}
+
+			for _, v := range groupValues[groupId] {
 				/* groupPoints := []*protocol.Point{} */
 				point := &protocol.Point{
 					Values: v,
 				}
 				point.SetTimestampInMicroseconds(timestamp)
 
-				// FIXME: this should be looking at the fields slice not the group by clause
-				// FIXME: we should check whether the selected columns are in the group by clause
-				for idx, _ := range self.groupBy.Elems {
-					if duration != nil && idx == 0 {
-						continue
-					}
-
-					value := groupId.GetValue(idx)
-
-					switch x := value.(type) {
-					case string:
-						point.Values = append(point.Values, &protocol.FieldValue{StringValue: &x})
-					case bool:
-						point.Values = append(point.Values, &protocol.FieldValue{BoolValue: &x})
-					case float64:
-						point.Values = append(point.Values, &protocol.FieldValue{DoubleValue: &x})
-					case int64:
-						point.Values = append(point.Values, &protocol.FieldValue{Int64Value: &x})
-					case nil:
-						point.Values = append(point.Values, nil)
-					}
-				}
-
+				point.Values = append(point.Values, self.getGroupByValues(groupId)...)
 				points = append(points, point)
 			}
 		}
@@ -580,6 +640,238 @@ func (self *QueryEngine) runAggregates() {
 	}
 }
 
+// Returns the values of the group at every point of the group if any
+// of the aggregators returns a value per point, e.g. moving_average()
+// without group by time. The other aggregators repeat the value of the
+// group. Returns nil if there are no such aggregators.
+func (self *QueryEngine) getPointValues(table string, groupId Group) ([]int64, [][][]*protocol.FieldValue) {
+	seen := map[int64]bool{}
+	timestamps := []int64{}
+	groupValues := make([][][]*protocol.FieldValue, len(self.aggregators))
+	for idx, aggregator := range self.aggregators {
+		pointAggregator, ok := aggregator.(PointAggregator)
+		if !ok {
+			groupValues[idx] = aggregator.GetValues(table, groupId)
+			continue
+		}
+		for _, timestamp := range pointAggregator.GetTimestamps(table, groupId) {
+			if !seen[timestamp] {
+				seen[timestamp] = true
+				timestamps = append(timestamps, timestamp)
+			}
+		}
+	}
+	if len(timestamps) == 0 {
+		return nil, nil
+	}
+
+	SortInt64(timestamps)
+	if !self.query.Ascending {
+		for i, j := 0, len(timestamps)-1; i < j; i, j = i+1, j-1 {
+			timestamps[i], timestamps[j] = timestamps[j], timestamps[i]
+		}
+	}
+
+	values := make([][][]*protocol.FieldValue, 0, len(timestamps))
+	for _, timestamp := range timestamps {
+		pointValues := [][][]*protocol.FieldValue{}
+		for idx, aggregator := range self.aggregators {
+			if pointAggregator, ok := aggregator.(PointAggregator); ok {
+				pointValues = append(pointValues, pointAggregator.GetValuesAt(table, groupId, timestamp))
+			} else {
+				pointValues = append(pointValues, groupValues[idx])
+			}
+		}
+		values = append(values, crossProduct(pointValues))
+	}
+	return timestamps, values
+}
+
+// Returns the values of the group by columns of the given group
+func (self *QueryEngine) getGroupByValues(groupId Group) []*protocol.FieldValue {
+	values := []*protocol.FieldValue{}
+
+	// FIXME: this should be looking at the fields slice not the group by clause
+	// FIXME: we should check whether the selected columns are in the group by clause
+	for idx, _ := range self.groupBy.Elems {
+		if self.duration != nil && idx == 0 {
+			continue
+		}
+
+		value := groupId.GetValue(idx)
+
+		switch x := value.(type) {
+		case string:
+			values = append(values, &protocol.FieldValue{StringValue: &x})
+		case bool:
+			values = append(values, &protocol.FieldValue{BoolValue: &x})
+		case float64:
+			values = append(values, &protocol.FieldValue{DoubleValue: &x})
+		case int64:
+			values = append(values, &protocol.FieldValue{Int64Value: &x})
+		case nil:
+			values = append(values, nil)
+		}
+	}
+	return values
+}
+
+// Yields the partial states of the aggregates of every group that has
+// points. The fields of the series are the group by columns, the
+// timestamps are the ones the groups would be returned with.
+func (self *QueryEngine) yieldPartialAggregates() {
+	fields := []string{}
+	for _, value := range self.groupBy.Elems {
+		if value.IsFunctionCall() {
+			continue
+		}
+		fields = append(fields, value.Name)
+	}
+
+	for table, tableGroups := range self.groups {
+		tempTable := table
+		points := make([]*protocol.Point, 0, len(tableGroups))
+		for groupId, _ := range tableGroups {
+			point := &protocol.Point{Values: self.getGroupByValues(groupId)}
+			if groupId.HasTimestamp() {
+				point.SetTimestampInMicroseconds(groupId.GetTimestamp())
+			} else {
+				point.SetTimestampInMicroseconds(*self.timestampAggregator.GetValues(table, groupId)[0][0].Int64Value)
+			}
+
+			for _, aggregator := range self.aggregators {
+				state, err := aggregator.(PartialAggregator).GetPartialState(table, groupId)
+				if err != nil {
+					log.Error("Error while getting the partial state of an aggregate: %s", err)
+					return
+				}
+				point.PartialStates = append(point.PartialStates, state)
+			}
+			points = append(points, point)
+		}
+
+		self.aggregateYield(&protocol.Series{
+			Name:   &tempTable,
+			Fields: fields,
+			Points: points,
+		})
+	}
+}
+
+// Returns the first and the last time bucket (in nanoseconds) of the
+// given table that should be returned. These are the buckets of the
+// start and end time of the query, or of the first and last point if
+// the query doesn't limit the time range.
+func (self *QueryEngine) getFillRange(table string) (int64, int64, bool) {
+	timeRange, ok := self.pointsRange[table]
+	if !ok {
+		return 0, 0, false
+	}
+
+	start, end := timeRange.startTime, timeRange.endTime
+	if self.query.IsStartTimeSpecified() {
+		start = common.TimeToMicroseconds(self.query.GetStartTime())
+	}
+	if self.query.IsEndTimeSpecified() {
+		// the end time is exclusive
+		end = common.TimeToMicroseconds(self.query.GetEndTime()) - 1
+	}
+
+	duration := int64(*self.duration)
+	return start * 1000 / duration * duration, end * 1000 / duration * duration, true
+}
+
+// Sets the values of the groups that don't have any points according
+// to the fill mode of the query
+func (self *QueryEngine) fillEmptyGroups(table string, groups []Group, groupValues map[Group][][]*protocol.FieldValue, columns int) {
+	// the buckets of every group in ascending time order
+	bucketsByGroup := map[Group][]Group{}
+	for _, group := range groups {
+		withoutTimestamp := group.WithoutTimestamp()
+		bucketsByGroup[withoutTimestamp] = append(bucketsByGroup[withoutTimestamp], group)
+	}
+
+	fillValue, _ := wrapDefaultValue(self.groupBy.FillValue)
+
+	for _, buckets := range bucketsByGroup {
+		sort.Sort(&AscendingGroupTimestampSortableGroups{CommonSortableGroups{buckets, table}})
+
+		// the index of the next bucket that has points
+		next := make([]int, len(buckets))
+		nextIndex := -1
+		for i := len(buckets) - 1; i >= 0; i-- {
+			next[i] = nextIndex
+			if groupValues[buckets[i]] != nil {
+				nextIndex = i
+			}
+		}
+
+		previous := -1
+		for i, bucket := range buckets {
+			if groupValues[bucket] != nil {
+				previous = i
+				continue
+			}
+
+			values := make([]*protocol.FieldValue, columns)
+			for column := range values {
+				values[column] = &protocol.FieldValue{IsNull: &common.TRUE}
+			}
+
+			switch self.groupBy.FillMode {
+			case parser.FillConstant:
+				for column := range values {
+					values[column] = fillValue
+				}
+			case parser.FillPrevious:
+				if previous != -1 {
+					previousValues := groupValues[buckets[previous]]
+					copy(values, previousValues[len(previousValues)-1])
+				}
+			case parser.FillLinear:
+				if previous == -1 || next[i] == -1 {
+					break
+				}
+				previousValues := groupValues[buckets[previous]]
+				nextValues := groupValues[buckets[next[i]]][0]
+				fraction := float64(i-previous) / float64(next[i]-previous)
+				for column, previousValue := range previousValues[len(previousValues)-1][:columns] {
+					if value, ok := interpolate(previousValue, nextValues[column], fraction); ok {
+						values[column] = &protocol.FieldValue{DoubleValue: &value}
+					}
+				}
+			}
+
+			groupValues[bucket] = [][]*protocol.FieldValue{values}
+		}
+	}
+}
+
+func interpolate(start, end *protocol.FieldValue, fraction float64) (float64, bool) {
+	startValue, ok := numericValue(start)
+	if !ok {
+		return 0, false
+	}
+	endValue, ok := numericValue(end)
+	if !ok {
+		return 0, false
+	}
+	return startValue + (endValue-startValue)*fraction, true
+}
+
+func numericValue(value *protocol.FieldValue) (float64, bool) {
+	switch {
+	case value == nil:
+		return 0, false
+	case value.Int64Value != nil:
+		return float64(*value.Int64Value), true
+	case value.DoubleValue != nil:
+		return *value.DoubleValue, true
+	default:
+		return 0, false
+	}
+}
+
 func (self *QueryEngine) executeArithmeticQuery(query *parser.SelectQuery, yield func(*protocol.Series) error) error {
 
 	names := map[string]*parser.Value{}
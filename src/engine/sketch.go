@@ -0,0 +1,285 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"protocol"
+	"sort"
+)
+
+//
+// Sketches
+//
+// Mergeable summaries of the values of a group with a bounded size, so
+// the approximate aggregates don't have to keep every value in memory
+// and the shards can ship their summaries to the coordinator.
+//
+
+const (
+	TDIGEST_COMPRESSION   = 100
+	HYPERLOGLOG_PRECISION = 12
+)
+
+type centroid struct {
+	mean  float64
+	count float64
+}
+
+type centroids []centroid
+
+func (self centroids) Len() int           { return len(self) }
+func (self centroids) Less(i, j int) bool { return self[i].mean < self[j].mean }
+func (self centroids) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+// A merging t-digest (Dunning & Ertl). The values are summarized by at
+// most about 2 * compression centroids, that are smaller near the
+// extremes, so the tail percentiles stay accurate.
+type tDigest struct {
+	compression float64
+	centroids   centroids
+	unmerged    centroids
+	count       float64
+	min         float64
+	max         float64
+}
+
+func newTDigest(compression float64) *tDigest {
+	return &tDigest{
+		compression: compression,
+		min:         math.Inf(1),
+		max:         math.Inf(-1),
+	}
+}
+
+func (self *tDigest) Add(value float64, count float64) {
+	if count <= 0 {
+		return
+	}
+	self.unmerged = append(self.unmerged, centroid{value, count})
+	self.count += count
+	self.min = math.Min(self.min, value)
+	self.max = math.Max(self.max, value)
+	if len(self.unmerged) >= int(self.compression)*5 {
+		self.compress()
+	}
+}
+
+func (self *tDigest) Merge(other *tDigest) {
+	if other.count == 0 {
+		return
+	}
+	self.unmerged = append(self.unmerged, other.centroids...)
+	self.unmerged = append(self.unmerged, other.unmerged...)
+	self.count += other.count
+	self.min = math.Min(self.min, other.min)
+	self.max = math.Max(self.max, other.max)
+	self.compress()
+}
+
+func (self *tDigest) compress() {
+	if len(self.unmerged) == 0 {
+		return
+	}
+
+	all := append(self.unmerged, self.centroids...)
+	sort.Sort(all)
+	merged := make(centroids, 0, len(self.centroids)+1)
+	current := all[0]
+	// the number of values in the centroids before the current one
+	soFar := 0.0
+	for _, next := range all[1:] {
+		q := (soFar + current.count + next.count) / self.count
+		limit := 4 * self.count * q * (1 - q) / self.compression
+		if current.count+next.count <= limit {
+			current.mean += (next.mean - current.mean) * next.count / (current.count + next.count)
+			current.count += next.count
+			continue
+		}
+		soFar += current.count
+		merged = append(merged, current)
+		current = next
+	}
+	merged = append(merged, current)
+
+	self.centroids = merged
+	self.unmerged = nil
+}
+
+// Returns the estimate of the value at the given quantile (0 - 1)
+func (self *tDigest) Quantile(q float64) float64 {
+	self.compress()
+	if len(self.centroids) == 0 {
+		return math.NaN()
+	}
+	if len(self.centroids) == 1 || q <= 0 {
+		return self.min
+	}
+	if q >= 1 {
+		return self.max
+	}
+
+	// every centroid is centered on the middle of its values, the
+	// values in between are interpolated
+	target := q * self.count
+	soFar := 0.0
+	for i, c := range self.centroids {
+		center := soFar + c.count/2
+		if target < center {
+			if i == 0 {
+				return self.min + (c.mean-self.min)*target/center
+			}
+			previous := self.centroids[i-1]
+			previousCenter := soFar - previous.count/2
+			return previous.mean + (c.mean-previous.mean)*(target-previousCenter)/(center-previousCenter)
+		}
+		soFar += c.count
+	}
+
+	last := self.centroids[len(self.centroids)-1]
+	lastCenter := self.count - last.count/2
+	if self.count == lastCenter {
+		return self.max
+	}
+	return last.mean + (self.max-last.mean)*(target-lastCenter)/(self.count-lastCenter)
+}
+
+func (self *tDigest) MarshalBinary() []byte {
+	self.compress()
+	buffer := bytes.NewBuffer(nil)
+	binary.Write(buffer, binary.BigEndian, self.compression)
+	binary.Write(buffer, binary.BigEndian, self.min)
+	binary.Write(buffer, binary.BigEndian, self.max)
+	binary.Write(buffer, binary.BigEndian, uint32(len(self.centroids)))
+	for _, c := range self.centroids {
+		binary.Write(buffer, binary.BigEndian, c.mean)
+		binary.Write(buffer, binary.BigEndian, c.count)
+	}
+	return buffer.Bytes()
+}
+
+func unmarshalTDigest(data []byte) (*tDigest, error) {
+	reader := bytes.NewReader(data)
+	digest := &tDigest{}
+	var size uint32
+	for _, field := range []interface{}{&digest.compression, &digest.min, &digest.max, &size} {
+		if err := binary.Read(reader, binary.BigEndian, field); err != nil {
+			return nil, fmt.Errorf("Invalid t-digest: %s", err)
+		}
+	}
+	if reader.Len() != int(size)*16 {
+		return nil, fmt.Errorf("Invalid t-digest: expected %d centroids", size)
+	}
+	digest.centroids = make(centroids, size)
+	for i := range digest.centroids {
+		binary.Read(reader, binary.BigEndian, &digest.centroids[i].mean)
+		binary.Read(reader, binary.BigEndian, &digest.centroids[i].count)
+		digest.count += digest.centroids[i].count
+	}
+	return digest, nil
+}
+
+// A HyperLogLog counter (Flajolet et al.) with 2^precision registers.
+// The standard error of the count is about 1.04 / sqrt(2^precision).
+type hyperLogLog struct {
+	precision uint8
+	registers []uint8
+}
+
+func newHyperLogLog(precision uint8) *hyperLogLog {
+	return &hyperLogLog{precision, make([]uint8, 1<<precision)}
+}
+
+func (self *hyperLogLog) Add(value *protocol.FieldValue) {
+	hash := hashFieldValue(value)
+	index := hash >> (64 - self.precision)
+	// the position of the first set bit of the remaining bits
+	rank := uint8(1)
+	for remaining := hash << self.precision; rank <= 64-self.precision && remaining&(1<<63) == 0; remaining <<= 1 {
+		rank++
+	}
+	if rank > self.registers[index] {
+		self.registers[index] = rank
+	}
+}
+
+func (self *hyperLogLog) Merge(other *hyperLogLog) error {
+	if other.precision != self.precision {
+		return fmt.Errorf("Can't merge HyperLogLog counters with different precisions")
+	}
+	for i, rank := range other.registers {
+		if rank > self.registers[i] {
+			self.registers[i] = rank
+		}
+	}
+	return nil
+}
+
+func (self *hyperLogLog) Count() int64 {
+	m := float64(len(self.registers))
+	sum := 0.0
+	zeros := 0
+	for _, rank := range self.registers {
+		sum += math.Pow(2, -float64(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+	// use linear counting for small cardinalities
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(estimate + 0.5)
+}
+
+func (self *hyperLogLog) MarshalBinary() []byte {
+	return append([]byte{self.precision}, self.registers...)
+}
+
+func unmarshalHyperLogLog(data []byte) (*hyperLogLog, error) {
+	if len(data) == 0 || data[0] > 16 || len(data) != 1+1<<data[0] {
+		return nil, fmt.Errorf("Invalid HyperLogLog counter")
+	}
+	return &hyperLogLog{data[0], append([]uint8{}, data[1:]...)}, nil
+}
+
+// 64 bit FNV-1a hash of the type and value, with the finalizer of
+// murmur3 to spread the bits
+func hashFieldValue(value *protocol.FieldValue) uint64 {
+	var data []byte
+	switch {
+	case value.StringValue != nil:
+		data = append([]byte{'s'}, *value.StringValue...)
+	case value.Int64Value != nil, value.DoubleValue != nil:
+		// integers are counted as the equal doubles, like distinct() does
+		number := value.GetDoubleValue()
+		if value.Int64Value != nil {
+			number = float64(*value.Int64Value)
+		}
+		data = make([]byte, 9)
+		data[0] = 'd'
+		binary.BigEndian.PutUint64(data[1:], math.Float64bits(number))
+	case value.BoolValue != nil:
+		data = []byte{'b', 0}
+		if *value.BoolValue {
+			data[1] = 1
+		}
+	}
+
+	hash := uint64(14695981039346656037)
+	for _, b := range data {
+		hash ^= uint64(b)
+		hash *= 1099511628211
+	}
+
+	hash ^= hash >> 33
+	hash *= 0xff51afd7ed558ccd
+	hash ^= hash >> 33
+	hash *= 0xc4ceb9fe1a85ec53
+	hash ^= hash >> 33
+	return hash
+}
@@ -0,0 +1,231 @@
+package engine
+
+import (
+	"common"
+	"parser"
+	"protocol"
+	"strconv"
+)
+
+func init() {
+	registeredAggregators["approx_percentile"] = NewApproximatePercentileAggregator
+	registeredAggregators["approx_median"] = NewApproximateMedianAggregator
+	registeredAggregators["approx_count_distinct"] = NewApproximateCountDistinctAggregator
+}
+
+//
+// Approximate Percentile Aggregator
+//
+
+type ApproximatePercentileAggregator struct {
+	AbstractAggregator
+	functionName string
+	percentile   float64
+	digests      map[string]map[interface{}]*tDigest
+	defaultValue *protocol.FieldValue
+}
+
+func (self *ApproximatePercentileAggregator) getDigest(series string, group interface{}) *tDigest {
+	digests := self.digests[series]
+	if digests == nil {
+		digests = make(map[interface{}]*tDigest)
+		self.digests[series] = digests
+	}
+
+	digest := digests[group]
+	if digest == nil {
+		digest = newTDigest(TDIGEST_COMPRESSION)
+		digests[group] = digest
+	}
+	return digest
+}
+
+func (self *ApproximatePercentileAggregator) AggregatePoint(series string, group interface{}, p *protocol.Point) error {
+	v, err := GetValue(self.value, self.columns, p)
+	if err != nil {
+		return err
+	}
+
+	value := 0.0
+	if v.Int64Value != nil {
+		value = float64(*v.Int64Value)
+	} else if v.DoubleValue != nil {
+		value = *v.DoubleValue
+	} else {
+		return nil
+	}
+
+	self.getDigest(series, group).Add(value, 1)
+	return nil
+}
+
+func (self *ApproximatePercentileAggregator) GetPartialState(series string, group interface{}) ([]byte, error) {
+	return self.getDigest(series, group).MarshalBinary(), nil
+}
+
+func (self *ApproximatePercentileAggregator) MergePartialState(series string, group interface{}, state []byte) error {
+	digest, err := unmarshalTDigest(state)
+	if err != nil {
+		return err
+	}
+	self.getDigest(series, group).Merge(digest)
+	return nil
+}
+
+func (self *ApproximatePercentileAggregator) ColumnNames() []string {
+	return []string{self.functionName}
+}
+
+func (self *ApproximatePercentileAggregator) GetValues(series string, group interface{}) [][]*protocol.FieldValue {
+	digest := self.digests[series][group]
+	if digest == nil || digest.count == 0 {
+		return [][]*protocol.FieldValue{
+			[]*protocol.FieldValue{self.defaultValue},
+		}
+	}
+
+	value := digest.Quantile(self.percentile / 100)
+	return [][]*protocol.FieldValue{
+		[]*protocol.FieldValue{
+			&protocol.FieldValue{DoubleValue: &value},
+		},
+	}
+}
+
+func NewApproximatePercentileAggregator(_ *parser.SelectQuery, value *parser.Value, defaultValue *parser.Value) (Aggregator, error) {
+	if len(value.Elems) != 2 {
+		return nil, common.NewQueryError(common.WrongNumberOfArguments, "function approx_percentile() requires exactly two arguments")
+	}
+	percentile, err := strconv.ParseFloat(value.Elems[1].Name, 64)
+
+	if err != nil || percentile <= 0 || percentile >= 100 {
+		return nil, common.NewQueryError(common.InvalidArgument, "function approx_percentile() requires a numeric second argument between 0 and 100")
+	}
+
+	wrappedDefaultValue, err := wrapDefaultValue(defaultValue)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ApproximatePercentileAggregator{
+		AbstractAggregator: AbstractAggregator{
+			value: value.Elems[0],
+		},
+		functionName: "approx_percentile",
+		percentile:   percentile,
+		digests:      make(map[string]map[interface{}]*tDigest),
+		defaultValue: wrappedDefaultValue,
+	}, nil
+}
+
+func NewApproximateMedianAggregator(_ *parser.SelectQuery, value *parser.Value, defaultValue *parser.Value) (Aggregator, error) {
+	if len(value.Elems) != 1 {
+		return nil, common.NewQueryError(common.WrongNumberOfArguments, "function approx_median() requires exactly one argument")
+	}
+
+	wrappedDefaultValue, err := wrapDefaultValue(defaultValue)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ApproximatePercentileAggregator{
+		AbstractAggregator: AbstractAggregator{
+			value: value.Elems[0],
+		},
+		functionName: "approx_median",
+		percentile:   50.0,
+		digests:      make(map[string]map[interface{}]*tDigest),
+		defaultValue: wrappedDefaultValue,
+	}, nil
+}
+
+//
+// Approximate Count Distinct Aggregator
+//
+
+type ApproximateCountDistinctAggregator struct {
+	AbstractAggregator
+	counters     map[string]map[interface{}]*hyperLogLog
+	defaultValue *protocol.FieldValue
+}
+
+func (self *ApproximateCountDistinctAggregator) getCounter(series string, group interface{}) *hyperLogLog {
+	counters := self.counters[series]
+	if counters == nil {
+		counters = make(map[interface{}]*hyperLogLog)
+		self.counters[series] = counters
+	}
+
+	counter := counters[group]
+	if counter == nil {
+		counter = newHyperLogLog(HYPERLOGLOG_PRECISION)
+		counters[group] = counter
+	}
+	return counter
+}
+
+func (self *ApproximateCountDistinctAggregator) AggregatePoint(series string, group interface{}, p *protocol.Point) error {
+	value, err := GetValue(self.value, self.columns, p)
+	if err != nil {
+		return err
+	}
+
+	if value.GetIsNull() || (value.StringValue == nil && value.Int64Value == nil &&
+		value.DoubleValue == nil && value.BoolValue == nil) {
+		return nil
+	}
+
+	self.getCounter(series, group).Add(value)
+	return nil
+}
+
+func (self *ApproximateCountDistinctAggregator) GetPartialState(series string, group interface{}) ([]byte, error) {
+	return self.getCounter(series, group).MarshalBinary(), nil
+}
+
+func (self *ApproximateCountDistinctAggregator) MergePartialState(series string, group interface{}, state []byte) error {
+	counter, err := unmarshalHyperLogLog(state)
+	if err != nil {
+		return err
+	}
+	return self.getCounter(series, group).Merge(counter)
+}
+
+func (self *ApproximateCountDistinctAggregator) ColumnNames() []string {
+	return []string{"approx_count_distinct"}
+}
+
+func (self *ApproximateCountDistinctAggregator) GetValues(series string, group interface{}) [][]*protocol.FieldValue {
+	counter := self.counters[series][group]
+	if counter == nil {
+		return [][]*protocol.FieldValue{
+			[]*protocol.FieldValue{self.defaultValue},
+		}
+	}
+
+	count := counter.Count()
+	return [][]*protocol.FieldValue{
+		[]*protocol.FieldValue{
+			&protocol.FieldValue{Int64Value: &count},
+		},
+	}
+}
+
+func NewApproximateCountDistinctAggregator(_ *parser.SelectQuery, value *parser.Value, defaultValue *parser.Value) (Aggregator, error) {
+	if len(value.Elems) != 1 {
+		return nil, common.NewQueryError(common.WrongNumberOfArguments, "function approx_count_distinct() requires exactly one argument")
+	}
+
+	wrappedDefaultValue, err := wrapDefaultValue(defaultValue)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ApproximateCountDistinctAggregator{
+		AbstractAggregator: AbstractAggregator{
+			value: value.Elems[0],
+		},
+		counters:     make(map[string]map[interface{}]*hyperLogLog),
+		defaultValue: wrappedDefaultValue,
+	}, nil
+}
@@ -0,0 +1,132 @@
+package engine
+
+import (
+	"fmt"
+	. "launchpad.net/gocheck"
+	"math"
+	"math/rand"
+	"parser"
+	"protocol"
+)
+
+type SketchSuite struct{}
+
+var _ = Suite(&SketchSuite{})
+
+func (self *SketchSuite) TestTDigestQuantiles(c *C) {
+	first, second := newTDigest(TDIGEST_COMPRESSION), newTDigest(TDIGEST_COMPRESSION)
+	for i, value := range rand.New(rand.NewSource(1)).Perm(100000) {
+		if i%2 == 0 {
+			first.Add(float64(value+1), 1)
+		} else {
+			second.Add(float64(value+1), 1)
+		}
+	}
+	c.Assert(len(first.MarshalBinary()) < 10000, Equals, true)
+
+	decoded, err := unmarshalTDigest(second.MarshalBinary())
+	c.Assert(err, IsNil)
+	first.Merge(decoded)
+
+	for _, q := range []float64{0.01, 0.5, 0.9, 0.99, 0.999} {
+		expected := q * 100000
+		actual := first.Quantile(q)
+		c.Assert(math.Abs(actual-expected)/expected < 0.01, Equals, true, Commentf("quantile %f: %f", q, actual))
+	}
+	c.Assert(first.Quantile(0), Equals, 1.0)
+	c.Assert(first.Quantile(1), Equals, 100000.0)
+}
+
+func (self *SketchSuite) TestHyperLogLogCount(c *C) {
+	first, second := newHyperLogLog(HYPERLOGLOG_PRECISION), newHyperLogLog(HYPERLOGLOG_PRECISION)
+	for i := 0; i < 60000; i++ {
+		first.Add(&protocol.FieldValue{StringValue: protocol.String(fmt.Sprintf("host%d", i))})
+	}
+	// the values are counted once, regardless of their count
+	for i := 40000; i < 100000; i++ {
+		second.Add(&protocol.FieldValue{StringValue: protocol.String(fmt.Sprintf("host%d", i))})
+		second.Add(&protocol.FieldValue{StringValue: protocol.String(fmt.Sprintf("host%d", i))})
+	}
+
+	decoded, err := unmarshalHyperLogLog(second.MarshalBinary())
+	c.Assert(err, IsNil)
+	c.Assert(first.Merge(decoded), IsNil)
+	count := first.Count()
+	c.Assert(math.Abs(float64(count)-100000)/100000 < 0.05, Equals, true, Commentf("count: %d", count))
+
+	small := newHyperLogLog(HYPERLOGLOG_PRECISION)
+	for i := int64(0); i < 10; i++ {
+		value := i % 5
+		small.Add(&protocol.FieldValue{Int64Value: &value})
+	}
+	c.Assert(small.Count(), Equals, int64(5))
+}
+
+func (self *SketchSuite) TestPartialAggregation(c *C) {
+	query, err := parser.ParseSelectQuery("select approx_median(column_one), approx_count_distinct(column_one) from foo group by time(1m), column_two")
+	c.Assert(err, IsNil)
+	c.Assert(CanAggregatePartially(query), Equals, true)
+
+	// the points of every group are split across the shards
+	merged := make(chan *protocol.Response)
+	mergingEngine := NewMergingQueryEngine(query, merged)
+	for shard := int64(0); shard < 2; shard++ {
+		partial := make(chan *protocol.Response, 10)
+		engine := NewPartialQueryEngine(query, partial)
+		for i := int64(0); i < 4; i++ {
+			value := shard*4 + i
+			timestamp := 1381346700000000 + (i%2)*60000000
+			engine.YieldPoint(protocol.String("foo"), []string{"column_one", "column_two"}, &protocol.Point{
+				Values: []*protocol.FieldValue{
+					&protocol.FieldValue{Int64Value: &value},
+					&protocol.FieldValue{StringValue: protocol.String("a")},
+				},
+				Timestamp: &timestamp,
+			})
+		}
+		engine.Close()
+
+		for response := range partial {
+			if *response.Type == protocol.Response_END_STREAM {
+				break
+			}
+			for _, point := range response.Series.Points {
+				c.Assert(point.PartialStates, HasLen, 2)
+				mergingEngine.YieldPoint(response.Series.Name, response.Series.Fields, point)
+			}
+		}
+	}
+
+	go mergingEngine.Close()
+	values := map[int64][]interface{}{}
+	for response := range merged {
+		if *response.Type == protocol.Response_END_STREAM {
+			break
+		}
+		c.Assert(response.Series.Fields, DeepEquals, []string{"approx_median", "approx_count_distinct", "column_two"})
+		for _, point := range response.Series.Points {
+			values[*point.Timestamp] = []interface{}{point.Values[0].GetValue(), point.Values[1].GetValue(), point.Values[2].GetValue()}
+		}
+	}
+
+	// 0, 2, 4, 6 were written in the first bucket and 1, 3, 5, 7 in the second
+	c.Assert(values, DeepEquals, map[int64][]interface{}{
+		1381346700000000: []interface{}{3.0, int64(4), "a"},
+		1381346760000000: []interface{}{4.0, int64(4), "a"},
+	})
+}
+
+func (self *SketchSuite) TestCanAggregatePartially(c *C) {
+	for queryString, expected := range map[string]bool{
+		"select approx_percentile(column_one, 99) from foo group by time(1m)":              true,
+		"select approx_percentile(column_one, 99), count(column_one) from foo":             true,
+		"select percentile(column_one, 99) from foo":                                       false,
+		"select approx_count_distinct(column_one) from foo merge bar":                      false,
+		"select column_one from foo":                                                       false,
+		"select approx_percentile(column_one, 99), moving_average(column_one, 2) from foo": false,
+	} {
+		query, err := parser.ParseSelectQuery(queryString)
+		c.Assert(err, IsNil)
+		c.Assert(CanAggregatePartially(query), Equals, expected, Commentf(queryString))
+	}
+}
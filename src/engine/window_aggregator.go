@@ -0,0 +1,427 @@
+package engine
+
+import (
+	"common"
+	"parser"
+	"protocol"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+// Window Aggregators
+//
+// Window aggregators look back across buckets. The value of a bucket is
+// computed from the points of the group up to the end of the bucket,
+// including the points of the earlier buckets. Without group by time
+// there's a value for every point of the group, the window ends after
+// the point. The points are kept until the values are requested, since
+// they can arrive out of order when the points of several shards are
+// aggregated, so a query can only keep WINDOW_AGGREGATOR_MAX_POINTS in
+// memory per aggregate.
+//
+
+const WINDOW_AGGREGATOR_MAX_POINTS = 1000000
+
+var windowAggregators = map[string]bool{
+	"moving_average": true,
+	"ema":            true,
+	"rolling_sum":    true,
+	// the derivative of a bucket starts at the last point of the
+	// earlier buckets
+	"non_negative_derivative": true,
+	"rate":                    true,
+}
+
+// Implemented by the aggregators that return a value for every point
+// of a group instead of one value for the group
+type PointAggregator interface {
+	// Returns the timestamps of the points of the group in ascending order
+	GetTimestamps(series string, group interface{}) []int64
+	// Returns the value of the group at the point with the given timestamp
+	GetValuesAt(series string, group interface{}, timestamp int64) [][]*protocol.FieldValue
+}
+
+func init() {
+	registeredAggregators["moving_average"] = NewMovingAverageAggregator
+	registeredAggregators["ema"] = NewExponentialMovingAverageAggregator
+	registeredAggregators["rolling_sum"] = NewRollingSumAggregator
+	registeredAggregators["non_negative_derivative"] = NewNonNegativeDerivativeAggregator
+	registeredAggregators["rate"] = NewRateAggregator
+}
+
+// Returns true if the query uses aggregates that look back across
+// buckets. These can't be aggregated at the shard level, because the
+// windows would end at the boundaries of the shards.
+func HasWindowAggregates(query *parser.SelectQuery) bool {
+	for _, column := range query.GetColumnNames() {
+		if column.IsFunctionCall() && windowAggregators[strings.ToLower(column.Name)] {
+			return true
+		}
+	}
+	return false
+}
+
+type windowPoint struct {
+	timestamp int64
+	value     float64
+}
+
+type windowPoints struct {
+	points []windowPoint
+	sorted bool
+	// sums[i] is the sum of the values of the first i points
+	sums []float64
+	// emas[i] is the exponential moving average after the point i
+	emas []float64
+}
+
+func (self *windowPoints) Len() int {
+	return len(self.points)
+}
+
+func (self *windowPoints) Less(i, j int) bool {
+	return self.points[i].timestamp < self.points[j].timestamp
+}
+
+func (self *windowPoints) Swap(i, j int) {
+	self.points[i], self.points[j] = self.points[j], self.points[i]
+}
+
+func (self *windowPoints) sort() {
+	if self.sorted {
+		return
+	}
+	sort.Stable(self)
+	self.sums = make([]float64, len(self.points)+1)
+	for i, point := range self.points {
+		self.sums[i+1] = self.sums[i] + point.value
+	}
+	self.emas = nil
+	self.sorted = true
+}
+
+// Computes the value of the window that ends before the point at index
+// end, which is the first point at or after endTime. The points of the
+// bucket start at the index begin.
+type windowFunction func(points *windowPoints, begin, end int, endTime int64) (float64, bool)
+
+type WindowAggregator struct {
+	AbstractAggregator
+	name         string
+	compute      windowFunction
+	groupByTime  int64
+	points       map[string]map[interface{}]*windowPoints
+	count        int
+	defaultValue *protocol.FieldValue
+}
+
+// The state of a group is shared by all the buckets of the group
+func (self *WindowAggregator) stateKey(group interface{}) interface{} {
+	if g, ok := group.(Group); ok {
+		return g.WithoutTimestamp()
+	}
+	return group
+}
+
+func (self *WindowAggregator) AggregatePoint(series string, group interface{}, p *protocol.Point) error {
+	fieldValue, err := GetValue(self.value, self.columns, p)
+	if err != nil {
+		return err
+	}
+
+	var value float64
+	if ptr := fieldValue.Int64Value; ptr != nil {
+		value = float64(*ptr)
+	} else if ptr := fieldValue.DoubleValue; ptr != nil {
+		value = *ptr
+	} else {
+		// else ignore this point
+		return nil
+	}
+
+	if self.count >= WINDOW_AGGREGATOR_MAX_POINTS {
+		return common.NewQueryError(common.InvalidArgument,
+			"function %s() can't look at more than %d points, use a shorter time range", self.name, WINDOW_AGGREGATOR_MAX_POINTS)
+	}
+
+	seriesPoints := self.points[series]
+	if seriesPoints == nil {
+		seriesPoints = make(map[interface{}]*windowPoints)
+		self.points[series] = seriesPoints
+	}
+
+	key := self.stateKey(group)
+	points := seriesPoints[key]
+	if points == nil {
+		points = &windowPoints{}
+		seriesPoints[key] = points
+	}
+	points.points = append(points.points, windowPoint{*p.GetTimestampInMicroseconds(), value})
+	points.sorted = false
+	self.count++
+	return nil
+}
+
+func (self *WindowAggregator) ColumnNames() []string {
+	return []string{self.name}
+}
+
+func (self *WindowAggregator) GetValues(series string, group interface{}) [][]*protocol.FieldValue {
+	points := self.points[series][self.stateKey(group)]
+	if points == nil || len(points.points) == 0 {
+		return self.defaultValues()
+	}
+
+	points.sort()
+	begin, end := 0, len(points.points)
+	endTime := points.points[end-1].timestamp + 1
+	if g, ok := group.(Group); ok && g.HasTimestamp() && self.groupByTime > 0 {
+		endTime = g.GetTimestamp() + self.groupByTime
+		begin = sort.Search(len(points.points), func(i int) bool {
+			return points.points[i].timestamp >= g.GetTimestamp()
+		})
+		end = sort.Search(len(points.points), func(i int) bool {
+			return points.points[i].timestamp >= endTime
+		})
+	}
+	return self.computeValues(points, begin, end, endTime)
+}
+
+func (self *WindowAggregator) GetTimestamps(series string, group interface{}) []int64 {
+	points := self.points[series][self.stateKey(group)]
+	if points == nil {
+		return nil
+	}
+
+	points.sort()
+	timestamps := []int64{}
+	for i, point := range points.points {
+		if i == 0 || point.timestamp != points.points[i-1].timestamp {
+			timestamps = append(timestamps, point.timestamp)
+		}
+	}
+	return timestamps
+}
+
+// The window of a point starts at the point and ends after the last
+// point with the same timestamp
+func (self *WindowAggregator) GetValuesAt(series string, group interface{}, timestamp int64) [][]*protocol.FieldValue {
+	points := self.points[series][self.stateKey(group)]
+	if points == nil || len(points.points) == 0 {
+		return self.defaultValues()
+	}
+
+	points.sort()
+	begin := sort.Search(len(points.points), func(i int) bool {
+		return points.points[i].timestamp >= timestamp
+	})
+	end := sort.Search(len(points.points), func(i int) bool {
+		return points.points[i].timestamp > timestamp
+	})
+	return self.computeValues(points, begin, end, timestamp+1)
+}
+
+func (self *WindowAggregator) computeValues(points *windowPoints, begin, end int, endTime int64) [][]*protocol.FieldValue {
+	value, ok := self.compute(points, begin, end, endTime)
+	if !ok {
+		return self.defaultValues()
+	}
+	return [][]*protocol.FieldValue{
+		[]*protocol.FieldValue{
+			&protocol.FieldValue{DoubleValue: &value},
+		},
+	}
+}
+
+func (self *WindowAggregator) defaultValues() [][]*protocol.FieldValue {
+	return [][]*protocol.FieldValue{
+		[]*protocol.FieldValue{self.defaultValue},
+	}
+}
+
+func NewWindowAggregator(name string, q *parser.SelectQuery, value *parser.Value, defaultValue *parser.Value, compute windowFunction) (Aggregator, error) {
+	if len(value.Elems) != 2 {
+		return nil, common.NewQueryError(common.WrongNumberOfArguments, "function %s() requires exactly two arguments", name)
+	}
+
+	var groupByTime int64
+	if q != nil {
+		duration, err := q.GetGroupByClause().GetGroupByTime()
+		if err != nil {
+			return nil, err
+		}
+		if duration != nil {
+			groupByTime = int64(*duration / time.Microsecond)
+		}
+	}
+
+	wrappedDefaultValue, err := wrapDefaultValue(defaultValue)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WindowAggregator{
+		AbstractAggregator: AbstractAggregator{
+			value: value.Elems[0],
+		},
+		name:         name,
+		compute:      compute,
+		groupByTime:  groupByTime,
+		points:       make(map[string]map[interface{}]*windowPoints),
+		defaultValue: wrappedDefaultValue,
+	}, nil
+}
+
+// moving_average(column, n) returns the mean of the last n points
+func NewMovingAverageAggregator(q *parser.SelectQuery, value *parser.Value, defaultValue *parser.Value) (Aggregator, error) {
+	var size int
+	if len(value.Elems) == 2 {
+		var err error
+		size, err = strconv.Atoi(value.Elems[1].Name)
+		if err != nil || size <= 0 {
+			return nil, common.NewQueryError(common.InvalidArgument, "function moving_average() requires a positive integer as the second argument")
+		}
+	}
+
+	return NewWindowAggregator("moving_average", q, value, defaultValue, func(points *windowPoints, _, end int, _ int64) (float64, bool) {
+		start := end - size
+		if start < 0 {
+			start = 0
+		}
+		if start == end {
+			return 0, false
+		}
+		return (points.sums[end] - points.sums[start]) / float64(end-start), true
+	})
+}
+
+// ema(column, alpha) returns the exponential moving average of the
+// points with the smoothing factor alpha
+func NewExponentialMovingAverageAggregator(q *parser.SelectQuery, value *parser.Value, defaultValue *parser.Value) (Aggregator, error) {
+	var alpha float64
+	if len(value.Elems) == 2 {
+		var err error
+		alpha, err = strconv.ParseFloat(value.Elems[1].Name, 64)
+		if err != nil || alpha <= 0 || alpha > 1 {
+			return nil, common.NewQueryError(common.InvalidArgument, "function ema() requires a smoothing factor between 0 and 1 as the second argument")
+		}
+	}
+
+	return NewWindowAggregator("ema", q, value, defaultValue, func(points *windowPoints, _, end int, _ int64) (float64, bool) {
+		if end == 0 {
+			return 0, false
+		}
+		if points.emas == nil {
+			points.emas = make([]float64, len(points.points))
+			points.emas[0] = points.points[0].value
+			for i := 1; i < len(points.points); i++ {
+				points.emas[i] = alpha*points.points[i].value + (1-alpha)*points.emas[i-1]
+			}
+		}
+		return points.emas[end-1], true
+	})
+}
+
+// rolling_sum(column, duration) returns the sum of the points in the
+// given duration before the end of the window
+func NewRollingSumAggregator(q *parser.SelectQuery, value *parser.Value, defaultValue *parser.Value) (Aggregator, error) {
+	var duration int64
+	if len(value.Elems) == 2 {
+		var err error
+		duration, err = common.ParseTimeDuration(value.Elems[1].Name)
+		if err != nil || duration <= 0 {
+			return nil, common.NewQueryError(common.InvalidArgument, "function rolling_sum() requires a duration as the second argument")
+		}
+		// ParseTimeDuration returns nanoseconds
+		duration /= 1000
+	}
+
+	return NewWindowAggregator("rolling_sum", q, value, defaultValue, func(points *windowPoints, _, end int, endTime int64) (float64, bool) {
+		start := sort.Search(end, func(i int) bool {
+			return points.points[i].timestamp >= endTime-duration
+		})
+		if start == end {
+			return 0, false
+		}
+		return points.sums[end] - points.sums[start], true
+	})
+}
+
+// Parses the time unit of the derivative functions in microseconds
+func parseDerivativeUnit(name string, value *parser.Value) (int64, error) {
+	if len(value.Elems) != 2 {
+		return 0, nil
+	}
+	unit, err := common.ParseTimeDuration(value.Elems[1].Name)
+	if err != nil || unit < int64(time.Microsecond) {
+		return 0, common.NewQueryError(common.InvalidArgument, "function %s() requires a time unit as the second argument", name)
+	}
+	return unit / int64(time.Microsecond), nil
+}
+
+// Calls f with the change of the counter between every two consecutive
+// points of the bucket, starting at the last point before the bucket
+func eachCounterChange(points *windowPoints, begin, end int, f func(previous, current windowPoint)) {
+	if begin > 0 {
+		begin--
+	}
+	for i := begin + 1; i < end; i++ {
+		f(points.points[i-1], points.points[i])
+	}
+}
+
+// non_negative_derivative(column, unit) returns the increase of the
+// column per unit of time. The intervals in which the value decreases,
+// i.e. the counter was reset or wrapped around, are left out.
+func NewNonNegativeDerivativeAggregator(q *parser.SelectQuery, value *parser.Value, defaultValue *parser.Value) (Aggregator, error) {
+	unit, err := parseDerivativeUnit("non_negative_derivative", value)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewWindowAggregator("non_negative_derivative", q, value, defaultValue, func(points *windowPoints, begin, end int, _ int64) (float64, bool) {
+		var deltaV float64
+		var deltaT int64
+		eachCounterChange(points, begin, end, func(previous, current windowPoint) {
+			if current.value < previous.value || current.timestamp == previous.timestamp {
+				return
+			}
+			deltaV += current.value - previous.value
+			deltaT += current.timestamp - previous.timestamp
+		})
+		if deltaT == 0 {
+			return 0, false
+		}
+		return deltaV / float64(deltaT) * float64(unit), true
+	})
+}
+
+// rate(column, unit) returns the increase of the counter per unit of
+// time. If the value decreases the counter is assumed to have been
+// reset to zero in between, so the new value is counted as increase.
+func NewRateAggregator(q *parser.SelectQuery, value *parser.Value, defaultValue *parser.Value) (Aggregator, error) {
+	unit, err := parseDerivativeUnit("rate", value)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewWindowAggregator("rate", q, value, defaultValue, func(points *windowPoints, begin, end int, _ int64) (float64, bool) {
+		var deltaV float64
+		var deltaT int64
+		eachCounterChange(points, begin, end, func(previous, current windowPoint) {
+			if current.value < previous.value {
+				deltaV += current.value
+			} else {
+				deltaV += current.value - previous.value
+			}
+			deltaT += current.timestamp - previous.timestamp
+		})
+		if deltaT == 0 {
+			return 0, false
+		}
+		return deltaV / float64(deltaT) * float64(unit), true
+	})
+}
@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"os"
 	"protocol"
+	"strings"
 	"time"
 )
 
@@ -1138,6 +1139,213 @@ func (self *EngineSuite) TestEmptyGroupsDescending(c *C) {
 	}
 }
 
+func (self *EngineSuite) TestEmptyGroupsWithFillModes(c *C) {
+	self.createEngine(c, `[
+    {
+      "points": [
+        { "values": [{ "int64_value": 1 }], "timestamp": 1381346701000000 },
+        { "values": [{ "int64_value": 3 }], "timestamp": 1381346701000000 },
+        { "values": [{ "int64_value": 5 }], "timestamp": 1381346701000000 },
+        { "values": [{ "int64_value": 7 }], "timestamp": 1381346701000000 },
+        { "values": [{ "int64_value": 4 }], "timestamp": 1381346701000000 },
+        { "values": [{ "int64_value": 2 }], "timestamp": 1381346701000000 },
+        { "values": [{ "int64_value": 6 }], "timestamp": 1381346701000000 },
+        { "values": [{ "int64_value": 6 }], "timestamp": 1381346871000000 },
+        { "values": [{ "int64_value": 5 }], "timestamp": 1381346871000000 },
+        { "values": [{ "int64_value": 4 }], "timestamp": 1381346871000000 },
+        { "values": [{ "int64_value": 1 }], "timestamp": 1381346871000000 }
+      ],
+      "name": "foo",
+      "fields": ["column_one"]
+    }
+  ]`)
+
+	// every bucket between the start and end time of the query should be returned
+	query := "select count(column_one) from foo where time > 1381346640s and time < 1381346880s group by time(1m) fill(%s) order asc"
+
+	for fill, emptyValues := range map[string][]string{
+		"null":     {`"is_null": true`, `"is_null": true`},
+		"previous": {`"is_null": true`, `"int64_value": 7`},
+		"linear":   {`"is_null": true`, `"double_value": 5.5`},
+		"1.5":      {`"double_value": 1.5`, `"double_value": 1.5`},
+	} {
+		self.runQuery(fmt.Sprintf(query, fill), c, fmt.Sprintf(`[
+    {
+      "points": [
+        { "values": [{ %s }], "timestamp": 1381346640000000},
+        { "values": [{ "int64_value": 7 }], "timestamp": 1381346700000000},
+        { "values": [{ %s }], "timestamp": 1381346760000000},
+        { "values": [{ "int64_value": 4 }], "timestamp": 1381346820000000}
+      ],
+      "name": "foo",
+      "fields": ["count"]
+    }
+  ]`, emptyValues[0], emptyValues[1]))
+	}
+}
+
+func (self *EngineSuite) TestEmptyGroupsOfQueriesSpanningShards(c *C) {
+	// the short term shards are an hour long, the points are in the first
+	// and the last bucket of two consecutive shards
+	self.createEngine(c, `[
+    {
+      "points": [
+        { "values": [{ "int64_value": 1 }], "timestamp": 1381345201000000 },
+        { "values": [{ "int64_value": 2 }], "timestamp": 1381345202000000 },
+        { "values": [{ "int64_value": 1 }], "timestamp": 1381350601000000 },
+        { "values": [{ "int64_value": 2 }], "timestamp": 1381350602000000 },
+        { "values": [{ "int64_value": 3 }], "timestamp": 1381350603000000 },
+        { "values": [{ "int64_value": 4 }], "timestamp": 1381350604000000 },
+        { "values": [{ "int64_value": 5 }], "timestamp": 1381350605000000 }
+      ],
+      "name": "foo",
+      "fields": ["column_one"]
+    }
+  ]`)
+
+	// every empty bucket is returned once, filled with the values of
+	// the buckets in the other shard
+	query := "select count(column_one) from foo where time > 1381345200s and time < 1381352400s group by time(30m) fill(%s) order asc"
+
+	for fill, emptyValues := range map[string][]string{
+		"0":        {`"int64_value": 0`, `"int64_value": 0`},
+		"null":     {`"is_null": true`, `"is_null": true`},
+		"previous": {`"int64_value": 2`, `"int64_value": 2`},
+		"linear":   {`"double_value": 3`, `"double_value": 4`},
+	} {
+		self.runQuery(fmt.Sprintf(query, fill), c, fmt.Sprintf(`[
+    {
+      "points": [
+        { "values": [{ "int64_value": 2 }], "timestamp": 1381345200000000},
+        { "values": [{ %s }], "timestamp": 1381347000000000},
+        { "values": [{ %s }], "timestamp": 1381348800000000},
+        { "values": [{ "int64_value": 5 }], "timestamp": 1381350600000000}
+      ],
+      "name": "foo",
+      "fields": ["count"]
+    }
+  ]`, emptyValues[0], emptyValues[1]))
+	}
+}
+
+func (self *EngineSuite) TestWindowAggregates(c *C) {
+	self.createEngine(c, `[
+    {
+      "points": [
+        { "values": [{ "int64_value": 1 }], "timestamp": 1381346701000000 },
+        { "values": [{ "int64_value": 2 }], "timestamp": 1381346761000000 },
+        { "values": [{ "int64_value": 3 }], "timestamp": 1381346821000000 },
+        { "values": [{ "int64_value": 4 }], "timestamp": 1381346881000000 }
+      ],
+      "name": "foo",
+      "fields": ["column_one"]
+    }
+  ]`)
+
+	// the windows include the points of the earlier buckets
+	for function, values := range map[string][]string{
+		"moving_average(column_one, 2)": {"1", "1.5", "2.5", "3.5"},
+		"ema(column_one, 0.5)":          {"1", "1.5", "2.25", "3.125"},
+		"rolling_sum(column_one, 2m)":   {"1", "3", "5", "7"},
+	} {
+		name := function[:strings.Index(function, "(")]
+		self.runQuery("select "+function+" from foo group by time(1m) order asc", c, fmt.Sprintf(`[
+    {
+      "points": [
+        { "values": [{ "double_value": %s }], "timestamp": 1381346700000000},
+        { "values": [{ "double_value": %s }], "timestamp": 1381346760000000},
+        { "values": [{ "double_value": %s }], "timestamp": 1381346820000000},
+        { "values": [{ "double_value": %s }], "timestamp": 1381346880000000}
+      ],
+      "name": "foo",
+      "fields": ["%s"]
+    }
+  ]`, values[0], values[1], values[2], values[3], name))
+
+		// without group by time the window ends after every point
+		self.runQuery("select "+function+" from foo order asc", c, fmt.Sprintf(`[
+    {
+      "points": [
+        { "values": [{ "double_value": %s }], "timestamp": 1381346701000000},
+        { "values": [{ "double_value": %s }], "timestamp": 1381346761000000},
+        { "values": [{ "double_value": %s }], "timestamp": 1381346821000000},
+        { "values": [{ "double_value": %s }], "timestamp": 1381346881000000}
+      ],
+      "name": "foo",
+      "fields": ["%s"]
+    }
+  ]`, values[0], values[1], values[2], values[3], name))
+	}
+
+	self.runQuery("select moving_average(column_one, 2) from foo", c, `[
+    {
+      "points": [
+        { "values": [{ "double_value": 3.5 }], "timestamp": 1381346881000000},
+        { "values": [{ "double_value": 2.5 }], "timestamp": 1381346821000000},
+        { "values": [{ "double_value": 1.5 }], "timestamp": 1381346761000000},
+        { "values": [{ "double_value": 1 }], "timestamp": 1381346701000000}
+      ],
+      "name": "foo",
+      "fields": ["moving_average"]
+    }
+  ]`)
+}
+
+func (self *EngineSuite) TestCounterDerivatives(c *C) {
+	// the counter is reset between the second and the third point
+	self.createEngine(c, `[
+    {
+      "points": [
+        { "values": [{ "int64_value": 10 }], "timestamp": 1381346701000000 },
+        { "values": [{ "int64_value": 20 }], "timestamp": 1381346731000000 },
+        { "values": [{ "int64_value": 5 }], "timestamp": 1381346761000000 },
+        { "values": [{ "int64_value": 15 }], "timestamp": 1381346791000000 },
+        { "values": [{ "int64_value": 25 }], "timestamp": 1381346821000000 }
+      ],
+      "name": "foo",
+      "fields": ["column_one"]
+    }
+  ]`)
+
+	for function, values := range map[string][]string{
+		"non_negative_derivative": {"20", "20", "20"},
+		"rate":                    {"20", "15", "20"},
+	} {
+		self.runQuery("select "+function+"(column_one, 1m) from foo group by time(1m) order asc", c, fmt.Sprintf(`[
+    {
+      "points": [
+        { "values": [{ "double_value": %s }], "timestamp": 1381346700000000},
+        { "values": [{ "double_value": %s }], "timestamp": 1381346760000000},
+        { "values": [{ "double_value": %s }], "timestamp": 1381346820000000}
+      ],
+      "name": "foo",
+      "fields": ["%s"]
+    }
+  ]`, values[0], values[1], values[2], function))
+
+	}
+
+	// without group by time there's a value for every point but the first
+	for function, values := range map[string][]string{
+		"non_negative_derivative": {`"is_null": true`, `"double_value": 20`, `"is_null": true`, `"double_value": 20`, `"double_value": 20`},
+		"rate":                    {`"is_null": true`, `"double_value": 20`, `"double_value": 10`, `"double_value": 20`, `"double_value": 20`},
+	} {
+		self.runQuery("select "+function+"(column_one, 1m) from foo order asc", c, fmt.Sprintf(`[
+    {
+      "points": [
+        { "values": [{ %s }], "timestamp": 1381346701000000},
+        { "values": [{ %s }], "timestamp": 1381346731000000},
+        { "values": [{ %s }], "timestamp": 1381346761000000},
+        { "values": [{ %s }], "timestamp": 1381346791000000},
+        { "values": [{ %s }], "timestamp": 1381346821000000}
+      ],
+      "name": "foo",
+      "fields": ["%s"]
+    }
+  ]`, values[0], values[1], values[2], values[3], values[4], function))
+	}
+}
+
 func (self *EngineSuite) TestMedianQueryWithGroupByTime(c *C) {
 	self.createEngine(c, `[
     {
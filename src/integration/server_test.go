@@ -368,6 +368,33 @@ func (self *ServerSuite) TestBigGroupByQueryAgainstMultipleShards(c *C) {
 	}
 }
 
+// The short term shards can't aggregate a group by time of 2h locally,
+// the long term shards can, but they have to send partial states too
+func (self *ServerSuite) TestAggregatesAgainstShortAndLongTermShards(c *C) {
+	t := (time.Now().Unix() - 3*3600) * 1000
+	for _, name := range []string{"test_mixed_term_aggregates", "Test_mixed_term_aggregates"} {
+		data := fmt.Sprintf(`[{"points": [[4], [10]], "name": "%s", "columns": ["value"]}]`, name)
+		self.serverProcesses[0].Post("/db/test_rep/series?u=paul&p=pass", data, c)
+		data = fmt.Sprintf(`[{"points": [[2, %d]], "name": "%s", "columns": ["value", "time"]}]`, t, name)
+		self.serverProcesses[0].Post("/db/test_rep/series?u=paul&p=pass", data, c)
+	}
+	time.Sleep(time.Second)
+	for _, s := range self.serverProcesses {
+		collection := s.Query("test_rep", "select count(value), sum(value), mean(value) from /^[tT]est_mixed_term_aggregates$/ group by time(2h)", false, c)
+		c.Assert(collection.Members, HasLen, 2)
+		for _, name := range []string{"test_mixed_term_aggregates", "Test_mixed_term_aggregates"} {
+			series := collection.GetSeries(name, c)
+			c.Assert(series.Points, HasLen, 2)
+			c.Assert(series.GetValueForPointAndColumn(0, "count", c).(float64), Equals, float64(2))
+			c.Assert(series.GetValueForPointAndColumn(0, "sum", c).(float64), Equals, float64(14))
+			c.Assert(series.GetValueForPointAndColumn(0, "mean", c).(float64), Equals, float64(7))
+			c.Assert(series.GetValueForPointAndColumn(1, "count", c).(float64), Equals, float64(1))
+			c.Assert(series.GetValueForPointAndColumn(1, "sum", c).(float64), Equals, float64(2))
+			c.Assert(series.GetValueForPointAndColumn(1, "mean", c).(float64), Equals, float64(2))
+		}
+	}
+}
+
 func (self *ServerSuite) TestWriteSplitToMultipleShards(c *C) {
 	data := `[
 		{"points": [[4], [10]], "name": "test_write_multiple_shards", "columns": ["value"]},
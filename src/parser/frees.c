@@ -150,6 +150,10 @@ close_query (query *q)
     free(q->drop_query);
   }
 
+  if (q->kill_query) {
+    free(q->kill_query);
+  }
+
   if (q->delete_query) {
     free_delete_query(q->delete_query);
     free(q->delete_query);
@@ -11,6 +11,7 @@ import (
 	"reflect"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 	"unsafe"
 )
@@ -81,9 +82,27 @@ type IntoClause struct {
 	Target *Value
 }
 
+type FillMode int
+
+// Determines which values are returned for the time buckets of a
+// group by query that don't have any points
+const (
+	// empty buckets aren't returned
+	FillNone FillMode = iota
+	FillNull
+	// FillValue is returned for empty buckets
+	FillConstant
+	// the values of the previous bucket are repeated
+	FillPrevious
+	// the values are interpolated from the surrounding buckets
+	FillLinear
+)
+
 type GroupByClause struct {
+	// true if empty buckets should be returned, regardless of the fill mode
 	FillWithZero bool
 	FillValue    *Value
+	FillMode     FillMode
 	Elems        []*Value
 }
 
@@ -139,7 +158,8 @@ type SelectDeleteCommonQuery struct {
 	BasicQuery
 	FromClause *FromClause
 	Condition  *WhereCondition
-	endTimeSet bool
+	startTimeSet bool
+	endTimeSet   bool
 }
 
 type SelectQuery struct {
@@ -156,6 +176,8 @@ type ListType int
 const (
 	Series ListType = iota
 	ContinuousQueries
+	RunningQueries
+	SeriesStats
 )
 
 type ListQuery struct {
@@ -166,6 +188,10 @@ type DropQuery struct {
 	Id int
 }
 
+type KillQuery struct {
+	Id int
+}
+
 type DropSeriesQuery struct {
 	tableName string
 }
@@ -185,12 +211,16 @@ type Query struct {
 	ListQuery       *ListQuery
 	DropSeriesQuery *DropSeriesQuery
 	DropQuery       *DropQuery
+	KillQuery       *KillQuery
 }
 
 func (self *Query) GetQueryString() string {
 	if self.SelectQuery != nil {
 		return self.SelectQuery.GetQueryString()
 	} else if self.ListQuery != nil {
+		if self.ListQuery.Type == SeriesStats {
+			return "list series stats"
+		}
 		return "list series"
 	} else if self.DeleteQuery != nil {
 		return self.DeleteQuery.GetQueryString()
@@ -210,6 +240,14 @@ func (self *Query) IsListContinuousQueriesQuery() bool {
 	return self.ListQuery != nil && self.ListQuery.Type == ContinuousQueries
 }
 
+func (self *Query) IsListRunningQueriesQuery() bool {
+	return self.ListQuery != nil && self.ListQuery.Type == RunningQueries
+}
+
+func (self *Query) IsListSeriesStatsQuery() bool {
+	return self.ListQuery != nil && self.ListQuery.Type == SeriesStats
+}
+
 func (self *BasicQuery) GetQueryString() string {
 	return self.queryString
 }
@@ -306,6 +344,7 @@ func GetGroupByClause(groupByClause *C.groupby_clause) (*GroupByClause, error) {
 	}
 
 	fillWithZero := false
+	fillMode := FillNone
 	var fillValue *Value
 
 	if groupByClause.fill_function != nil {
@@ -321,14 +360,32 @@ func GetGroupByClause(groupByClause *C.groupby_clause) (*GroupByClause, error) {
 			return nil, fmt.Errorf("`fill` accepts one argument only")
 		}
 
-		fillValue = fun.Elems[0]
 		fillWithZero = true
+		switch arg := fun.Elems[0]; arg.Type {
+		case ValueInt, ValueFloat:
+			fillMode = FillConstant
+			fillValue = arg
+		case ValueSimpleName:
+			switch strings.ToLower(arg.Name) {
+			case "null":
+				fillMode = FillNull
+			case "previous":
+				fillMode = FillPrevious
+			case "linear":
+				fillMode = FillLinear
+			default:
+				return nil, fmt.Errorf("Unknown fill mode %s", arg.Name)
+			}
+		default:
+			return nil, fmt.Errorf("`fill` accepts a number, null, previous or linear")
+		}
 	}
 
 	return &GroupByClause{
 		Elems:        values,
 		FillWithZero: fillWithZero,
 		FillValue:    fillValue,
+		FillMode:     fillMode,
 	}, nil
 }
 
@@ -512,6 +569,14 @@ func ParseQuery(query string) ([]*Query, error) {
 		return []*Query{&Query{QueryString: query, ListQuery: &ListQuery{Type: ContinuousQueries}}}, nil
 	}
 
+	if q.list_queries_query != 0 {
+		return []*Query{&Query{QueryString: query, ListQuery: &ListQuery{Type: RunningQueries}}}, nil
+	}
+
+	if q.list_series_stats_query != 0 {
+		return []*Query{&Query{QueryString: query, ListQuery: &ListQuery{Type: SeriesStats}}}, nil
+	}
+
 	if q.select_query != nil {
 		selectQuery, err := parseSelectQuery(query, q.select_query)
 		if err != nil {
@@ -533,6 +598,8 @@ func ParseQuery(query string) ([]*Query, error) {
 		return []*Query{&Query{QueryString: query, DropSeriesQuery: dropSeriesQuery}}, nil
 	} else if q.drop_query != nil {
 		return []*Query{&Query{QueryString: query, DropQuery: &DropQuery{Id: int(q.drop_query.id)}}}, nil
+	} else if q.kill_query != nil {
+		return []*Query{&Query{QueryString: query, KillQuery: &KillQuery{Id: int(q.kill_query.id)}}}, nil
 	}
 	return nil, fmt.Errorf("Unknown query type encountered")
 }
@@ -592,7 +659,9 @@ func parseSelectDeleteCommonQuery(queryString string, fromClause *C.from_clause,
 		return goQuery, err
 	}
 
-	if startTime.Unix() > 0 {
+	goQuery.startTimeSet = startTime.Unix() > 0
+
+	if goQuery.startTimeSet {
 		goQuery.startTime = startTime
 	} else if goQuery.endTime.Unix() > 0 {
 		goQuery.startTime = time.Unix(math.MinInt64, 0)
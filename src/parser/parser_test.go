@@ -526,6 +526,24 @@ func (self *QueryParserSuite) TestParseSelectWithGroupByFillWithZero(c *C) {
 	c.Assert(groupBy.Elems[1].Elems[0].Name, Equals, "1h")
 }
 
+func (self *QueryParserSuite) TestParseSelectWithGroupByFillModes(c *C) {
+	for fill, mode := range map[string]FillMode{
+		"null":     FillNull,
+		"previous": FillPrevious,
+		"linear":   FillLinear,
+		"1.5":      FillConstant,
+	} {
+		q, err := ParseSelectQuery(fmt.Sprintf("select mean(value) from foo group by time(1m) fill(%s) where time>now()-1d;", fill))
+		c.Assert(err, IsNil)
+		groupBy := q.GetGroupByClause()
+		c.Assert(groupBy.FillWithZero, Equals, true)
+		c.Assert(groupBy.FillMode, Equals, mode)
+	}
+
+	_, err := ParseSelectQuery("select mean(value) from foo group by time(1m) fill(next) where time>now()-1d;")
+	c.Assert(err, NotNil)
+}
+
 func (self *QueryParserSuite) TestParseSelectWithGroupByWithInvalidFunctions(c *C) {
 	for _, query := range []string{
 		"select count(*) from users.events group by user_email,time(1h) foobar(0) where time>now()-1d;",
@@ -809,6 +827,30 @@ func (self *QueryParserSuite) TestParseContinuousQueryList(c *C) {
 	c.Assert(queries[0].IsListContinuousQueriesQuery(), Equals, true)
 }
 
+func (self *QueryParserSuite) TestParseRunningQueriesListAndKill(c *C) {
+	queries, err := ParseQuery("list queries;")
+	c.Assert(err, IsNil)
+	c.Assert(queries, HasLen, 1)
+	c.Assert(queries[0].IsListQuery(), Equals, true)
+	c.Assert(queries[0].IsListRunningQueriesQuery(), Equals, true)
+
+	queries, err = ParseQuery("kill query 12")
+	c.Assert(err, IsNil)
+	c.Assert(queries, HasLen, 1)
+	c.Assert(queries[0].KillQuery, NotNil)
+	c.Assert(queries[0].KillQuery.Id, Equals, 12)
+}
+
+func (self *QueryParserSuite) TestParseListSeriesStats(c *C) {
+	queries, err := ParseQuery("list series stats")
+	c.Assert(err, IsNil)
+	c.Assert(queries, HasLen, 1)
+	c.Assert(queries[0].IsListQuery(), Equals, true)
+	c.Assert(queries[0].IsListSeriesQuery(), Equals, false)
+	c.Assert(queries[0].IsListSeriesStatsQuery(), Equals, true)
+	c.Assert(queries[0].GetQueryString(), Equals, "list series stats")
+}
+
 // TODO:
 // insert into user.events.count.per_day select count(*) from user.events where time<forever group by time(1d)
 // insert into :series_name.percentiles.95 select percentile(95,value) from stats.* where time<forever group by time(1d)
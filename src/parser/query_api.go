@@ -201,6 +201,18 @@ func (self *BasicQuery) GetEndTime() time.Time {
 	return self.endTime
 }
 
+// Returns true if the query has a condition on the start time,
+// otherwise the start time is the beginning of time
+func (self *SelectDeleteCommonQuery) IsStartTimeSpecified() bool {
+	return self.startTimeSet
+}
+
+// Returns true if the query has a condition on the end time, otherwise
+// the end time is the time the query was parsed
+func (self *SelectDeleteCommonQuery) IsEndTimeSpecified() bool {
+	return self.endTimeSet
+}
+
 // parse time that matches the following format:
 //   2006-01-02 [15[:04[:05[.000]]]]
 // notice, hour, minute and seconds are optional
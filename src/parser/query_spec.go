@@ -15,12 +15,31 @@ type QuerySpec struct {
 	endTime                     time.Time
 	seriesValuesAndColumns      map[*Value][]string
 	RunAgainstAllServersInShard bool
+	// Set by the coordinator if any of the shards of the query can't
+	// aggregate locally. The other shards don't aggregate locally either,
+	// because the coordinator can't merge aggregated points.
+	AggregateInCoordinator bool
+	cancellation           *common.QueryCancellation
 }
 
 func NewQuerySpec(user common.User, database string, query *Query) *QuerySpec {
 	return &QuerySpec{user: user, query: query, database: database}
 }
 
+// The shards stop reading points once the given cancellation is
+// cancelled
+func (self *QuerySpec) SetCancellation(cancellation *common.QueryCancellation) {
+	self.cancellation = cancellation
+}
+
+func (self *QuerySpec) Cancellation() *common.QueryCancellation {
+	return self.cancellation
+}
+
+func (self *QuerySpec) IsCancelled() bool {
+	return self.cancellation.IsCancelled()
+}
+
 func (self *QuerySpec) GetStartTime() time.Time {
 	if self.query.SelectQuery != nil {
 		return self.query.SelectQuery.GetStartTime()
@@ -133,6 +152,10 @@ func (self *QuerySpec) IsListSeriesQuery() bool {
 	return self.query.IsListSeriesQuery()
 }
 
+func (self *QuerySpec) IsListSeriesStatsQuery() bool {
+	return self.query.IsListSeriesStatsQuery()
+}
+
 func (self *QuerySpec) IsDeleteFromSeriesQuery() bool {
 	return self.query.DeleteQuery != nil
 }
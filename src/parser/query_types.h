@@ -103,13 +103,20 @@ typedef struct {
   int id;
 } drop_query;
 
+typedef struct {
+  int id;
+} kill_query;
+
 typedef struct {
   select_query *select_query;
   delete_query *delete_query;
   drop_series_query *drop_series_query;
   drop_query *drop_query;
+  kill_query *kill_query;
   char list_series_query;
   char list_continuous_queries_query;
+  char list_queries_query;
+  char list_series_stats_query;
   error *error;
 } query;
 
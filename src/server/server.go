@@ -2,12 +2,16 @@ package server
 
 import (
 	"admin"
+	"api/graphite"
 	"api/http"
+	"api/udp"
 	"cluster"
 	log "code.google.com/p/log4go"
+	"common"
 	"configuration"
 	"coordinator"
 	"datastore"
+	"io"
 	"wal"
 )
 
@@ -16,13 +20,22 @@ type Server struct {
 	ProtobufServer *coordinator.ProtobufServer
 	ClusterConfig  *cluster.ClusterConfiguration
 	HttpApi        *http.HttpServer
+	UdpApi         *udp.Server
+	GraphiteApi    *graphite.Server
 	AdminServer    *admin.HttpServer
 	Coordinator    coordinator.Coordinator
 	Config         *configuration.Configuration
 	RequestHandler *coordinator.ProtobufRequestHandler
+	StatsWriter    *coordinator.InternalStatsWriter
+	AntiEntropy    *coordinator.AntiEntropy
 	stopped        bool
 	writeLog       *wal.WAL
 	shardStore     *datastore.LevelDbShardDatastore
+
+	// set if the server was restored from a backup, the cluster
+	// configuration is restored once the raft server is up
+	restoredClusterConfig []byte
+	restoredShardIds      []uint32
 }
 
 func NewServer(config *configuration.Configuration) (*Server, error) {
@@ -41,6 +54,7 @@ func NewServer(config *configuration.Configuration) (*Server, error) {
 	}
 
 	clusterConfig := cluster.NewClusterConfiguration(config, writeLog, shardDb, newClient)
+	shardDb.SetIndexedColumnLookup(clusterConfig)
 	raftServer := coordinator.NewRaftServer(config, clusterConfig)
 	clusterConfig.LocalRaftName = raftServer.GetRaftName()
 	clusterConfig.SetShardCreator(raftServer)
@@ -53,17 +67,27 @@ func NewServer(config *configuration.Configuration) (*Server, error) {
 	raftServer.AssignCoordinator(coord)
 	httpApi := http.NewHttpServer(config.ApiHttpPortString(), config.AdminAssetsDir, coord, coord, clusterConfig, raftServer)
 	httpApi.EnableSsl(config.ApiHttpSslPortString(), config.ApiHttpCertPath)
+	httpApi.EnableBackup(shardDb)
+	httpApi.SetMaxBodySize(config.ApiMaxBodySize)
+	udpApi := udp.NewServer(config.UdpServerPortString(), config.UdpServerDatabase, config.UdpServerUsername, config.UdpServerPassword, coord, coord)
+	graphiteApi := graphite.NewServer(config.GraphitePortString(), config.GraphiteDatabase, config.GraphiteUsername, config.GraphitePassword, config.GraphiteBatchSize, config.GraphiteFlushInterval.Duration, coord, coord)
 	adminServer := admin.NewHttpServer(config.AdminAssetsDir, config.AdminHttpPortString())
+	statsWriter := coordinator.NewInternalStatsWriter(coord, common.InternalStats, config.MonitoringWriteInterval.Duration)
+	antiEntropy := coordinator.NewAntiEntropy(clusterConfig, config.AntiEntropyInterval.Duration)
 
 	return &Server{
 		RaftServer:     raftServer,
 		ProtobufServer: protobufServer,
 		ClusterConfig:  clusterConfig,
 		HttpApi:        httpApi,
+		UdpApi:         udpApi,
+		GraphiteApi:    graphiteApi,
 		Coordinator:    coord,
 		AdminServer:    adminServer,
 		Config:         config,
 		RequestHandler: requestHandler,
+		StatsWriter:    statsWriter,
+		AntiEntropy:    antiEntropy,
 		writeLog:       writeLog,
 		shardStore:     shardDb}, nil
 }
@@ -80,6 +104,15 @@ func (self *Server) ListenAndServe() error {
 	self.ClusterConfig.WaitForLocalServerLoaded()
 	self.writeLog.SetServerId(self.ClusterConfig.ServerId())
 
+	if self.restoredClusterConfig != nil {
+		log.Info("Restoring cluster configuration from backup")
+		err = self.RaftServer.RestoreClusterConfiguration(self.restoredClusterConfig, self.restoredShardIds)
+		if err != nil {
+			return err
+		}
+		self.restoredClusterConfig = nil
+	}
+
 	log.Info("Recovering from log...")
 	err = self.ClusterConfig.RecoverFromWAL()
 	if err != nil {
@@ -93,11 +126,41 @@ func (self *Server) ListenAndServe() error {
 	}
 	log.Info("Starting admin interface on port %d", self.Config.AdminHttpPort)
 	go self.AdminServer.ListenAndServe()
+	if self.Config.UdpServerEnabled {
+		log.Info("Starting Udp Api server on port %d", self.Config.UdpServerPort)
+		go self.UdpApi.ListenAndServe()
+	}
+	if self.Config.GraphiteEnabled {
+		log.Info("Starting Graphite Api server on port %d", self.Config.GraphitePort)
+		go self.GraphiteApi.ListenAndServe()
+	}
+	if self.Config.MonitoringEnabled {
+		log.Info("Writing internal stats every %s", self.Config.MonitoringWriteInterval.Duration)
+		go self.StatsWriter.Run()
+	}
+	if self.Config.AntiEntropyInterval.Duration > 0 {
+		log.Info("Repairing the shards from their replicas every %s", self.Config.AntiEntropyInterval.Duration)
+	}
+	go self.AntiEntropy.Run()
 	log.Info("Starting Http Api server on port %d", self.Config.ApiHttpPort)
 	self.HttpApi.ListenAndServe()
 	return nil
 }
 
+// Restores the shards from the given backup. The cluster
+// configuration in the backup is restored when the server starts
+// listening.
+func (self *Server) Restore(backup io.Reader) error {
+	clusterConfig, shardIds, err := self.shardStore.Restore(backup)
+	if err != nil {
+		return err
+	}
+	log.Info("Restored %d shards from backup", len(shardIds))
+	self.restoredClusterConfig = clusterConfig
+	self.restoredShardIds = shardIds
+	return nil
+}
+
 func (self *Server) Stop() {
 	if self.stopped {
 		return
@@ -105,6 +168,12 @@ func (self *Server) Stop() {
 	self.stopped = true
 	self.RaftServer.Close()
 	self.HttpApi.Close()
+	self.UdpApi.Close()
+	self.GraphiteApi.Close()
+	if self.Config.MonitoringEnabled {
+		self.StatsWriter.Close()
+	}
+	self.AntiEntropy.Close()
 	self.ProtobufServer.Close()
 	self.AdminServer.Close()
 	self.writeLog.Close()
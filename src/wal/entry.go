@@ -14,8 +14,21 @@ type commitEntry struct {
 	requestNumber uint32
 }
 
+type removeServerEntry struct {
+	confirmation chan *confirmation
+	serverId     uint32
+}
+
+type stopWaitingForCommitsEntry struct {
+	confirmation  chan *confirmation
+	requestNumber uint32
+}
+
 type appendEntry struct {
 	confirmation chan *confirmation
 	request      *protocol.Request
 	shardId      uint32
+	// registered for the request number of the request once it's logged,
+	// nil if the caller doesn't wait for commits
+	waiter *commitWaiter
 }
@@ -81,6 +81,10 @@ func (self *state) commitRequestNumber(serverId, requestNumber uint32) {
 	self.ServerLastRequestNumber[serverId] = requestNumber
 }
 
+func (self *state) removeServer(serverId uint32) {
+	delete(self.ServerLastRequestNumber, serverId)
+}
+
 func (self *state) LowestCommitedRequestNumber() uint32 {
 	requestNumber := uint32(math.MaxUint32)
 	for _, number := range self.ServerLastRequestNumber {
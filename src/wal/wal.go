@@ -2,6 +2,7 @@ package wal
 
 import (
 	logger "code.google.com/p/log4go"
+	"common"
 	"configuration"
 	"fmt"
 	"os"
@@ -18,6 +19,14 @@ type WAL struct {
 	nextLogFileSuffix  int
 	requestsPerLogFile int
 	entries            chan interface{}
+	// the callers that wait for servers to commit a request, by request
+	// number
+	commitWaiters map[uint32]*commitWaiter
+}
+
+type commitWaiter struct {
+	serverIds map[uint32]bool
+	commits   chan uint32
 }
 
 const HOST_ID_OFFSET = uint64(10000)
@@ -74,6 +83,7 @@ func NewWAL(config *configuration.Configuration) (*WAL, error) {
 		requestsPerLogFile: config.WalRequestsPerLogFile,
 		nextLogFileSuffix:  nextLogFileSuffix,
 		entries:            make(chan interface{}, 10),
+		commitWaiters:      make(map[uint32]*commitWaiter),
 	}
 
 	// if we don't have any log files open yet, open a new one
@@ -95,12 +105,28 @@ func (self *WAL) SetServerId(id uint32) {
 
 // Marks a given request for a given server as committed
 func (self *WAL) Commit(requestNumber uint32, serverId uint32) error {
+	common.InternalStats.Increment("wal.commits")
 	confirmationChan := make(chan *confirmation)
 	self.entries <- &commitEntry{confirmationChan, serverId, requestNumber}
 	confirmation := <-confirmationChan
 	return confirmation.err
 }
 
+// Stops keeping the requests that the server didn't commit yet, so the
+// log files can be deleted once the other servers committed them
+func (self *WAL) RemoveServer(serverId uint32) error {
+	confirmationChan := make(chan *confirmation)
+	self.entries <- &removeServerEntry{confirmationChan, serverId}
+	confirmation := <-confirmationChan
+	return confirmation.err
+}
+
+func (self *WAL) StopWaitingForCommits(requestNumber uint32) {
+	confirmationChan := make(chan *confirmation)
+	self.entries <- &stopWaitingForCommitsEntry{confirmationChan, requestNumber}
+	<-confirmationChan
+}
+
 func (self *WAL) RecoverServerFromLastCommit(serverId uint32, shardIds []uint32, yield func(request *protocol.Request, shardId uint32) error) error {
 	lastLogFile := self.logFiles[len(self.logFiles)-1]
 	requestNumber := lastLogFile.state.ServerLastRequestNumber[serverId]
@@ -166,6 +192,11 @@ func (self *WAL) processEntries() {
 			self.processCommitEntry(x)
 		case *appendEntry:
 			self.processAppendEntry(x)
+		case *removeServerEntry:
+			self.processRemoveServerEntry(x)
+		case *stopWaitingForCommitsEntry:
+			delete(self.commitWaiters, x.requestNumber)
+			x.confirmation <- &confirmation{0, nil}
 		case *closeEntry:
 			x.confirmation <- &confirmation{0, self.processClose()}
 			logger.Info("Closing wal")
@@ -190,17 +221,38 @@ func (self *WAL) processAppendEntry(e *appendEntry) {
 		e.confirmation <- &confirmation{0, err}
 		return
 	}
+	if e.waiter != nil {
+		self.commitWaiters[requestNumber] = e.waiter
+	}
 	e.confirmation <- &confirmation{requestNumber, nil}
 }
 
 func (self *WAL) processCommitEntry(e *commitEntry) {
 	lastLogFile := self.logFiles[len(self.logFiles)-1]
 	lastLogFile.state.commitRequestNumber(e.serverId, e.requestNumber)
+	self.deleteCommittedLogFiles()
+	if waiter, ok := self.commitWaiters[e.requestNumber]; ok && waiter.serverIds[e.serverId] {
+		delete(waiter.serverIds, e.serverId)
+		waiter.commits <- e.serverId
+	}
+	e.confirmation <- &confirmation{0, nil}
+}
+
+func (self *WAL) processRemoveServerEntry(e *removeServerEntry) {
+	lastLogFile := self.logFiles[len(self.logFiles)-1]
+	lastLogFile.state.removeServer(e.serverId)
+	self.deleteCommittedLogFiles()
+	e.confirmation <- &confirmation{0, nil}
+}
+
+// deletes the log files that only have requests that all the servers
+// committed
+func (self *WAL) deleteCommittedLogFiles() {
+	lastLogFile := self.logFiles[len(self.logFiles)-1]
 	lowestCommitedRequestNumber := lastLogFile.state.LowestCommitedRequestNumber()
 
 	index := self.firstLogFile(lowestCommitedRequestNumber)
 	if index == 0 {
-		e.confirmation <- &confirmation{0, nil}
 		return
 	}
 
@@ -210,7 +262,6 @@ func (self *WAL) processCommitEntry(e *commitEntry) {
 		logFile.close()
 		logFile.delete()
 	}
-	e.confirmation <- &confirmation{0, nil}
 }
 
 // creates a new log file using the next suffix and initializes its
@@ -245,11 +296,27 @@ func (self *WAL) createNewLog() (*log, error) {
 // should be marked as committed for each server as it gets confirmed.
 func (self *WAL) AssignSequenceNumbersAndLog(request *protocol.Request, shard Shard) (uint32, error) {
 	confirmationChan := make(chan *confirmation)
-	self.entries <- &appendEntry{confirmationChan, request, shard.Id()}
+	self.entries <- &appendEntry{confirmationChan, request, shard.Id(), nil}
 	confirmation := <-confirmationChan
 	return confirmation.requestNumber, confirmation.err
 }
 
+// Logs the request like AssignSequenceNumbersAndLog. The returned channel
+// gets the id of every one of the servers once it committed the request,
+// it's registered before the request can be committed.
+// StopWaitingForCommits has to be called once the caller isn't waiting
+// anymore.
+func (self *WAL) LogAndWaitForCommits(request *protocol.Request, shard Shard, serverIds []uint32) (uint32, <-chan uint32, error) {
+	waiter := &commitWaiter{serverIds: make(map[uint32]bool), commits: make(chan uint32, len(serverIds))}
+	for _, serverId := range serverIds {
+		waiter.serverIds[serverId] = true
+	}
+	confirmationChan := make(chan *confirmation)
+	self.entries <- &appendEntry{confirmationChan, request, shard.Id(), waiter}
+	confirmation := <-confirmationChan
+	return confirmation.requestNumber, waiter.commits, confirmation.err
+}
+
 func (self *WAL) doesLogFileContainRequest(requestNumber uint32) func(int) bool {
 	return func(i int) bool {
 		if self.logFiles[i].firstRequestNumber() > requestNumber {
@@ -133,6 +133,56 @@ func (_ *WalSuite) TestLogFilesCompaction(c *C) {
 	c.Assert(os.IsNotExist(err), Equals, true)
 }
 
+func (_ *WalSuite) TestLogFilesCompactionAfterRemovingServer(c *C) {
+	wal := newWal(c)
+	wal.config.WalRequestsPerLogFile = 2000
+	wal.requestsPerLogFile = 2000
+	wal.Commit(0, 1)
+	wal.Commit(0, 2)
+	for i := 0; i < 2500; i++ {
+		request := generateRequest(2)
+		_, err := wal.AssignSequenceNumbersAndLog(request, &MockShard{id: 1})
+		c.Assert(err, IsNil)
+	}
+	c.Assert(wal.logFiles, HasLen, 2)
+	c.Assert(wal.Commit(2001, 1), IsNil)
+	c.Assert(wal.logFiles, HasLen, 2)
+	// server 2 will never commit the requests
+	c.Assert(wal.RemoveServer(2), IsNil)
+	c.Assert(wal.logFiles, HasLen, 1)
+}
+
+func (_ *WalSuite) TestWaitingForCommits(c *C) {
+	wal := newWal(c)
+	id, commits, err := wal.LogAndWaitForCommits(generateRequest(2), &MockShard{id: 1}, []uint32{1, 2})
+	c.Assert(err, IsNil)
+	c.Assert(wal.Commit(id, 3), IsNil)
+	c.Assert(wal.Commit(id, 2), IsNil)
+	c.Assert(wal.Commit(id, 2), IsNil)
+	c.Assert(commits, HasLen, 1)
+	c.Assert(<-commits, Equals, uint32(2))
+	wal.StopWaitingForCommits(id)
+	c.Assert(wal.Commit(id, 1), IsNil)
+	c.Assert(commits, HasLen, 0)
+
+	// only the logged requests get commits
+	other, err := wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+	c.Assert(err, IsNil)
+	c.Assert(wal.Commit(other, 1), IsNil)
+	c.Assert(commits, HasLen, 0)
+}
+
+func (_ *WalSuite) TestCommitsRightAfterTheLogAreSentToTheWaiter(c *C) {
+	wal := newWal(c)
+	for i := 0; i < 100; i++ {
+		id, commits, err := wal.LogAndWaitForCommits(generateRequest(2), &MockShard{id: 1}, []uint32{2})
+		c.Assert(err, IsNil)
+		c.Assert(wal.Commit(id, 2), IsNil)
+		c.Assert(<-commits, Equals, uint32(2))
+		wal.StopWaitingForCommits(id)
+	}
+}
+
 func (_ *WalSuite) TestMultipleLogFiles(c *C) {
 	wal := newWal(c)
 	wal.config.WalRequestsPerLogFile = 2000